@@ -0,0 +1,167 @@
+package alert
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type RuleType string
+
+const (
+	RULE_RIG_OFFLINE    RuleType = "RIG_OFFLINE"
+	RULE_LOW_HASHRATE   RuleType = "LOW_HASHRATE"
+	RULE_REJECT_RATE    RuleType = "REJECT_RATE"
+	RULE_MINER_RESTARTS RuleType = "MINER_RESTARTS"
+	// Raised by rigs whose GPUs failed to reset. Not a configurable rule
+	RULE_GPU_RESET RuleType = "GPU_RESET"
+	// Raised by rigs that throttled, excluded or stopped overheating GPUs. Not
+	// a configurable rule
+	RULE_THERMAL RuleType = "THERMAL"
+)
+
+const (
+	defaultMinShares = 10
+	defaultGrace     = 120
+)
+
+// Alert structure representing a rule firing, or no longer firing, for a rig
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Type     RuleType  `json:"type"`
+	Rig      string    `json:"rig"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	Resolved bool      `json:"resolved"`
+}
+
+// Subject returns a one-line summary of the alert
+func (a *Alert) Subject() string {
+	if a.Resolved {
+		return fmt.Sprintf("[RESOLVED] %v: %v", a.Rig, a.Rule)
+	}
+	return fmt.Sprintf("[ALERT] %v: %v", a.Rig, a.Rule)
+}
+
+// RigState structure representing everything known about a rig that rules
+// are evaluated against
+type RigState struct {
+	Rig      string
+	LastSeen time.Time
+	Mining   bool
+	Paused   bool
+	// Current hashrate in H/s, or nil if the miner's output could not be parsed
+	Hashrate *float64
+	// Expected hashrate in H/s, or 0 if unknown
+	Baseline float64
+	// How long the miner has been running
+	MinerUptime time.Duration
+	// Shares since the miner was started
+	Accepted uint64
+	Rejected uint64
+	// Number of times the miner was started within the last hour
+	RecentStarts int
+}
+
+// Rule structure representing a condition that raises an alert
+type Rule struct {
+	Name string   `json:"name" yaml:"name"`
+	Type RuleType `json:"type" yaml:"type"`
+	// RIG_OFFLINE: minutes without a heartbeat
+	Minutes int `json:"minutes" yaml:"minutes"`
+	// LOW_HASHRATE: percent of the baseline hashrate below which to alert.
+	// REJECT_RATE: percent of rejected shares above which to alert
+	Percent float64 `json:"percent" yaml:"percent"`
+	// MINER_RESTARTS: number of miner starts per hour above which to alert
+	Count int `json:"count" yaml:"count"`
+	// REJECT_RATE: number of shares needed before the reject rate is checked
+	MinShares int `json:"min_shares" yaml:"min_shares"`
+	// LOW_HASHRATE: seconds to let the miner warm up before checking hashrate
+	Grace int `json:"grace" yaml:"grace"`
+	// Rigs this rule applies to. Empty applies to every rig
+	Rigs []string `json:"rigs" yaml:"rigs"`
+}
+
+// Validate checks the rule for errors and fills in defaults
+func (r *Rule) Validate() error {
+	if strings.Compare(r.Name, "") == 0 {
+		r.Name = strings.ToLower(string(r.Type))
+	}
+	switch r.Type {
+	case RULE_RIG_OFFLINE:
+		if r.Minutes <= 0 {
+			return fmt.Errorf("Rule '%v': minutes must be positive", r.Name)
+		}
+	case RULE_LOW_HASHRATE:
+		if r.Percent <= 0 || r.Percent > 100 {
+			return fmt.Errorf("Rule '%v': percent must be between 0 and 100", r.Name)
+		}
+		if r.Grace <= 0 {
+			r.Grace = defaultGrace
+		}
+	case RULE_REJECT_RATE:
+		if r.Percent <= 0 || r.Percent > 100 {
+			return fmt.Errorf("Rule '%v': percent must be between 0 and 100", r.Name)
+		}
+		if r.MinShares <= 0 {
+			r.MinShares = defaultMinShares
+		}
+	case RULE_MINER_RESTARTS:
+		if r.Count <= 0 {
+			return fmt.Errorf("Rule '%v': count must be positive", r.Name)
+		}
+	default:
+		return fmt.Errorf("Rule '%v': unknown type '%v'", r.Name, r.Type)
+	}
+	return nil
+}
+
+// AppliesTo returns whether the rule applies to rig
+func (r *Rule) AppliesTo(rig string) bool {
+	if len(r.Rigs) == 0 {
+		return true
+	}
+	for _, target := range r.Rigs {
+		if strings.Compare(target, rig) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns whether the rule fires for state at now along with a message
+// describing why
+func (r *Rule) Check(state *RigState, now time.Time) (string, bool) {
+	switch r.Type {
+	case RULE_RIG_OFFLINE:
+		offline := now.Sub(state.LastSeen)
+		if offline > time.Duration(r.Minutes)*time.Minute {
+			return fmt.Sprintf("Rig has been offline for %v", offline.Round(time.Second)), true
+		}
+	case RULE_LOW_HASHRATE:
+		if !state.Mining || state.Paused || state.Hashrate == nil || state.Baseline <= 0 {
+			return "", false
+		}
+		if state.MinerUptime < time.Duration(r.Grace)*time.Second {
+			return "", false
+		}
+		percent := *state.Hashrate * 100 / state.Baseline
+		if percent < r.Percent {
+			return fmt.Sprintf("Hashrate %.1f H/s is %.1f%% of the expected %.1f H/s", *state.Hashrate, percent, state.Baseline), true
+		}
+	case RULE_REJECT_RATE:
+		total := state.Accepted + state.Rejected
+		if total == 0 || total < uint64(r.MinShares) {
+			return "", false
+		}
+		percent := float64(state.Rejected) * 100 / float64(total)
+		if percent > r.Percent {
+			return fmt.Sprintf("%d of %d shares (%.1f%%) were rejected", state.Rejected, total, percent), true
+		}
+	case RULE_MINER_RESTARTS:
+		if state.RecentStarts > r.Count {
+			return fmt.Sprintf("Miner was started %d times in the last hour", state.RecentStarts), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,94 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	require := require.New(t)
+
+	rule := &Rule{Type: RULE_REJECT_RATE, Percent: 5}
+	require.Nil(rule.Validate())
+	require.Equal("reject_rate", rule.Name)
+	require.Equal(defaultMinShares, rule.MinShares)
+
+	require.NotNil((&Rule{Type: RULE_RIG_OFFLINE}).Validate())
+	require.NotNil((&Rule{Type: RULE_LOW_HASHRATE, Percent: 150}).Validate())
+	require.NotNil((&Rule{Type: RULE_MINER_RESTARTS}).Validate())
+	require.NotNil((&Rule{Type: "BOGUS"}).Validate())
+}
+
+func TestRuleCheck(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1500000000, 0)
+	hashrate := 700.0
+	state := &RigState{
+		Rig:          "rig1",
+		LastSeen:     now.Add(-3 * time.Minute),
+		Mining:       true,
+		Hashrate:     &hashrate,
+		Baseline:     1000,
+		MinerUptime:  time.Minute,
+		Accepted:     8,
+		Rejected:     1,
+		RecentStarts: 3,
+	}
+
+	offline := &Rule{Type: RULE_RIG_OFFLINE, Minutes: 5}
+	require.Nil(offline.Validate())
+	_, firing := offline.Check(state, now)
+	require.False(firing)
+	_, firing = offline.Check(state, now.Add(5*time.Minute))
+	require.True(firing)
+
+	lowHashrate := &Rule{Type: RULE_LOW_HASHRATE, Percent: 80}
+	require.Nil(lowHashrate.Validate())
+	// Still warming up
+	_, firing = lowHashrate.Check(state, now)
+	require.False(firing)
+	state.MinerUptime = time.Hour
+	msg, firing := lowHashrate.Check(state, now)
+	require.True(firing)
+	require.Contains(msg, "70.0%")
+	// Paused rigs are expected to have no hashrate
+	state.Paused = true
+	_, firing = lowHashrate.Check(state, now)
+	require.False(firing)
+	state.Paused = false
+	// Unknown hashrates never fire
+	state.Hashrate = nil
+	_, firing = lowHashrate.Check(state, now)
+	require.False(firing)
+
+	rejectRate := &Rule{Type: RULE_REJECT_RATE, Percent: 5}
+	require.Nil(rejectRate.Validate())
+	// Too few shares to tell
+	_, firing = rejectRate.Check(state, now)
+	require.False(firing)
+	state.Accepted = 90
+	state.Rejected = 10
+	_, firing = rejectRate.Check(state, now)
+	require.True(firing)
+
+	restarts := &Rule{Type: RULE_MINER_RESTARTS, Count: 3}
+	require.Nil(restarts.Validate())
+	_, firing = restarts.Check(state, now)
+	require.False(firing)
+	state.RecentStarts = 4
+	_, firing = restarts.Check(state, now)
+	require.True(firing)
+}
+
+func TestRuleAppliesTo(t *testing.T) {
+	require := require.New(t)
+
+	rule := &Rule{Type: RULE_MINER_RESTARTS, Count: 1}
+	require.True(rule.AppliesTo("rig1"))
+	rule.Rigs = []string{"rig2"}
+	require.False(rule.AppliesTo("rig1"))
+	require.True(rule.AppliesTo("rig2"))
+}
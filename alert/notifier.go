@@ -0,0 +1,241 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type NotifierType string
+
+const (
+	NOTIFIER_WEBHOOK NotifierType = "WEBHOOK"
+	NOTIFIER_EMAIL   NotifierType = "EMAIL"
+	NOTIFIER_COMMAND NotifierType = "COMMAND"
+)
+
+const defaultNotifierTimeout = 10
+
+// Notifier is the interface implemented by everything alerts can be sent to
+type Notifier interface {
+	Notify(alert *Alert) error
+}
+
+// NotifierConfig structure representing the configuration of a Notifier
+type NotifierConfig struct {
+	Type NotifierType `json:"type" yaml:"type"`
+	// Seconds to wait for the notification to be delivered
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// WEBHOOK
+	URL     string            `json:"url" yaml:"url"`
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// EMAIL
+	Host     string   `json:"host" yaml:"host"`
+	Port     int      `json:"port" yaml:"port"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	From     string   `json:"from" yaml:"from"`
+	To       []string `json:"to" yaml:"to"`
+	// COMMAND
+	Command string   `json:"command" yaml:"command"`
+	Args    []string `json:"args" yaml:"args"`
+}
+
+// ParseNotifier returns the Notifier described by conf
+func ParseNotifier(conf *NotifierConfig) (Notifier, error) {
+	timeout := time.Duration(defaultNotifierTimeout) * time.Second
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	switch conf.Type {
+	case NOTIFIER_WEBHOOK:
+		if strings.Compare(conf.URL, "") == 0 {
+			return nil, fmt.Errorf("Webhook notifier is missing 'url'")
+		}
+		return &WebhookNotifier{conf.URL, conf.Headers, &http.Client{Timeout: timeout}}, nil
+	case NOTIFIER_EMAIL:
+		if strings.Compare(conf.Host, "") == 0 || strings.Compare(conf.From, "") == 0 || len(conf.To) == 0 {
+			return nil, fmt.Errorf("Email notifier requires 'host', 'from' and 'to'")
+		}
+		port := conf.Port
+		if port <= 0 {
+			port = 25
+		}
+		return &EmailNotifier{
+			Address:  net.JoinHostPort(conf.Host, strconv.Itoa(port)),
+			Username: conf.Username,
+			Password: conf.Password,
+			From:     conf.From,
+			To:       conf.To,
+			Timeout:  timeout,
+		}, nil
+	case NOTIFIER_COMMAND:
+		if strings.Compare(conf.Command, "") == 0 {
+			return nil, fmt.Errorf("Command notifier is missing 'command'")
+		}
+		return &CommandNotifier{conf.Command, conf.Args, timeout}, nil
+	default:
+		return nil, fmt.Errorf("Unimplemented notifier: %v", conf.Type)
+	}
+}
+
+// WebhookNotifier POSTs alerts as JSON to a URL
+type WebhookNotifier struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (wn *WebhookNotifier) Notify(alert *Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal alert: %v", err)
+	}
+	req, err := http.NewRequest("POST", wn.URL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range wn.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := wn.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to call webhook '%v': %v", wn.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to call webhook '%v': %v", wn.URL, resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier sends alerts over SMTP. Authentication is only attempted when
+// a username is configured.
+type EmailNotifier struct {
+	Address  string
+	Username string
+	Password string
+	From     string
+	To       []string
+	// How long the whole conversation with the SMTP server may take
+	Timeout time.Duration
+}
+
+func (en *EmailNotifier) Notify(alert *Alert) error {
+	var auth smtp.Auth
+	if strings.Compare(en.Username, "") != 0 {
+		host, _, _ := net.SplitHostPort(en.Address)
+		auth = smtp.PlainAuth("", en.Username, en.Password, host)
+	}
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %v\r\n", en.From)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(msg, "Subject: %v\r\n", alert.Subject())
+	fmt.Fprintf(msg, "Date: %v\r\n", alert.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "\r\n")
+	fmt.Fprintf(msg, "Rig: %v\r\n", alert.Rig)
+	fmt.Fprintf(msg, "Rule: %v (%v)\r\n", alert.Rule, alert.Type)
+	fmt.Fprintf(msg, "Time: %v\r\n", alert.Time)
+	fmt.Fprintf(msg, "\r\n%v\r\n", alert.Message)
+	if err := en.send(auth, msg.Bytes()); err != nil {
+		return fmt.Errorf("Failed to send alert email via '%v': %v", en.Address, err)
+	}
+	return nil
+}
+
+// send does what smtp.SendMail does, but gives up once the timeout expires so
+// that a stuck SMTP server does not hold up alerting
+func (en *EmailNotifier) send(auth smtp.Auth, msg []byte) error {
+	timeout := en.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(defaultNotifierTimeout) * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", en.Address, timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	host, _, _ := net.SplitHostPort(en.Address)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("Server does not support authentication")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(en.From); err != nil {
+		return err
+	}
+	for _, to := range en.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// CommandNotifier runs a command for every alert. The alert is passed as JSON
+// on stdin and in the ALERT_* environment variables.
+type CommandNotifier struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (cn *CommandNotifier) Notify(alert *Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal alert: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cn.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cn.Command, cn.Args...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("ALERT_RULE=%v", alert.Rule),
+		fmt.Sprintf("ALERT_TYPE=%v", alert.Type),
+		fmt.Sprintf("ALERT_RIG=%v", alert.Rig),
+		fmt.Sprintf("ALERT_MESSAGE=%v", alert.Message),
+		fmt.Sprintf("ALERT_RESOLVED=%v", alert.Resolved),
+	)
+	cmd.Stdin = bytes.NewReader(b)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to run alert command '%v': %v: %v", cn.Command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package alert
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testAlert() *Alert {
+	return &Alert{
+		Rule:    "offline",
+		Type:    RULE_RIG_OFFLINE,
+		Rig:     "rig1",
+		Message: "Rig has been offline for 10m0s",
+		Time:    time.Unix(1500000000, 0),
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	require := require.New(t)
+
+	received := make(chan *Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Compare(req.Header.Get("X-Token"), "secret") != 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var alert Alert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- &alert
+	}))
+	defer server.Close()
+
+	notifier, err := ParseNotifier(&NotifierConfig{Type: NOTIFIER_WEBHOOK, URL: server.URL})
+	require.Nil(err)
+	require.NotNil(notifier.Notify(testAlert()))
+
+	notifier, err = ParseNotifier(&NotifierConfig{
+		Type:    NOTIFIER_WEBHOOK,
+		URL:     server.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+	require.Nil(err)
+	require.Nil(notifier.Notify(testAlert()))
+	alert := <-received
+	require.Equal("rig1", alert.Rig)
+	require.Equal(RULE_RIG_OFFLINE, alert.Type)
+}
+
+// serveSMTP accepts a single SMTP session on l and sends the message data it
+// receives on the returned channel
+func serveSMTP(l net.Listener) chan string {
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+		data := false
+		msg := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if data {
+				if strings.Compare(line, ".\r\n") == 0 {
+					data = false
+					messages <- msg
+					fmt.Fprintf(conn, "250 OK\r\n")
+				} else {
+					msg += line
+				}
+				continue
+			}
+			switch strings.ToUpper(strings.Fields(line)[0]) {
+			case "EHLO", "HELO":
+				fmt.Fprintf(conn, "250 localhost\r\n")
+			case "DATA":
+				data = true
+				fmt.Fprintf(conn, "354 Go ahead\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return messages
+}
+
+func TestEmailNotifier(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer l.Close()
+	messages := serveSMTP(l)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	notifier, err := ParseNotifier(&NotifierConfig{
+		Type: NOTIFIER_EMAIL,
+		Host: "127.0.0.1",
+		Port: port,
+		From: "minerconfig@localhost",
+		To:   []string{"ops@localhost"},
+	})
+	require.Nil(err)
+	require.Nil(notifier.Notify(testAlert()))
+
+	msg := <-messages
+	require.Contains(msg, "Subject: [ALERT] rig1: offline")
+	require.Contains(msg, "Rig has been offline for 10m0s")
+
+	_, err = ParseNotifier(&NotifierConfig{Type: NOTIFIER_EMAIL, Host: "127.0.0.1"})
+	require.NotNil(err)
+
+	// Servers that never answer are given up on
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer stuck.Close()
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	notifier, err = ParseNotifier(&NotifierConfig{
+		Type:    NOTIFIER_EMAIL,
+		Timeout: 1,
+		Host:    "127.0.0.1",
+		Port:    stuck.Addr().(*net.TCPAddr).Port,
+		From:    "minerconfig@localhost",
+		To:      []string{"ops@localhost"},
+	})
+	require.Nil(err)
+	start := time.Now()
+	require.NotNil(notifier.Notify(testAlert()))
+	require.True(time.Since(start) < 5*time.Second)
+}
+
+func TestCommandNotifier(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-alert")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alert")
+
+	notifier, err := ParseNotifier(&NotifierConfig{
+		Type:    NOTIFIER_COMMAND,
+		Command: "/bin/sh",
+		Args:    []string{"-c", fmt.Sprintf(`echo "$ALERT_RIG $ALERT_RESOLVED" > %v; cat >> %v`, path, path)},
+	})
+	require.Nil(err)
+	alert := testAlert()
+	alert.Resolved = true
+	require.Nil(notifier.Notify(alert))
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	lines := strings.SplitN(string(b), "\n", 2)
+	require.Equal("rig1 true", lines[0])
+	var received Alert
+	require.Nil(json.Unmarshal([]byte(lines[1]), &received))
+	require.True(received.Resolved)
+
+	notifier, err = ParseNotifier(&NotifierConfig{Type: NOTIFIER_COMMAND, Command: "/bin/false"})
+	require.Nil(err)
+	require.NotNil(notifier.Notify(alert))
+}
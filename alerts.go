@@ -0,0 +1,244 @@
+package minerconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/minerconfig/alert"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// AlertConfig structure representing the configuration of alerting
+type AlertConfig struct {
+	// Seconds between evaluations
+	Interval  int                     `json:"interval" yaml:"interval"`
+	Rules     []*alert.Rule           `json:"rules" yaml:"rules"`
+	Notifiers []*alert.NotifierConfig `json:"notifiers" yaml:"notifiers"`
+	// Expected hashrate (H/s) of each rig. Rigs without one are compared
+	// against the hashrate they registered for the algorithm they are mining
+	Baselines map[string]float64 `json:"baselines" yaml:"baselines"`
+}
+
+// Alerter periodically evaluates the alert rules against every known rig and
+// notifies whenever an alert fires or resolves
+type Alerter struct {
+	sync.Mutex
+	*AlertConfig
+	Notifiers []alert.Notifier
+	// Clock used for evaluation. Defaults to time.Now
+	Now    func() time.Time
+	server *Server
+	// Alerts currently firing keyed by rule name and rig
+	firing map[string]*alert.Alert
+	// Miner starts last reported by each rig and when new starts were seen
+	lastStarts map[string]int
+	startTimes map[string][]time.Time
+	stop       chan struct{}
+}
+
+// NewAlerter creates a new Alerter for server
+func NewAlerter(server *Server, config *AlertConfig) (*Alerter, error) {
+	names := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Duplicate alert rule '%v'", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	if config.Interval <= 0 {
+		config.Interval = 60
+	}
+	a := &Alerter{}
+	a.AlertConfig = config
+	for _, notifierConfig := range config.Notifiers {
+		notifier, err := alert.ParseNotifier(notifierConfig)
+		if err != nil {
+			return nil, err
+		}
+		a.Notifiers = append(a.Notifiers, notifier)
+	}
+	a.Now = time.Now
+	a.server = server
+	a.firing = make(map[string]*alert.Alert)
+	a.lastStarts = make(map[string]int)
+	a.startTimes = make(map[string][]time.Time)
+	return a, nil
+}
+
+// Start periodically evaluates the rules until Stop is called
+func (a *Alerter) Start() {
+	a.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(a.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.Evaluate()
+			}
+		}
+	}()
+}
+
+// Stop stops periodic evaluation
+func (a *Alerter) Stop() {
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+}
+
+// countStarts records any new miner starts of rig and returns the number of
+// starts within the last hour. Must be called with the lock held
+func (a *Alerter) countStarts(rig *Rig, now time.Time) int {
+	rigID := rig.RigID
+	if rig.Status != nil {
+		current := rig.Status.MinerStarts
+		if last, ok := a.lastStarts[rigID]; ok {
+			starts := current - last
+			if current < last {
+				// The client restarted
+				starts = current
+			}
+			for idx := 0; idx < starts; idx++ {
+				a.startTimes[rigID] = append(a.startTimes[rigID], now)
+			}
+		}
+		a.lastStarts[rigID] = current
+	}
+	recent := make([]time.Time, 0)
+	for _, t := range a.startTimes[rigID] {
+		if now.Sub(t) <= time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	a.startTimes[rigID] = recent
+	return len(recent)
+}
+
+// rigState returns the state of rig that rules are checked against. Must be
+// called with the lock held
+func (a *Alerter) rigState(rig *Rig, now time.Time) *alert.RigState {
+	state := &alert.RigState{}
+	state.Rig = rig.RigID
+	state.LastSeen = rig.LastSeen
+	state.RecentStarts = a.countStarts(rig, now)
+	// The last status of an offline rig is stale
+	if !rig.Online || rig.Status == nil {
+		return state
+	}
+	status := rig.Status
+	state.Mining = status.Mining
+	state.Paused = status.Paused
+	state.Hashrate = status.Hashrate
+	state.MinerUptime = time.Duration(status.MinerUptime) * time.Second
+	state.Accepted = status.Accepted
+	state.Rejected = status.Rejected
+	state.Baseline = a.Baselines[rig.RigID]
+	if state.Baseline <= 0 {
+		state.Baseline = rig.Hashrates[status.Algorithm]
+	}
+	return state
+}
+
+// Evaluate checks every rule against every known rig, notifies of alerts that
+// fired or resolved and returns them
+func (a *Alerter) Evaluate() []*alert.Alert {
+	a.Lock()
+	now := a.Now()
+	ret := make([]*alert.Alert, 0)
+	for _, rig := range a.server.Inventory.Rigs() {
+		state := a.rigState(rig, now)
+		for _, rule := range a.Rules {
+			if !rule.AppliesTo(rig.RigID) {
+				continue
+			}
+			key := fmt.Sprintf("%v/%v", rule.Name, rig.RigID)
+			message, firing := rule.Check(state, now)
+			active, wasFiring := a.firing[key]
+			if firing && !wasFiring {
+				active = &alert.Alert{
+					Rule:    rule.Name,
+					Type:    rule.Type,
+					Rig:     rig.RigID,
+					Message: message,
+					Time:    now,
+				}
+				a.firing[key] = active
+				ret = append(ret, active)
+			} else if !firing && wasFiring {
+				delete(a.firing, key)
+				resolved := &alert.Alert{}
+				*resolved = *active
+				resolved.Time = now
+				resolved.Resolved = true
+				ret = append(ret, resolved)
+			}
+		}
+	}
+	a.Unlock()
+
+	// Notifiers may take a while. Don't hold up the rest of the server
+	for _, al := range ret {
+		a.notify(al)
+	}
+	return ret
+}
+
+// notify logs al and sends it to every notifier
+func (a *Alerter) notify(al *alert.Alert) {
+	if al.Resolved {
+		log.Infof("[alert]: Resolved '%v' on rig '%v'", al.Rule, al.Rig)
+	} else {
+		log.Warnf("[alert]: '%v' on rig '%v': %v", al.Rule, al.Rig, al.Message)
+	}
+	for _, notifier := range a.Notifiers {
+		if err := notifier.Notify(al); err != nil {
+			log.Errorf("[alert]: %v", err)
+		}
+	}
+}
+
+// Raise sends an alert that was not raised by a rule, such as a rig failing
+// to reset its GPUs, to every notifier. Raised alerts are never resolved
+func (a *Alerter) Raise(al *alert.Alert) {
+	if al.Time.IsZero() {
+		al.Time = a.Now()
+	}
+	a.notify(al)
+}
+
+// Active returns the alerts that are currently firing
+func (a *Alerter) Active() []*alert.Alert {
+	a.Lock()
+	defer a.Unlock()
+	ret := make([]*alert.Alert, 0)
+	for _, active := range a.firing {
+		ret = append(ret, active)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Time.Equal(ret[j].Time) {
+			return strings.Compare(ret[i].Rig, ret[j].Rig) < 0
+		}
+		return ret[i].Time.Before(ret[j].Time)
+	})
+	return ret
+}
+
+// handleGetAlerts sends the alerts that are currently firing to the requester
+func (s *Server) handleGetAlerts(w *websockets.WebsocketClient, data interface{}) {
+	alerts := make([]*alert.Alert, 0)
+	if s.Alerter != nil {
+		alerts = s.Alerter.Active()
+	}
+	w.Emit("get-alerts-result", jsonData(alerts))
+}
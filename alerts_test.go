@@ -0,0 +1,118 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gurupras/minerconfig/alert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testAlertConfig string = `
+interval: 60
+baselines:
+  rig1: 1000
+rules:
+  - name: offline
+    type: RIG_OFFLINE
+    minutes: 5
+  - name: low-hashrate
+    type: LOW_HASHRATE
+    percent: 80
+    grace: 60
+  - name: restarts
+    type: MINER_RESTARTS
+    count: 2
+`
+
+// recordingNotifier remembers every alert it was notified of
+type recordingNotifier struct {
+	alerts []*alert.Alert
+}
+
+func (rn *recordingNotifier) Notify(a *alert.Alert) error {
+	rn.alerts = append(rn.alerts, a)
+	return nil
+}
+
+func TestAlerter(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-alerts")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	var alertConfig AlertConfig
+	require.Nil(yaml.Unmarshal([]byte(testAlertConfig), &alertConfig))
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Alerts:        &alertConfig,
+	})
+	require.Nil(err)
+	alerter := server.Alerter
+	notifier := &recordingNotifier{}
+	alerter.Notifiers = []alert.Notifier{notifier}
+
+	now := time.Unix(1500000000, 0)
+	clock := func() time.Time {
+		return now
+	}
+	alerter.Now = clock
+	server.Inventory.Now = clock
+
+	server.Inventory.Register(&RigInfo{RigID: "rig1"}, "10.0.0.2:51234")
+	server.Inventory.Register(&RigInfo{RigID: "rig2", Hashrates: map[string]float64{"cryptonight": 500}}, "10.0.0.3:51234")
+
+	report := func(rig string, hashrate float64, starts int) {
+		status := &StatusReport{}
+		status.Mining = true
+		status.Algorithm = "cryptonight"
+		status.MinerUptime = 600
+		status.MinerStarts = starts
+		status.Hashrate = &hashrate
+		server.Inventory.ReportStatus(rig, status)
+	}
+
+	report("rig1", 950, 1)
+	report("rig2", 490, 1)
+	require.Equal(0, len(alerter.Evaluate()))
+
+	// rig2 falls below 80% of the hashrate it registered
+	report("rig2", 300, 1)
+	alerts := alerter.Evaluate()
+	require.Equal(1, len(alerts))
+	require.Equal("low-hashrate", alerts[0].Rule)
+	require.Equal("rig2", alerts[0].Rig)
+	require.Equal(1, len(alerter.Active()))
+
+	// Firing alerts are only notified once
+	require.Equal(0, len(alerter.Evaluate()))
+
+	report("rig2", 480, 1)
+	alerts = alerter.Evaluate()
+	require.Equal(1, len(alerts))
+	require.True(alerts[0].Resolved)
+	require.Equal(0, len(alerter.Active()))
+
+	// Three more starts within an hour
+	report("rig1", 950, 4)
+	alerts = alerter.Evaluate()
+	require.Equal(1, len(alerts))
+	require.Equal("restarts", alerts[0].Rule)
+	require.Equal("rig1", alerts[0].Rig)
+
+	// rig1 goes quiet. Starts age out of the hour along the way
+	now = now.Add(time.Hour + time.Minute)
+	report("rig2", 480, 1)
+	alerts = alerter.Evaluate()
+	require.Equal(2, len(alerts))
+	require.Equal("offline", alerts[0].Rule)
+	require.Equal("rig1", alerts[0].Rig)
+	require.Equal("restarts", alerts[1].Rule)
+	require.True(alerts[1].Resolved)
+
+	require.Equal(5, len(notifier.alerts))
+}
@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 #ifndef __BASE_H_
 #define __BASE_H_
 
@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 #include "base.h"
 #include <stdio.h>
 #include <assert.h>
@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 package amdconfig
 
 /*
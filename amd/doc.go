@@ -0,0 +1,4 @@
+// Package amdconfig maps AMD OpenCL devices to their PCI topology. It requires
+// cgo and the OpenCL SDK and is only built with the opencl build tag. Use the
+// discovery package instead of depending on it directly.
+package amdconfig
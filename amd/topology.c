@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 #include "topology.h"
 #include <stdio.h>
 #include <assert.h>
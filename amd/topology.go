@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 package amdconfig
 
 /*
@@ -42,3 +45,24 @@ func FindIndexMatchingTopology(topology *pcie.Topology) (int, error) {
 	}
 	return -1, fmt.Errorf("Failed to find an OpenCL device matching topology: %v\n", *topology)
 }
+
+// Device structure representing an AMD OpenCL GPU
+type Device struct {
+	Platform int
+	Index    int
+	Name     string
+	Topology *pcie.Topology
+}
+
+// ListDevices returns the AMD OpenCL GPUs of every platform
+func ListDevices() []*Device {
+	ret := make([]*Device, 0)
+	numPlatforms := getNumPlatforms()
+	for platformIdx := 0; platformIdx < int(numPlatforms); platformIdx++ {
+		for _, ctx := range getAMDDevices(platformIdx) {
+			topology, _ := GetDeviceTopology(ctx.DeviceID)
+			ret = append(ret, &Device{platformIdx, ctx.DeviceIndex, ctx.Name, topology})
+		}
+	}
+	return ret
+}
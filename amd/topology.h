@@ -1,3 +1,6 @@
+//go:build opencl
+// +build opencl
+
 #ifndef __TOPOLOGY_H_
 #define __TOPOLOGY_H_
 
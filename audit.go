@@ -0,0 +1,272 @@
+package minerconfig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audited events
+const (
+	AUDIT_ADD_POOL      = "add-pool"
+	AUDIT_SELECT_POOLS  = "select-pools"
+	AUDIT_PAUSE_MINING  = "pause-mining"
+	AUDIT_RESUME_MINING = "resume-mining"
+	AUDIT_MINER_COMMAND = "miner-command"
+	AUDIT_ROLLOUT       = "rollout"
+	AUDIT_WALLET        = "wallet"
+	AUDIT_IMPORT_POOLS  = "import-pools"
+)
+
+// Actors for changes made by the server itself rather than a user
+const (
+	ACTOR_PROFIT_SWITCHER = "profit-switcher"
+	ACTOR_SCHEDULER       = "scheduler"
+	ACTOR_ROLLOUT         = "rollout"
+)
+
+const defaultAuditQueryLimit = 100
+
+// AuditEntry structure representing a single change recorded in the audit log
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Remote address of whoever made the change, or the server component that
+	// made it
+	Actor string `json:"actor"`
+	// Rig affected by the change. Empty for farm-wide changes
+	Rig     string      `json:"rig"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// AuditQuery structure representing a filter for audit log entries. Zero
+// values match everything
+type AuditQuery struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Farm-wide entries affect every rig and are always included
+	Rig    string   `json:"rig"`
+	Events []string `json:"events"`
+	// Maximum number of entries returned. Defaults to 100
+	Limit int `json:"limit"`
+}
+
+// Matches returns whether entry passes the filter
+func (q *AuditQuery) Matches(entry *AuditEntry) bool {
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time.After(q.Until) {
+		return false
+	}
+	if strings.Compare(q.Rig, "") != 0 && strings.Compare(entry.Rig, "") != 0 && strings.Compare(entry.Rig, q.Rig) != 0 {
+		return false
+	}
+	if len(q.Events) > 0 {
+		found := false
+		for _, event := range q.Events {
+			if strings.Compare(event, entry.Event) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditLog is an append-only log of changes stored as one JSON entry per line
+type AuditLog struct {
+	sync.Mutex
+	// Clock used to timestamp entries. Defaults to time.Now
+	Now  func() time.Time
+	path string
+}
+
+// NewAuditLog creates an AuditLog stored at path
+func NewAuditLog(path string) *AuditLog {
+	al := &AuditLog{}
+	al.Now = time.Now
+	al.path = path
+	return al
+}
+
+// Record appends entry to the log, timestamping it if needed
+func (al *AuditLog) Record(entry *AuditEntry) {
+	al.Lock()
+	defer al.Unlock()
+	if entry.Time.IsZero() {
+		entry.Time = al.Now()
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Failed to marshal audit entry: %v", err)
+		return
+	}
+	f, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Errorf("Failed to open audit log '%v': %v", al.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write audit log '%v': %v", al.path, err)
+	}
+}
+
+// Query returns the entries matching q, newest first
+func (al *AuditLog) Query(q *AuditQuery) ([]*AuditEntry, error) {
+	al.Lock()
+	defer al.Unlock()
+	ret := make([]*AuditEntry, 0)
+	if !easyfiles.Exists(al.path) {
+		return ret, nil
+	}
+	f, err := os.Open(al.path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log '%v': %v", al.path, err)
+	}
+	defer f.Close()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditQueryLimit
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warnf("Ignoring malformed audit entry: %v", err)
+			continue
+		}
+		if !q.Matches(&entry) {
+			continue
+		}
+		ret = append(ret, &entry)
+		// Only the newest entries are returned
+		if len(ret) > limit {
+			ret = ret[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read audit log '%v': %v", al.path, err)
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret, nil
+}
+
+// clientAddr returns the remote address of w for use as an actor
+func clientAddr(w *websockets.WebsocketClient) string {
+	return fmt.Sprintf("%v", w.RemoteAddr())
+}
+
+// poolURLs returns the URLs of pools for use in audit entries
+func poolURLs(pools []interface{}) []string {
+	ret := make([]string, 0)
+	for _, rawPool := range pools {
+		var pool Pool
+		if err := decodeData(rawPool, &pool); err != nil {
+			continue
+		}
+		ret = append(ret, pool.Url)
+	}
+	return ret
+}
+
+// auditSelection records that actor changed the selected pools of rig
+func (s *Server) auditSelection(actor string, rig string, message string) {
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_SELECT_POOLS,
+		Actor:   actor,
+		Rig:     rig,
+		Message: message,
+		Details: poolURLs(s.Store.SelectedPools(rig)),
+	})
+}
+
+// auditGroupSelection records that actor changed the selected pools of group
+func (s *Server) auditGroupSelection(actor string, group string, message string) {
+	var details []string
+	if s.Store.HasGroupSelectedPools(group) {
+		details = poolURLs(s.Store.RigSelectedPools("", group))
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_SELECT_POOLS,
+		Actor:   actor,
+		Message: fmt.Sprintf("Group '%v': %v", group, message),
+		Details: details,
+	})
+}
+
+// handleGetAuditLog sends the audit log entries matching the requested query
+func (s *Server) handleGetAuditLog(w *websockets.WebsocketClient, data interface{}) {
+	var q AuditQuery
+	if data != nil {
+		if err := decodeData(data, &q); err != nil {
+			log.Errorf("[get-audit-log]: Failed to unmarshal: %v", err)
+			w.Emit("error", fmt.Sprintf("Invalid get-audit-log request: %v", err))
+			return
+		}
+	}
+	entries, err := s.Audit.Query(&q)
+	if err != nil {
+		log.Errorf("[get-audit-log]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	w.Emit("get-audit-log-result", jsonData(entries))
+}
+
+// handleAuditHTTP serves the audit log over HTTP. Supported parameters are
+// since and until (RFC 3339), rig, event (repeatable) and limit
+func (s *Server) handleAuditHTTP(w http.ResponseWriter, req *http.Request) {
+	var q AuditQuery
+	params := req.URL.Query()
+	var err error
+	if since := params.Get("since"); strings.Compare(since, "") != 0 {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if until := params.Get("until"); strings.Compare(until, "") != 0 {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid until: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := params.Get("limit"); strings.Compare(limit, "") != 0 {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	q.Rig = params.Get("rig")
+	q.Events = params["event"]
+
+	entries, err := s.Audit.Query(&q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Errorf("Failed to write audit log response: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-audit")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2017, 11, 6, 3, 0, 0, 0, time.UTC)
+	audit := NewAuditLog(filepath.Join(dir, "audit.log"))
+	audit.Now = func() time.Time {
+		return now
+	}
+
+	// Nothing recorded yet
+	entries, err := audit.Query(&AuditQuery{})
+	require.Nil(err)
+	require.Equal(0, len(entries))
+
+	audit.Record(&AuditEntry{Event: AUDIT_ADD_POOL, Actor: "10.0.0.5:40000"})
+	now = now.Add(time.Minute)
+	audit.Record(&AuditEntry{Event: AUDIT_SELECT_POOLS, Actor: "10.0.0.5:40000", Details: []string{"pool.minexmr.com:5555"}})
+	now = now.Add(time.Minute)
+	audit.Record(&AuditEntry{Event: AUDIT_SELECT_POOLS, Actor: ACTOR_SCHEDULER, Rig: "rig7"})
+	now = now.Add(time.Minute)
+	audit.Record(&AuditEntry{Event: AUDIT_SELECT_POOLS, Actor: ACTOR_PROFIT_SWITCHER, Rig: "rig8"})
+
+	// Newest first
+	entries, err = audit.Query(&AuditQuery{})
+	require.Nil(err)
+	require.Equal(4, len(entries))
+	require.Equal("rig8", entries[0].Rig)
+	require.Equal(AUDIT_ADD_POOL, entries[3].Event)
+
+	// Farm-wide changes affect rig7 too
+	entries, err = audit.Query(&AuditQuery{Rig: "rig7", Events: []string{AUDIT_SELECT_POOLS}})
+	require.Nil(err)
+	require.Equal(2, len(entries))
+	require.Equal(ACTOR_SCHEDULER, entries[0].Actor)
+	require.Equal("10.0.0.5:40000", entries[1].Actor)
+
+	start := time.Date(2017, 11, 6, 3, 1, 0, 0, time.UTC)
+	entries, err = audit.Query(&AuditQuery{Since: start, Until: start.Add(time.Minute)})
+	require.Nil(err)
+	require.Equal(2, len(entries))
+
+	entries, err = audit.Query(&AuditQuery{Limit: 1})
+	require.Nil(err)
+	require.Equal(1, len(entries))
+	require.Equal("rig8", entries[0].Rig)
+}
+
+func TestAuditHTTP(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-audit")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	server.Audit.Record(&AuditEntry{Event: AUDIT_SELECT_POOLS, Actor: ACTOR_SCHEDULER, Rig: "rig7"})
+	server.Audit.Record(&AuditEntry{Event: AUDIT_MINER_COMMAND, Actor: "10.0.0.5:40000", Rig: "rig7"})
+
+	req := httptest.NewRequest("GET", "/api/audit?rig=rig7&event=select-pools", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	var entries []*AuditEntry
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Equal(1, len(entries))
+	require.Equal(ACTOR_SCHEDULER, entries[0].Actor)
+
+	req = httptest.NewRequest("GET", "/api/audit?since=yesterday", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusBadRequest, w.Code)
+}
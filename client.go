@@ -3,23 +3,25 @@ package minerconfig
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/gorilla/websocket"
-	mineros "github.com/gurupras/go-cryptonight-miner/miner-os"
 	"github.com/gurupras/go-easyfiles"
-	amdconfig "github.com/gurupras/minerconfig/amd"
+	"github.com/gurupras/minerconfig/discovery"
 	gpureset "github.com/gurupras/minerconfig/gpu-reset"
-	gputool "github.com/gurupras/minerconfig/gpu-tool"
+	"github.com/gurupras/minerconfig/sensors"
 	"github.com/homesound/simple-websockets"
 	log "github.com/sirupsen/logrus"
 )
@@ -33,9 +35,29 @@ type Client struct {
 	*ClientConfig
 	*websockets.WebsocketClient
 	MinerConfig     *Config
+	Discoverer      discovery.Discoverer
 	origMinerConfig *Config
 	TempConfigPath  string
+	minerMutex      sync.Mutex
 	miner           *exec.Cmd
+	minerStdin      io.WriteCloser
+	output          outputTap
+	stats           minerStats
+	counters        clientCounters
+	connectedSince  time.Time
+	logs            *LogBuffer
+	logStreamMutex  sync.Mutex
+	logStreamStop   chan struct{}
+	stdinOnce       sync.Once
+	handlersMutex   sync.Mutex
+	handlers        map[string]func(w *websockets.WebsocketClient, data interface{})
+	gpus            []GPUInfo
+	stateMutex      sync.Mutex
+	state           ClientState
+	resumeTimer     *time.Timer
+	sensorsMutex    sync.Mutex
+	readings        []*sensors.Reading
+	thermal         *thermalPolicy
 }
 
 // ClientConfig structure representing the configuration parameters for a
@@ -47,6 +69,36 @@ type ClientConfig struct {
 	MinerConfigPath  string        `json:"miner_config_path" yaml:"miner_config_path"`
 	MinerConfig      *Config       `json:"miner_config" yaml:"miner_config"`
 	WebserverAddress string        `json:"webserver_address" yaml:"webserver_address"`
+	// ID the client registers with on the webserver. Defaults to the hostname
+	RigID string `json:"rig_id" yaml:"rig_id"`
+	// Hashrate (H/s) of this rig for every algorithm it can mine. Used by the
+	// webserver to pick the most profitable pools
+	Hashrates map[string]float64 `json:"hashrates" yaml:"hashrates"`
+	// Group the rig belongs to. Used to pause or resume a set of rigs together
+	Group string `json:"group" yaml:"group"`
+	// Path to the file used to remember state such as being paused across
+	// restarts. miner-client defaults this to a file next to its
+	// configuration. Defaults to a file named after the rig in the temp
+	// directory otherwise
+	StatePath string `json:"state_path" yaml:"state_path"`
+	// Set if the miner pauses on 'p' and resumes on 'r' over stdin (e.g.
+	// xmr-stak). The miner is stopped and started otherwise
+	StdinPause bool `json:"stdin_pause" yaml:"stdin_pause"`
+	// Number of lines of miner and client output kept for log streaming
+	LogBufferLines int `json:"log_buffer_lines" yaml:"log_buffer_lines"`
+	// Maximum number of log lines per second streamed to the webserver
+	LogRateLimit int `json:"log_rate_limit" yaml:"log_rate_limit"`
+	// Seconds between status reports sent to the webserver
+	StatusInterval int `json:"status_interval" yaml:"status_interval"`
+	// Address to serve Prometheus metrics on, e.g. ":9101". Metrics are not
+	// served if empty
+	MetricsAddress string `json:"metrics_address" yaml:"metrics_address"`
+	// Where and how often GPU temperatures, fan speeds and power draw are
+	// read. Sensors are not read if nil
+	Sensors *sensors.Config `json:"sensors" yaml:"sensors"`
+	// Temperatures above which GPUs are throttled, excluded or mining is
+	// stopped. Sensors are read with their defaults if not configured
+	Thermal *ThermalConfig `json:"thermal" yaml:"thermal"`
 }
 
 // NewClient creates a new minerconfig client
@@ -69,6 +121,23 @@ func NewClient(clientConfig *ClientConfig) (*Client, error) {
 			}
 		}
 	}
+	if clientConfig.MinerConfig != nil {
+		if err := clientConfig.MinerConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid miner-config: %v", err)
+		}
+	}
+
+	if strings.Compare(clientConfig.RigID, "") == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get hostname for rig ID: %v", err)
+		}
+		clientConfig.RigID = hostname
+	}
+	if strings.Compare(clientConfig.StatePath, "") == 0 {
+		clientConfig.StatePath = filepath.Join(os.TempDir(), fmt.Sprintf("minerconfig-%v.state", clientConfig.RigID))
+		log.Warnf("No state path configured. Using '%v', which may not survive a reboot", clientConfig.StatePath)
+	}
 
 	tmpConfigFile, err := easyfiles.TempFile(os.TempDir(), "minerconfig", ".json")
 	if err != nil {
@@ -83,11 +152,59 @@ func NewClient(clientConfig *ClientConfig) (*Client, error) {
 	c.origMinerConfig = clientConfig.MinerConfig
 	c.MinerConfig = c.origMinerConfig.Clone()
 	c.TempConfigPath = tmpConfigPath
+	c.Discoverer = discovery.Default()
+	c.handlers = make(map[string]func(w *websockets.WebsocketClient, data interface{}))
+	c.logs = NewLogBuffer(clientConfig.LogBufferLines)
+	clientLogHook.add(c.logs)
+	ready := false
+	defer func() {
+		if !ready {
+			clientLogHook.remove(c.logs)
+		}
+	}()
+	if err := c.LoadState(); err != nil {
+		return nil, err
+	}
+	// GPU settings applied before a crash are still active
+	if err := c.RevertGPUTool(); err != nil {
+		log.Errorf("%v", err)
+	}
+	if c.Thermal != nil {
+		if err := c.Thermal.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid thermal config: %v", err)
+		}
+		c.thermal = newThermalPolicy(c.Thermal)
+		if c.Sensors == nil {
+			c.Sensors = &sensors.Config{}
+		}
+	}
+	// The GPUs are read from the websocket, miner and sensors goroutines
+	// without a lock, so they are discovered once before any of them starts
+	c.gpus = c.GPUs()
+	var readers []sensors.Reader
+	if c.Sensors != nil {
+		if readers, err = sensors.NewReaders(c.Sensors); err != nil {
+			return nil, fmt.Errorf("Invalid sensors config: %v", err)
+		}
+	}
 	// Should we connect here?
 	if err := c.Connect(); err != nil {
 		return nil, fmt.Errorf("Failed to connect to webserver: %v", err)
 	}
-	go c.ProcessMessages()
+	// Resuming asks the webserver for pools, so the pause loaded from the
+	// state file only starts expiring once we are connected
+	c.stateMutex.Lock()
+	c.scheduleResume()
+	c.stateMutex.Unlock()
+	go c.keepalive()
+	go c.reportStatus()
+	if c.Sensors != nil {
+		go c.monitorSensors(readers)
+	}
+	if strings.Compare(c.MetricsAddress, "") != 0 {
+		go c.serveMetrics()
+	}
+	ready = true
 	return c, nil
 }
 
@@ -104,19 +221,73 @@ func (c *Client) Connect() error {
 	}
 	client := websockets.NewClient(ws)
 	c.WebsocketClient = client
+	c.connectedSince = time.Now()
 
-	// Periodically send messages to server for keepalive
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
-			if err := c.Emit("keepalive", "{}"); err != nil {
-				if err = c.Connect(); err != nil {
-					log.Errorf("Failed to re-connect to server: %v", err)
-				}
+	// Listeners belong to the previous connection, if any
+	c.handlersMutex.Lock()
+	for evt, fn := range c.handlers {
+		client.On(evt, fn)
+	}
+	c.handlersMutex.Unlock()
+	go client.ProcessMessages()
+
+	if err := c.Register(); err != nil {
+		return fmt.Errorf("Failed to register with webserver: %v", err)
+	}
+	return nil
+}
+
+// keepalive periodically sends messages to the server and re-connects if they
+// fail
+func (c *Client) keepalive() {
+	for {
+		time.Sleep(5 * time.Second)
+		b, err := json.Marshal(c.heartbeat())
+		if err != nil {
+			log.Errorf("Failed to marshal heartbeat: %v", err)
+			continue
+		}
+		if err := c.Emit("keepalive", string(b)); err != nil {
+			if err = c.Connect(); err != nil {
+				log.Errorf("Failed to re-connect to server: %v", err)
+			} else {
+				c.counters.reconnected()
 			}
 		}
-	}()
-	return nil
+	}
+}
+
+// Handle adds a listener for evt that is kept across re-connects
+func (c *Client) Handle(evt string, fn func(w *websockets.WebsocketClient, data interface{})) {
+	c.handlersMutex.Lock()
+	c.handlers[evt] = fn
+	c.handlersMutex.Unlock()
+	c.On(evt, fn)
+}
+
+// rigInfo returns what this rig registers with the webserver as
+func (c *Client) rigInfo() *RigInfo {
+	hostname, _ := os.Hostname()
+	return &RigInfo{
+		RigID:       c.RigID,
+		Group:       c.Group,
+		Hashrates:   c.Hashrates,
+		Version:     Version,
+		Hostname:    hostname,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		MinerBinary: c.BinaryPath,
+		GPUs:        c.gpus,
+	}
+}
+
+// Register informs the webserver of this rig's ID, hashrates and hardware
+func (c *Client) Register() error {
+	b, err := json.Marshal(c.rigInfo())
+	if err != nil {
+		return err
+	}
+	return c.Emit("register-rig", string(b))
 }
 
 // HandlePoolInfo handles the selected-pools data from the server
@@ -140,11 +311,20 @@ func (c *Client) HandlePoolInfo(w *websockets.WebsocketClient, data interface{})
 		log.Errorf("Failed to convert data into []Pool: %v", err)
 		return
 	}
+	// Hold the miner until it is started so that pausing or thermal protection
+	// cannot stop it halfway through
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
 	if len(poolData) == 0 {
 		// The server has no selected pools..wait for it to inform us
 		log.Infof("Server has no selected pool information. Waiting for server to inform us")
+		if err := c.idle(); err != nil {
+			log.Errorf("%v", err)
+		}
 		return
 	}
+	// Tell this rig apart from the others in pool dashboards
+	expandPoolTemplates(poolData, c.rigInfo().TemplateValues())
 
 	c.MinerConfig = c.origMinerConfig.Clone()
 	minerConfig := c.MinerConfig
@@ -159,35 +339,42 @@ func (c *Client) HandlePoolInfo(w *websockets.WebsocketClient, data interface{})
 	minerConfig.Pass = firstPool.Pass
 	minerConfig.Algorithm = firstPool.Algorithm
 
+	// Neither reset the GPUs nor apply settings when the miner is not started
+	// anyway
+	if c.Paused() {
+		log.Infof("Mining is paused. Not starting miner")
+		if err := c.idle(); err != nil {
+			log.Errorf("%v", err)
+		}
+		return
+	}
+	if c.thermal != nil && c.thermal.stopped() {
+		log.Warnf("GPUs are overheating. Not starting miner")
+		if err := c.idle(); err != nil {
+			log.Errorf("%v", err)
+		}
+		return
+	}
+
 	// Stop current miner if it exists
 	// Overwrite TempConfigPath file
 	// Start miner with -c TempConfigPath
-	if err := c.ResetMiner(); err != nil {
+	if err := c.resetMiner(); err != nil {
 		log.Errorf("Failed to reset miner: %v", err)
+		if _, ok := err.(*ResetFailedError); ok {
+			log.Errorf("Not starting miner")
+			return
+		}
 	}
-	// Check to see if every thread has an Index. If not, then we need to parse
-	// DeviceIndex into Index
-	if minerConfig.Threads != nil {
-		for threadIdx := 0; threadIdx < len(minerConfig.Threads); threadIdx++ {
-			threadInfo := minerConfig.Threads[threadIdx]
-			if threadInfo.Index == nil && threadInfo.DeviceIndex == nil {
-				log.Fatalf("Either 'index' or 'device_index' must be present for every thread")
-			}
-			if threadInfo.Index == nil {
-				// We need to convert the DeviceIndex into an OpenCL index
-				instanceId := minerConfig.DeviceInstanceIDs[*threadInfo.DeviceIndex]
-				topology, err := mineros.GetPCITopology(instanceId)
-				if err != nil {
-					log.Fatalf("Failed to get topology for device instance ID '%v': %v\n", instanceId, err)
-				}
-				var openclIdx int
-				openclIdx, err = amdconfig.FindIndexMatchingTopology(topology)
-				if err != nil {
-					log.Fatalf("%v", err)
-				}
-				minerConfig.Threads[threadIdx].Index = &openclIdx
-				log.Infof("Thread-%d: OpenCL index=%d", threadIdx, *minerConfig.Threads[threadIdx].Index)
-			}
+	if err := resolveThreadIndices(minerConfig, c.Discoverer); err != nil {
+		log.Errorf("%v. Not starting miner", err)
+		return
+	}
+
+	if c.thermal != nil {
+		if err := c.thermal.apply(minerConfig, c.gpus); err != nil {
+			log.Errorf("%v. Not starting miner", err)
+			return
 		}
 	}
 
@@ -204,19 +391,53 @@ func (c *Client) HandlePoolInfo(w *websockets.WebsocketClient, data interface{})
 	}
 
 	log.Infof("Starting miner ...")
-	if err := c.StartMiner(); err != nil {
+	if err := c.startMiner(); err != nil {
 		log.Errorf("Failed to start miner: %v", err)
 		return
 	}
 }
 
+// resolveThreadIndices gives every thread of config that only has a
+// DeviceIndex the OpenCL index of that device
+func resolveThreadIndices(config *Config, discoverer discovery.Discoverer) error {
+	for threadIdx, thread := range config.Threads {
+		if thread.Index != nil {
+			continue
+		}
+		if thread.DeviceIndex == nil {
+			return fmt.Errorf("Thread-%d: either 'index' or 'device_index' must be present", threadIdx)
+		}
+		if *thread.DeviceIndex < 0 || *thread.DeviceIndex >= len(config.DeviceInstanceIDs) {
+			return fmt.Errorf("Thread-%d: no device instance ID at device_index %d", threadIdx, *thread.DeviceIndex)
+		}
+		device := config.DeviceInstanceIDs[*thread.DeviceIndex]
+		topology, err := deviceTopology(device)
+		if err != nil {
+			return fmt.Errorf("Thread-%d: failed to get topology of '%v': %v", threadIdx, device, err)
+		}
+		openclIdx, err := discovery.FindIndexMatchingTopology(discoverer, topology)
+		if err != nil {
+			return fmt.Errorf("Thread-%d: %v", threadIdx, err)
+		}
+		config.Threads[threadIdx].Index = &openclIdx
+		log.Infof("Thread-%d: OpenCL index=%d", threadIdx, openclIdx)
+	}
+	return nil
+}
+
 // ResetMiner stops current miner (if exists) and starts a new instance
 func (c *Client) ResetMiner() error {
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.resetMiner()
+}
+
+// resetMiner is ResetMiner with minerMutex held
+func (c *Client) resetMiner() error {
 	if c.miner != nil {
-		if err := c.StopMiner(); err != nil {
+		if err := c.stopMiner(); err != nil {
 			return fmt.Errorf("Failed to stop miner: %v", err)
 		}
-		c.miner = nil
 		// // Remove tmpConfigPath
 		// if strings.Compare(c.TempConfigPath, "") != 0 {
 		// 	os.Remove(c.TempConfigPath)
@@ -234,20 +455,38 @@ func (c *Client) ResetMiner() error {
 			if err := cmd.Wait(); err != nil {
 				return fmt.Errorf("Failed to wait for reset script to complete: %v", err)
 			}
+			c.counters.gpuReset()
 		} else {
-			if runtime.GOOS != "windows" {
-				log.Fatalf("Sorry! This is unimeplemented on your OS")
-			}
 			// Get pre-determined properties and figure out how to run them
 			instanceIDs := c.MinerConfig.Reset.DeviceInstanceIDs
 			gpuToolConf := c.MinerConfig.Reset.GPUTool
-			gpureset.ResetGPU(instanceIDs)
-			// Now, we need to run the gpu tool to configure the GPU
-			gpuTool, err := gputool.ParseGPUTool(gpuToolConf.Type)
+			strategy := c.MinerConfig.Reset.Strategy
+			if strategy == nil {
+				var err error
+				if strategy, err = gpureset.DefaultStrategy(); err != nil {
+					return err
+				}
+			}
+			resetter, err := gpureset.NewResetter(strategy, nil)
 			if err != nil {
-				return err
+				return fmt.Errorf("Failed to set up GPU reset: %v", err)
+			}
+			var verify func(device string) error
+			if c.MinerConfig.Reset.Verify {
+				verify = discoveryVerifier(c.Discoverer)
+			}
+			results := resetDevices(resetter, instanceIDs, c.MinerConfig.Reset.Retries, verify)
+			c.counters.gpuReset()
+			if failed := failedResets(results); len(failed) > 0 {
+				if err := c.honorResetFailure(failed); err != nil {
+					return err
+				}
+			}
+			if gpuToolConf == nil {
+				return nil
 			}
-			if err := gpuTool.Run(gpuToolConf.Path, gpuToolConf.Args); err != nil {
+			// Now, we need to run the gpu tool to configure the GPU
+			if err := c.applyGPUTool(gpuToolConf); err != nil {
 				return fmt.Errorf("Failed to run gpu-tool: %v", err)
 			}
 		}
@@ -258,18 +497,33 @@ func (c *Client) ResetMiner() error {
 
 // AddPoolListeners adds the default listeners
 func (c *Client) AddPoolListeners() {
-	c.On("update-selected-pools", c.HandlePoolInfo)
-	c.On("get-selected-pools-result", c.HandlePoolInfo)
+	c.Handle("update-selected-pools", c.HandlePoolInfo)
+	c.Handle("get-selected-pools-result", c.HandlePoolInfo)
+	c.Handle("pause-mining", c.HandlePause)
+	c.Handle("resume-mining", c.HandleResume)
+	c.Handle("miner-command", c.HandleMinerCommand)
+	c.Handle("subscribe-logs", c.HandleSubscribeLogs)
+	c.Handle("unsubscribe-logs", c.HandleUnsubscribeLogs)
 }
 
 // UpdatePools requests the server to send back the current set of selected pools
 func (c *Client) UpdatePools() error {
-	return c.Emit("get-selected-pools", "{}")
+	b, err := json.Marshal(&SelectionRequest{Rig: c.RigID})
+	if err != nil {
+		return err
+	}
+	return c.Emit("get-selected-pools", string(b))
 }
 
 // StartMiner starts the miner
 func (c *Client) StartMiner() error {
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.startMiner()
+}
 
+// startMiner is StartMiner with minerMutex held
+func (c *Client) startMiner() error {
 	var miner *exec.Cmd
 	args := make([]string, 0)
 
@@ -300,15 +554,70 @@ func (c *Client) StartMiner() error {
 		miner = exec.Command(c.BinaryPath, args...)
 	}
 	log.Infof("cmdline: %v", cmdline)
-	miner.Stdin = os.Stdin
-	miner.Stdout = os.Stdout
-	miner.Stderr = os.Stderr
+	stdin, err := miner.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to get miner stdin: %v", err)
+	}
+	miner.Stdout = io.MultiWriter(os.Stdout, &c.output, &c.stats, &logWriter{buffer: c.logs, source: "miner"})
+	miner.Stderr = io.MultiWriter(os.Stderr, &c.output, &c.stats, &logWriter{buffer: c.logs, source: "miner"})
 	c.miner = miner
+	c.minerStdin = stdin
+	// Keep forwarding our own stdin so that the miner's hotkeys still work
+	// when running in a terminal
+	c.stdinOnce.Do(func() {
+		go c.forwardStdin()
+	})
+	c.stats.minerStarted(time.Now())
 	return miner.Start()
 }
 
+func (c *Client) forwardStdin() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if err := c.WriteMinerStdin(buf[:n]); err != nil {
+				log.Debugf("Failed to forward stdin to miner: %v", err)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WriteMinerStdin writes b to the stdin of the running miner
+func (c *Client) WriteMinerStdin(b []byte) error {
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.writeMinerStdin(b)
+}
+
+// writeMinerStdin is WriteMinerStdin with minerMutex held
+func (c *Client) writeMinerStdin(b []byte) error {
+	if c.miner == nil || c.minerStdin == nil {
+		return fmt.Errorf("Miner is not running")
+	}
+	_, err := c.minerStdin.Write(b)
+	return err
+}
+
+// minerRunning returns whether the miner is running
+func (c *Client) minerRunning() bool {
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.miner != nil
+}
+
 // StopMiner stops the miner
 func (c *Client) StopMiner() error {
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.stopMiner()
+}
+
+// stopMiner is StopMiner with minerMutex held
+func (c *Client) stopMiner() error {
 	//return c.miner.Process.Kill()
 	if runtime.GOOS == "windows" {
 		if err := c.miner.Process.Kill(); err != nil {
@@ -320,5 +629,10 @@ func (c *Client) StopMiner() error {
 		}
 		c.miner.Wait()
 	}
+	c.miner = nil
+	c.minerStdin = nil
+	if err := c.RevertGPUTool(); err != nil {
+		log.Errorf("%v", err)
+	}
 	return nil
 }
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -45,6 +47,10 @@ func main() {
 			os.Exit(-1)
 		}
 	}
+	// Keep state next to the configuration so that it survives reboots
+	if strings.Compare(clientConfig.StatePath, "") == 0 {
+		clientConfig.StatePath = strings.TrimSuffix(*configPath, filepath.Ext(*configPath)) + ".state"
+	}
 
 	client, err := minerconfig.NewClient(&clientConfig)
 	if err != nil {
@@ -64,8 +70,13 @@ func main() {
 	client.UpdatePools()
 	log.Infof("Requested get-pools")
 
-	// Wait forever
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	wg.Wait()
+	// Stop the miner and restore GPU settings before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Received %v. Shutting down", sig)
+	if err := client.Shutdown(); err != nil {
+		log.Errorf("Failed to shut down cleanly: %v", err)
+		os.Exit(-1)
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -327,6 +329,135 @@ func TestMiner(t *testing.T) {
 	require.Nil(err)
 }
 
+// buildDummyMiner builds dummyminer into a temporary directory and returns
+// the path to the binary
+func buildDummyMiner(require *require.Assertions) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "dummyminer")
+	require.Nil(err)
+	binaryPath := filepath.Join(dir, "dummyminer")
+	cmd := exec.Command("go", "build", "-o", binaryPath, "./dummyminer")
+	out, err := cmd.CombinedOutput()
+	require.Nil(err, string(out))
+	return binaryPath
+}
+
+// newOfflineClient creates a client that is not connected to any webserver
+func newOfflineClient(require *require.Assertions, clientConfig *ClientConfig) *Client {
+	c := &Client{}
+	c.ClientConfig = clientConfig
+	c.MinerConfig = &Config{}
+	c.origMinerConfig = c.MinerConfig
+	c.TempConfigPath = clientConfig.MinerConfigPath
+	c.handlers = make(map[string]func(w *websockets.WebsocketClient, data interface{}))
+	c.logs = NewLogBuffer(clientConfig.LogBufferLines)
+	require.Nil(c.LoadState())
+	return c
+}
+
+func TestPauseResume(t *testing.T) {
+	require := require.New(t)
+
+	binaryPath := buildDummyMiner(require)
+	defer os.RemoveAll(filepath.Dir(binaryPath))
+
+	clientConfig := generateValidClientConfig(require)
+	defer os.Remove(clientConfig.MinerConfigPath)
+	clientConfig.BinaryPath = binaryPath
+	clientConfig.StatePath = filepath.Join(filepath.Dir(binaryPath), "state")
+	clientConfig.StdinPause = true
+
+	c := newOfflineClient(require, clientConfig)
+	require.False(c.Paused())
+	require.Nil(c.StartMiner())
+
+	// Miners that support it are paused over stdin and keep running
+	until := time.Now().Add(time.Hour).Round(time.Second)
+	require.Nil(c.Pause(&until))
+	require.True(c.Paused())
+	require.NotNil(c.miner)
+
+	// The paused state survives a restart
+	restarted := newOfflineClient(require, clientConfig)
+	require.True(restarted.Paused())
+	require.True(until.Equal(*restarted.state.PausedUntil))
+
+	require.Nil(c.Resume())
+	require.False(c.Paused())
+
+	// Other miners are stopped
+	c.StdinPause = false
+	require.Nil(c.Pause(nil))
+	require.Nil(c.miner)
+
+	// Expired pauses are dropped on restart
+	past := time.Now().Add(-time.Minute)
+	c.state.PausedUntil = &past
+	require.Nil(c.saveState())
+	restarted = newOfflineClient(require, clientConfig)
+	require.False(restarted.Paused())
+}
+
+func TestMinerCommand(t *testing.T) {
+	require := require.New(t)
+
+	binaryPath := buildDummyMiner(require)
+	defer os.RemoveAll(filepath.Dir(binaryPath))
+
+	clientConfig := generateValidClientConfig(require)
+	defer os.Remove(clientConfig.MinerConfigPath)
+	clientConfig.BinaryPath = binaryPath
+	clientConfig.StatePath = filepath.Join(filepath.Dir(binaryPath), "state")
+
+	c := newOfflineClient(require, clientConfig)
+
+	// Nothing to send commands to yet
+	_, err := c.RunMinerCommand("h", 10*time.Millisecond)
+	require.NotNil(err)
+
+	require.Nil(c.StartMiner())
+	defer c.StopMiner()
+
+	output, err := c.RunMinerCommand("h", 500*time.Millisecond)
+	require.Nil(err)
+	require.Contains(output, "Hash Rate: ...")
+
+	output, err = c.RunMinerCommand("p", 500*time.Millisecond)
+	require.Nil(err)
+	require.Contains(output, "Paused")
+
+	// A paused dummyminer stops reporting its hash rate
+	output, err = c.RunMinerCommand("", 500*time.Millisecond)
+	require.Nil(err)
+	require.NotContains(output, "Hash rate")
+
+	output, err = c.RunMinerCommand("r", 500*time.Millisecond)
+	require.Nil(err)
+	require.Contains(output, "Resumed")
+}
+
+func TestMinerCommandResult(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-miner-command")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	requester := &websockets.WebsocketClient{}
+	rig1 := &websockets.WebsocketClient{}
+	rig2 := &websockets.WebsocketClient{}
+	server.associateRig(rig1, &RigInfo{RigID: "rig1"})
+	server.associateRig(rig2, &RigInfo{RigID: "rig2"})
+
+	id := server.minerCommands.add(requester, "rig1")
+	// Neither other rigs nor other clients can answer the command
+	server.handleMinerCommandResult(rig2, jsonData(&MinerCommand{ID: id, Output: "fake"}))
+	server.handleMinerCommandResult(requester, jsonData(&MinerCommand{ID: id, Output: "fake"}))
+	require.Nil(server.minerCommands.remove(id, "rig2"))
+	require.Equal(requester, server.minerCommands.remove(id, "rig1"))
+}
+
 func TestMain(m *testing.M) {
 	log.SetLevel(log.WarnLevel)
 	// call flag.Parse() here if TestMain uses flags
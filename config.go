@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"fmt"
 
+	gpureset "github.com/gurupras/minerconfig/gpu-reset"
 	gputool "github.com/gurupras/minerconfig/gpu-tool"
 )
 
@@ -33,6 +34,34 @@ type Config struct {
 	Reset *Reset `json:"reset" yaml:"reset"`
 }
 
+// Validate checks the reset configuration for errors that would otherwise
+// only show up when the miner is reset
+func (c *Config) Validate() error {
+	if c.Reset == nil {
+		return nil
+	}
+	switch c.Reset.OnFailure {
+	case "", RESET_SKIP_DEVICE, RESET_ABORT, RESET_ALERT:
+	default:
+		return fmt.Errorf("Unknown GPU reset failure policy: '%v'", c.Reset.OnFailure)
+	}
+	if c.Reset.GPUTool != nil {
+		tool, err := gputool.ParseGPUTool(c.Reset.GPUTool.Type)
+		if err != nil {
+			return err
+		}
+		if err := tool.Validate(c.Reset.GPUTool.Args); err != nil {
+			return fmt.Errorf("Invalid arguments for gpu-tool %v: %v", c.Reset.GPUTool.Type, err)
+		}
+		if c.Reset.GPUTool.IdleArgs != nil {
+			if err := tool.Validate(c.Reset.GPUTool.IdleArgs); err != nil {
+				return fmt.Errorf("Invalid idle arguments for gpu-tool %v: %v", c.Reset.GPUTool.Type, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Config) Clone() *Config {
 	ret := &Config{}
 	*ret = *c
@@ -99,18 +128,42 @@ type Pool struct {
 	PoolName   *string `json:"pool_name" yaml:"pool_name"`
 	WalletName *string `json:"wallet_name" yaml:"wallet_name"`
 	Label      *string `json:"label" yaml:"label"`
+	// Name of a wallet registered with the webserver. The webserver fills in
+	// User from UserTemplate, which defaults to "{wallet}", before sending the
+	// pool to a rig
+	Wallet       *string `json:"wallet" yaml:"wallet"`
+	UserTemplate *string `json:"user_template" yaml:"user_template"`
+	// Pool fee in percent
+	Fee *float64 `json:"fee" yaml:"fee"`
 }
 
 type Reset struct {
-	ScriptPath        string   `json:"script_path" yaml:"script_path"`
+	ScriptPath string `json:"script_path" yaml:"script_path"`
+	// Device instance IDs on Windows, PCI addresses such as 0000:01:00.0 on
+	// Linux
 	DeviceInstanceIDs []string `json:"device_instance_ids" yaml:"device_instance_ids"`
 	GPUTool           *GPUTool `json:"gpu_tool" yaml:"gpu_tool"`
+	// How to reset the devices. Defaults to disabling and enabling them with
+	// PowerShell on Windows and to sysfs on Linux
+	Strategy *gpureset.StrategyConfig `json:"strategy" yaml:"strategy"`
+	// Number of times to retry devices that failed to reset
+	Retries int `json:"retries" yaml:"retries"`
+	// Check that every device is discovered again after it was reset
+	Verify bool `json:"verify" yaml:"verify"`
+	// What to do when devices fail to reset. Defaults to ALERT
+	OnFailure ResetFailurePolicy `json:"on_failure" yaml:"on_failure"`
 }
 
 type GPUTool struct {
-	Type gputool.GPUToolType    `json:"type" yaml:"type"`
+	Type gputool.GPUToolType `json:"type" yaml:"type"`
+	// Path to the tool. AMDGPU_SYSFS: path to a YAML file of profiles.
+	// NVIDIA: directory of nvidia-smi and nvidia-settings, empty to use PATH
 	Path string                 `json:"path" yaml:"path"`
 	Args map[string]interface{} `json:"args" yaml:"args"`
+	// Arguments applied when mining stops. Without them, the tool restores
+	// the default settings of the GPUs it configured. SCRIPT and MSI-AB
+	// cannot, so their settings are only reverted with idle arguments
+	IdleArgs map[string]interface{} `json:"idle_args" yaml:"idle_args"`
 }
 
 // Hash of this Pool
@@ -36,3 +36,39 @@ device_index: 0`
 	}
 	require.Equal(expected, got)
 }
+
+func TestConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	testConfig := `
+reset:
+  device_instance_ids: ["0000:01:00.0"]
+  on_failure: SKIP_DEVICE
+  gpu_tool:
+    type: ODNT
+    path: OverdriveNTool.exe
+    args:
+      gpu-id: [0, 1]
+      profile: mining`
+
+	var config Config
+	require.Nil(yaml.Unmarshal([]byte(testConfig), &config))
+	require.Nil(config.Validate())
+
+	config.Reset.GPUTool.IdleArgs = map[string]interface{}{"gpu-id": 0}
+	require.NotNil(config.Validate())
+	config.Reset.GPUTool.IdleArgs["profile"] = "idle"
+	require.Nil(config.Validate())
+
+	delete(config.Reset.GPUTool.Args, "profile")
+	require.NotNil(config.Validate())
+
+	config.Reset.GPUTool = &GPUTool{Type: "BOGUS"}
+	require.NotNil(config.Validate())
+
+	config.Reset.GPUTool = nil
+	config.Reset.OnFailure = "IGNORE"
+	require.NotNil(config.Validate())
+
+	require.Nil((&Config{}).Validate())
+}
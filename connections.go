@@ -0,0 +1,117 @@
+package minerconfig
+
+import (
+	"sync"
+	"time"
+
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// connections keeps track of the websocket clients that are still connected.
+// The websocket server does not tell us when a client goes away, so a client
+// is considered disconnected once sending to it fails or once it has been
+// silent for longer than the rig timeout. Rigs send keepalives and browsers
+// poll for rigs every 5 seconds
+type connections struct {
+	sync.Mutex
+	lastSeen map[*websockets.WebsocketClient]time.Time
+}
+
+// seen records that client sent a message at now
+func (cs *connections) seen(client *websockets.WebsocketClient, now time.Time) {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.lastSeen == nil {
+		cs.lastSeen = make(map[*websockets.WebsocketClient]time.Time)
+	}
+	cs.lastSeen[client] = now
+}
+
+func (cs *connections) forget(client *websockets.WebsocketClient) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.lastSeen, client)
+}
+
+// count returns the number of connected clients
+func (cs *connections) count() int {
+	cs.Lock()
+	defer cs.Unlock()
+	return len(cs.lastSeen)
+}
+
+// clients returns the connected clients
+func (cs *connections) clients() []*websockets.WebsocketClient {
+	cs.Lock()
+	defer cs.Unlock()
+	ret := make([]*websockets.WebsocketClient, 0, len(cs.lastSeen))
+	for client := range cs.lastSeen {
+		ret = append(ret, client)
+	}
+	return ret
+}
+
+// silent returns the clients that have not sent anything since before
+func (cs *connections) silent(before time.Time) []*websockets.WebsocketClient {
+	cs.Lock()
+	defer cs.Unlock()
+	ret := make([]*websockets.WebsocketClient, 0)
+	for client, lastSeen := range cs.lastSeen {
+		if lastSeen.Before(before) {
+			ret = append(ret, client)
+		}
+	}
+	return ret
+}
+
+// on adds a listener for evt that also records that the sender is connected
+// and counts the event
+func (s *Server) on(evt string, fn func(w *websockets.WebsocketClient, data interface{})) {
+	s.Server.On(evt, func(w *websockets.WebsocketClient, data interface{}) {
+		s.connections.seen(w, time.Now())
+		s.metrics.events.WithLabelValues(evt).Inc()
+		fn(w, data)
+	})
+}
+
+// disconnected forgets client along with the rig it registered as, its log
+// subscriptions and the miner commands it is waiting on
+func (s *Server) disconnected(client *websockets.WebsocketClient) {
+	s.connections.forget(client)
+	s.logSubscribers.forget(client)
+	s.minerCommands.forget(client)
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	if rigInfo, ok := s.rigs[client]; ok {
+		log.Infof("Rig '%v' disconnected", rigInfo.RigID)
+		delete(s.rigs, client)
+	}
+}
+
+// emit sends evt to client and forgets client if that fails
+func (s *Server) emit(client *websockets.WebsocketClient, evt string, data interface{}) error {
+	if err := client.Emit(evt, data); err != nil {
+		s.disconnected(client)
+		return err
+	}
+	return nil
+}
+
+// broadcast sends evt to every connected client
+func (s *Server) broadcast(evt string, data interface{}) {
+	for _, client := range s.connections.clients() {
+		if err := s.emit(client, evt, data); err != nil {
+			log.Errorf("Failed to send %v: %v", evt, err)
+		}
+	}
+}
+
+// sweepConnections forgets the clients that have been silent for longer than
+// the rig timeout
+func (s *Server) sweepConnections(now time.Time) {
+	timeout := time.Duration(s.RigTimeout) * time.Second
+	for _, client := range s.connections.silent(now.Add(-timeout)) {
+		s.disconnected(client)
+	}
+}
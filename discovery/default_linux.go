@@ -0,0 +1,9 @@
+//go:build !opencl
+// +build !opencl
+
+package discovery
+
+// Default returns the Discoverer of this platform
+func Default() Discoverer {
+	return &Sysfs{}
+}
@@ -0,0 +1,23 @@
+//go:build !opencl && !linux
+// +build !opencl,!linux
+
+package discovery
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// unsupported is the Discoverer of platforms that can only discover GPUs
+// through OpenCL
+type unsupported struct {
+}
+
+func (u *unsupported) Devices() ([]*Device, error) {
+	return nil, fmt.Errorf("Discovering GPUs on %v requires building with -tags opencl", runtime.GOOS)
+}
+
+// Default returns the Discoverer of this platform
+func Default() Discoverer {
+	return &unsupported{}
+}
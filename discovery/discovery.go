@@ -0,0 +1,52 @@
+// Package discovery lists the GPUs of a rig along with their PCI topology.
+// The OpenCL implementation requires cgo and the OpenCL SDK and is only built
+// with the opencl build tag. Without it, GPUs are discovered through sysfs on
+// Linux.
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/gurupras/minerconfig/pcie"
+)
+
+type Vendor string
+
+const (
+	VENDOR_AMD     Vendor = "AMD"
+	VENDOR_NVIDIA  Vendor = "NVIDIA"
+	VENDOR_INTEL   Vendor = "INTEL"
+	VENDOR_UNKNOWN Vendor = "UNKNOWN"
+)
+
+// Device structure representing a GPU
+type Device struct {
+	// OpenCL platform of the device. Always 0 for devices that were not
+	// discovered through OpenCL
+	Platform int
+	// Index of the device among the GPUs of its platform, as used by miners
+	Index    int
+	Name     string
+	Vendor   Vendor
+	Topology *pcie.Topology
+}
+
+// Discoverer lists the GPUs of a rig
+type Discoverer interface {
+	Devices() ([]*Device, error)
+}
+
+// FindIndexMatchingTopology returns the index of the device discovered by d
+// at topology
+func FindIndexMatchingTopology(d Discoverer, topology *pcie.Topology) (int, error) {
+	devices, err := d.Devices()
+	if err != nil {
+		return -1, err
+	}
+	for _, device := range devices {
+		if device.Topology != nil && *device.Topology == *topology {
+			return device.Index, nil
+		}
+	}
+	return -1, fmt.Errorf("Failed to find a device matching topology: %v", topology)
+}
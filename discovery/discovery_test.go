@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gurupras/minerconfig/internal/sysfstest"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSysfs(t *testing.T) {
+	require := require.New(t)
+
+	sysfs := sysfstest.New(require)
+	defer sysfs.Remove()
+	sysfs.AddPCIDevice("0000:00:00.0", "0x060000", "0x8086", "0x1918", "")
+	sysfs.AddPCIDevice("0000:00:02.0", sysfstest.CLASS_VGA, "0x8086", "0x1912", "i915")
+	sysfs.AddPCIDevice("0000:01:00.0", sysfstest.CLASS_VGA, "0x1002", "0x67df", "amdgpu")
+	sysfs.AddPCIDevice("0000:01:00.1", "0x040300", "0x1002", "0xaaf0", "snd_hda_intel")
+	sysfs.AddPCIDevice("0000:02:00.0", sysfstest.CLASS_VGA, "0x10de", "0x1b81", "nvidia")
+	sysfs.AddPCIDevice("0000:03:00.0", "0x038000", "0x1002", "0x687f", "amdgpu")
+	// GPUs that are passed through to a VM or have no driver are not listed
+	sysfs.AddPCIDevice("0000:04:00.0", sysfstest.CLASS_VGA, "0x1002", "0x67df", "vfio-pci")
+	sysfs.AddPCIDevice("0000:05:00.0", sysfstest.CLASS_VGA, "0x1002", "0x67df", "")
+	sysfs.AddPCIDevice("0000:06:00.0", sysfstest.CLASS_VGA, "0x1002", "0x67df", "amdgpu")
+	// OpenCL may list GPUs bound to other drivers, so the index of the GPUs
+	// after them cannot be told
+	sysfs.AddPCIDevice("0000:07:00.0", sysfstest.CLASS_VGA, "0x10de", "0x1b81", "nouveau")
+	sysfs.AddPCIDevice("0000:08:00.0", sysfstest.CLASS_VGA, "0x10de", "0x1b81", "nvidia")
+
+	discoverer := &Sysfs{sysfs.Root}
+	devices, err := discoverer.Devices()
+	require.Nil(err)
+	require.Equal(4, len(devices))
+
+	require.Equal(VENDOR_AMD, devices[0].Vendor)
+	require.Equal("AMD 0x67df", devices[0].Name)
+	require.Equal(&pcie.Topology{Bus: 1}, devices[0].Topology)
+	require.Equal(0, devices[0].Index)
+
+	require.Equal(VENDOR_NVIDIA, devices[1].Vendor)
+	require.Equal(0, devices[1].Index)
+
+	// Indices count the GPUs of every vendor on their own
+	require.Equal(VENDOR_AMD, devices[2].Vendor)
+	require.Equal(1, devices[2].Index)
+
+	require.Equal(&pcie.Topology{Bus: 6}, devices[3].Topology)
+	require.Equal(2, devices[3].Index)
+
+	idx, err := FindIndexMatchingTopology(discoverer, &pcie.Topology{Bus: 6})
+	require.Nil(err)
+	require.Equal(2, idx)
+	for _, bus := range []int{4, 7, 8, 9} {
+		_, err = FindIndexMatchingTopology(discoverer, &pcie.Topology{Bus: bus})
+		require.NotNil(err)
+	}
+}
+
+func TestFake(t *testing.T) {
+	require := require.New(t)
+
+	fake := &Fake{List: []*Device{{Index: 2, Topology: &pcie.Topology{Bus: 5}}}}
+	idx, err := FindIndexMatchingTopology(fake, &pcie.Topology{Bus: 5})
+	require.Nil(err)
+	require.Equal(2, idx)
+
+	fake.Err = fmt.Errorf("no devices")
+	_, err = FindIndexMatchingTopology(fake, &pcie.Topology{Bus: 5})
+	require.NotNil(err)
+}
@@ -0,0 +1,14 @@
+package discovery
+
+// Fake returns a fixed list of devices. Used in tests
+type Fake struct {
+	List []*Device
+	Err  error
+}
+
+func (f *Fake) Devices() ([]*Device, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.List, nil
+}
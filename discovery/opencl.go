@@ -0,0 +1,25 @@
+//go:build opencl
+// +build opencl
+
+package discovery
+
+import (
+	amdconfig "github.com/gurupras/minerconfig/amd"
+)
+
+// OpenCL discovers the AMD GPUs of every OpenCL platform
+type OpenCL struct {
+}
+
+func (o *OpenCL) Devices() ([]*Device, error) {
+	ret := make([]*Device, 0)
+	for _, d := range amdconfig.ListDevices() {
+		ret = append(ret, &Device{d.Platform, d.Index, d.Name, VENDOR_AMD, d.Topology})
+	}
+	return ret, nil
+}
+
+// Default returns the Discoverer of this platform
+func Default() Discoverer {
+	return &OpenCL{}
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gurupras/minerconfig/pcie"
+)
+
+// PCI vendor IDs
+var vendors = map[string]Vendor{
+	"0x1002": VENDOR_AMD,
+	"0x10de": VENDOR_NVIDIA,
+	"0x8086": VENDOR_INTEL,
+}
+
+// Drivers of the GPUs that OpenCL lists
+var drivers = map[string]bool{
+	"amdgpu": true,
+	"nvidia": true,
+}
+
+// Drivers that keep GPUs away from the host, e.g. for passing them through to
+// a VM. GPUs without any driver are not available either
+var detached = map[string]bool{
+	"":         true,
+	"vfio-pci": true,
+	"pci-stub": true,
+}
+
+// Sysfs discovers GPUs by listing the display controllers on the PCI bus. It
+// does not need any GPU SDK. Only GPUs bound to amdgpu or nvidia are listed.
+// They are indexed by PCI address among the GPUs of their vendor, which is the
+// order OpenCL lists them in. A GPU of the same vendor that is bound to any
+// other driver may be listed by OpenCL as well, so the GPUs after it are left
+// out rather than given an index that may be wrong
+type Sysfs struct {
+	// Root of sysfs. Defaults to /sys
+	Root string
+}
+
+func readAttribute(devicePath string, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(devicePath, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readDriver returns the name of the driver the device at devicePath is bound
+// to, or "" if it is not bound to any
+func readDriver(devicePath string) (string, error) {
+	target, err := os.Readlink(filepath.Join(devicePath, "driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+func (s *Sysfs) Devices() ([]*Device, error) {
+	root := s.Root
+	if strings.Compare(root, "") == 0 {
+		root = "/sys"
+	}
+	matches, err := filepath.Glob(filepath.Join(root, "bus", "pci", "devices", "*"))
+	if err != nil {
+		return nil, err
+	}
+	// Glob returns paths in lexical order, which is PCI address order
+	sort.Strings(matches)
+
+	ret := make([]*Device, 0)
+	indices := make(map[Vendor]int)
+	// Vendors whose remaining GPUs cannot be indexed
+	uncertain := make(map[Vendor]bool)
+	for _, devicePath := range matches {
+		class, err := readAttribute(devicePath, "class")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PCI class of '%v': %v", devicePath, err)
+		}
+		// 0x03xxxx: display controllers
+		if !strings.HasPrefix(class, "0x03") {
+			continue
+		}
+		topology, err := pcie.ParseTopology(filepath.Base(devicePath))
+		if err != nil {
+			return nil, err
+		}
+		vendorID, err := readAttribute(devicePath, "vendor")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PCI vendor of '%v': %v", devicePath, err)
+		}
+		vendor, ok := vendors[vendorID]
+		if !ok {
+			vendor = VENDOR_UNKNOWN
+		}
+		driver, err := readDriver(devicePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read driver of '%v': %v", devicePath, err)
+		}
+		if !drivers[driver] {
+			if !detached[driver] {
+				uncertain[vendor] = true
+			}
+			continue
+		}
+		if uncertain[vendor] {
+			continue
+		}
+		deviceID, _ := readAttribute(devicePath, "device")
+
+		device := &Device{}
+		device.Index = indices[vendor]
+		device.Name = fmt.Sprintf("%v %v", vendor, deviceID)
+		device.Vendor = vendor
+		device.Topology = topology
+		indices[vendor]++
+		ret = append(ret, device)
+	}
+	return ret, nil
+}
@@ -1,22 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/eiannone/keyboard"
 	log "github.com/sirupsen/logrus"
 )
 
-func main() {
-	// We're going to be dumping random text until close
-	shouldQuit := false
+// getKeyFunc returns a function that reads a single key. Keys are read from
+// the keyboard when running in a terminal and from stdin otherwise so that
+// the miner can be controlled by a parent process.
+func getKeyFunc() (func() (rune, error), func()) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		reader := bufio.NewReader(os.Stdin)
+		return func() (rune, error) {
+			char, _, err := reader.ReadRune()
+			return char, err
+		}, func() {}
+	}
 
 	err := keyboard.Open()
 	if err != nil {
 		panic(err)
 	}
-	defer keyboard.Close()
+	return func() (rune, error) {
+			char, _, err := keyboard.GetSingleKey()
+			return char, err
+		}, func() {
+			keyboard.Close()
+		}
+}
+
+func main() {
+	// We're going to be dumping random text until close
+	shouldQuit := false
+	// Set to 1 while paused. Written by the key loop, read by the output loop
+	var paused int32
+
+	getKey, closeFn := getKeyFunc()
+	defer closeFn()
 
 	go func() {
 		for {
@@ -24,22 +50,25 @@ func main() {
 				break
 			}
 			time.Sleep(100 * time.Millisecond)
-			fmt.Printf("%v: Hash rate: ...\n", time.Now())
+			if atomic.LoadInt32(&paused) == 0 {
+				fmt.Printf("%v: Hash rate: ...\n", time.Now())
+			}
 		}
 	}()
 	for {
-		char, key, err := keyboard.GetSingleKey()
+		char, err := getKey()
 		if err != nil {
-			log.Errorf("Failed to get key from keyboard: %v", err)
+			log.Errorf("Failed to get key: %v", err)
+			break
 		}
-		_ = key
-		_ = err
 		switch char {
 		case 'h':
 			fmt.Printf("Hash Rate: ...\n")
 		case 'p':
+			atomic.StoreInt32(&paused, 1)
 			fmt.Printf("Paused\n")
 		case 'r':
+			atomic.StoreInt32(&paused, 0)
 			fmt.Printf("Resumed\n")
 		case 'q':
 			fmt.Printf("Quit..\n")
@@ -0,0 +1,36 @@
+package gpureset
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DevconResetter restarts devices with devcon.exe. Devices are identified by
+// device instance ID
+type DevconResetter struct {
+	*StrategyConfig
+	runner Runner
+}
+
+func newDevconResetter(config *StrategyConfig, runner Runner) (Resetter, error) {
+	if strings.Compare(config.Path, "") == 0 {
+		config.Path = "devcon.exe"
+	}
+	return &DevconResetter{config, runner}, nil
+}
+
+func (d *DevconResetter) Reset(devices []string) []*Result {
+	results := newResults(devices)
+	for _, result := range results {
+		log.Infof("Restarting device '%v'", result.Device)
+		// '@' makes devcon match the instance ID exactly
+		if err := run(d.runner, d.StrategyConfig, d.Path, "restart", fmt.Sprintf("@%v", result.Device)); err != nil {
+			result.Err = fmt.Errorf("Failed to restart device: %v", err)
+		}
+	}
+	time.Sleep(d.sleep())
+	return results
+}
@@ -1,48 +1,19 @@
 package gpureset
 
-import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"runtime"
-	"strings"
-
-	easyfiles "github.com/gurupras/go-easyfiles"
-	log "github.com/sirupsen/logrus"
-)
+import "fmt"
 
+// ResetGPU resets the devices in ids with the default strategy of this OS
 func ResetGPU(ids []string) error {
-	if runtime.GOOS == "windows" {
-		tmpBatchFile, err := easyfiles.TempFile(os.TempDir(), "gpu-reset", ".bat")
-		if err != nil {
-			return err
-		}
-		fileContents := make([]string, 0)
-		for _, instanceID := range ids {
-			// This is expected to be a device instance ID
-			fileContents = append(fileContents, fmt.Sprintf(`
-powershell.exe -NoProfile -ExecutionPolicy Bypass "disable-pnpdevice '%v' -ErrorAction Ignore -Confirm:$false"
-	    `, instanceID))
-		}
-		fileContents = append(fileContents, `powershell.exe -NoProfile -ExecutionPolicy Bypass "start-sleep -s 2"`)
-		for _, instanceID := range ids {
-			fileContents = append(fileContents, fmt.Sprintf(`
-powershell.exe -NoProfile -ExecutionPolicy Bypass "enable-pnpdevice '%v' -ErrorAction Ignore -Confirm:$false"
-		`, instanceID))
-		}
-		fileContents = append(fileContents, `powershell.exe -NoProfile -ExecutionPolicy Bypass "start-sleep -s 2"`)
-		tmpBatchPath := tmpBatchFile.Name()
-		tmpBatchFile.Close()
-		defer os.Remove(tmpBatchPath)
-		fileContentsStr := strings.Join(fileContents, "\n") // FIXME: This should be cross-platform
-		if err := ioutil.WriteFile(tmpBatchPath, []byte(fileContentsStr), 0666); err != nil {
-			return err
-		}
-		log.Infof("cmdline: %v", tmpBatchPath)
-		cmd := exec.Command(tmpBatchPath)
-		return cmd.Run()
-	} else {
-		return fmt.Errorf("Unimplemented")
+	config, err := DefaultStrategy()
+	if err != nil {
+		return err
+	}
+	resetter, err := NewResetter(config, nil)
+	if err != nil {
+		return err
+	}
+	if failed := Failed(resetter.Reset(ids)); len(failed) > 0 {
+		return fmt.Errorf("Failed to reset '%v': %v", failed[0].Device, failed[0].Err)
 	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package gpureset
 
 import (
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -9,7 +10,10 @@ import (
 func TestResetGPU(t *testing.T) {
 	require := require.New(t)
 
+	if runtime.GOOS != "windows" {
+		t.Skip("Resets a Windows device instance ID")
+	}
 	instanceID := `PCI\VEN_1002&DEV_687F&SUBSYS_0B361002&REV_C1\6&17A7B5E1&0&00000008`
-	err := ResetGPU(instanceID)
+	err := ResetGPU([]string{instanceID})
 	require.Nil(err)
 }
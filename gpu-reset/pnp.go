@@ -0,0 +1,45 @@
+package gpureset
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PnPResetter disables every device and then enables them again with
+// PowerShell. Devices are identified by device instance ID
+type PnPResetter struct {
+	*StrategyConfig
+	runner Runner
+}
+
+func newPnPResetter(config *StrategyConfig, runner Runner) (Resetter, error) {
+	return &PnPResetter{config, runner}, nil
+}
+
+func (p *PnPResetter) powershell(command string, instanceID string) error {
+	return run(p.runner, p.StrategyConfig, "powershell.exe", "-NoProfile", "-ExecutionPolicy", "Bypass",
+		fmt.Sprintf("%v -InstanceId '%v' -ErrorAction Stop -Confirm:$false", command, instanceID))
+}
+
+func (p *PnPResetter) Reset(devices []string) []*Result {
+	results := newResults(devices)
+	for _, result := range results {
+		log.Infof("Disabling device '%v'", result.Device)
+		if err := p.powershell("Disable-PnpDevice", result.Device); err != nil {
+			result.Err = fmt.Errorf("Failed to disable device: %v", err)
+		}
+	}
+	time.Sleep(p.sleep())
+	// Devices that failed to be disabled are enabled too in case they were
+	// disabled nonetheless
+	for _, result := range results {
+		log.Infof("Enabling device '%v'", result.Device)
+		if err := p.powershell("Enable-PnpDevice", result.Device); err != nil && result.Err == nil {
+			result.Err = fmt.Errorf("Failed to enable device: %v", err)
+		}
+	}
+	time.Sleep(p.sleep())
+	return results
+}
@@ -0,0 +1,167 @@
+package gpureset
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StrategyType string
+
+const (
+	// Disable and enable devices with PowerShell's PnpDevice cmdlets
+	STRATEGY_PNP StrategyType = "PNP"
+	// Restart devices with devcon.exe
+	STRATEGY_DEVCON StrategyType = "DEVCON"
+	// Reset PCI devices through Linux's sysfs
+	STRATEGY_SYSFS StrategyType = "SYSFS"
+	// Run a script with the devices as arguments
+	STRATEGY_SCRIPT StrategyType = "SCRIPT"
+)
+
+const (
+	defaultTimeout = 30
+	defaultSleep   = 2
+)
+
+// StrategyConfig structure representing how to reset GPUs
+type StrategyConfig struct {
+	Type StrategyType `json:"type" yaml:"type"`
+	// Seconds to wait for every command before giving up. Defaults to 30
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// Seconds to wait between taking devices down and bringing them back up.
+	// Defaults to 2
+	Sleep int `json:"sleep" yaml:"sleep"`
+	// DEVCON: path to devcon.exe. SCRIPT: path to the script
+	Path string `json:"path" yaml:"path"`
+	// SYSFS: how devices are reset. Defaults to AUTO
+	Method SysfsMethod `json:"method" yaml:"method"`
+	// SYSFS: root of sysfs. Defaults to /sys
+	Root string `json:"root" yaml:"root"`
+}
+
+func (sc *StrategyConfig) timeout() time.Duration {
+	if sc.Timeout <= 0 {
+		return defaultTimeout * time.Second
+	}
+	return time.Duration(sc.Timeout) * time.Second
+}
+
+func (sc *StrategyConfig) sleep() time.Duration {
+	if sc.Sleep <= 0 {
+		return defaultSleep * time.Second
+	}
+	return time.Duration(sc.Sleep) * time.Second
+}
+
+// Result structure representing the outcome of resetting a single device
+type Result struct {
+	Device string
+	Err    error
+}
+
+// Resetter resets GPUs
+type Resetter interface {
+	// Reset resets devices, returning a result for every one of them in the
+	// same order
+	Reset(devices []string) []*Result
+}
+
+// Runner runs external commands. Strategies run everything through a Runner
+// so that they can be tested without touching real devices
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// ExecRunner runs commands with os/exec
+type ExecRunner struct {
+}
+
+func (er *ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%v failed: %v: %v", name, err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// StrategyFactory creates a Resetter from config
+type StrategyFactory func(config *StrategyConfig, runner Runner) (Resetter, error)
+
+var (
+	strategiesMutex sync.Mutex
+	strategies      = map[StrategyType]StrategyFactory{
+		STRATEGY_PNP:    newPnPResetter,
+		STRATEGY_DEVCON: newDevconResetter,
+		STRATEGY_SYSFS:  newSysfsStrategy,
+		STRATEGY_SCRIPT: newScriptResetter,
+	}
+)
+
+// RegisterStrategy makes a reset strategy available to NewResetter
+func RegisterStrategy(strategyType StrategyType, factory StrategyFactory) {
+	strategiesMutex.Lock()
+	defer strategiesMutex.Unlock()
+	strategies[strategyType] = factory
+}
+
+// NewResetter creates a Resetter for config. A nil runner runs commands with
+// os/exec
+func NewResetter(config *StrategyConfig, runner Runner) (Resetter, error) {
+	if runner == nil {
+		runner = &ExecRunner{}
+	}
+	strategiesMutex.Lock()
+	factory, ok := strategies[config.Type]
+	strategiesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown GPU reset strategy: '%v'", config.Type)
+	}
+	return factory(config, runner)
+}
+
+// DefaultStrategy returns the reset strategy used on this OS when none is
+// configured
+func DefaultStrategy() (*StrategyConfig, error) {
+	switch runtime.GOOS {
+	case "windows":
+		return &StrategyConfig{Type: STRATEGY_PNP}, nil
+	case "linux":
+		return &StrategyConfig{Type: STRATEGY_SYSFS}, nil
+	default:
+		return nil, fmt.Errorf("No GPU reset strategy for %v", runtime.GOOS)
+	}
+}
+
+// Failed returns the results that have an error
+func Failed(results []*Result) []*Result {
+	ret := make([]*Result, 0)
+	for _, result := range results {
+		if result.Err != nil {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// newResults returns a result for every device
+func newResults(devices []string) []*Result {
+	ret := make([]*Result, 0)
+	for _, device := range devices {
+		ret = append(ret, &Result{Device: device})
+	}
+	return ret
+}
+
+// run runs a single command with the timeout of config
+func run(runner Runner, config *StrategyConfig, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout())
+	defer cancel()
+	_, err := runner.Run(ctx, name, args...)
+	return err
+}
@@ -0,0 +1,97 @@
+package gpureset
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingRunner records every command and fails those containing failOn
+type recordingRunner struct {
+	sync.Mutex
+	commands []string
+	failOn   string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, fmt.Errorf("No timeout")
+	}
+	if strings.Compare(r.failOn, "") != 0 && strings.Contains(command, r.failOn) {
+		return nil, fmt.Errorf("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestPnPResetter(t *testing.T) {
+	require := require.New(t)
+
+	runner := &recordingRunner{failOn: "Disable-PnpDevice -InstanceId 'GPU2'"}
+	resetter, err := NewResetter(&StrategyConfig{Type: STRATEGY_PNP, Sleep: 1}, runner)
+	require.Nil(err)
+	results := resetter.Reset([]string{"GPU1", "GPU2"})
+	require.Equal(2, len(results))
+	require.Nil(results[0].Err)
+	require.NotNil(results[1].Err)
+	require.Equal(1, len(Failed(results)))
+
+	// Everything is disabled before anything is enabled
+	require.Equal(4, len(runner.commands))
+	require.Contains(runner.commands[0], "Disable-PnpDevice -InstanceId 'GPU1'")
+	require.Contains(runner.commands[2], "Enable-PnpDevice -InstanceId 'GPU1'")
+	require.Contains(runner.commands[3], "Enable-PnpDevice -InstanceId 'GPU2'")
+}
+
+func TestDevconResetter(t *testing.T) {
+	require := require.New(t)
+
+	runner := &recordingRunner{}
+	resetter, err := NewResetter(&StrategyConfig{Type: STRATEGY_DEVCON, Sleep: 1}, runner)
+	require.Nil(err)
+	results := resetter.Reset([]string{`PCI\VEN_1002&DEV_687F`})
+	require.Nil(results[0].Err)
+	require.Equal([]string{`devcon.exe restart @PCI\VEN_1002&DEV_687F`}, runner.commands)
+}
+
+func TestScriptResetter(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewResetter(&StrategyConfig{Type: STRATEGY_SCRIPT}, nil)
+	require.NotNil(err)
+
+	runner := &recordingRunner{failOn: "reset.sh"}
+	resetter, err := NewResetter(&StrategyConfig{Type: STRATEGY_SCRIPT, Path: "/opt/reset.sh"}, runner)
+	require.Nil(err)
+	results := resetter.Reset([]string{"0000:01:00.0", "0000:02:00.0"})
+	require.Equal([]string{"/opt/reset.sh 0000:01:00.0 0000:02:00.0"}, runner.commands)
+	require.Equal(2, len(Failed(results)))
+}
+
+func TestNewResetter(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewResetter(&StrategyConfig{Type: "BOGUS"}, nil)
+	require.NotNil(err)
+
+	RegisterStrategy("BOGUS", func(config *StrategyConfig, runner Runner) (Resetter, error) {
+		return newScriptResetter(&StrategyConfig{Path: "bogus"}, runner)
+	})
+	_, err = NewResetter(&StrategyConfig{Type: "BOGUS"}, nil)
+	require.Nil(err)
+
+	sysfs, _ := fakeSysfs(require)
+	defer sysfs.Remove()
+	resetter, err := NewResetter(&StrategyConfig{Type: STRATEGY_SYSFS, Root: sysfs.Root, Sleep: 1}, nil)
+	require.Nil(err)
+	results := resetter.Reset([]string{"0000:01:00.0", "not-an-address"})
+	require.Nil(results[0].Err)
+	require.NotNil(results[1].Err)
+}
@@ -0,0 +1,30 @@
+package gpureset
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScriptResetter runs a script with every device as an argument
+type ScriptResetter struct {
+	*StrategyConfig
+	runner Runner
+}
+
+func newScriptResetter(config *StrategyConfig, runner Runner) (Resetter, error) {
+	if strings.Compare(config.Path, "") == 0 {
+		return nil, fmt.Errorf("The SCRIPT reset strategy needs a path")
+	}
+	return &ScriptResetter{config, runner}, nil
+}
+
+// Reset runs the script once. Every device gets the outcome of the script
+func (s *ScriptResetter) Reset(devices []string) []*Result {
+	results := newResults(devices)
+	if err := run(s.runner, s.StrategyConfig, s.Path, devices...); err != nil {
+		for _, result := range results {
+			result.Err = fmt.Errorf("Reset script failed: %v", err)
+		}
+	}
+	return results
+}
@@ -0,0 +1,149 @@
+package gpureset
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gurupras/minerconfig/pcie"
+	log "github.com/sirupsen/logrus"
+)
+
+type SysfsMethod string
+
+const (
+	// Pick the first method the device supports, in the order below
+	SYSFS_AUTO SysfsMethod = "AUTO"
+	// Function level reset through the device's reset file
+	SYSFS_RESET SysfsMethod = "RESET"
+	// Unbind the device from its driver and bind it again
+	SYSFS_REBIND SysfsMethod = "REBIND"
+	// Remove the device and rescan the bus
+	SYSFS_REMOVE SysfsMethod = "REMOVE"
+)
+
+// SysfsResetter resets PCI devices on Linux through sysfs
+type SysfsResetter struct {
+	// Root of sysfs. Defaults to /sys
+	Root   string
+	Method SysfsMethod
+	// Time to wait between taking a device down and bringing it back up
+	Sleep time.Duration
+	// How long to wait for a removed device to reappear after a rescan
+	Timeout time.Duration
+}
+
+// NewSysfsResetter creates a SysfsResetter for the real sysfs
+func NewSysfsResetter() *SysfsResetter {
+	r := &SysfsResetter{}
+	r.Root = "/sys"
+	r.Method = SYSFS_AUTO
+	r.Sleep = 2 * time.Second
+	r.Timeout = 10 * time.Second
+	return r
+}
+
+func (r *SysfsResetter) devicePath(topology *pcie.Topology) string {
+	return filepath.Join(r.Root, "bus", "pci", "devices", topology.Address())
+}
+
+func writeSysfs(path string, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0200); err != nil {
+		return fmt.Errorf("Failed to write '%v' to '%v': %v", value, path, err)
+	}
+	return nil
+}
+
+// method returns the method used to reset the device at devicePath
+func (r *SysfsResetter) method(devicePath string) SysfsMethod {
+	if r.Method != SYSFS_AUTO && strings.Compare(string(r.Method), "") != 0 {
+		return r.Method
+	}
+	if _, err := os.Stat(filepath.Join(devicePath, "reset")); err == nil {
+		return SYSFS_RESET
+	}
+	if _, err := os.Stat(filepath.Join(devicePath, "driver")); err == nil {
+		return SYSFS_REBIND
+	}
+	return SYSFS_REMOVE
+}
+
+// Reset resets the PCI device at topology
+func (r *SysfsResetter) Reset(topology *pcie.Topology) error {
+	devicePath := r.devicePath(topology)
+	if _, err := os.Stat(devicePath); err != nil {
+		return fmt.Errorf("No PCI device at %v: %v", topology.Address(), err)
+	}
+	address := topology.Address()
+	method := r.method(devicePath)
+	log.Infof("Resetting PCI device %v (%v)", address, method)
+	switch method {
+	case SYSFS_RESET:
+		return writeSysfs(filepath.Join(devicePath, "reset"), "1")
+	case SYSFS_REBIND:
+		driverPath, err := filepath.EvalSymlinks(filepath.Join(devicePath, "driver"))
+		if err != nil {
+			return fmt.Errorf("Failed to find driver of %v: %v", address, err)
+		}
+		driver := filepath.Base(driverPath)
+		if err := writeSysfs(filepath.Join(devicePath, "driver", "unbind"), address); err != nil {
+			return err
+		}
+		time.Sleep(r.Sleep)
+		return writeSysfs(filepath.Join(r.Root, "bus", "pci", "drivers", driver, "bind"), address)
+	case SYSFS_REMOVE:
+		if err := writeSysfs(filepath.Join(devicePath, "remove"), "1"); err != nil {
+			return err
+		}
+		time.Sleep(r.Sleep)
+		if err := writeSysfs(filepath.Join(r.Root, "bus", "pci", "rescan"), "1"); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(r.Timeout)
+		for {
+			if _, err := os.Stat(devicePath); err == nil {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("PCI device %v did not come back after a rescan", address)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	default:
+		return fmt.Errorf("Unknown sysfs reset method: '%v'", method)
+	}
+}
+
+// sysfsStrategy resets devices identified by PCI address through sysfs
+type sysfsStrategy struct {
+	resetter *SysfsResetter
+}
+
+func newSysfsStrategy(config *StrategyConfig, runner Runner) (Resetter, error) {
+	resetter := NewSysfsResetter()
+	if strings.Compare(config.Root, "") != 0 {
+		resetter.Root = config.Root
+	}
+	if strings.Compare(string(config.Method), "") != 0 {
+		resetter.Method = config.Method
+	}
+	resetter.Sleep = config.sleep()
+	resetter.Timeout = config.timeout()
+	return &sysfsStrategy{resetter}, nil
+}
+
+func (s *sysfsStrategy) Reset(devices []string) []*Result {
+	results := newResults(devices)
+	for _, result := range results {
+		topology, err := pcie.ParseTopology(result.Device)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		result.Err = s.resetter.Reset(topology)
+	}
+	return results
+}
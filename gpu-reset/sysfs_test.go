@@ -0,0 +1,60 @@
+package gpureset
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/minerconfig/internal/sysfstest"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSysfs creates a sysfs tree with an amdgpu device at 0000:01:00.0
+func fakeSysfs(require *require.Assertions) (*sysfstest.Sysfs, string) {
+	sysfs := sysfstest.New(require)
+	devicePath := sysfs.AddPCIDevice("0000:01:00.0", sysfstest.CLASS_VGA, "0x1002", "0x67df", "amdgpu")
+	sysfs.WriteFiles(devicePath, map[string]string{"remove": ""})
+	sysfs.WriteFiles(sysfs.Path("bus", "pci"), map[string]string{"rescan": ""})
+	return sysfs, devicePath
+}
+
+func readFile(require *require.Assertions, path string) string {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	return string(b)
+}
+
+func TestSysfsResetter(t *testing.T) {
+	require := require.New(t)
+
+	sysfs, devicePath := fakeSysfs(require)
+	defer sysfs.Remove()
+	root := sysfs.Root
+
+	resetter := NewSysfsResetter()
+	resetter.Root = root
+	resetter.Sleep = 0
+	resetter.Timeout = 0
+	topology := &pcie.Topology{Bus: 1}
+
+	// No reset file, so the driver is rebound
+	require.Nil(resetter.Reset(topology))
+	require.Equal("0000:01:00.0", readFile(require, filepath.Join(root, "bus", "pci", "drivers", "amdgpu", "unbind")))
+	require.Equal("0000:01:00.0", readFile(require, filepath.Join(root, "bus", "pci", "drivers", "amdgpu", "bind")))
+
+	resetter.Method = SYSFS_REMOVE
+	require.Nil(resetter.Reset(topology))
+	require.Equal("1", readFile(require, filepath.Join(devicePath, "remove")))
+	require.Equal("1", readFile(require, filepath.Join(root, "bus", "pci", "rescan")))
+
+	// Function level reset is preferred where supported
+	require.Nil(ioutil.WriteFile(filepath.Join(devicePath, "reset"), nil, 0666))
+	resetter.Method = SYSFS_AUTO
+	require.Nil(resetter.Reset(topology))
+	require.Equal("1", readFile(require, filepath.Join(devicePath, "reset")))
+
+	require.NotNil(resetter.Reset(&pcie.Topology{Bus: 2}))
+	// The same bus in another domain is a different device
+	require.NotNil(resetter.Reset(&pcie.Topology{Domain: 1, Bus: 1}))
+}
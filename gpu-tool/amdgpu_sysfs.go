@@ -0,0 +1,454 @@
+package gputool
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gurupras/minerconfig/pcie"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var performanceLevels = map[string]bool{
+	"auto":             true,
+	"low":              true,
+	"high":             true,
+	"manual":           true,
+	"profile_standard": true,
+	"profile_min_sclk": true,
+	"profile_min_mclk": true,
+	"profile_peak":     true,
+}
+
+// ClockState structure representing a single DPM state of pp_od_clk_voltage
+type ClockState struct {
+	Index int `json:"index" yaml:"index"`
+	// Clock in MHz
+	Clock int `json:"clock" yaml:"clock"`
+	// Voltage in mV
+	Voltage int `json:"voltage" yaml:"voltage"`
+}
+
+// AMDGPUProfile structure representing the clocks, voltages, power cap and
+// fan settings applied to a GPU. Settings that are left out are not touched
+type AMDGPUProfile struct {
+	CoreStates   []ClockState `json:"core_states" yaml:"core_states"`
+	MemoryStates []ClockState `json:"memory_states" yaml:"memory_states"`
+	// Written to power_dpm_force_performance_level. Defaults to manual when
+	// clock states are given
+	PerformanceLevel string `json:"performance_level" yaml:"performance_level"`
+	// Power cap in watts
+	PowerCap int `json:"power_cap" yaml:"power_cap"`
+	// Fan speed in percent
+	Fan *int `json:"fan" yaml:"fan"`
+	// Hand the fan back to the driver
+	FanAuto bool `json:"fan_auto" yaml:"fan_auto"`
+}
+
+// Validate checks the profile for errors
+func (p *AMDGPUProfile) Validate() error {
+	for _, states := range [][]ClockState{p.CoreStates, p.MemoryStates} {
+		for _, state := range states {
+			if state.Index < 0 || state.Clock <= 0 || state.Voltage <= 0 {
+				return fmt.Errorf("Invalid clock state: index=%v clock=%v voltage=%v", state.Index, state.Clock, state.Voltage)
+			}
+		}
+	}
+	if strings.Compare(p.PerformanceLevel, "") != 0 && !performanceLevels[p.PerformanceLevel] {
+		return fmt.Errorf("Invalid performance level: '%v'", p.PerformanceLevel)
+	}
+	if p.PowerCap < 0 {
+		return fmt.Errorf("Power cap must not be negative")
+	}
+	if p.Fan != nil && (*p.Fan < 0 || *p.Fan > 100) {
+		return fmt.Errorf("Fan speed must be between 0 and 100")
+	}
+	if p.Fan != nil && p.FanAuto {
+		return fmt.Errorf("Fan speed and fan_auto are mutually exclusive")
+	}
+	return nil
+}
+
+// performanceLevel returns the performance level the profile needs
+func (p *AMDGPUProfile) performanceLevel() string {
+	if strings.Compare(p.PerformanceLevel, "") != 0 {
+		return p.PerformanceLevel
+	}
+	if len(p.CoreStates) > 0 || len(p.MemoryStates) > 0 {
+		return "manual"
+	}
+	return ""
+}
+
+// AMDGPUProfiles structure representing a file of profiles and the GPUs they
+// apply to
+type AMDGPUProfiles struct {
+	Profiles map[string]*AMDGPUProfile `json:"profiles" yaml:"profiles"`
+	// Profile of each GPU keyed by PCI address. GPUs that are not listed get
+	// the profile given in the tool's arguments, if any
+	Devices map[string]string `json:"devices" yaml:"devices"`
+	devices map[pcie.Topology]string
+}
+
+// LoadAMDGPUProfiles reads and validates the profiles in path
+func LoadAMDGPUProfiles(path string) (*AMDGPUProfiles, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read profiles: %v", err)
+	}
+	profiles := &AMDGPUProfiles{}
+	if err := yaml.Unmarshal(b, profiles); err != nil {
+		return nil, fmt.Errorf("Failed to parse profiles: %v", err)
+	}
+	if err := profiles.Validate(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Validate checks every profile and device mapping for errors
+func (ap *AMDGPUProfiles) Validate() error {
+	for name, profile := range ap.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("Profile '%v': %v", name, err)
+		}
+	}
+	ap.devices = make(map[pcie.Topology]string)
+	for address, name := range ap.Devices {
+		topology, err := pcie.ParseTopology(address)
+		if err != nil {
+			return err
+		}
+		if _, ok := ap.Profiles[name]; !ok {
+			return fmt.Errorf("Device %v: unknown profile '%v'", address, name)
+		}
+		ap.devices[*topology] = name
+	}
+	return nil
+}
+
+// AMDGPUSysfs applies profiles to amdgpu devices through sysfs on Linux.
+//
+// The path given to Run is a file of AMDGPUProfiles. Arguments:
+//
+//	profile: profile applied to GPUs the file has no mapping for
+//	devices: PCI addresses of the only GPUs to configure
+//	root:    root of sysfs. Defaults to /sys
+type AMDGPUSysfs struct {
+	Root string
+}
+
+func (a *AMDGPUSysfs) root() string {
+	if strings.Compare(a.Root, "") == 0 {
+		return "/sys"
+	}
+	return a.Root
+}
+
+// Cards returns the device directory of every amdgpu card keyed by its PCI
+// topology
+func (a *AMDGPUSysfs) Cards() (map[pcie.Topology]string, error) {
+	matches, err := filepath.Glob(filepath.Join(a.root(), "class", "drm", "card*"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[pcie.Topology]string)
+	for _, card := range matches {
+		// Skip connectors such as card0-DP-1
+		if strings.Contains(filepath.Base(card), "-") {
+			continue
+		}
+		devicePath := filepath.Join(card, "device")
+		uevent, err := readUevent(filepath.Join(devicePath, "uevent"))
+		if err != nil {
+			log.Debugf("Skipping %v: %v", card, err)
+			continue
+		}
+		if strings.Compare(uevent["DRIVER"], "amdgpu") != 0 {
+			continue
+		}
+		topology, err := pcie.ParseTopology(uevent["PCI_SLOT_NAME"])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", card, err)
+		}
+		ret[*topology] = devicePath
+	}
+	return ret, nil
+}
+
+// readUevent parses the KEY=VALUE lines of a uevent file
+func readUevent(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tokens := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(tokens) == 2 {
+			ret[tokens[0]] = tokens[1]
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func writeSysfs(path string, values ...string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open '%v': %v", path, err)
+	}
+	defer f.Close()
+	// Every write is a separate command to the driver
+	for _, value := range values {
+		if _, err := f.Write([]byte(value + "\n")); err != nil {
+			return fmt.Errorf("Failed to write '%v' to '%v': %v", value, path, err)
+		}
+	}
+	return nil
+}
+
+func readSysfsInt(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// hwmon returns the hwmon directory of the device at devicePath
+func hwmon(devicePath string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(devicePath, "hwmon", "hwmon*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("No hwmon directory under %v", devicePath)
+	}
+	return matches[0], nil
+}
+
+// Apply applies profile to the device at devicePath
+func (a *AMDGPUSysfs) Apply(devicePath string, profile *AMDGPUProfile) error {
+	if level := profile.performanceLevel(); strings.Compare(level, "") != 0 {
+		if err := writeSysfs(filepath.Join(devicePath, "power_dpm_force_performance_level"), level); err != nil {
+			return err
+		}
+	}
+	if len(profile.CoreStates) > 0 || len(profile.MemoryStates) > 0 {
+		commands := make([]string, 0)
+		for _, state := range profile.CoreStates {
+			commands = append(commands, fmt.Sprintf("s %d %d %d", state.Index, state.Clock, state.Voltage))
+		}
+		for _, state := range profile.MemoryStates {
+			commands = append(commands, fmt.Sprintf("m %d %d %d", state.Index, state.Clock, state.Voltage))
+		}
+		// Commit the new table
+		commands = append(commands, "c")
+		if err := writeSysfs(filepath.Join(devicePath, "pp_od_clk_voltage"), commands...); err != nil {
+			return err
+		}
+	}
+	if profile.PowerCap == 0 && profile.Fan == nil && !profile.FanAuto {
+		return nil
+	}
+
+	hwmonPath, err := hwmon(devicePath)
+	if err != nil {
+		return err
+	}
+	if profile.PowerCap > 0 {
+		microwatts := profile.PowerCap * 1000000
+		if max, err := readSysfsInt(filepath.Join(hwmonPath, "power1_cap_max")); err == nil && microwatts > max {
+			return fmt.Errorf("Power cap of %vW exceeds the maximum of %vW", profile.PowerCap, max/1000000)
+		}
+		if err := writeSysfs(filepath.Join(hwmonPath, "power1_cap"), strconv.Itoa(microwatts)); err != nil {
+			return err
+		}
+	}
+	if profile.FanAuto {
+		return writeSysfs(filepath.Join(hwmonPath, "pwm1_enable"), "2")
+	}
+	if profile.Fan != nil {
+		max, err := readSysfsInt(filepath.Join(hwmonPath, "pwm1_max"))
+		if err != nil {
+			max = 255
+		}
+		if err := writeSysfs(filepath.Join(hwmonPath, "pwm1_enable"), "1"); err != nil {
+			return err
+		}
+		return writeSysfs(filepath.Join(hwmonPath, "pwm1"), strconv.Itoa(*profile.Fan*max/100))
+	}
+	return nil
+}
+
+var amdgpuSysfsSchema = []*ArgSpec{
+	{Name: "profile", Type: ARG_STRING, Description: "Profile applied to GPUs the profiles file has no mapping for"},
+	{Name: "devices", Type: ARG_STRING_LIST, Description: "PCI addresses of the only GPUs to configure"},
+	{Name: "root", Type: ARG_STRING, Description: "Root of sysfs. Defaults to /sys"},
+}
+
+func (a *AMDGPUSysfs) Schema() []*ArgSpec {
+	return amdgpuSysfsSchema
+}
+
+func (a *AMDGPUSysfs) Validate(args map[string]interface{}) error {
+	if err := ValidateArgs(amdgpuSysfsSchema, args); err != nil {
+		return err
+	}
+	if v, ok := args["devices"]; ok {
+		devices, _ := toStringList(v)
+		for _, device := range devices {
+			if _, err := pcie.ParseTopology(device); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// amdgpuTarget structure representing a card and the profile it gets
+type amdgpuTarget struct {
+	Topology   pcie.Topology
+	DevicePath string
+	Name       string
+	Profile    *AMDGPUProfile
+}
+
+// targets returns the cards that args apply a profile to, in PCI order
+func (a *AMDGPUSysfs) targets(path string, args map[string]interface{}) ([]*amdgpuTarget, error) {
+	if err := a.Validate(args); err != nil {
+		return nil, err
+	}
+	tool := &AMDGPUSysfs{a.Root}
+	if root, ok := args["root"].(string); ok {
+		tool.Root = root
+	}
+	profiles, err := LoadAMDGPUProfiles(path)
+	if err != nil {
+		return nil, err
+	}
+	defaultProfile := ""
+	if profile, ok := args["profile"]; ok {
+		defaultProfile = profile.(string)
+		if _, ok := profiles.Profiles[defaultProfile]; !ok {
+			return nil, fmt.Errorf("Unknown profile '%v'", defaultProfile)
+		}
+	}
+	var only map[pcie.Topology]bool
+	if v, ok := args["devices"]; ok {
+		devices, _ := toStringList(v)
+		only = make(map[pcie.Topology]bool)
+		for _, device := range devices {
+			topology, _ := pcie.ParseTopology(device)
+			only[*topology] = true
+		}
+	}
+
+	cards, err := tool.Cards()
+	if err != nil {
+		return nil, err
+	}
+	topologies := make([]pcie.Topology, 0)
+	for topology := range cards {
+		topologies = append(topologies, topology)
+	}
+	sort.Slice(topologies, func(i, j int) bool {
+		return strings.Compare(topologies[i].String(), topologies[j].String()) < 0
+	})
+	for topology := range only {
+		if _, ok := cards[topology]; !ok {
+			return nil, fmt.Errorf("No amdgpu device at %v", topology.String())
+		}
+	}
+
+	ret := make([]*amdgpuTarget, 0)
+	for _, topology := range topologies {
+		if only != nil && !only[topology] {
+			continue
+		}
+		name, ok := profiles.devices[topology]
+		if !ok {
+			name = defaultProfile
+		}
+		if strings.Compare(name, "") == 0 {
+			continue
+		}
+		ret = append(ret, &amdgpuTarget{topology, cards[topology], name, profiles.Profiles[name]})
+	}
+	return ret, nil
+}
+
+// Restore hands the clocks, voltages, power cap and fan of the device at
+// devicePath back to the driver
+func (a *AMDGPUSysfs) Restore(devicePath string) error {
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	if path := filepath.Join(devicePath, "pp_od_clk_voltage"); exists(path) {
+		if err := writeSysfs(path, "r", "c"); err != nil {
+			return err
+		}
+	}
+	if err := writeSysfs(filepath.Join(devicePath, "power_dpm_force_performance_level"), "auto"); err != nil {
+		return err
+	}
+	hwmonPath, err := hwmon(devicePath)
+	if err != nil {
+		return err
+	}
+	if watts, err := readSysfsInt(filepath.Join(hwmonPath, "power1_cap_default")); err == nil {
+		if err := writeSysfs(filepath.Join(hwmonPath, "power1_cap"), strconv.Itoa(watts)); err != nil {
+			return err
+		}
+	}
+	if path := filepath.Join(hwmonPath, "pwm1_enable"); exists(path) {
+		return writeSysfs(path, "2")
+	}
+	return nil
+}
+
+func (a *AMDGPUSysfs) Run(path string, args map[string]interface{}) error {
+	targets, err := a.targets(path, args)
+	if err != nil {
+		return err
+	}
+	failures := make(GPUErrors, 0)
+	for _, target := range targets {
+		log.Infof("Applying profile '%v' to %v", target.Name, target.Topology.String())
+		if err := a.Apply(target.DevicePath, target.Profile); err != nil {
+			failures = append(failures, &GPUError{target.Topology.String(), err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// Revert restores the defaults of every card that Run applies a profile to
+func (a *AMDGPUSysfs) Revert(path string, args map[string]interface{}) error {
+	targets, err := a.targets(path, args)
+	if err != nil {
+		return err
+	}
+	failures := make(GPUErrors, 0)
+	for _, target := range targets {
+		log.Infof("Restoring defaults of %v", target.Topology.String())
+		if err := a.Restore(target.DevicePath); err != nil {
+			failures = append(failures, &GPUError{target.Topology.String(), err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
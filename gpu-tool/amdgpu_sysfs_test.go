@@ -0,0 +1,154 @@
+package gputool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/minerconfig/internal/sysfstest"
+	"github.com/stretchr/testify/require"
+)
+
+var testAMDGPUProfiles = `
+profiles:
+  mining:
+    core_states:
+      - index: 7
+        clock: 1400
+        voltage: 950
+    memory_states:
+      - index: 3
+        clock: 1100
+        voltage: 900
+    power_cap: 150
+    fan: 80
+  idle:
+    performance_level: auto
+    fan_auto: true
+devices:
+  "0000:02:00.0": idle
+`
+
+// fakeDRM creates a sysfs tree with an amdgpu card for every address and a
+// card driven by another driver
+func fakeDRM(require *require.Assertions, addresses ...string) (*sysfstest.Sysfs, []string) {
+	sysfs := sysfstest.New(require)
+	devicePaths := make([]string, 0)
+	for _, address := range addresses {
+		devicePath, hwmonPath := sysfs.AddCard(address, "amdgpu")
+		sysfs.WriteFiles(devicePath, map[string]string{
+			"power_dpm_force_performance_level": "",
+			"pp_od_clk_voltage":                 "",
+		})
+		sysfs.WriteFiles(hwmonPath, map[string]string{
+			"power1_cap":         "",
+			"pwm1_enable":        "",
+			"pwm1":               "",
+			"power1_cap_max":     "200000000\n",
+			"power1_cap_default": "180000000\n",
+			"pwm1_max":           "255\n",
+		})
+		devicePaths = append(devicePaths, devicePath)
+	}
+	sysfs.AddCard("0000:09:00.0", "nouveau")
+	// Connectors are not cards
+	require.Nil(os.MkdirAll(sysfs.Path("class", "drm", "card0-DP-1"), 0777))
+	return sysfs, devicePaths
+}
+
+func readFile(require *require.Assertions, path string) string {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	return string(b)
+}
+
+func TestAMDGPUSysfs(t *testing.T) {
+	require := require.New(t)
+
+	sysfs, devicePaths := fakeDRM(require, "0000:01:00.0", "0000:02:00.0")
+	defer sysfs.Remove()
+	root := sysfs.Root
+
+	profilesPath := filepath.Join(root, "profiles.yaml")
+	require.Nil(ioutil.WriteFile(profilesPath, []byte(testAMDGPUProfiles), 0666))
+
+	tool, err := ParseGPUTool(GPU_TOOL_AMDGPU_SYSFS)
+	require.Nil(err)
+
+	cards, err := (&AMDGPUSysfs{root}).Cards()
+	require.Nil(err)
+	require.Equal(2, len(cards))
+
+	require.Nil(tool.Run(profilesPath, map[string]interface{}{
+		"root":    root,
+		"profile": "mining",
+	}))
+	mining := devicePaths[0]
+	require.Equal("manual\n", readFile(require, filepath.Join(mining, "power_dpm_force_performance_level")))
+	require.Equal("s 7 1400 950\nm 3 1100 900\nc\n", readFile(require, filepath.Join(mining, "pp_od_clk_voltage")))
+	require.Equal("150000000\n", readFile(require, filepath.Join(mining, "hwmon", "hwmon0", "power1_cap")))
+	require.Equal("1\n", readFile(require, filepath.Join(mining, "hwmon", "hwmon0", "pwm1_enable")))
+	require.Equal("204\n", readFile(require, filepath.Join(mining, "hwmon", "hwmon0", "pwm1")))
+
+	// The device mapping overrides the default profile
+	idle := devicePaths[1]
+	require.Equal("auto\n", readFile(require, filepath.Join(idle, "power_dpm_force_performance_level")))
+	require.Equal("", readFile(require, filepath.Join(idle, "pp_od_clk_voltage")))
+	require.Equal("2\n", readFile(require, filepath.Join(idle, "hwmon", "hwmon1", "pwm1_enable")))
+
+	// Only the requested devices are touched
+	require.Nil(ioutil.WriteFile(filepath.Join(mining, "pp_od_clk_voltage"), nil, 0666))
+	require.Nil(tool.Run(profilesPath, map[string]interface{}{
+		"root":    root,
+		"profile": "mining",
+		"devices": []interface{}{"02:00.0"},
+	}))
+	require.Equal("", readFile(require, filepath.Join(mining, "pp_od_clk_voltage")))
+
+	// Only the devices that were configured are restored
+	require.Nil(tool.Revert(profilesPath, map[string]interface{}{
+		"root":    root,
+		"devices": []interface{}{"0000:01:00.0"},
+		"profile": "mining",
+	}))
+	require.Equal("auto\n", readFile(require, filepath.Join(mining, "power_dpm_force_performance_level")))
+	require.Equal("r\nc\n", readFile(require, filepath.Join(mining, "pp_od_clk_voltage")))
+	require.Equal("180000000\n", readFile(require, filepath.Join(mining, "hwmon", "hwmon0", "power1_cap")))
+	require.Equal("2\n", readFile(require, filepath.Join(mining, "hwmon", "hwmon0", "pwm1_enable")))
+	require.Equal("", readFile(require, filepath.Join(idle, "hwmon", "hwmon1", "power1_cap")))
+
+	require.NotNil(tool.Run(profilesPath, map[string]interface{}{
+		"root":    root,
+		"devices": []interface{}{"0000:05:00.0"},
+	}))
+	require.NotNil(tool.Run(profilesPath, map[string]interface{}{
+		"root":    root,
+		"profile": "missing",
+	}))
+}
+
+func TestAMDGPUProfilesValidate(t *testing.T) {
+	require := require.New(t)
+
+	fan := 120
+	profiles := &AMDGPUProfiles{Profiles: map[string]*AMDGPUProfile{"bad": {Fan: &fan}}}
+	require.NotNil(profiles.Validate())
+
+	profiles = &AMDGPUProfiles{Profiles: map[string]*AMDGPUProfile{"bad": {PerformanceLevel: "turbo"}}}
+	require.NotNil(profiles.Validate())
+
+	profiles = &AMDGPUProfiles{Profiles: map[string]*AMDGPUProfile{"bad": {CoreStates: []ClockState{{Index: 1, Clock: 1000}}}}}
+	require.NotNil(profiles.Validate())
+
+	profiles = &AMDGPUProfiles{
+		Profiles: map[string]*AMDGPUProfile{"ok": {}},
+		Devices:  map[string]string{"0000:01:00.0": "missing"},
+	}
+	require.NotNil(profiles.Validate())
+
+	// Power caps above what the card allows are refused
+	sysfs, devicePaths := fakeDRM(require, "0000:01:00.0")
+	defer sysfs.Remove()
+	require.NotNil((&AMDGPUSysfs{sysfs.Root}).Apply(devicePaths[0], &AMDGPUProfile{PowerCap: 300}))
+}
@@ -1,6 +1,13 @@
 package gputool
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 type GPUToolType string
 
@@ -8,10 +15,46 @@ const (
 	GPU_TOOL_MSI_AB          GPUToolType = "MSI-AB"
 	GPU_TOOL_OVERDRIVE_NTOOL GPUToolType = "ODNT"
 	GPU_TOOL_SCRIPT          GPUToolType = "SCRIPT"
+	GPU_TOOL_AMDGPU_SYSFS    GPUToolType = "AMDGPU_SYSFS"
+	GPU_TOOL_NVIDIA          GPUToolType = "NVIDIA"
+)
+
+type ArgType string
+
+const (
+	ARG_STRING ArgType = "string"
+	ARG_INT    ArgType = "int"
+	ARG_NUMBER ArgType = "number"
+	// A single int or a list of them
+	ARG_INT_LIST ArgType = "int-list"
+	// A single string or a list of them
+	ARG_STRING_LIST ArgType = "string-list"
 )
 
+// ArgSpec structure representing an argument accepted by a GPU tool
+type ArgSpec struct {
+	Name        string  `json:"name"`
+	Type        ArgType `json:"type"`
+	Required    bool    `json:"required"`
+	Description string  `json:"description"`
+	// Strings accepted in place of a value of Type, such as "auto"
+	Keywords []string `json:"keywords"`
+}
+
+// ErrRevertUnsupported is returned by Revert of tools that cannot restore
+// default settings by themselves. Their settings are only reverted if idle
+// arguments are configured
+var ErrRevertUnsupported = errors.New("Restoring default settings is not supported")
+
 type GPUToolInterface interface {
+	// Schema describes the arguments the tool accepts
+	Schema() []*ArgSpec
+	// Validate checks args before they are passed to Run
+	Validate(args map[string]interface{}) error
 	Run(path string, args map[string]interface{}) error
+	// Revert restores the default settings of the GPUs that Run configured
+	// with args. Returns ErrRevertUnsupported if the tool cannot do so
+	Revert(path string, args map[string]interface{}) error
 }
 
 func ParseGPUTool(toolType GPUToolType) (GPUToolInterface, error) {
@@ -22,7 +65,154 @@ func ParseGPUTool(toolType GPUToolType) (GPUToolInterface, error) {
 		return &OverdriveNTool{}, nil
 	case GPU_TOOL_SCRIPT:
 		return &ScriptTool{}, nil
+	case GPU_TOOL_AMDGPU_SYSFS:
+		return &AMDGPUSysfs{}, nil
+	case GPU_TOOL_NVIDIA:
+		return &NVIDIATool{}, nil
 	default:
 		return nil, fmt.Errorf("Unimplemented GPUTool: %v", toolType)
 	}
 }
+
+// GPUError structure representing a GPU that a tool failed to configure
+type GPUError struct {
+	GPU string
+	Err error
+}
+
+// GPUErrors is returned by Run when some of the GPUs could not be configured
+type GPUErrors []*GPUError
+
+func (ge GPUErrors) Error() string {
+	errors := make([]string, 0)
+	for _, e := range ge {
+		errors = append(errors, fmt.Sprintf("GPU %v: %v", e.GPU, e.Err))
+	}
+	return fmt.Sprintf("Failed to configure GPUs: %v", strings.Join(errors, "; "))
+}
+
+// ValidateArgs checks that args only has arguments described by schema, that
+// every required argument is present and that every value has the right type
+func ValidateArgs(schema []*ArgSpec, args map[string]interface{}) error {
+	specs := make(map[string]*ArgSpec)
+	for _, spec := range schema {
+		specs[spec.Name] = spec
+		if _, ok := args[spec.Name]; spec.Required && !ok {
+			return fmt.Errorf("Missing argument '%v'", spec.Name)
+		}
+	}
+	keys := make([]string, 0)
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		spec, ok := specs[key]
+		if !ok {
+			return fmt.Errorf("Unknown argument '%v'", key)
+		}
+		if err := spec.check(args[key]); err != nil {
+			return fmt.Errorf("Invalid argument '%v': %v", key, err)
+		}
+	}
+	return nil
+}
+
+// check returns an error if v is not of the type of the argument
+func (as *ArgSpec) check(v interface{}) error {
+	if s, ok := v.(string); ok {
+		for _, keyword := range as.Keywords {
+			if strings.Compare(s, keyword) == 0 {
+				return nil
+			}
+		}
+	}
+	var err error
+	switch as.Type {
+	case ARG_STRING:
+		if _, ok := v.(string); !ok {
+			err = fmt.Errorf("%v is not a string", v)
+		}
+	case ARG_INT:
+		_, err = toInt(v)
+	case ARG_NUMBER:
+		_, err = toFloat(v)
+	case ARG_INT_LIST:
+		_, err = toIntList(v)
+	case ARG_STRING_LIST:
+		_, err = toStringList(v)
+	default:
+		err = fmt.Errorf("Unknown argument type '%v'", as.Type)
+	}
+	return err
+}
+
+// toInt converts a number decoded from JSON or YAML into an int
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, fmt.Errorf("%v is not a whole number", n)
+		}
+		return int(n), nil
+	case string:
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("'%v' is not a number", n)
+		}
+		return i, nil
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+}
+
+// toIntList converts a single int or a list of them into a list
+func toIntList(v interface{}) ([]int, error) {
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+	ret := make([]int, 0)
+	for _, value := range values {
+		i, err := toInt(value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, i)
+	}
+	return ret, nil
+}
+
+// toStringList converts a single string or a list of them into a list
+func toStringList(v interface{}) ([]string, error) {
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+	ret := make([]string, 0)
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", value)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
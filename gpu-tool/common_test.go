@@ -0,0 +1,121 @@
+package gputool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateArgs(t *testing.T) {
+	require := require.New(t)
+
+	schema := []*ArgSpec{
+		{Name: "name", Type: ARG_STRING, Required: true},
+		{Name: "count", Type: ARG_INT},
+		{Name: "ratio", Type: ARG_NUMBER},
+		{Name: "ids", Type: ARG_INT_LIST},
+		{Name: "tags", Type: ARG_STRING_LIST},
+		{Name: "speed", Type: ARG_INT, Keywords: []string{"auto"}},
+	}
+	require.Nil(ValidateArgs(schema, map[string]interface{}{
+		"name":  "x",
+		"count": float64(2),
+		"ratio": 0.5,
+		"ids":   []interface{}{0, 1},
+		"tags":  "a",
+		"speed": "auto",
+	}))
+	require.Nil(ValidateArgs(schema, map[string]interface{}{"name": "x", "ids": 3, "speed": 50}))
+
+	for _, bad := range []map[string]interface{}{
+		{},
+		{"name": 1},
+		{"name": "x", "unknown": 1},
+		{"name": "x", "count": 1.5},
+		{"name": "x", "ratio": "high"},
+		{"name": "x", "ids": []interface{}{"a"}},
+		{"name": "x", "tags": []interface{}{1}},
+		{"name": "x", "speed": "fast"},
+	} {
+		require.NotNil(ValidateArgs(schema, bad), "%v", bad)
+	}
+}
+
+func TestGPUToolValidate(t *testing.T) {
+	require := require.New(t)
+
+	for _, toolType := range []GPUToolType{GPU_TOOL_MSI_AB, GPU_TOOL_OVERDRIVE_NTOOL, GPU_TOOL_SCRIPT, GPU_TOOL_AMDGPU_SYSFS, GPU_TOOL_NVIDIA} {
+		tool, err := ParseGPUTool(toolType)
+		require.Nil(err)
+		require.NotNil(tool.Schema())
+	}
+
+	ab := &MSIAfterBurner{}
+	require.Nil(ab.Validate(map[string]interface{}{"profile": 2}))
+	require.NotNil(ab.Validate(map[string]interface{}{}))
+	require.NotNil(ab.Validate(map[string]interface{}{"profile": 6}))
+	// Never runs Afterburner with -Profile<nil>
+	require.NotNil(ab.Run("MSIAfterburner.exe", nil))
+	require.Equal(ErrRevertUnsupported, ab.Revert("MSIAfterburner.exe", map[string]interface{}{"profile": 2}))
+
+	odnt := &OverdriveNTool{}
+	require.Nil(odnt.Validate(map[string]interface{}{"gpu-id": 0, "profile": "mining"}))
+	require.Nil(odnt.Validate(map[string]interface{}{"gpu-id": []interface{}{0, 1}, "profile": "mining"}))
+	require.NotNil(odnt.Validate(map[string]interface{}{"profile": "mining"}))
+	require.NotNil(odnt.Validate(map[string]interface{}{"gpu-id": 0}))
+	require.NotNil(odnt.Validate(map[string]interface{}{"gpu-id": []interface{}{}, "profile": "mining"}))
+
+	script := &ScriptTool{}
+	require.Nil(script.Validate(nil))
+	require.Nil(script.Validate(map[string]interface{}{"args": []interface{}{"revert"}}))
+	require.NotNil(script.Validate(map[string]interface{}{"profile": 1}))
+	require.Equal(ErrRevertUnsupported, script.Revert("overclock.sh", nil))
+
+	amd := &AMDGPUSysfs{}
+	require.Nil(amd.Validate(map[string]interface{}{"devices": []interface{}{"0000:01:00.0"}}))
+	require.NotNil(amd.Validate(map[string]interface{}{"devices": "card0"}))
+}
+
+func TestOverdriveNToolMultipleGPUs(t *testing.T) {
+	require := require.New(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake OverdriveNTool is a shell script")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gputool-odnt")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "invocations.log")
+	path := filepath.Join(dir, "OverdriveNTool.exe")
+	// Logs one argument per line
+	fake := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + logPath + "\n[ -z \"$FAKE_ODNT_FAIL\" ] || { echo 'Failed to apply'; exit 1; }\n"
+	require.Nil(ioutil.WriteFile(path, []byte(fake), 0755))
+
+	odnt := &OverdriveNTool{}
+	args := map[string]interface{}{"gpu-id": []interface{}{0, 2}, "profile": "mining"}
+	require.Nil(odnt.Run(path, args))
+	require.Equal("-consoleonly\n-p0mining\n-p2mining", strings.TrimSpace(readFile(require, logPath)))
+
+	// Profile names may contain spaces
+	require.Nil(odnt.Run(path, map[string]interface{}{"gpu-id": []interface{}{0, 2}, "profile": "My Profile"}))
+	require.Equal("-consoleonly\n-p0My Profile\n-p2My Profile", strings.TrimSpace(readFile(require, logPath)))
+
+	require.Nil(odnt.Revert(path, args))
+	require.Equal("-consoleonly\n-r0\n-r2", strings.TrimSpace(readFile(require, logPath)))
+
+	os.Setenv("FAKE_ODNT_FAIL", "1")
+	defer os.Unsetenv("FAKE_ODNT_FAIL")
+	err = odnt.Run(path, args)
+	gpuErrors, ok := err.(GPUErrors)
+	require.True(ok)
+	require.Equal(2, len(gpuErrors))
+	require.Equal("0", gpuErrors[0].GPU)
+	require.Equal("2", gpuErrors[1].GPU)
+	require.Contains(gpuErrors[1].Err.Error(), "Failed to apply")
+}
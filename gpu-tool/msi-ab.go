@@ -6,14 +6,42 @@ import (
 	"path/filepath"
 )
 
+var msiAfterBurnerSchema = []*ArgSpec{
+	{Name: "profile", Type: ARG_INT, Required: true, Description: "Afterburner profile slot, 1 to 5"},
+}
+
 type MSIAfterBurner struct {
 }
 
+func (ab *MSIAfterBurner) Schema() []*ArgSpec {
+	return msiAfterBurnerSchema
+}
+
+func (ab *MSIAfterBurner) Validate(args map[string]interface{}) error {
+	if err := ValidateArgs(msiAfterBurnerSchema, args); err != nil {
+		return err
+	}
+	if profile, _ := toInt(args["profile"]); profile < 1 || profile > 5 {
+		return fmt.Errorf("Afterburner profile must be between 1 and 5: %v", profile)
+	}
+	return nil
+}
+
 func (ab *MSIAfterBurner) Run(path string, args map[string]interface{}) error {
-	profile := args["profile"]
+	if err := ab.Validate(args); err != nil {
+		return err
+	}
+	profile, _ := toInt(args["profile"])
 
 	cmdArgs := fmt.Sprintf("-Profile%v", profile)
 	cmd := exec.Command(path, []string{cmdArgs}...)
 	cmd.Dir = filepath.Dir(path)
 	return cmd.Run()
 }
+
+// Revert is not supported. Afterburner cannot restore defaults from the
+// command line, so a profile slot with the default settings must be configured
+// as the idle profile instead
+func (ab *MSIAfterBurner) Revert(path string, args map[string]interface{}) error {
+	return ErrRevertUnsupported
+}
@@ -0,0 +1,362 @@
+package gputool
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	powerLimitRegexp = regexp.MustCompile(`Power limit for GPU \S+ was set to ([0-9.]+) W`)
+	assignedRegexp   = regexp.MustCompile(`Attribute '(\w+)' \(\S*(\[\w+:\d+\])\) assigned value (-?\d+)`)
+	fanRegexp        = regexp.MustCompile(`\[fan:(\d+)\]`)
+)
+
+var nvidiaSchema = []*ArgSpec{
+	{Name: "gpus", Type: ARG_INT_LIST, Description: "Indices of the GPUs to configure. Defaults to every GPU"},
+	{Name: "power_limit", Type: ARG_NUMBER, Description: "Power limit in watts"},
+	{Name: "core_offset", Type: ARG_INT, Description: "Core clock offset in MHz"},
+	{Name: "memory_offset", Type: ARG_INT, Description: "Memory transfer rate offset in MHz"},
+	{Name: "fan", Type: ARG_INT, Keywords: []string{"auto"}, Description: "Fan speed in percent, or auto"},
+	{Name: "display", Type: ARG_STRING, Description: "X display nvidia-settings talks to"},
+}
+
+// NVIDIAArgs structure representing the settings applied to NVIDIA GPUs
+type NVIDIAArgs struct {
+	// Indices of the GPUs to configure. Defaults to every GPU
+	GPUs []int
+	// Power limit in watts
+	PowerLimit *float64
+	// Clock offsets in MHz
+	CoreOffset   *int
+	MemoryOffset *int
+	// Fan speed in percent. A negative value hands the fan back to the driver
+	Fan *int
+	// X display nvidia-settings talks to
+	Display string
+}
+
+// ParseNVIDIAArgs converts and validates the arguments of the NVIDIA tool
+func ParseNVIDIAArgs(args map[string]interface{}) (*NVIDIAArgs, error) {
+	if err := ValidateArgs(nvidiaSchema, args); err != nil {
+		return nil, err
+	}
+
+	ret := &NVIDIAArgs{}
+	if v, ok := args["gpus"]; ok {
+		gpus, _ := toIntList(v)
+		for _, gpu := range gpus {
+			if gpu < 0 {
+				return nil, fmt.Errorf("Invalid GPU index: %v", gpu)
+			}
+		}
+		ret.GPUs = gpus
+	}
+	if v, ok := args["power_limit"]; ok {
+		watts, _ := toFloat(v)
+		if watts <= 0 {
+			return nil, fmt.Errorf("Invalid power_limit: %v", v)
+		}
+		ret.PowerLimit = &watts
+	}
+	for _, key := range []string{"core_offset", "memory_offset"} {
+		v, ok := args[key]
+		if !ok {
+			continue
+		}
+		offset, _ := toInt(v)
+		if key == "core_offset" {
+			ret.CoreOffset = &offset
+		} else {
+			ret.MemoryOffset = &offset
+		}
+	}
+	if v, ok := args["fan"]; ok {
+		fan := -1
+		if s, ok := v.(string); !ok || strings.Compare(s, "auto") != 0 {
+			fan, _ = toInt(v)
+			if fan < 0 || fan > 100 {
+				return nil, fmt.Errorf("fan must be 'auto' or between 0 and 100: %v", v)
+			}
+		}
+		ret.Fan = &fan
+	}
+	if v, ok := args["display"]; ok {
+		ret.Display = v.(string)
+	}
+	return ret, nil
+}
+
+// nvidiaAssignment structure representing a single nvidia-settings attribute
+type nvidiaAssignment struct {
+	GPU       int
+	Target    string
+	Attribute string
+	Value     int
+}
+
+func (na *nvidiaAssignment) String() string {
+	return fmt.Sprintf("%v/%v=%d", na.Target, na.Attribute, na.Value)
+}
+
+// assignments returns the nvidia-settings attributes that apply args to gpu,
+// which is cooled by fans
+func (na *NVIDIAArgs) assignments(gpu int, fans []int) []*nvidiaAssignment {
+	target := fmt.Sprintf("[gpu:%d]", gpu)
+	ret := make([]*nvidiaAssignment, 0)
+	if na.CoreOffset != nil {
+		ret = append(ret, &nvidiaAssignment{gpu, target, "GPUGraphicsClockOffsetAllPerformanceLevels", *na.CoreOffset})
+	}
+	if na.MemoryOffset != nil {
+		ret = append(ret, &nvidiaAssignment{gpu, target, "GPUMemoryTransferRateOffsetAllPerformanceLevels", *na.MemoryOffset})
+	}
+	if na.Fan != nil {
+		if *na.Fan < 0 {
+			ret = append(ret, &nvidiaAssignment{gpu, target, "GPUFanControlState", 0})
+		} else {
+			ret = append(ret, &nvidiaAssignment{gpu, target, "GPUFanControlState", 1})
+			for _, fan := range fans {
+				ret = append(ret, &nvidiaAssignment{gpu, fmt.Sprintf("[fan:%d]", fan), "GPUTargetFanSpeed", *na.Fan})
+			}
+		}
+	}
+	return ret
+}
+
+// NVIDIATool applies power limits with nvidia-smi and clock offsets and fan
+// speeds with nvidia-settings. The path given to Run is the directory of both
+// tools. An empty path looks them up on PATH
+type NVIDIATool struct {
+}
+
+func nvidiaCommand(dir string, name string) string {
+	if strings.Compare(dir, "") == 0 {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+func runNVIDIA(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v failed: %v: %v", name, err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// listGPUs returns the index of every GPU nvidia-smi knows of
+func listGPUs(smi string) ([]int, error) {
+	out, err := runNVIDIA(smi, "--query-gpu=index", "--format=csv,noheader")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]int, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.Compare(strings.TrimSpace(line), "") == 0 {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected nvidia-smi output: %v", line)
+		}
+		ret = append(ret, idx)
+	}
+	return ret, nil
+}
+
+// setPowerLimit sets the power limit of gpu and checks that nvidia-smi
+// confirmed it
+func setPowerLimit(smi string, gpu int, watts float64) error {
+	out, err := runNVIDIA(smi, "-i", strconv.Itoa(gpu), "-pl", strconv.FormatFloat(watts, 'f', -1, 64))
+	if err != nil {
+		return err
+	}
+	match := powerLimitRegexp.FindStringSubmatch(out)
+	if match == nil {
+		return fmt.Errorf("nvidia-smi did not confirm the power limit: %v", strings.TrimSpace(out))
+	}
+	set, _ := strconv.ParseFloat(match[1], 64)
+	if math.Abs(set-watts) > 0.01 {
+		return fmt.Errorf("nvidia-smi set the power limit to %vW instead of %vW", set, watts)
+	}
+	return nil
+}
+
+// listFans returns the fans that cool gpu. Cards often have more than one fan,
+// so fans are not numbered like the GPUs
+func listFans(settings string, display string, gpu int) ([]int, error) {
+	cmdArgs := make([]string, 0)
+	if strings.Compare(display, "") != 0 {
+		cmdArgs = append(cmdArgs, "-c", display)
+	}
+	cmdArgs = append(cmdArgs, "-q", fmt.Sprintf("[gpu:%d]/fans", gpu))
+	out, err := runNVIDIA(settings, cmdArgs...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, match := range fanRegexp.FindAllStringSubmatch(out, -1) {
+		fan, _ := strconv.Atoi(match[1])
+		if !seen[fan] {
+			seen[fan] = true
+			ret = append(ret, fan)
+		}
+	}
+	return ret, nil
+}
+
+// assign runs nvidia-settings with assignments and returns the ones it did
+// not confirm
+func assign(settings string, display string, assignments []*nvidiaAssignment) ([]*nvidiaAssignment, error) {
+	cmdArgs := make([]string, 0)
+	if strings.Compare(display, "") != 0 {
+		cmdArgs = append(cmdArgs, "-c", display)
+	}
+	for _, a := range assignments {
+		cmdArgs = append(cmdArgs, "-a", a.String())
+	}
+	out, err := runNVIDIA(settings, cmdArgs...)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := make(map[string]bool)
+	for _, match := range assignedRegexp.FindAllStringSubmatch(out, -1) {
+		confirmed[fmt.Sprintf("%v/%v=%v", match[2], match[1], match[3])] = true
+	}
+	ret := make([]*nvidiaAssignment, 0)
+	for _, a := range assignments {
+		if !confirmed[a.String()] {
+			ret = append(ret, a)
+		}
+	}
+	return ret, nil
+}
+
+func (n *NVIDIATool) Schema() []*ArgSpec {
+	return nvidiaSchema
+}
+
+func (n *NVIDIATool) Validate(args map[string]interface{}) error {
+	_, err := ParseNVIDIAArgs(args)
+	return err
+}
+
+// defaultPowerLimit returns the power limit gpu ships with
+func defaultPowerLimit(smi string, gpu int) (float64, error) {
+	out, err := runNVIDIA(smi, "-i", strconv.Itoa(gpu), "--query-gpu=power.default_limit", "--format=csv,noheader,nounits")
+	if err != nil {
+		return 0, err
+	}
+	watts, err := strconv.ParseFloat(strings.TrimSpace(out), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected nvidia-smi output: %v", strings.TrimSpace(out))
+	}
+	return watts, nil
+}
+
+// apply applies nvidiaArgs to the GPUs. With restore, the power limit of every
+// GPU is set to its default rather than to nvidiaArgs.PowerLimit
+func (n *NVIDIATool) apply(path string, nvidiaArgs *NVIDIAArgs, restore bool) error {
+	smi := nvidiaCommand(path, "nvidia-smi")
+	settings := nvidiaCommand(path, "nvidia-settings")
+
+	gpus := nvidiaArgs.GPUs
+	if len(gpus) == 0 {
+		var err error
+		if gpus, err = listGPUs(smi); err != nil {
+			return err
+		}
+	}
+
+	failures := make(GPUErrors, 0)
+	if nvidiaArgs.PowerLimit != nil {
+		for _, gpu := range gpus {
+			watts := *nvidiaArgs.PowerLimit
+			if restore {
+				var err error
+				if watts, err = defaultPowerLimit(smi, gpu); err != nil {
+					failures = append(failures, &GPUError{strconv.Itoa(gpu), err})
+					continue
+				}
+			}
+			log.Infof("Setting power limit of GPU %d to %vW", gpu, watts)
+			if err := setPowerLimit(smi, gpu, watts); err != nil {
+				failures = append(failures, &GPUError{strconv.Itoa(gpu), err})
+			}
+		}
+	}
+
+	assignments := make([]*nvidiaAssignment, 0)
+	for _, gpu := range gpus {
+		var fans []int
+		if nvidiaArgs.Fan != nil && *nvidiaArgs.Fan >= 0 {
+			var err error
+			if fans, err = listFans(settings, nvidiaArgs.Display, gpu); err != nil {
+				failures = append(failures, &GPUError{strconv.Itoa(gpu), err})
+				continue
+			}
+			if len(fans) == 0 {
+				log.Warnf("nvidia-settings lists no fans for GPU %d. Not setting its fan speed", gpu)
+			}
+		}
+		assignments = append(assignments, nvidiaArgs.assignments(gpu, fans)...)
+	}
+	if len(assignments) > 0 {
+		unconfirmed, err := assign(settings, nvidiaArgs.Display, assignments)
+		if err != nil {
+			// nvidia-settings applies every GPU at once
+			unconfirmed = assignments
+		}
+		for _, a := range unconfirmed {
+			gpuErr := err
+			if gpuErr == nil {
+				gpuErr = fmt.Errorf("nvidia-settings did not confirm %v", a)
+			}
+			failures = append(failures, &GPUError{strconv.Itoa(a.GPU), gpuErr})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func (n *NVIDIATool) Run(path string, args map[string]interface{}) error {
+	nvidiaArgs, err := ParseNVIDIAArgs(args)
+	if err != nil {
+		return err
+	}
+	return n.apply(path, nvidiaArgs, false)
+}
+
+// Revert restores the default power limit, removes clock offsets and hands
+// the fans back to the driver for every setting that args change
+func (n *NVIDIATool) Revert(path string, args map[string]interface{}) error {
+	nvidiaArgs, err := ParseNVIDIAArgs(args)
+	if err != nil {
+		return err
+	}
+	zero := 0
+	auto := -1
+	defaults := &NVIDIAArgs{}
+	defaults.GPUs = nvidiaArgs.GPUs
+	defaults.PowerLimit = nvidiaArgs.PowerLimit
+	defaults.Display = nvidiaArgs.Display
+	if nvidiaArgs.CoreOffset != nil {
+		defaults.CoreOffset = &zero
+	}
+	if nvidiaArgs.MemoryOffset != nil {
+		defaults.MemoryOffset = &zero
+	}
+	if nvidiaArgs.Fan != nil {
+		defaults.Fan = &auto
+	}
+	return n.apply(path, defaults, true)
+}
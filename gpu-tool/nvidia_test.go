@@ -0,0 +1,182 @@
+package gputool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var fakeNvidiaSmi = `#!/bin/sh
+echo "nvidia-smi $*" >> "$FAKE_NVIDIA_LOG"
+case "$*" in
+*--query-gpu=index*)
+	printf '0\n1\n'
+	;;
+*--query-gpu=power.default_limit*)
+	echo "180.00"
+	;;
+*-pl*)
+	if [ -z "$FAKE_NVIDIA_SILENT" ]; then
+		echo "Power limit for GPU 00000000:0$2:00.0 was set to $4.00 W from 180.00 W."
+	fi
+	echo "All done."
+	;;
+esac
+`
+
+// Every GPU has two fans
+var fakeNvidiaSettings = `#!/bin/sh
+echo "nvidia-settings $*" >> "$FAKE_NVIDIA_LOG"
+[ -n "$FAKE_NVIDIA_SILENT" ] && exit 0
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-q" ]; then
+		shift
+		gpu=${1#\[gpu:}
+		gpu=${gpu%%]*}
+		echo ""
+		echo "  Attribute 'Fans' (rig:0[gpu:$gpu]):"
+		echo "    [fan:$((gpu * 2))] (Fan $((gpu * 2)))"
+		echo "    [fan:$((gpu * 2 + 1))] (Fan $((gpu * 2 + 1)))"
+		echo ""
+	fi
+	if [ "$1" = "-a" ]; then
+		shift
+		target=${1%%/*}
+		rest=${1#*/}
+		echo ""
+		echo "  Attribute '${rest%%=*}' (rig:0${target}) assigned value ${rest#*=}."
+		echo ""
+	fi
+	shift
+done
+`
+
+// fakeNvidia puts fake nvidia-smi and nvidia-settings that log every
+// invocation on PATH
+func fakeNvidia(t *testing.T, require *require.Assertions) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake NVIDIA tools are shell scripts")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gputool-nvidia")
+	require.Nil(err)
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte(fakeNvidiaSmi), 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "nvidia-settings"), []byte(fakeNvidiaSettings), 0755))
+	logPath := filepath.Join(dir, "invocations.log")
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	os.Setenv("FAKE_NVIDIA_LOG", logPath)
+	return logPath, func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv("FAKE_NVIDIA_LOG")
+		os.Unsetenv("FAKE_NVIDIA_SILENT")
+		os.RemoveAll(dir)
+	}
+}
+
+func invocations(require *require.Assertions, logPath string) []string {
+	b, err := ioutil.ReadFile(logPath)
+	require.Nil(err)
+	os.Remove(logPath)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestNVIDIATool(t *testing.T) {
+	require := require.New(t)
+
+	logPath, cleanup := fakeNvidia(t, require)
+	defer cleanup()
+
+	tool, err := ParseGPUTool(GPU_TOOL_NVIDIA)
+	require.Nil(err)
+
+	require.Nil(tool.Run("", map[string]interface{}{
+		"power_limit":   150,
+		"core_offset":   100,
+		"memory_offset": float64(-500),
+		"fan":           70,
+		"display":       ":0",
+	}))
+	require.Equal([]string{
+		"nvidia-smi --query-gpu=index --format=csv,noheader",
+		"nvidia-smi -i 0 -pl 150",
+		"nvidia-smi -i 1 -pl 150",
+		"nvidia-settings -c :0 -q [gpu:0]/fans",
+		"nvidia-settings -c :0 -q [gpu:1]/fans",
+		"nvidia-settings -c :0 " +
+			"-a [gpu:0]/GPUGraphicsClockOffsetAllPerformanceLevels=100 " +
+			"-a [gpu:0]/GPUMemoryTransferRateOffsetAllPerformanceLevels=-500 " +
+			"-a [gpu:0]/GPUFanControlState=1 -a [fan:0]/GPUTargetFanSpeed=70 -a [fan:1]/GPUTargetFanSpeed=70 " +
+			"-a [gpu:1]/GPUGraphicsClockOffsetAllPerformanceLevels=100 " +
+			"-a [gpu:1]/GPUMemoryTransferRateOffsetAllPerformanceLevels=-500 " +
+			"-a [gpu:1]/GPUFanControlState=1 -a [fan:2]/GPUTargetFanSpeed=70 -a [fan:3]/GPUTargetFanSpeed=70",
+	}, invocations(require, logPath))
+
+	require.Nil(tool.Run("", map[string]interface{}{
+		"gpus": []interface{}{1},
+		"fan":  "auto",
+	}))
+	require.Equal([]string{
+		"nvidia-settings -a [gpu:1]/GPUFanControlState=0",
+	}, invocations(require, logPath))
+
+	// Everything that was changed is restored
+	require.Nil(tool.Revert("", map[string]interface{}{
+		"gpus":        []interface{}{0},
+		"power_limit": 150,
+		"core_offset": 100,
+		"fan":         70,
+	}))
+	require.Equal([]string{
+		"nvidia-smi -i 0 --query-gpu=power.default_limit --format=csv,noheader,nounits",
+		"nvidia-smi -i 0 -pl 180",
+		"nvidia-settings -a [gpu:0]/GPUGraphicsClockOffsetAllPerformanceLevels=0 -a [gpu:0]/GPUFanControlState=0",
+	}, invocations(require, logPath))
+
+	// Settings that were not confirmed are errors
+	os.Setenv("FAKE_NVIDIA_SILENT", "1")
+	err = tool.Run("", map[string]interface{}{
+		"gpus":        []interface{}{0},
+		"power_limit": 120.5,
+		"core_offset": 50,
+	})
+	require.NotNil(err)
+	require.Contains(err.Error(), "GPU 0: nvidia-smi did not confirm the power limit")
+	require.Contains(err.Error(), "did not confirm [gpu:0]/GPUGraphicsClockOffsetAllPerformanceLevels=50")
+}
+
+func TestParseNVIDIAArgs(t *testing.T) {
+	require := require.New(t)
+
+	args, err := ParseNVIDIAArgs(map[string]interface{}{
+		"gpus":        []interface{}{0, float64(2)},
+		"core_offset": "100",
+		"power_limit": 150,
+		"fan":         "auto",
+	})
+	require.Nil(err)
+	require.Equal([]int{0, 2}, args.GPUs)
+	require.Equal(150.0, *args.PowerLimit)
+	require.Equal(-1, *args.Fan)
+	require.Equal(100, *args.CoreOffset)
+	require.Nil(args.MemoryOffset)
+
+	for _, bad := range []map[string]interface{}{
+		{"powerlimit": 150},
+		{"power_limit": -1},
+		{"power_limit": "high"},
+		{"core_offset": 10.5},
+		{"fan": 101},
+		{"fan": "manual"},
+		{"gpus": "first"},
+		{"display": 0},
+		{"gpus": []interface{}{-1}},
+	} {
+		_, err := ParseNVIDIAArgs(bad)
+		require.NotNil(err, "%v", bad)
+	}
+}
@@ -4,21 +4,82 @@ import (
 	"fmt"
 	"os/exec"
 	"path/filepath"
-
-	"github.com/google/shlex"
+	"strconv"
+	"strings"
 )
 
+var overdriveNToolSchema = []*ArgSpec{
+	{Name: "gpu-id", Type: ARG_INT_LIST, Required: true, Description: "OverdriveNTool index of every GPU to apply the profile to"},
+	{Name: "profile", Type: ARG_STRING, Required: true, Description: "Name of the OverdriveNTool profile"},
+}
+
 type OverdriveNTool struct {
 }
 
-func (odnt *OverdriveNTool) Run(path string, args map[string]interface{}) error {
-	gpuID := args["gpu-id"]
-	profile := args["profile"]
-	cmdArgs, err := shlex.Split(fmt.Sprintf("-consoleonly -p%v%v", gpuID, profile))
-	if err != nil {
+func (odnt *OverdriveNTool) Schema() []*ArgSpec {
+	return overdriveNToolSchema
+}
+
+func (odnt *OverdriveNTool) Validate(args map[string]interface{}) error {
+	if err := ValidateArgs(overdriveNToolSchema, args); err != nil {
 		return err
 	}
+	gpuIDs, _ := toIntList(args["gpu-id"])
+	if len(gpuIDs) == 0 {
+		return fmt.Errorf("No GPU given in 'gpu-id'")
+	}
+	for _, gpuID := range gpuIDs {
+		if gpuID < 0 {
+			return fmt.Errorf("Invalid GPU index: %v", gpuID)
+		}
+	}
+	if strings.Compare(args["profile"].(string), "") == 0 {
+		return fmt.Errorf("Profile must not be empty")
+	}
+	return nil
+}
+
+// run runs OverdriveNTool with a flag for every GPU in gpuIDs. OverdriveNTool
+// does not tell which GPU failed, so a failure is reported for every one
+func (odnt *OverdriveNTool) run(path string, gpuIDs []int, flag func(gpuID int) string) error {
+	// One argument per flag so that profile names may contain spaces
+	cmdArgs := []string{"-consoleonly"}
+	for _, gpuID := range gpuIDs {
+		cmdArgs = append(cmdArgs, flag(gpuID))
+	}
 	cmd := exec.Command(path, cmdArgs...)
 	cmd.Dir = filepath.Dir(path)
-	return cmd.Run()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		err = fmt.Errorf("%v: %v", err, strings.TrimSpace(string(out)))
+		failures := make(GPUErrors, 0)
+		for _, gpuID := range gpuIDs {
+			failures = append(failures, &GPUError{strconv.Itoa(gpuID), err})
+		}
+		return failures
+	}
+	return nil
+}
+
+// Run applies the profile to every GPU in a single invocation of
+// OverdriveNTool, which takes a -p flag per GPU
+func (odnt *OverdriveNTool) Run(path string, args map[string]interface{}) error {
+	if err := odnt.Validate(args); err != nil {
+		return err
+	}
+	gpuIDs, _ := toIntList(args["gpu-id"])
+	return odnt.run(path, gpuIDs, func(gpuID int) string {
+		return fmt.Sprintf("-p%v%v", gpuID, args["profile"])
+	})
+}
+
+// Revert resets every GPU to its default settings with OverdriveNTool's -r
+// flag
+func (odnt *OverdriveNTool) Revert(path string, args map[string]interface{}) error {
+	if err := odnt.Validate(args); err != nil {
+		return err
+	}
+	gpuIDs, _ := toIntList(args["gpu-id"])
+	return odnt.run(path, gpuIDs, func(gpuID int) string {
+		return fmt.Sprintf("-r%v", gpuID)
+	})
 }
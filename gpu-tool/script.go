@@ -5,11 +5,38 @@ import (
 	"path/filepath"
 )
 
+var scriptSchema = []*ArgSpec{
+	{Name: "args", Type: ARG_STRING_LIST, Description: "Arguments passed to the script, e.g. [revert] as idle arguments"},
+}
+
+// ScriptTool runs a script to apply settings. Scripts are not expected to know
+// how to restore defaults, so their settings are only reverted by running them
+// with idle arguments
 type ScriptTool struct {
 }
 
+func (script *ScriptTool) Schema() []*ArgSpec {
+	return scriptSchema
+}
+
+func (script *ScriptTool) Validate(args map[string]interface{}) error {
+	return ValidateArgs(script.Schema(), args)
+}
+
 func (script *ScriptTool) Run(path string, args map[string]interface{}) error {
-	cmd := exec.Command(path)
+	if err := script.Validate(args); err != nil {
+		return err
+	}
+	var cmdArgs []string
+	if v, ok := args["args"]; ok {
+		cmdArgs, _ = toStringList(v)
+	}
+	cmd := exec.Command(path, cmdArgs...)
 	cmd.Dir = filepath.Dir(path)
 	return cmd.Run()
 }
+
+// Revert is not supported. Configure idle arguments instead
+func (script *ScriptTool) Revert(path string, args map[string]interface{}) error {
+	return ErrRevertUnsupported
+}
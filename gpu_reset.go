@@ -0,0 +1,257 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mineros "github.com/gurupras/go-cryptonight-miner/miner-os"
+	"github.com/gurupras/minerconfig/alert"
+	"github.com/gurupras/minerconfig/discovery"
+	gpureset "github.com/gurupras/minerconfig/gpu-reset"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+type ResetFailurePolicy string
+
+const (
+	// Start the miner without the threads of the devices that failed
+	RESET_SKIP_DEVICE ResetFailurePolicy = "SKIP_DEVICE"
+	// Don't start the miner
+	RESET_ABORT ResetFailurePolicy = "ABORT"
+	// Start the miner on every device. The webserver is alerted of failures
+	// regardless of the policy
+	RESET_ALERT ResetFailurePolicy = "ALERT"
+)
+
+// DeviceResetResult structure representing the outcome of resetting a GPU
+type DeviceResetResult struct {
+	Device   string `json:"device"`
+	Attempts int    `json:"attempts"`
+	// Whether the device was seen again after it was reset
+	Verified bool   `json:"verified"`
+	Error    string `json:"error"`
+}
+
+// GPUResetReport structure representing the GPUs of a rig that failed to reset
+type GPUResetReport struct {
+	Policy ResetFailurePolicy   `json:"policy"`
+	Failed []*DeviceResetResult `json:"failed"`
+}
+
+// ResetFailedError is returned by ResetMiner when GPUs failed to reset and the
+// miner must not be started
+type ResetFailedError struct {
+	Failed []*DeviceResetResult
+}
+
+func (e *ResetFailedError) Error() string {
+	devices := make([]string, 0)
+	for _, result := range e.Failed {
+		devices = append(devices, fmt.Sprintf("%v (%v)", result.Device, result.Error))
+	}
+	return fmt.Sprintf("Failed to reset GPUs: %v", strings.Join(devices, ", "))
+}
+
+// resetDevices resets devices with resetter, retrying the ones that fail up to
+// retries times. Devices that verify returns an error for are treated as
+// having failed. A nil verify skips verification
+func resetDevices(resetter gpureset.Resetter, devices []string, retries int, verify func(device string) error) []*DeviceResetResult {
+	results := make([]*DeviceResetResult, len(devices))
+	pending := make([]int, 0)
+	for idx, device := range devices {
+		results[idx] = &DeviceResetResult{Device: device}
+		pending = append(pending, idx)
+	}
+	for attempt := 0; attempt <= retries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			log.Warnf("Retrying reset of %d GPU(s) (attempt %d of %d)", len(pending), attempt+1, retries+1)
+		}
+		ids := make([]string, 0)
+		for _, idx := range pending {
+			ids = append(ids, devices[idx])
+		}
+		failed := make([]int, 0)
+		for i, r := range resetter.Reset(ids) {
+			result := results[pending[i]]
+			result.Attempts++
+			err := r.Err
+			if err == nil && verify != nil {
+				if err = verify(result.Device); err == nil {
+					result.Verified = true
+				}
+			}
+			if err != nil {
+				result.Error = err.Error()
+				failed = append(failed, pending[i])
+			} else {
+				result.Error = ""
+			}
+		}
+		pending = failed
+	}
+	return results
+}
+
+// failedResets returns the results that have an error
+func failedResets(results []*DeviceResetResult) []*DeviceResetResult {
+	ret := make([]*DeviceResetResult, 0)
+	for _, result := range results {
+		if strings.Compare(result.Error, "") != 0 {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// deviceTopology returns the PCI topology of a device given either as a PCI
+// address or as a device instance ID
+func deviceTopology(device string) (*pcie.Topology, error) {
+	if topology, err := pcie.ParseTopology(device); err == nil {
+		return topology, nil
+	}
+	return mineros.GetPCITopology(device)
+}
+
+// discoveryVerifier returns a function that checks that a device is among the
+// devices discovered by discoverer
+func discoveryVerifier(discoverer discovery.Discoverer) func(device string) error {
+	return func(device string) error {
+		topology, err := deviceTopology(device)
+		if err != nil {
+			return fmt.Errorf("Failed to get topology of '%v': %v", device, err)
+		}
+		if _, err := discovery.FindIndexMatchingTopology(discoverer, topology); err != nil {
+			return fmt.Errorf("Device %v is not listed after the reset: %v", topology, err)
+		}
+		return nil
+	}
+}
+
+// threadTopology returns the PCI topology of the GPU thread runs on, or nil if
+// it is not known. Threads given by OpenCL index are matched through gpus
+func threadTopology(config *Config, gpus []GPUInfo, thread *GPUThread) *pcie.Topology {
+	if thread.DeviceIndex != nil && *thread.DeviceIndex < len(config.DeviceInstanceIDs) {
+		topology, err := deviceTopology(config.DeviceInstanceIDs[*thread.DeviceIndex])
+		if err != nil {
+			return nil
+		}
+		return topology
+	}
+	if thread.Index != nil {
+		for _, gpu := range gpus {
+			if gpu.OpenCLIndex != nil && *gpu.OpenCLIndex == *thread.Index {
+				return gpu.Topology
+			}
+		}
+	}
+	return nil
+}
+
+// skipFailedThreads removes the threads of the devices in failed from config.
+// Threads given by OpenCL index are matched through gpus. It fails if no
+// threads would be left
+func skipFailedThreads(config *Config, gpus []GPUInfo, failed []*DeviceResetResult) error {
+	if len(config.Threads) == 0 {
+		return fmt.Errorf("Cannot skip devices without a list of threads")
+	}
+	failedIDs := make(map[string]bool)
+	failedTopologies := make([]*pcie.Topology, 0)
+	for _, result := range failed {
+		failedIDs[result.Device] = true
+		if topology, err := deviceTopology(result.Device); err == nil {
+			failedTopologies = append(failedTopologies, topology)
+		}
+	}
+	isFailed := func(topology *pcie.Topology) bool {
+		for _, t := range failedTopologies {
+			if topology != nil && *t == *topology {
+				return true
+			}
+		}
+		return false
+	}
+
+	threads := make([]GPUThread, 0)
+	for idx, thread := range config.Threads {
+		skip := isFailed(threadTopology(config, gpus, &thread))
+		if thread.DeviceIndex != nil && *thread.DeviceIndex < len(config.DeviceInstanceIDs) {
+			skip = skip || failedIDs[config.DeviceInstanceIDs[*thread.DeviceIndex]]
+		}
+		if skip {
+			log.Warnf("Skipping thread-%d: its GPU failed to reset", idx)
+			continue
+		}
+		threads = append(threads, thread)
+	}
+	if len(threads) == 0 {
+		return fmt.Errorf("Every thread runs on a GPU that failed to reset")
+	}
+	config.Threads = threads
+	return nil
+}
+
+// honorResetFailure reports GPUs that failed to reset to the webserver and
+// applies the configured failure policy to the miner config
+func (c *Client) honorResetFailure(failed []*DeviceResetResult) error {
+	policy := c.MinerConfig.Reset.OnFailure
+	if strings.Compare(string(policy), "") == 0 {
+		policy = RESET_ALERT
+	}
+	for _, result := range failed {
+		log.Errorf("Failed to reset GPU '%v' after %d attempt(s): %v", result.Device, result.Attempts, result.Error)
+	}
+	if c.WebsocketClient != nil {
+		b, err := json.Marshal(&GPUResetReport{policy, failed})
+		if err != nil {
+			log.Errorf("Failed to marshal GPU reset report: %v", err)
+		} else if err := c.Emit("gpu-reset-failed", string(b)); err != nil {
+			log.Errorf("Failed to report GPU reset failure: %v", err)
+		}
+	}
+
+	switch policy {
+	case RESET_SKIP_DEVICE:
+		if err := skipFailedThreads(c.MinerConfig, c.gpus, failed); err != nil {
+			log.Errorf("%v", err)
+			return &ResetFailedError{failed}
+		}
+	case RESET_ABORT:
+		return &ResetFailedError{failed}
+	case RESET_ALERT:
+	default:
+		return fmt.Errorf("Unknown GPU reset failure policy: '%v'", policy)
+	}
+	return nil
+}
+
+// handleGPUResetFailed records that a rig failed to reset some of its GPUs
+// and raises an alert
+func (s *Server) handleGPUResetFailed(w *websockets.WebsocketClient, data interface{}) {
+	rigID := s.RigID(w)
+	if strings.Compare(rigID, "") == 0 {
+		return
+	}
+	var report GPUResetReport
+	if err := decodeData(data, &report); err != nil {
+		log.Errorf("[gpu-reset-failed]: Failed to unmarshal report from rig '%v': %v", rigID, err)
+		return
+	}
+	devices := make([]string, 0)
+	for _, result := range report.Failed {
+		devices = append(devices, fmt.Sprintf("%v (%v)", result.Device, result.Error))
+	}
+	message := fmt.Sprintf("%d GPU(s) failed to reset, policy %v: %v", len(report.Failed), report.Policy, strings.Join(devices, ", "))
+	log.Warnf("[gpu-reset-failed]: Rig '%v': %v", rigID, message)
+	s.publishEvent("gpu-reset-failed", fmt.Sprintf("rig=%v %v", rigID, message))
+	if s.Alerter != nil {
+		s.Alerter.Raise(&alert.Alert{
+			Rule:    "gpu-reset",
+			Type:    alert.RULE_GPU_RESET,
+			Rig:     rigID,
+			Message: message,
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package minerconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gurupras/minerconfig/alert"
+	"github.com/gurupras/minerconfig/discovery"
+	gpureset "github.com/gurupras/minerconfig/gpu-reset"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyResetter fails to reset each device the given number of times
+type flakyResetter struct {
+	failures map[string]int
+	calls    [][]string
+}
+
+func (fr *flakyResetter) Reset(devices []string) []*gpureset.Result {
+	fr.calls = append(fr.calls, devices)
+	ret := make([]*gpureset.Result, 0)
+	for _, device := range devices {
+		result := &gpureset.Result{Device: device}
+		if fr.failures[device] > 0 {
+			fr.failures[device]--
+			result.Err = fmt.Errorf("device busy")
+		}
+		ret = append(ret, result)
+	}
+	return ret
+}
+
+func TestResetDevicesRetries(t *testing.T) {
+	require := require.New(t)
+
+	devices := []string{"0000:01:00.0", "0000:02:00.0", "0000:03:00.0"}
+	resetter := &flakyResetter{failures: map[string]int{
+		"0000:02:00.0": 1,
+		"0000:03:00.0": 5,
+	}}
+	results := resetDevices(resetter, devices, 2, nil)
+	require.Equal(3, len(results))
+	// Only failed devices are retried
+	require.Equal([][]string{
+		devices,
+		{"0000:02:00.0", "0000:03:00.0"},
+		{"0000:03:00.0"},
+	}, resetter.calls)
+
+	require.Equal(1, results[0].Attempts)
+	require.Equal("", results[0].Error)
+	require.Equal(2, results[1].Attempts)
+	require.Equal("", results[1].Error)
+	require.Equal(3, results[2].Attempts)
+	require.Equal("device busy", results[2].Error)
+
+	failed := failedResets(results)
+	require.Equal(1, len(failed))
+	require.Equal("0000:03:00.0", failed[0].Device)
+	require.Contains((&ResetFailedError{failed}).Error(), "0000:03:00.0 (device busy)")
+}
+
+func TestResetDevicesVerify(t *testing.T) {
+	require := require.New(t)
+
+	discoverer := &discovery.Fake{List: []*discovery.Device{
+		{Index: 0, Topology: &pcie.Topology{Bus: 1, Device: 0, Function: 0}},
+	}}
+	verify := discoveryVerifier(discoverer)
+	resetter := &flakyResetter{failures: map[string]int{}}
+	results := resetDevices(resetter, []string{"0000:01:00.0", "0000:02:00.0"}, 1, verify)
+	require.True(results[0].Verified)
+	require.Equal("", results[0].Error)
+	require.False(results[1].Verified)
+	require.Equal(2, results[1].Attempts)
+	require.Contains(results[1].Error, "not listed")
+
+	// The device shows up on the retry
+	discoverer.List = append(discoverer.List, &discovery.Device{Index: 1, Topology: &pcie.Topology{Bus: 2, Device: 0, Function: 0}})
+	results = resetDevices(resetter, []string{"0000:02:00.0"}, 1, verify)
+	require.True(results[0].Verified)
+	require.Equal(1, results[0].Attempts)
+}
+
+func TestResolveThreadIndices(t *testing.T) {
+	require := require.New(t)
+
+	discoverer := &discovery.Fake{List: []*discovery.Device{
+		{Index: 3, Topology: &pcie.Topology{Bus: 1}},
+	}}
+	config := &Config{}
+	config.DeviceInstanceIDs = []string{"0000:01:00.0", "0000:02:00.0"}
+	config.Threads = []GPUThread{{DeviceIndex: intPtr(0)}}
+	require.Nil(resolveThreadIndices(config, discoverer))
+	require.Equal(3, *config.Threads[0].Index)
+
+	// Threads that cannot be resolved are errors rather than fatal
+	for _, thread := range []GPUThread{{}, {DeviceIndex: intPtr(1)}, {DeviceIndex: intPtr(2)}} {
+		config.Threads = []GPUThread{thread}
+		require.NotNil(resolveThreadIndices(config, discoverer))
+	}
+}
+
+func TestSkipFailedThreads(t *testing.T) {
+	require := require.New(t)
+
+	intPtr := func(i int) *int {
+		return &i
+	}
+	config := &Config{}
+	config.DeviceInstanceIDs = []string{"0000:01:00.0", "0000:02:00.0"}
+	config.Threads = []GPUThread{
+		{DeviceIndex: intPtr(0)},
+		{DeviceIndex: intPtr(1)},
+		{Index: intPtr(0)},
+		{Index: intPtr(1)},
+	}
+	gpus := []GPUInfo{
+		{OpenCLIndex: intPtr(0), Topology: &pcie.Topology{Bus: 2, Device: 0, Function: 0}},
+		{OpenCLIndex: intPtr(1), Topology: &pcie.Topology{Bus: 1, Device: 0, Function: 0}},
+	}
+	failed := []*DeviceResetResult{{Device: "0000:02:00.0", Error: "device busy"}}
+	require.Nil(skipFailedThreads(config, gpus, failed))
+	require.Equal(2, len(config.Threads))
+	require.Equal(0, *config.Threads[0].DeviceIndex)
+	require.Equal(1, *config.Threads[1].Index)
+
+	// Nothing would be left to mine with
+	failed = append(failed, &DeviceResetResult{Device: "0000:01:00.0", Error: "device busy"})
+	require.NotNil(skipFailedThreads(config, gpus, failed))
+	require.Equal(2, len(config.Threads))
+
+	require.NotNil(skipFailedThreads(&Config{}, gpus, failed))
+}
+
+func TestHonorResetFailure(t *testing.T) {
+	require := require.New(t)
+
+	intPtr := func(i int) *int {
+		return &i
+	}
+	failed := []*DeviceResetResult{{Device: "0000:02:00.0", Attempts: 1, Error: "device busy"}}
+	newClient := func(policy ResetFailurePolicy) *Client {
+		c := &Client{}
+		c.MinerConfig = &Config{}
+		c.MinerConfig.Reset = &Reset{OnFailure: policy}
+		c.MinerConfig.DeviceInstanceIDs = []string{"0000:01:00.0", "0000:02:00.0"}
+		c.MinerConfig.Threads = []GPUThread{
+			{DeviceIndex: intPtr(0)},
+			{DeviceIndex: intPtr(1)},
+		}
+		return c
+	}
+
+	c := newClient("")
+	require.Nil(c.honorResetFailure(failed))
+	require.Equal(2, len(c.MinerConfig.Threads))
+
+	c = newClient(RESET_SKIP_DEVICE)
+	require.Nil(c.honorResetFailure(failed))
+	require.Equal(1, len(c.MinerConfig.Threads))
+
+	c = newClient(RESET_ABORT)
+	err := c.honorResetFailure(failed)
+	_, ok := err.(*ResetFailedError)
+	require.True(ok)
+
+	c = newClient("BOGUS")
+	require.NotNil(c.honorResetFailure(failed))
+}
+
+func TestAlerterRaise(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-gpu-reset")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Alerts:        &AlertConfig{},
+	})
+	require.Nil(err)
+	notifier := &recordingNotifier{}
+	server.Alerter.Notifiers = []alert.Notifier{notifier}
+
+	server.Alerter.Raise(&alert.Alert{Rule: "gpu-reset", Type: alert.RULE_GPU_RESET, Rig: "rig1"})
+	require.Equal(1, len(notifier.alerts))
+	require.False(notifier.alerts[0].Time.IsZero())
+	require.Equal(0, len(server.Alerter.Active()))
+}
@@ -0,0 +1,84 @@
+package minerconfig
+
+import (
+	"fmt"
+
+	gputool "github.com/gurupras/minerconfig/gpu-tool"
+	log "github.com/sirupsen/logrus"
+)
+
+// applyGPUTool runs the gpu-tool of conf. What is applied is recorded in the
+// client state before the tool runs so that it is reverted even if the client
+// crashes in the meantime
+func (c *Client) applyGPUTool(conf *GPUTool) error {
+	tool, err := gputool.ParseGPUTool(conf.Type)
+	if err != nil {
+		return err
+	}
+	applied := &GPUTool{}
+	*applied = *conf
+	c.stateMutex.Lock()
+	c.state.GPUTool = applied
+	err = c.saveState()
+	c.stateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return tool.Run(conf.Path, conf.Args)
+}
+
+// RevertGPUTool reverts the GPU settings last applied by the gpu-tool, if
+// any, by applying its idle arguments or by restoring the defaults. The record
+// is kept if reverting fails so that it is tried again, unless the tool cannot
+// restore defaults at all
+func (c *Client) RevertGPUTool() error {
+	c.stateMutex.Lock()
+	applied := c.state.GPUTool
+	c.stateMutex.Unlock()
+	if applied == nil {
+		return nil
+	}
+	tool, err := gputool.ParseGPUTool(applied.Type)
+	if err != nil {
+		return err
+	}
+	if applied.IdleArgs != nil {
+		log.Infof("Applying idle GPU settings")
+		err = tool.Run(applied.Path, applied.IdleArgs)
+	} else {
+		log.Infof("Restoring default GPU settings")
+		err = tool.Revert(applied.Path, applied.Args)
+		if err == gputool.ErrRevertUnsupported {
+			log.Warnf("gpu-tool %v cannot restore default GPU settings. Configure idle_args to revert them", applied.Type)
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to revert GPU settings: %v", err)
+	}
+
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	c.state.GPUTool = nil
+	return c.saveState()
+}
+
+// Shutdown stops the miner and reverts GPU settings before the client exits
+func (c *Client) Shutdown() error {
+	clientLogHook.remove(c.logs)
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	return c.idle()
+}
+
+// idle stops the miner, if it is running, and reverts GPU settings. Must be
+// called with minerMutex held
+func (c *Client) idle() error {
+	if c.miner != nil {
+		if err := c.stopMiner(); err != nil {
+			return fmt.Errorf("Failed to stop miner: %v", err)
+		}
+		return nil
+	}
+	return c.RevertGPUTool()
+}
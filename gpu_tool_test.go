@@ -0,0 +1,85 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	gputool "github.com/gurupras/minerconfig/gpu-tool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevertGPUTool(t *testing.T) {
+	require := require.New(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake gpu-tool is a shell script")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-gpu-tool")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "invocations.log")
+	scriptPath := filepath.Join(dir, "overclock.sh")
+	script := "#!/bin/sh\necho run \"$@\" >> " + logPath + "\n"
+	require.Nil(ioutil.WriteFile(scriptPath, []byte(script), 0755))
+	invocations := func() []string {
+		b, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			return []string{}
+		}
+		os.Remove(logPath)
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+
+	newClient := func() *Client {
+		c := &Client{}
+		c.ClientConfig = &ClientConfig{}
+		c.StatePath = filepath.Join(dir, "client.state")
+		require.Nil(c.LoadState())
+		return c
+	}
+
+	// Nothing was applied
+	c := newClient()
+	require.Nil(c.RevertGPUTool())
+	require.Equal([]string{}, invocations())
+
+	conf := &GPUTool{Type: gputool.GPU_TOOL_SCRIPT, Path: scriptPath}
+	conf.IdleArgs = map[string]interface{}{"args": []interface{}{"revert"}}
+	require.Nil(c.applyGPUTool(conf))
+	require.Equal([]string{"run"}, invocations())
+
+	// The client crashed. The restarted client still knows what to revert
+	c = newClient()
+	require.NotNil(c.state.GPUTool)
+	require.Nil(c.RevertGPUTool())
+	require.Equal([]string{"run revert"}, invocations())
+	require.Nil(c.RevertGPUTool())
+	require.Equal([]string{}, invocations())
+	require.Nil(newClient().state.GPUTool)
+
+	require.Nil(c.applyGPUTool(conf))
+	require.Nil(c.Shutdown())
+	require.Equal([]string{"run", "run revert"}, invocations())
+
+	// Scripts cannot restore defaults without idle arguments. Nothing is run
+	// and nothing is left to retry
+	conf.IdleArgs = nil
+	require.Nil(c.applyGPUTool(conf))
+	invocations()
+	require.Nil(c.RevertGPUTool())
+	require.Equal([]string{}, invocations())
+	require.Nil(newClient().state.GPUTool)
+
+	// Failed reverts are tried again
+	conf.IdleArgs = map[string]interface{}{"args": []interface{}{"revert"}}
+	require.Nil(c.applyGPUTool(conf))
+	invocations()
+	require.Nil(os.Remove(scriptPath))
+	require.NotNil(c.RevertGPUTool())
+	require.NotNil(newClient().state.GPUTool)
+}
@@ -0,0 +1,36 @@
+package minerconfig
+
+import (
+	"time"
+
+	"github.com/gurupras/minerconfig/sensors"
+)
+
+// updateSensors reads every sensor, keeps the readings for status reports and
+// applies the thermal policy to them
+func (c *Client) updateSensors(readers []sensors.Reader) []*sensors.Reading {
+	readings := sensors.ReadAll(readers)
+	c.sensorsMutex.Lock()
+	c.readings = readings
+	c.sensorsMutex.Unlock()
+	if c.thermal != nil {
+		c.protect(readings)
+	}
+	return readings
+}
+
+// monitorSensors periodically reads the sensors of every GPU
+func (c *Client) monitorSensors(readers []sensors.Reader) {
+	interval := time.Duration(c.Sensors.IntervalSeconds()) * time.Second
+	for {
+		c.updateSensors(readers)
+		time.Sleep(interval)
+	}
+}
+
+// Readings returns the latest sensor readings of every GPU
+func (c *Client) Readings() []*sensors.Reading {
+	c.sensorsMutex.Lock()
+	defer c.sensorsMutex.Unlock()
+	return c.readings
+}
@@ -0,0 +1,232 @@
+package minerconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// SelectionRequest structure representing a request concerning the selected
+// pools of a rig, of a group if Rig is empty, or the farm-wide selection if
+// both are empty
+type SelectionRequest struct {
+	Rig   string `json:"rig"`
+	Group string `json:"group"`
+	// rollback-selected-pools: version to restore
+	Version int `json:"version"`
+	// preview-selected-pools: the proposed selection
+	// update-group-selected-pools: the new selection. Nil removes the
+	// selection of the group
+	Pools []interface{} `json:"pools"`
+}
+
+// isGroup returns whether the request concerns the selection of a group
+func (sr *SelectionRequest) isGroup() bool {
+	return strings.Compare(sr.Rig, "") == 0 && strings.Compare(sr.Group, "") != 0
+}
+
+// SelectionHistory structure representing the versions of a selection
+type SelectionHistory struct {
+	Rig      string              `json:"rig"`
+	Group    string              `json:"group"`
+	Versions []*SelectionVersion `json:"versions"`
+	Error    string              `json:"error"`
+}
+
+// SelectionPreview structure representing what would change if a proposed
+// selection were applied
+type SelectionPreview struct {
+	Rig      string   `json:"rig"`
+	Current  []string `json:"current"`
+	Proposed []string `json:"proposed"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	// Registered rigs that would switch to the proposed selection
+	Rigs []string `json:"rigs"`
+}
+
+// PreviewSelection returns what would change if proposed became the
+// selection of rig
+func (s *Server) PreviewSelection(rig string, proposed []interface{}) *SelectionPreview {
+	preview := &SelectionPreview{}
+	preview.Rig = rig
+	preview.Current = poolURLs(s.Store.SelectedPools(rig))
+	preview.Proposed = poolURLs(proposed)
+	preview.Added = difference(preview.Proposed, preview.Current)
+	preview.Removed = difference(preview.Current, preview.Proposed)
+	preview.Rigs = make([]string, 0)
+	if strings.Compare(rig, "") != 0 {
+		preview.Rigs = append(preview.Rigs, rig)
+	} else {
+		for rigID, rigInfo := range s.Rigs() {
+			// Rigs with a selection of their own or of their group are
+			// unaffected
+			if s.Store.UsesFarmSelection(rigID, rigInfo.Group) {
+				preview.Rigs = append(preview.Rigs, rigID)
+			}
+		}
+		sort.Strings(preview.Rigs)
+	}
+	return preview
+}
+
+// difference returns the entries of a that are not in b
+func difference(a []string, b []string) []string {
+	inB := make(map[string]bool)
+	for _, entry := range b {
+		inB[entry] = true
+	}
+	ret := make([]string, 0)
+	for _, entry := range a {
+		if !inB[entry] {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// PushSelection sends the current selection of rig to the clients using it.
+// An empty rig refers to the farm-wide selection
+func (s *Server) PushSelection(rig string) {
+	if strings.Compare(rig, "") == 0 {
+		s.BroadcastSelectedPools()
+	} else {
+		s.PushSelectedPools(rig)
+	}
+}
+
+// RollbackFarmSelection restores version of the farm-wide selection on behalf
+// of actor. Like any other farm-wide change, it is tried on canaries first if
+// staged rollouts are enabled
+func (s *Server) RollbackFarmSelection(actor string, version int) (bool, error) {
+	history, err := s.Store.History("")
+	if err != nil {
+		return false, err
+	}
+	v := findVersion(history, version)
+	if v == nil {
+		return false, fmt.Errorf("No version %d of the farm-wide selected pools", version)
+	}
+	return s.SetFarmSelectedPools(actor, v.Pools, fmt.Sprintf("Rolled back to version %d", version))
+}
+
+// handleGetSelectionHistory sends the versions of the requested selection
+func (s *Server) handleGetSelectionHistory(w *websockets.WebsocketClient, data interface{}) {
+	var request SelectionRequest
+	if data != nil {
+		if err := decodeData(data, &request); err != nil {
+			log.Errorf("[get-selected-pools-history]: Failed to unmarshal: %v", err)
+			w.Emit("error", fmt.Sprintf("Invalid get-selected-pools-history request: %v", err))
+			return
+		}
+	}
+	history := &SelectionHistory{}
+	history.Rig = request.Rig
+	var versions []*SelectionVersion
+	var err error
+	if request.isGroup() {
+		history.Group = request.Group
+		versions, err = s.Store.GroupHistory(request.Group)
+	} else {
+		versions, err = s.Store.History(request.Rig)
+	}
+	if err != nil {
+		history.Error = err.Error()
+	} else {
+		history.Versions = versions
+	}
+	w.Emit("get-selected-pools-history-result", jsonData(history))
+}
+
+// handleRollbackSelectedPools restores a previous version of a selection and
+// pushes it to the affected rigs
+func (s *Server) handleRollbackSelectedPools(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("rollback-selected-pools", fmt.Sprintf("clientaddr=%v request=%v", w.RemoteAddr(), data))
+	var request SelectionRequest
+	if err := decodeData(data, &request); err != nil {
+		log.Errorf("[rollback-selected-pools]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid rollback-selected-pools request: %v", err))
+		return
+	}
+	if request.isGroup() {
+		if err := s.Store.RollbackGroup(request.Group, request.Version); err != nil {
+			log.Errorf("[rollback-selected-pools]: %v", err)
+			w.Emit("error", err.Error())
+			return
+		}
+		log.Infof("[rollback-selected-pools]: Rolled back the selected pools of group '%v' to version %d", request.Group, request.Version)
+		s.auditGroupSelection(clientAddr(w), request.Group, fmt.Sprintf("Rolled back to version %d", request.Version))
+		s.PushGroupSelectedPools(request.Group)
+		w.Emit("rollback-selected-pools-result", jsonData(&request))
+		return
+	}
+	if strings.Compare(request.Rig, "") == 0 {
+		started, err := s.RollbackFarmSelection(clientAddr(w), request.Version)
+		if err != nil {
+			log.Errorf("[rollback-selected-pools]: %v", err)
+			w.Emit("error", err.Error())
+			return
+		}
+		if started {
+			log.Infof("[rollback-selected-pools]: Trying version %d of the farm-wide selected pools on canaries", request.Version)
+			w.Emit("get-rollout-result", jsonData(s.Rollout.Current()))
+		} else {
+			log.Infof("[rollback-selected-pools]: Rolled back the farm-wide selected pools to version %d", request.Version)
+		}
+		w.Emit("rollback-selected-pools-result", jsonData(&request))
+		return
+	}
+	if err := s.Store.Rollback(request.Rig, request.Version); err != nil {
+		log.Errorf("[rollback-selected-pools]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	log.Infof("[rollback-selected-pools]: Rolled back the selected pools of '%v' to version %d", request.Rig, request.Version)
+	s.auditSelection(clientAddr(w), request.Rig, fmt.Sprintf("Rolled back to version %d", request.Version))
+	s.PushSelection(request.Rig)
+	w.Emit("rollback-selected-pools-result", jsonData(&request))
+}
+
+// handlePreviewSelectedPools sends what would change if the proposed
+// selection were applied, without applying it
+func (s *Server) handlePreviewSelectedPools(w *websockets.WebsocketClient, data interface{}) {
+	var request SelectionRequest
+	if err := decodeData(data, &request); err != nil {
+		log.Errorf("[preview-selected-pools]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid preview-selected-pools request: %v", err))
+		return
+	}
+	w.Emit("preview-selected-pools-result", jsonData(s.PreviewSelection(request.Rig, request.Pools)))
+}
+
+// handleUpdateGroupSelectedPools sets or removes the selection of a group and
+// pushes it to the rigs of the group
+func (s *Server) handleUpdateGroupSelectedPools(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("update-group-selected-pools", fmt.Sprintf("clientaddr=%v request=%v", w.RemoteAddr(), data))
+	var request SelectionRequest
+	if err := decodeData(data, &request); err != nil {
+		log.Errorf("[update-group-selected-pools]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid update-group-selected-pools request: %v", err))
+		return
+	}
+	var err error
+	var message string
+	if request.Pools == nil {
+		err = s.Store.RemoveGroupSelectedPools(request.Group)
+		message = "Removed the selection of the group"
+	} else {
+		err = s.Store.SetGroupSelectedPools(request.Group, request.Pools)
+		message = fmt.Sprintf("Selected %d pools", len(request.Pools))
+	}
+	if err != nil {
+		log.Errorf("[update-group-selected-pools]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	s.auditGroupSelection(clientAddr(w), request.Group, message)
+	s.PushGroupSelectedPools(request.Group)
+	w.Emit("update-group-selected-pools-result", jsonData(&request))
+}
@@ -0,0 +1,108 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectionHistory(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// A selection made before history was kept
+	poolsDir := filepath.Join(dir, "pools")
+	require.Nil(os.MkdirAll(poolsDir, 0777))
+	require.Nil(ioutil.WriteFile(filepath.Join(poolsDir, "selected-pools"), []byte(`[{"url": "a"}]`), 0666))
+
+	store := NewPoolStore(poolsDir)
+	require.Nil(store.SetSelectedPools("", []interface{}{map[string]interface{}{"url": "b"}}))
+	require.Nil(store.SetSelectedPools("", []interface{}{map[string]interface{}{"url": "c"}}))
+
+	history, err := store.History("")
+	require.Nil(err)
+	require.Equal(3, len(history))
+	require.Equal(1, history[0].Version)
+	require.Equal([]string{"a"}, poolURLs(history[0].Pools))
+	require.Equal([]string{"c"}, poolURLs(history[2].Pools))
+
+	// Rolling back creates a new version
+	require.Nil(store.Rollback("", 1))
+	require.Equal([]string{"a"}, poolURLs(store.SelectedPools("")))
+	history, err = store.History("")
+	require.Nil(err)
+	require.Equal(4, len(history))
+	require.NotNil(store.Rollback("", 42))
+
+	// Falling back to the farm-wide selection is a version too, both before
+	// a rig's first selection and after its selection is removed
+	require.Nil(store.SetSelectedPools("rig1", []interface{}{map[string]interface{}{"url": "d"}}))
+	require.Nil(store.RemoveRigSelectedPools("rig1"))
+	history, err = store.History("rig1")
+	require.Nil(err)
+	require.Equal(3, len(history))
+	require.Nil(history[0].Pools)
+	require.Nil(store.Rollback("rig1", 2))
+	require.Equal([]string{"d"}, poolURLs(store.SelectedPools("rig1")))
+	require.Nil(store.Rollback("rig1", 1))
+	require.False(store.HasRigSelectedPools("rig1"))
+	require.Equal([]string{"a"}, poolURLs(store.SelectedPools("rig1")))
+
+	// Groups have a history of their own. Rigs fall back to their group
+	require.Nil(store.SetGroupSelectedPools("gpu-farm", []interface{}{map[string]interface{}{"url": "f"}}))
+	require.Equal([]string{"f"}, poolURLs(store.RigSelectedPools("rig1", "gpu-farm")))
+	require.Equal([]string{"a"}, poolURLs(store.RigSelectedPools("rig1", "")))
+	require.False(store.UsesFarmSelection("rig1", "gpu-farm"))
+	require.Nil(store.RemoveGroupSelectedPools("gpu-farm"))
+	history, err = store.GroupHistory("gpu-farm")
+	require.Nil(err)
+	require.Equal(3, len(history))
+	require.Nil(store.RollbackGroup("gpu-farm", 2))
+	require.True(store.HasGroupSelectedPools("gpu-farm"))
+	require.NotNil(store.SetGroupSelectedPools("../group", nil))
+
+	// History survives restarts and is trimmed
+	store = NewPoolStore(poolsDir)
+	store.MaxHistory = 2
+	require.Nil(store.SetSelectedPools("", []interface{}{map[string]interface{}{"url": "e"}}))
+	history, err = store.History("")
+	require.Nil(err)
+	require.Equal(2, len(history))
+	require.Equal(5, history[1].Version)
+	require.Equal([]string{"f"}, poolURLs(store.RigSelectedPools("rig2", "gpu-farm")))
+
+	_, err = store.History("../rig")
+	require.NotNil(err)
+}
+
+func TestPreviewSelection(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-history")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	require.Nil(server.Store.SetSelectedPools("", []interface{}{
+		map[string]interface{}{"url": "a"},
+		map[string]interface{}{"url": "b"},
+	}))
+
+	preview := server.PreviewSelection("", []interface{}{
+		map[string]interface{}{"url": "b"},
+		map[string]interface{}{"url": "c"},
+	})
+	require.Equal([]string{"a", "b"}, preview.Current)
+	require.Equal([]string{"c"}, preview.Added)
+	require.Equal([]string{"a"}, preview.Removed)
+
+	// Nothing was applied
+	require.Equal([]string{"a", "b"}, poolURLs(server.Store.SelectedPools("")))
+}
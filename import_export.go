@@ -0,0 +1,435 @@
+package minerconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type PoolFormat string
+
+const (
+	FORMAT_JSON     PoolFormat = "json"
+	FORMAT_YAML     PoolFormat = "yaml"
+	FORMAT_XMR_STAK PoolFormat = "xmr-stak"
+	FORMAT_XMRIG    PoolFormat = "xmrig"
+)
+
+// Largest import accepted over HTTP
+const maxImportSize = 1 << 20
+
+var (
+	blockCommentRegexp  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	lineCommentRegexp   = regexp.MustCompile(`(?m)^\s*//.*$`)
+	trailingCommaRegexp = regexp.MustCompile(`,(\s*[\]}])`)
+)
+
+// ImportResult structure representing the outcome of an import. Nothing is
+// imported if any pool is invalid
+type ImportResult struct {
+	DryRun  bool           `json:"dry_run"`
+	Added   int            `json:"added"`
+	Updated int            `json:"updated"`
+	Skipped int            `json:"skipped"`
+	Invalid int            `json:"invalid"`
+	Entries []*ImportEntry `json:"entries"`
+}
+
+// xmrStakPool structure representing an entry of the pool_list of xmr-stak's
+// pools.txt
+type xmrStakPool struct {
+	PoolAddress    string `json:"pool_address"`
+	WalletAddress  string `json:"wallet_address"`
+	RigID          string `json:"rig_id"`
+	PoolPassword   string `json:"pool_password"`
+	UseNicehash    bool   `json:"use_nicehash"`
+	UseTLS         bool   `json:"use_tls"`
+	TLSFingerprint string `json:"tls_fingerprint"`
+	PoolWeight     int    `json:"pool_weight"`
+}
+
+// xmrigPool structure representing an entry of the pools array of xmrig's
+// config.json
+type xmrigPool struct {
+	Url       string      `json:"url"`
+	User      string      `json:"user"`
+	Pass      string      `json:"pass"`
+	Keepalive interface{} `json:"keepalive"`
+	Nicehash  bool        `json:"nicehash"`
+	Algo      string      `json:"algo,omitempty"`
+}
+
+// poolMap converts pool into the form pools are kept in by the store,
+// leaving out unset optional fields
+func poolMap(pool *Pool) (map[string]interface{}, error) {
+	var ret map[string]interface{}
+	if err := decodeData(pool, &ret); err != nil {
+		return nil, err
+	}
+	for k, v := range ret {
+		if v == nil {
+			delete(ret, k)
+		}
+	}
+	return ret, nil
+}
+
+func poolMaps(pools []Pool) ([]map[string]interface{}, error) {
+	ret := make([]map[string]interface{}, 0)
+	for idx := range pools {
+		pool, err := poolMap(&pools[idx])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pool)
+	}
+	return ret, nil
+}
+
+// ParsePools parses the pools in b. JSON, YAML and xmrig input may be a
+// single pool, a list of pools or an object with a "pools" list
+func ParsePools(format PoolFormat, b []byte) ([]map[string]interface{}, error) {
+	switch format {
+	case FORMAT_JSON:
+		var pools []map[string]interface{}
+		if err := json.Unmarshal(b, &pools); err == nil {
+			return pools, nil
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, fmt.Errorf("Failed to parse JSON pools: %v", err)
+		}
+		if _, ok := obj["pools"]; !ok {
+			return []map[string]interface{}{obj}, nil
+		}
+		var wrapper struct {
+			Pools []map[string]interface{} `json:"pools"`
+		}
+		if err := json.Unmarshal(b, &wrapper); err != nil {
+			return nil, fmt.Errorf("Failed to parse JSON pools: %v", err)
+		}
+		return wrapper.Pools, nil
+	case FORMAT_YAML:
+		var pools []Pool
+		if err := yaml.Unmarshal(b, &pools); err == nil {
+			return poolMaps(pools)
+		}
+		var wrapper struct {
+			Pools []Pool `yaml:"pools"`
+		}
+		if err := yaml.Unmarshal(b, &wrapper); err != nil {
+			return nil, fmt.Errorf("Failed to parse YAML pools: %v", err)
+		}
+		if wrapper.Pools == nil {
+			var pool Pool
+			if err := yaml.Unmarshal(b, &pool); err != nil {
+				return nil, fmt.Errorf("Failed to parse YAML pools: %v", err)
+			}
+			wrapper.Pools = []Pool{pool}
+		}
+		return poolMaps(wrapper.Pools)
+	case FORMAT_XMRIG:
+		var entries []xmrigPool
+		// Pools without an algorithm of their own use the one of the config
+		defaultAlgo := ""
+		if err := json.Unmarshal(b, &entries); err != nil {
+			var wrapper struct {
+				Algo  string      `json:"algo"`
+				Pools []xmrigPool `json:"pools"`
+			}
+			if err := json.Unmarshal(b, &wrapper); err != nil {
+				return nil, fmt.Errorf("Failed to parse xmrig pools: %v", err)
+			}
+			entries = wrapper.Pools
+			defaultAlgo = wrapper.Algo
+		}
+		pools := make([]Pool, 0)
+		for _, entry := range entries {
+			pool := Pool{}
+			pool.Url = entry.Url
+			pool.User = entry.User
+			pool.Pass = entry.Pass
+			pool.Nicehash = entry.Nicehash
+			pool.Algorithm = entry.Algo
+			if strings.Compare(pool.Algorithm, "") == 0 {
+				pool.Algorithm = defaultAlgo
+			}
+			// xmrig accepts either a boolean or a keepalive interval
+			switch keepalive := entry.Keepalive.(type) {
+			case bool:
+				pool.Keepalive = keepalive
+			case float64:
+				pool.Keepalive = keepalive > 0
+			}
+			pools = append(pools, pool)
+		}
+		return poolMaps(pools)
+	case FORMAT_XMR_STAK:
+		// pools.txt is the inside of a JSON object with comments and
+		// trailing commas
+		b = blockCommentRegexp.ReplaceAll(b, nil)
+		b = lineCommentRegexp.ReplaceAll(b, nil)
+		b = bytes.TrimSpace(b)
+		b = bytes.TrimSuffix(b, []byte(","))
+		b = append(append([]byte("{"), b...), '}')
+		b = trailingCommaRegexp.ReplaceAll(b, []byte("$1"))
+		var config struct {
+			PoolList []xmrStakPool `json:"pool_list"`
+			Currency string        `json:"currency"`
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return nil, fmt.Errorf("Failed to parse xmr-stak pools: %v", err)
+		}
+		pools := make([]Pool, 0)
+		for _, entry := range config.PoolList {
+			pool := Pool{}
+			pool.Url = entry.PoolAddress
+			pool.User = entry.WalletAddress
+			pool.Pass = entry.PoolPassword
+			pool.Nicehash = entry.UseNicehash
+			// xmr-stak picks its algorithm by currency
+			pool.Algorithm = config.Currency
+			if strings.Compare(config.Currency, "") != 0 {
+				coin := config.Currency
+				pool.Coin = &coin
+			}
+			pools = append(pools, pool)
+		}
+		return poolMaps(pools)
+	default:
+		return nil, fmt.Errorf("Unknown pool format: '%v'", format)
+	}
+}
+
+// FormatPools writes pools in format. Also returns the content type of the
+// output
+func FormatPools(format PoolFormat, rawPools []interface{}) ([]byte, string, error) {
+	var pools []Pool
+	if err := decodeData(rawPools, &pools); err != nil {
+		return nil, "", fmt.Errorf("Failed to decode pools: %v", err)
+	}
+	switch format {
+	case FORMAT_JSON:
+		b, err := json.MarshalIndent(map[string]interface{}{"pools": rawPools}, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to marshal pools: %v", err)
+		}
+		return b, "application/json", nil
+	case FORMAT_YAML:
+		wrapper := struct {
+			Pools []Pool `yaml:"pools"`
+		}{pools}
+		b, err := yaml.Marshal(&wrapper)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to marshal pools: %v", err)
+		}
+		return b, "application/x-yaml", nil
+	case FORMAT_XMRIG:
+		entries := make([]xmrigPool, 0)
+		for _, pool := range pools {
+			entries = append(entries, xmrigPool{pool.Url, pool.User, pool.Pass, pool.Keepalive, pool.Nicehash, pool.Algorithm})
+		}
+		b, err := json.MarshalIndent(map[string]interface{}{"pools": entries}, "", "    ")
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to marshal pools: %v", err)
+		}
+		return b, "application/json", nil
+	case FORMAT_XMR_STAK:
+		var buf bytes.Buffer
+		buf.WriteString("\"pool_list\" :\n[\n")
+		for idx, pool := range pools {
+			entry := xmrStakPool{}
+			entry.PoolAddress = pool.Url
+			entry.WalletAddress = pool.User
+			entry.PoolPassword = pool.Pass
+			entry.UseNicehash = pool.Nicehash
+			// Earlier pools are preferred
+			entry.PoolWeight = len(pools) - idx
+			b, err := json.Marshal(&entry)
+			if err != nil {
+				return nil, "", fmt.Errorf("Failed to marshal pools: %v", err)
+			}
+			buf.WriteString("\t")
+			buf.Write(b)
+			buf.WriteString(",\n")
+		}
+		buf.WriteString("],\n")
+		currency := "monero"
+		if len(pools) > 0 && pools[0].Coin != nil {
+			currency = *pools[0].Coin
+		}
+		buf.WriteString(fmt.Sprintf("\"currency\" : %v,\n", strconv.Quote(currency)))
+		return buf.Bytes(), "text/plain", nil
+	default:
+		return nil, "", fmt.Errorf("Unknown pool format: '%v'", format)
+	}
+}
+
+// ValidatePool checks that pool has everything a miner needs
+func (s *Server) ValidatePool(pool map[string]interface{}) error {
+	var p Pool
+	if err := decodeData(pool, &p); err != nil {
+		return fmt.Errorf("Invalid pool: %v", err)
+	}
+	if strings.Compare(p.Url, "") == 0 {
+		return fmt.Errorf("Pool must have 'url' key")
+	}
+	// The user of pools referencing a wallet is filled in by the server
+	if strings.Compare(p.User, "") == 0 && p.Wallet == nil {
+		return fmt.Errorf("Pool must have 'user' or 'wallet' key")
+	}
+	if strings.Compare(p.Pass, "") == 0 {
+		return fmt.Errorf("Pool must have 'pass' key")
+	}
+	return s.Wallets.CheckPool(pool)
+}
+
+// ImportPools validates pools and adds them to the store on behalf of actor.
+// Either every pool is imported or, if any of them is invalid, none are.
+// source describes where the pools came from in the audit log
+func (s *Server) ImportPools(actor string, source string, pools []map[string]interface{}, dryRun bool) (*ImportResult, error) {
+	result := &ImportResult{DryRun: dryRun}
+	invalid := make(map[int]error)
+	for idx, pool := range pools {
+		if err := s.ValidatePool(pool); err != nil {
+			invalid[idx] = err
+		}
+	}
+	// Report what would have happened to the valid pools either way
+	entries, err := s.Store.ImportPools(pools, dryRun || len(invalid) > 0)
+	if err != nil {
+		return nil, err
+	}
+	for idx, err := range invalid {
+		entries[idx].Action = IMPORT_INVALID
+		entries[idx].Reason = err.Error()
+	}
+	result.Entries = entries
+	for _, entry := range entries {
+		switch entry.Action {
+		case IMPORT_ADD:
+			result.Added++
+		case IMPORT_UPDATE:
+			result.Updated++
+		case IMPORT_SKIP:
+			result.Skipped++
+		case IMPORT_INVALID:
+			result.Invalid++
+		}
+	}
+	if dryRun || result.Invalid > 0 || result.Added+result.Updated == 0 {
+		return result, nil
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_IMPORT_POOLS,
+		Actor:   actor,
+		Message: fmt.Sprintf("Imported %d new and %d updated pools from %v", result.Added, result.Updated, source),
+		Details: entries,
+	})
+	s.broadcast("get-available-pools-result", s.Store.Pools())
+	return result, nil
+}
+
+// handleAddPools adds a batch of pools given as a JSON list or an object with
+// a "pools" list, and sends the submitter what happened to every pool
+func (s *Server) handleAddPools(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("add-pools", fmt.Sprintf("clientaddr=%v", w.RemoteAddr()))
+	var b []byte
+	switch data.(type) {
+	case string:
+		b = []byte(data.(string))
+	default:
+		var err error
+		if b, err = json.Marshal(data); err != nil {
+			log.Errorf("[add-pools]: Failed to marshal: %v", err)
+			w.Emit("error", fmt.Sprintf("Invalid add-pools request: %v", err))
+			return
+		}
+	}
+	pools, err := ParsePools(FORMAT_JSON, b)
+	if err != nil {
+		log.Errorf("[add-pools]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	result, err := s.ImportPools(clientAddr(w), "add-pools", pools, false)
+	if err != nil {
+		log.Errorf("[add-pools]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	w.Emit("add-pools-result", jsonData(result))
+}
+
+// handleExportHTTP writes the available pools, or the pools selected for a
+// rig if selected is set, in the requested format
+func (s *Server) handleExportHTTP(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	format := PoolFormat(params.Get("format"))
+	if strings.Compare(string(format), "") == 0 {
+		format = FORMAT_JSON
+	}
+	pools := s.Store.Pools()
+	if strings.Compare(params.Get("selected"), "") != 0 {
+		pools, _ = s.rigSelection(params.Get("rig"))
+	}
+	b, contentType, err := FormatPools(format, pools)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(b); err != nil {
+		log.Errorf("Failed to write export response: %v", err)
+	}
+}
+
+// handleImportHTTP adds the pools in the request body to the store. With
+// dry_run set, only reports what would be added, updated or skipped. Responds
+// with 422 and imports nothing if any pool is invalid
+func (s *Server) handleImportHTTP(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	format := PoolFormat(params.Get("format"))
+	if strings.Compare(string(format), "") == 0 {
+		format = FORMAT_JSON
+	}
+	dryRun := false
+	if v := params.Get("dry_run"); strings.Compare(v, "") != 0 {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dry_run: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	pools, err := ParsePools(format, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.ImportPools(req.RemoteAddr, string(format), pools, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if result.Invalid > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("Failed to write import response: %v", err)
+	}
+}
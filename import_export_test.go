@@ -0,0 +1,230 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/homesound/simple-websockets"
+	"github.com/stretchr/testify/require"
+)
+
+const testXmrStakPools = `/*
+ * pool_address    - Pool address should be entered as "pool_address:port" (e.g. "pool.example.com:3333").
+ */
+"pool_list" :
+[
+	{"pool_address" : "pool.minexmr.com:5555", "wallet_address" : "4abc.rig1", "rig_id" : "", "pool_password" : "x", "use_nicehash" : false, "use_tls" : false, "tls_fingerprint" : "", "pool_weight" : 2 },
+	// {"pool_address" : "commented.out:3333", "wallet_address" : "", "rig_id" : "", "pool_password" : "", "use_nicehash" : false, "use_tls" : false, "tls_fingerprint" : "", "pool_weight" : 1 },
+	{"pool_address" : "xmr.nanopool.org:14444", "wallet_address" : "4abc.rig1", "rig_id" : "", "pool_password" : "x", "use_nicehash" : true, "use_tls" : false, "tls_fingerprint" : "", "pool_weight" : 1 },
+],
+
+/*
+ * Currency to mine.
+ */
+"currency" : "monero7",
+`
+
+func TestParsePools(t *testing.T) {
+	require := require.New(t)
+
+	pools, err := ParsePools(FORMAT_JSON, []byte(`{"url": "a", "user": "u", "custom": 1}`))
+	require.Nil(err)
+	require.Equal(1, len(pools))
+	require.Equal(float64(1), pools[0]["custom"])
+
+	pools, err = ParsePools(FORMAT_JSON, []byte(`{"pools": [{"url": "a"}, {"url": "b"}]}`))
+	require.Nil(err)
+	require.Equal(2, len(pools))
+
+	pools, err = ParsePools(FORMAT_YAML, []byte("pools:\n  - url: a\n    user: u\n    nicehash: true\n"))
+	require.Nil(err)
+	require.Equal("a", pools[0]["url"])
+	require.Equal(true, pools[0]["nicehash"])
+	_, ok := pools[0]["coin"]
+	require.False(ok)
+
+	pools, err = ParsePools(FORMAT_XMRIG, []byte(`{"algo": "cryptonight", "pools": [{"url": "a", "user": "u", "pass": "x", "keepalive": 60, "algo": "cn/1"}]}`))
+	require.Nil(err)
+	require.Equal(true, pools[0]["keepalive"])
+	require.Equal("cn/1", pools[0]["algorithm"])
+
+	pools, err = ParsePools(FORMAT_XMR_STAK, []byte(testXmrStakPools))
+	require.Nil(err)
+	require.Equal(2, len(pools))
+	require.Equal("pool.minexmr.com:5555", pools[0]["url"])
+	require.Equal(true, pools[1]["nicehash"])
+	require.Equal("monero7", pools[1]["coin"])
+
+	_, err = ParsePools(FORMAT_JSON, []byte(`[`))
+	require.NotNil(err)
+	_, err = ParsePools("bogus", []byte(`[]`))
+	require.NotNil(err)
+}
+
+func TestFormatPools(t *testing.T) {
+	require := require.New(t)
+
+	pools := []interface{}{
+		map[string]interface{}{"url": "a", "user": "u", "pass": "x", "coin": "monero7"},
+		map[string]interface{}{"url": "b", "user": "u", "pass": "x", "nicehash": true},
+	}
+	for _, format := range []PoolFormat{FORMAT_JSON, FORMAT_YAML, FORMAT_XMRIG, FORMAT_XMR_STAK} {
+		b, _, err := FormatPools(format, pools)
+		require.Nil(err)
+		// What is exported can be imported again
+		parsed, err := ParsePools(format, b)
+		require.Nil(err, "%v: %v", format, string(b))
+		require.Equal(2, len(parsed))
+		require.Equal("b", parsed[1]["url"])
+		require.Equal(true, parsed[1]["nicehash"])
+	}
+	_, _, err := FormatPools("bogus", pools)
+	require.NotNil(err)
+}
+
+func TestImportPools(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-import")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := NewPoolStore(dir)
+	_, err = store.AddPool([]byte(`{"url": "a", "user": "u", "pass": "x"}`))
+	require.Nil(err)
+
+	pools := []map[string]interface{}{
+		{"url": "a", "user": "u", "pass": "x"},
+		{"url": "a", "user": "u2", "pass": "x"},
+		{"url": "b", "user": "u", "pass": "x"},
+		{"url": "b", "user": "u", "pass": "y"},
+		{"user": "u"},
+	}
+	entries, err := store.ImportPools(pools, true)
+	require.Nil(err)
+	require.Equal(IMPORT_SKIP, entries[0].Action)
+	require.Equal(IMPORT_ADD, entries[1].Action)
+	require.Equal(IMPORT_ADD, entries[2].Action)
+	require.Equal(IMPORT_SKIP, entries[3].Action)
+	require.Equal(IMPORT_SKIP, entries[4].Action)
+	// Dry runs change nothing
+	require.Equal(1, len(store.Pools()))
+
+	_, err = store.ImportPools(pools, false)
+	require.Nil(err)
+	require.Equal(3, len(store.Pools()))
+
+	entries, err = store.ImportPools([]map[string]interface{}{{"url": "a", "user": "u", "pass": "z"}}, false)
+	require.Nil(err)
+	require.Equal(IMPORT_UPDATE, entries[0].Action)
+
+	// Updates replace the persisted pool
+	store = NewPoolStore(dir)
+	require.Equal(3, len(store.Pools()))
+	for _, rawPool := range store.Pools() {
+		pool := rawPool.(map[string]interface{})
+		if pool["url"] == "a" && pool["user"] == "u" {
+			require.Equal("z", pool["pass"])
+		}
+	}
+}
+
+func TestImportExportHTTP(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-import")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+
+	req := httptest.NewRequest("POST", "/api/pools/import?format=xmr-stak&dry_run=true", strings.NewReader(testXmrStakPools))
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	var result ImportResult
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &result))
+	require.True(result.DryRun)
+	require.Equal(2, result.Added)
+	require.Equal(0, len(server.Store.Pools()))
+
+	req = httptest.NewRequest("POST", "/api/pools/import?format=xmr-stak", strings.NewReader(testXmrStakPools))
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(2, len(server.Store.Pools()))
+
+	req = httptest.NewRequest("GET", "/api/pools/export?format=yaml", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	require.Contains(w.Body.String(), "pool.minexmr.com:5555")
+
+	req = httptest.NewRequest("POST", "/api/pools/import?format=json", strings.NewReader(`[{"url": "c", "pass": "x", "algorithm": "cryptonight", "wallet": "missing"}, {"url": "d", "user": "u", "pass": "x", "algorithm": "cryptonight"}]`))
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusUnprocessableEntity, w.Code)
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(IMPORT_INVALID, result.Entries[0].Action)
+	require.Contains(result.Entries[0].Reason, "missing")
+	require.Equal(IMPORT_ADD, result.Entries[1].Action)
+	require.Equal(2, len(server.Store.Pools()))
+
+	// Rigs export the pools of their group
+	require.Nil(server.Store.SetGroupSelectedPools("gpu", []interface{}{map[string]interface{}{"url": "group-pool:3333"}}))
+	server.associateRig(&websockets.WebsocketClient{}, &RigInfo{RigID: "rig1", Group: "gpu"})
+	req = httptest.NewRequest("GET", "/api/pools/export?format=json&selected=true&rig=rig1", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	require.Contains(w.Body.String(), "group-pool:3333")
+
+	req = httptest.NewRequest("GET", "/api/pools/export?format=bogus", nil)
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServerImportPools(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-import")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+
+	valid := map[string]interface{}{"url": "a", "user": "u", "pass": "x", "algorithm": "cryptonight"}
+	require.Nil(server.ValidatePool(valid))
+	require.NotNil(server.ValidatePool(map[string]interface{}{"url": "a", "user": "u"}))
+	require.NotNil(server.ValidatePool(map[string]interface{}{"url": "a", "pass": "x", "algorithm": "cryptonight"}))
+	require.NotNil(server.ValidatePool(map[string]interface{}{"url": 5}))
+
+	// One bad pool keeps the whole batch out
+	result, err := server.ImportPools("10.0.0.5:40000", "add-pools", []map[string]interface{}{
+		valid,
+		{"url": "b", "user": "u", "algorithm": "cryptonight"},
+	}, false)
+	require.Nil(err)
+	require.Equal(1, result.Invalid)
+	require.Equal(1, result.Added)
+	require.Equal(IMPORT_INVALID, result.Entries[1].Action)
+	require.Equal(0, len(server.Store.Pools()))
+
+	result, err = server.ImportPools("10.0.0.5:40000", "add-pools", []map[string]interface{}{valid, valid}, false)
+	require.Nil(err)
+	require.Equal(1, result.Added)
+	require.Equal(1, result.Skipped)
+	require.Equal(1, len(server.Store.Pools()))
+
+	entries, err := server.Audit.Query(&AuditQuery{Events: []string{AUDIT_IMPORT_POOLS}})
+	require.Nil(err)
+	require.Equal(1, len(entries))
+}
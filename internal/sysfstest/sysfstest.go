@@ -0,0 +1,86 @@
+// Package sysfstest builds fake sysfs trees for tests of the packages that
+// read or write sysfs
+package sysfstest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+// PCI class of VGA compatible display controllers
+const CLASS_VGA = "0x030000"
+
+// Sysfs is a sysfs tree in a temporary directory
+type Sysfs struct {
+	Root    string
+	require *require.Assertions
+	cards   int
+}
+
+// New creates an empty sysfs tree. Remove it once the test is done
+func New(require *require.Assertions) *Sysfs {
+	root, err := ioutil.TempDir(os.TempDir(), "minerconfig-sysfs")
+	require.Nil(err)
+	return &Sysfs{Root: root, require: require}
+}
+
+// Remove deletes the tree
+func (s *Sysfs) Remove() {
+	os.RemoveAll(s.Root)
+}
+
+// Path returns the path of elem in the tree
+func (s *Sysfs) Path(elem ...string) string {
+	return filepath.Join(append([]string{s.Root}, elem...)...)
+}
+
+// WriteFiles creates every file of files, relative to dir, along with its
+// parent directories
+func (s *Sysfs) WriteFiles(dir string, files map[string]string) {
+	for file, content := range files {
+		path := filepath.Join(dir, file)
+		s.require.Nil(os.MkdirAll(filepath.Dir(path), 0777))
+		s.require.Nil(ioutil.WriteFile(path, []byte(content), 0666))
+	}
+}
+
+// AddDriver creates the PCI driver named driver, with its bind and unbind
+// files, and returns its path
+func (s *Sysfs) AddDriver(driver string) string {
+	driverPath := s.Path("bus", "pci", "drivers", driver)
+	s.WriteFiles(driverPath, map[string]string{"bind": "", "unbind": ""})
+	return driverPath
+}
+
+// AddPCIDevice creates the PCI device at address and returns its path. The
+// device is bound to driver unless driver is empty
+func (s *Sysfs) AddPCIDevice(address, class, vendor, device, driver string) string {
+	devicePath := s.Path("bus", "pci", "devices", address)
+	s.WriteFiles(devicePath, map[string]string{
+		"class":  class + "\n",
+		"vendor": vendor + "\n",
+		"device": device + "\n",
+	})
+	if strings.Compare(driver, "") != 0 {
+		s.require.Nil(os.Symlink(s.AddDriver(driver), filepath.Join(devicePath, "driver")))
+	}
+	return devicePath
+}
+
+// AddCard creates the next DRM card, at address and driven by driver, and
+// returns the paths of its device and hwmon directories
+func (s *Sysfs) AddCard(address, driver string) (string, string) {
+	devicePath := s.Path("class", "drm", fmt.Sprintf("card%d", s.cards), "device")
+	hwmonPath := filepath.Join(devicePath, "hwmon", fmt.Sprintf("hwmon%d", s.cards))
+	s.require.Nil(os.MkdirAll(hwmonPath, 0777))
+	s.WriteFiles(devicePath, map[string]string{
+		"uevent": fmt.Sprintf("DRIVER=%v\nPCI_SLOT_NAME=%v\n", driver, address),
+	})
+	s.cards++
+	return devicePath, hwmonPath
+}
@@ -0,0 +1,342 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/gurupras/minerconfig/discovery"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRigTimeout = 30
+
+// RigInfo structure representing the information a client registers itself
+// with
+type RigInfo struct {
+	RigID string `json:"rig_id" yaml:"rig_id"`
+	Group string `json:"group" yaml:"group"`
+	// Hashrate (H/s) of the rig for every algorithm it can mine
+	Hashrates   map[string]float64 `json:"hashrates" yaml:"hashrates"`
+	Version     string             `json:"version" yaml:"version"`
+	Hostname    string             `json:"hostname" yaml:"hostname"`
+	OS          string             `json:"os" yaml:"os"`
+	Arch        string             `json:"arch" yaml:"arch"`
+	MinerBinary string             `json:"miner_binary" yaml:"miner_binary"`
+	GPUs        []GPUInfo          `json:"gpus" yaml:"gpus"`
+}
+
+// GPUInfo structure representing a GPU of a rig. GPUs are known either by
+// their device instance ID, their OpenCL index, or both when their PCI
+// topologies match.
+type GPUInfo struct {
+	DeviceInstanceID string         `json:"device_instance_id" yaml:"device_instance_id"`
+	OpenCLIndex      *int           `json:"opencl_index" yaml:"opencl_index"`
+	Name             string         `json:"name" yaml:"name"`
+	Topology         *pcie.Topology `json:"topology" yaml:"topology"`
+}
+
+// Heartbeat structure representing the periodic keepalive sent by clients
+type Heartbeat struct {
+	// ID of the rig sending the heartbeat. Used to recognize the connection of
+	// a rig that was marked offline
+	Rig string `json:"rig"`
+	// URL of the pool the miner was started with
+	Pool   string `json:"pool"`
+	Mining bool   `json:"mining"`
+	Paused bool   `json:"paused"`
+}
+
+// Rig structure representing a rig known to the webserver
+type Rig struct {
+	RigInfo
+	Heartbeat
+	// Latest status report, if the rig sent any
+	Status    *StatusReport `json:"status"`
+	Address   string        `json:"address"`
+	Online    bool          `json:"online"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+// RigInventory keeps track of every rig that ever registered with the
+// webserver and whether it is still sending heartbeats
+type RigInventory struct {
+	sync.Mutex
+	// Rigs not heard from in this long are marked offline
+	Timeout time.Duration
+	// Clock used for heartbeats. Defaults to time.Now
+	Now  func() time.Time
+	path string
+	rigs map[string]*Rig
+}
+
+// NewRigInventory creates a RigInventory persisted at path
+func NewRigInventory(path string, timeout time.Duration) *RigInventory {
+	ri := &RigInventory{}
+	ri.Timeout = timeout
+	ri.Now = time.Now
+	ri.path = path
+	ri.rigs = make(map[string]*Rig)
+	if easyfiles.Exists(path) {
+		if b, err := ioutil.ReadFile(path); err != nil {
+			log.Errorf("Failed to read rig inventory '%v': %v", path, err)
+		} else if err := json.Unmarshal(b, &ri.rigs); err != nil {
+			log.Errorf("Failed to unmarshal rig inventory '%v': %v", path, err)
+		}
+	}
+	// Nobody is connected until they say so
+	for _, rig := range ri.rigs {
+		rig.Online = false
+	}
+	return ri
+}
+
+// save persists the inventory. Must be called with the lock held
+func (ri *RigInventory) save() {
+	b, err := json.Marshal(ri.rigs)
+	if err != nil {
+		log.Errorf("Failed to marshal rig inventory: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(ri.path, b, 0666); err != nil {
+		log.Errorf("Failed to write rig inventory: %v", err)
+	}
+}
+
+// Register records a rig that registered from address
+func (ri *RigInventory) Register(info *RigInfo, address string) {
+	ri.Lock()
+	defer ri.Unlock()
+	now := ri.Now()
+	rig, ok := ri.rigs[info.RigID]
+	if !ok {
+		rig = &Rig{}
+		rig.FirstSeen = now
+		ri.rigs[info.RigID] = rig
+	}
+	rig.RigInfo = *info
+	rig.Address = address
+	rig.Online = true
+	rig.LastSeen = now
+	ri.save()
+}
+
+// Heartbeat records a heartbeat of rig. Heartbeats of unknown rigs are ignored
+func (ri *RigInventory) Heartbeat(rigID string, heartbeat *Heartbeat) {
+	ri.Lock()
+	defer ri.Unlock()
+	rig, ok := ri.rigs[rigID]
+	if !ok {
+		return
+	}
+	if !rig.Online {
+		log.Infof("Rig '%v' is back online", rigID)
+	}
+	rig.Heartbeat = *heartbeat
+	rig.Online = true
+	rig.LastSeen = ri.Now()
+}
+
+// ReportStatus records a status report of rig. Reports of unknown rigs are
+// ignored
+func (ri *RigInventory) ReportStatus(rigID string, report *StatusReport) {
+	ri.Lock()
+	defer ri.Unlock()
+	rig, ok := ri.rigs[rigID]
+	if !ok {
+		return
+	}
+	rig.Heartbeat = report.Heartbeat
+	rig.Status = report
+	rig.Online = true
+	rig.LastSeen = ri.Now()
+}
+
+// Sweep marks rigs that stopped sending heartbeats offline and returns their
+// IDs
+func (ri *RigInventory) Sweep() []string {
+	ri.Lock()
+	defer ri.Unlock()
+	now := ri.Now()
+	ret := make([]string, 0)
+	for rigID, rig := range ri.rigs {
+		if rig.Online && now.Sub(rig.LastSeen) > ri.Timeout {
+			log.Warnf("Rig '%v' went offline. Last seen %v", rigID, rig.LastSeen)
+			rig.Online = false
+			rig.Mining = false
+			ret = append(ret, rigID)
+		}
+	}
+	if len(ret) > 0 {
+		ri.save()
+	}
+	return ret
+}
+
+// Get returns a copy of rig, or nil if it is unknown
+func (ri *RigInventory) Get(rigID string) *Rig {
+	ri.Lock()
+	defer ri.Unlock()
+	rig, ok := ri.rigs[rigID]
+	if !ok {
+		return nil
+	}
+	ret := &Rig{}
+	*ret = *rig
+	return ret
+}
+
+// Rigs returns copies of all known rigs sorted by ID
+func (ri *RigInventory) Rigs() []*Rig {
+	ri.Lock()
+	defer ri.Unlock()
+	ret := make([]*Rig, 0)
+	for _, rig := range ri.rigs {
+		r := &Rig{}
+		*r = *rig
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.Compare(ret[i].RigID, ret[j].RigID) < 0
+	})
+	return ret
+}
+
+// Remove forgets about rig
+func (ri *RigInventory) Remove(rigID string) {
+	ri.Lock()
+	defer ri.Unlock()
+	delete(ri.rigs, rigID)
+	ri.save()
+}
+
+// GPUs returns the GPUs of this rig. Device instance IDs are matched to
+// discovered devices by PCI topology, and any remaining devices are listed on
+// their own.
+func (c *Client) GPUs() []GPUInfo {
+	ret := make([]GPUInfo, 0)
+	devices, err := c.Discoverer.Devices()
+	if err != nil {
+		log.Warnf("Failed to discover GPUs: %v", err)
+	}
+	matched := make(map[*discovery.Device]bool)
+	for _, instanceID := range c.MinerConfig.DeviceInstanceIDs {
+		gpu := GPUInfo{DeviceInstanceID: instanceID}
+		topology, err := deviceTopology(instanceID)
+		if err != nil {
+			log.Debugf("Failed to get topology for device instance ID '%v': %v", instanceID, err)
+		} else {
+			gpu.Topology = topology
+			for _, device := range devices {
+				if device.Topology != nil && *device.Topology == *topology {
+					index := device.Index
+					gpu.OpenCLIndex = &index
+					gpu.Name = device.Name
+					matched[device] = true
+					break
+				}
+			}
+		}
+		ret = append(ret, gpu)
+	}
+	for _, device := range devices {
+		if matched[device] {
+			continue
+		}
+		index := device.Index
+		ret = append(ret, GPUInfo{
+			OpenCLIndex: &index,
+			Name:        device.Name,
+			Topology:    device.Topology,
+		})
+	}
+	return ret
+}
+
+// heartbeat returns the current heartbeat of this client
+func (c *Client) heartbeat() *Heartbeat {
+	heartbeat := &Heartbeat{}
+	heartbeat.Rig = c.RigID
+	heartbeat.Paused = c.Paused()
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	if c.miner != nil {
+		heartbeat.Mining = true
+		if len(c.MinerConfig.Pools) > 0 {
+			heartbeat.Pool = c.MinerConfig.Pools[0].Url
+		}
+	}
+	return heartbeat
+}
+
+// handleKeepalive records the heartbeat of a registered rig
+func (s *Server) handleKeepalive(w *websockets.WebsocketClient, data interface{}) {
+	var heartbeat Heartbeat
+	if err := decodeData(data, &heartbeat); err != nil {
+		log.Errorf("[keepalive]: Failed to unmarshal heartbeat from '%v': %v", clientAddr(w), err)
+		return
+	}
+	rigID := s.heartbeatRigID(w, &heartbeat)
+	if strings.Compare(rigID, "") == 0 {
+		return
+	}
+	s.Inventory.Heartbeat(rigID, &heartbeat)
+}
+
+// heartbeatRigID returns the ID of the rig that sent heartbeat over client.
+// Connections that were forgotten are associated with the rig again if the
+// rig is known
+func (s *Server) heartbeatRigID(client *websockets.WebsocketClient, heartbeat *Heartbeat) string {
+	if rigID := s.RigID(client); strings.Compare(rigID, "") != 0 {
+		return rigID
+	}
+	if strings.Compare(heartbeat.Rig, "") == 0 {
+		return ""
+	}
+	rig := s.Inventory.Get(heartbeat.Rig)
+	if rig == nil {
+		return ""
+	}
+	log.Infof("Rig '%v' re-associated with its connection", heartbeat.Rig)
+	s.associateRig(client, &rig.RigInfo)
+	return heartbeat.Rig
+}
+
+// sweepRigs marks rigs that stopped sending heartbeats offline. Their
+// connections are kept since they are forgotten once they disconnect
+func (s *Server) sweepRigs() {
+	s.Inventory.Sweep()
+}
+
+// handleGetRigs sends the rig inventory to the requester
+func (s *Server) handleGetRigs(w *websockets.WebsocketClient, data interface{}) {
+	w.Emit("get-rigs-result", jsonData(s.Inventory.Rigs()))
+}
+
+// registerRig associates client with rigInfo, replacing any previous
+// connection of the same rig
+func (s *Server) registerRig(client *websockets.WebsocketClient, rigInfo *RigInfo) {
+	s.associateRig(client, rigInfo)
+	s.Inventory.Register(rigInfo, fmt.Sprintf("%v", client.RemoteAddr()))
+}
+
+// associateRig associates client with rigInfo, replacing any previous
+// connection of the same rig
+func (s *Server) associateRig(client *websockets.WebsocketClient, rigInfo *RigInfo) {
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	for other, otherInfo := range s.rigs {
+		if other != client && strings.Compare(otherInfo.RigID, rigInfo.RigID) == 0 {
+			delete(s.rigs, other)
+		}
+	}
+	s.rigs[client] = rigInfo
+}
@@ -0,0 +1,136 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/homesound/simple-websockets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRigInventory(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-inventory")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rigs.json")
+
+	now := time.Unix(1500000000, 0)
+	inventory := NewRigInventory(path, 30*time.Second)
+	inventory.Now = func() time.Time {
+		return now
+	}
+
+	index := 0
+	inventory.Register(&RigInfo{
+		RigID:   "rig1",
+		Version: "dev",
+		OS:      "linux",
+		GPUs:    []GPUInfo{{OpenCLIndex: &index, Name: "Ellesmere"}},
+	}, "10.0.0.2:51234")
+	inventory.Register(&RigInfo{RigID: "rig2"}, "10.0.0.3:51234")
+
+	// Heartbeats of rigs that never registered are ignored
+	inventory.Heartbeat("unknown", &Heartbeat{Mining: true})
+	require.Nil(inventory.Get("unknown"))
+
+	now = now.Add(20 * time.Second)
+	inventory.Heartbeat("rig1", &Heartbeat{Pool: "pool.minexmr.com:5555", Mining: true})
+	require.Equal(0, len(inventory.Sweep()))
+
+	// rig2 has been quiet for too long
+	now = now.Add(20 * time.Second)
+	require.Equal([]string{"rig2"}, inventory.Sweep())
+	rigs := inventory.Rigs()
+	require.Equal(2, len(rigs))
+	require.Equal("rig1", rigs[0].RigID)
+	require.True(rigs[0].Online)
+	require.Equal("pool.minexmr.com:5555", rigs[0].Pool)
+	require.Equal("Ellesmere", rigs[0].GPUs[0].Name)
+	require.False(rigs[1].Online)
+
+	// Offline rigs are only reported once
+	require.Equal(0, len(inventory.Sweep()))
+
+	// A heartbeat brings it back
+	inventory.Heartbeat("rig2", &Heartbeat{})
+	require.True(inventory.Get("rig2").Online)
+
+	// Rigs are remembered across restarts, but offline until they reconnect
+	reloaded := NewRigInventory(path, 30*time.Second)
+	rigs = reloaded.Rigs()
+	require.Equal(2, len(rigs))
+	require.False(rigs[0].Online)
+	require.Equal("10.0.0.2:51234", rigs[0].Address)
+	require.Equal("linux", rigs[0].OS)
+}
+
+func TestSweepConnections(t *testing.T) {
+	require := require.New(t)
+
+	s := &Server{}
+	s.ServerConfig = &ServerConfig{RigTimeout: 30}
+	s.rigs = make(map[*websockets.WebsocketClient]*RigInfo)
+	live := &websockets.WebsocketClient{}
+	dead := &websockets.WebsocketClient{}
+	s.rigs[live] = &RigInfo{RigID: "rig1"}
+	s.rigs[dead] = &RigInfo{RigID: "rig2"}
+
+	logID, _ := s.logSubscribers.add("rig1", dead)
+	commandID := s.minerCommands.add(dead, "rig1")
+
+	now := time.Now()
+	s.connections.seen(dead, now.Add(-time.Minute))
+	s.connections.seen(live, now)
+	require.Equal(2, s.connections.count())
+	s.sweepConnections(now)
+	require.Equal(1, s.connections.count())
+	// Nothing is kept for connections that are gone
+	require.Equal(0, len(s.logSubscribers.recipients(&LogBatch{Rig: "rig1", ID: logID})))
+	require.Equal(0, len(s.logSubscribers.recipients(&LogBatch{Rig: "rig1"})))
+	require.Nil(s.minerCommands.remove(commandID, ""))
+	require.Equal("rig1", s.RigID(live))
+	require.Equal("", s.RigID(dead))
+	require.Equal(1, len(s.RigClients("rig1")))
+	require.Equal(0, len(s.RigClients("rig2")))
+}
+
+func TestRigReconnect(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-inventory")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	now := time.Unix(1500000000, 0)
+	server.Inventory.Now = func() time.Time {
+		return now
+	}
+	client := &websockets.WebsocketClient{}
+	rigInfo := &RigInfo{RigID: "rig1"}
+	server.associateRig(client, rigInfo)
+	server.Inventory.Register(rigInfo, "10.0.0.2:51234")
+
+	// Rigs that time out keep their connection
+	now = now.Add(time.Hour)
+	server.sweepRigs()
+	require.False(server.Inventory.Get("rig1").Online)
+	require.Equal("rig1", server.RigID(client))
+	server.handleKeepalive(client, `{"rig": "rig1", "mining": true}`)
+	require.True(server.Inventory.Get("rig1").Online)
+
+	// Forgotten connections are associated again by their heartbeats
+	server.disconnected(client)
+	require.Equal("", server.RigID(client))
+	server.handleKeepalive(client, `{"rig": "unknown"}`)
+	require.Equal("", server.RigID(client))
+	server.handleStatusReport(client, `{"rig": "rig1", "mining": false}`)
+	require.Equal("rig1", server.RigID(client))
+	require.False(server.Inventory.Get("rig1").Mining)
+}
@@ -0,0 +1,473 @@
+package minerconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogBufferLines = 1000
+	defaultLogRateLimit   = 50
+	defaultLogBacklog     = 100
+	// Lines longer than this are split
+	maxLogLineLength  = 4096
+	logStreamInterval = 500 * time.Millisecond
+)
+
+// LogLine structure representing a single line of miner or client output
+type LogLine struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Either "miner" or "client"
+	Source string `json:"source"`
+	Text   string `json:"text"`
+}
+
+// LogBuffer is a bounded ring buffer of LogLines. Once full, the oldest lines
+// are overwritten.
+type LogBuffer struct {
+	sync.Mutex
+	lines   []LogLine
+	start   int
+	count   int
+	nextSeq uint64
+}
+
+// NewLogBuffer creates a LogBuffer holding up to capacity lines
+func NewLogBuffer(capacity int) *LogBuffer {
+	if capacity <= 0 {
+		capacity = defaultLogBufferLines
+	}
+	lb := &LogBuffer{}
+	lb.lines = make([]LogLine, capacity)
+	lb.nextSeq = 1
+	return lb
+}
+
+// Append adds a line of text from source
+func (lb *LogBuffer) Append(source string, text string) {
+	lb.Lock()
+	defer lb.Unlock()
+	line := LogLine{lb.nextSeq, time.Now(), source, text}
+	lb.nextSeq++
+	if lb.count < len(lb.lines) {
+		lb.lines[(lb.start+lb.count)%len(lb.lines)] = line
+		lb.count++
+	} else {
+		lb.lines[lb.start] = line
+		lb.start = (lb.start + 1) % len(lb.lines)
+	}
+}
+
+// Last returns up to the last n lines
+func (lb *LogBuffer) Last(n int) []LogLine {
+	lb.Lock()
+	defer lb.Unlock()
+	if n > lb.count {
+		n = lb.count
+	}
+	ret := make([]LogLine, n)
+	for idx := 0; idx < n; idx++ {
+		ret[idx] = lb.lines[(lb.start+lb.count-n+idx)%len(lb.lines)]
+	}
+	return ret
+}
+
+// Since returns the lines after seq along with the number of lines after seq
+// that were already overwritten
+func (lb *LogBuffer) Since(seq uint64) ([]LogLine, uint64) {
+	lb.Lock()
+	defer lb.Unlock()
+	ret := make([]LogLine, 0)
+	var missed uint64
+	if lb.count > 0 {
+		oldest := lb.lines[lb.start].Seq
+		if seq+1 < oldest {
+			missed = oldest - seq - 1
+		}
+	}
+	for idx := 0; idx < lb.count; idx++ {
+		line := lb.lines[(lb.start+idx)%len(lb.lines)]
+		if line.Seq > seq {
+			ret = append(ret, line)
+		}
+	}
+	return ret, missed
+}
+
+// LastSeq returns the sequence number of the most recent line
+func (lb *LogBuffer) LastSeq() uint64 {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.nextSeq - 1
+}
+
+// logWriter is an io.Writer that splits whatever is written to it into lines
+// and appends them to a LogBuffer
+type logWriter struct {
+	sync.Mutex
+	buffer  *LogBuffer
+	source  string
+	partial bytes.Buffer
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.Lock()
+	defer lw.Unlock()
+	for _, b := range p {
+		if b == '\n' {
+			lw.buffer.Append(lw.source, strings.TrimRight(lw.partial.String(), "\r"))
+			lw.partial.Reset()
+			continue
+		}
+		lw.partial.WriteByte(b)
+		if lw.partial.Len() >= maxLogLineLength {
+			lw.buffer.Append(lw.source, lw.partial.String())
+			lw.partial.Reset()
+		}
+	}
+	return len(p), nil
+}
+
+// logHook is a logrus hook that copies the client's own log messages into
+// the LogBuffers of every client. logrus hooks cannot be removed, so the hook
+// is added once and clients add and remove their buffers instead
+type logHook struct {
+	sync.Mutex
+	once    sync.Once
+	buffers map[*LogBuffer]bool
+}
+
+var clientLogHook = &logHook{}
+
+// add starts copying log messages into buffer
+func (h *logHook) add(buffer *LogBuffer) {
+	h.once.Do(func() {
+		log.AddHook(h)
+	})
+	h.Lock()
+	defer h.Unlock()
+	if h.buffers == nil {
+		h.buffers = make(map[*LogBuffer]bool)
+	}
+	h.buffers[buffer] = true
+}
+
+// remove stops copying log messages into buffer
+func (h *logHook) remove(buffer *LogBuffer) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.buffers, buffer)
+}
+
+func (h *logHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logHook) Fire(entry *log.Entry) error {
+	line := fmt.Sprintf("%v %v", strings.ToUpper(entry.Level.String()), entry.Message)
+	h.Lock()
+	defer h.Unlock()
+	for buffer := range h.buffers {
+		buffer.Append("client", line)
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket limiting the number of lines per second
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{float64(rate), float64(rate), time.Now()}
+}
+
+// take returns how many of n lines may be sent at now
+func (r *rateLimiter) take(n int, now time.Time) int {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	allowed := n
+	if float64(allowed) > r.tokens {
+		allowed = int(r.tokens)
+	}
+	r.tokens -= float64(allowed)
+	return allowed
+}
+
+// LogSubscription structure representing a subscribe-logs or unsubscribe-logs
+// request
+type LogSubscription struct {
+	// Assigned by the server to route the backlog to the right subscriber
+	ID  string `json:"id"`
+	Rig string `json:"rig"`
+	// Number of buffered lines to send on subscribing
+	Lines int `json:"lines"`
+}
+
+// LogBatch structure representing a batch of log lines sent by a client
+type LogBatch struct {
+	// Set when this batch is the backlog requested by a subscription
+	ID    string    `json:"id"`
+	Rig   string    `json:"rig"`
+	Lines []LogLine `json:"lines"`
+	// Lines that were not sent due to rate limiting or overwritten
+	Dropped uint64 `json:"dropped"`
+}
+
+// Logs returns the client's log buffer
+func (c *Client) Logs() *LogBuffer {
+	return c.logs
+}
+
+// sendLogBatch sends batch to the server
+func (c *Client) sendLogBatch(batch *LogBatch) error {
+	batch.Rig = c.RigID
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return c.Emit("log-lines", string(b))
+}
+
+// StreamLogs starts streaming new log lines to the server until StopLogs is
+// called. Calling it while already streaming has no effect.
+func (c *Client) StreamLogs() {
+	c.logStreamMutex.Lock()
+	defer c.logStreamMutex.Unlock()
+	if c.logStreamStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	c.logStreamStop = stop
+	rate := c.LogRateLimit
+	if rate <= 0 {
+		rate = defaultLogRateLimit
+	}
+	go func() {
+		limiter := newRateLimiter(rate)
+		lastSeq := c.logs.LastSeq()
+		var dropped uint64
+		ticker := time.NewTicker(logStreamInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				lines, missed := c.logs.Since(lastSeq)
+				dropped += missed
+				if len(lines) == 0 {
+					continue
+				}
+				lastSeq = lines[len(lines)-1].Seq
+				// Prefer the most recent lines when over the limit
+				allowed := limiter.take(len(lines), now)
+				dropped += uint64(len(lines) - allowed)
+				lines = lines[len(lines)-allowed:]
+				if len(lines) == 0 {
+					continue
+				}
+				if err := c.sendLogBatch(&LogBatch{Lines: lines, Dropped: dropped}); err != nil {
+					log.Debugf("Failed to send log lines: %v", err)
+					continue
+				}
+				dropped = 0
+			}
+		}
+	}()
+}
+
+// StopLogs stops streaming log lines to the server
+func (c *Client) StopLogs() {
+	c.logStreamMutex.Lock()
+	defer c.logStreamMutex.Unlock()
+	if c.logStreamStop != nil {
+		close(c.logStreamStop)
+		c.logStreamStop = nil
+	}
+}
+
+// HandleSubscribeLogs handles subscribe-logs requests from the server by
+// sending the requested backlog and streaming new lines
+func (c *Client) HandleSubscribeLogs(w *websockets.WebsocketClient, data interface{}) {
+	var subscription LogSubscription
+	if err := decodeData(data, &subscription); err != nil {
+		log.Errorf("Failed to parse subscribe-logs request: %v", err)
+		return
+	}
+	lines := subscription.Lines
+	if lines <= 0 {
+		lines = defaultLogBacklog
+	}
+	if err := c.sendLogBatch(&LogBatch{ID: subscription.ID, Lines: c.logs.Last(lines)}); err != nil {
+		log.Errorf("Failed to send log backlog: %v", err)
+	}
+	c.StreamLogs()
+}
+
+// HandleUnsubscribeLogs handles unsubscribe-logs requests from the server
+func (c *Client) HandleUnsubscribeLogs(w *websockets.WebsocketClient, data interface{}) {
+	c.StopLogs()
+}
+
+// logSubscribers keeps track of which websocket clients are tailing which rig
+type logSubscribers struct {
+	sync.Mutex
+	nextID  int
+	rigs    map[string]map[*websockets.WebsocketClient]bool
+	pending map[string]*websockets.WebsocketClient
+}
+
+// add subscribes w to rig. It returns the ID to route the backlog with and
+// whether w is the first subscriber of rig
+func (ls *logSubscribers) add(rig string, w *websockets.WebsocketClient) (string, bool) {
+	ls.Lock()
+	defer ls.Unlock()
+	if ls.rigs == nil {
+		ls.rigs = make(map[string]map[*websockets.WebsocketClient]bool)
+		ls.pending = make(map[string]*websockets.WebsocketClient)
+	}
+	first := false
+	if _, ok := ls.rigs[rig]; !ok {
+		ls.rigs[rig] = make(map[*websockets.WebsocketClient]bool)
+		first = true
+	}
+	ls.rigs[rig][w] = true
+	ls.nextID++
+	id := fmt.Sprintf("%d", ls.nextID)
+	ls.pending[id] = w
+	return id, first
+}
+
+// remove unsubscribes w from rig and returns whether rig has no subscribers
+// left
+func (ls *logSubscribers) remove(rig string, w *websockets.WebsocketClient) bool {
+	ls.Lock()
+	defer ls.Unlock()
+	subscribers, ok := ls.rigs[rig]
+	if !ok {
+		return false
+	}
+	delete(subscribers, w)
+	if len(subscribers) == 0 {
+		delete(ls.rigs, rig)
+		return true
+	}
+	return false
+}
+
+// forget drops every subscription and pending backlog of w. Rigs left without
+// subscribers stop streaming once they send their next batch
+func (ls *logSubscribers) forget(w *websockets.WebsocketClient) {
+	ls.Lock()
+	defer ls.Unlock()
+	for rig, subscribers := range ls.rigs {
+		delete(subscribers, w)
+		if len(subscribers) == 0 {
+			delete(ls.rigs, rig)
+		}
+	}
+	for id, subscriber := range ls.pending {
+		if subscriber == w {
+			delete(ls.pending, id)
+		}
+	}
+}
+
+// recipients returns who batch should be sent to
+func (ls *logSubscribers) recipients(batch *LogBatch) []*websockets.WebsocketClient {
+	ls.Lock()
+	defer ls.Unlock()
+	ret := make([]*websockets.WebsocketClient, 0)
+	if strings.Compare(batch.ID, "") != 0 {
+		if w, ok := ls.pending[batch.ID]; ok {
+			delete(ls.pending, batch.ID)
+			ret = append(ret, w)
+		}
+		return ret
+	}
+	for w := range ls.rigs[batch.Rig] {
+		ret = append(ret, w)
+	}
+	return ret
+}
+
+// handleSubscribeLogs subscribes the requester to a rig's logs, asking the
+// rig to start streaming if needed
+func (s *Server) handleSubscribeLogs(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("subscribe-logs", fmt.Sprintf("clientaddr=%v subscription=%v", w.RemoteAddr(), data))
+	var subscription LogSubscription
+	if err := decodeData(data, &subscription); err != nil {
+		log.Errorf("[subscribe-logs]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid subscribe-logs request: %v", err))
+		return
+	}
+	clients := s.RigClients(subscription.Rig)
+	if len(clients) == 0 {
+		w.Emit("error", fmt.Sprintf("Rig '%v' is not connected", subscription.Rig))
+		return
+	}
+	subscription.ID, _ = s.logSubscribers.add(subscription.Rig, w)
+	b, err := json.Marshal(&subscription)
+	if err != nil {
+		log.Errorf("[subscribe-logs]: Failed to marshal: %v", err)
+		return
+	}
+	// Always forward so that the new subscriber gets its backlog. Clients that
+	// are already streaming keep doing so
+	for _, client := range clients {
+		s.emit(client, "subscribe-logs", string(b))
+	}
+}
+
+// handleUnsubscribeLogs unsubscribes the requester from a rig's logs, asking
+// the rig to stop streaming once nobody is left
+func (s *Server) handleUnsubscribeLogs(w *websockets.WebsocketClient, data interface{}) {
+	var subscription LogSubscription
+	if err := decodeData(data, &subscription); err != nil {
+		log.Errorf("[unsubscribe-logs]: Failed to unmarshal: %v", err)
+		return
+	}
+	if s.logSubscribers.remove(subscription.Rig, w) {
+		for _, client := range s.RigClients(subscription.Rig) {
+			client.Emit("unsubscribe-logs", "{}")
+		}
+	}
+}
+
+// handleLogLines forwards a batch of log lines from a rig to its subscribers
+func (s *Server) handleLogLines(w *websockets.WebsocketClient, data interface{}) {
+	var batch LogBatch
+	if err := decodeData(data, &batch); err != nil {
+		log.Errorf("[log-lines]: Failed to unmarshal: %v", err)
+		return
+	}
+	recipients := s.logSubscribers.recipients(&batch)
+	if len(recipients) == 0 && strings.Compare(batch.ID, "") == 0 {
+		// Nobody is listening anymore
+		w.Emit("unsubscribe-logs", "{}")
+		return
+	}
+	payload := jsonData(&batch)
+	for _, recipient := range recipients {
+		if err := recipient.Emit("log-lines", payload); err != nil {
+			// The subscriber is gone
+			if s.logSubscribers.remove(batch.Rig, recipient) {
+				w.Emit("unsubscribe-logs", "{}")
+			}
+		}
+	}
+}
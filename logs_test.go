@@ -0,0 +1,95 @@
+package minerconfig
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogBuffer(t *testing.T) {
+	require := require.New(t)
+
+	lb := NewLogBuffer(3)
+	require.Equal(0, len(lb.Last(10)))
+
+	for idx := 1; idx <= 5; idx++ {
+		lb.Append("miner", fmt.Sprintf("line-%d", idx))
+	}
+	lines := lb.Last(10)
+	require.Equal(3, len(lines))
+	require.Equal("line-3", lines[0].Text)
+	require.Equal("line-5", lines[2].Text)
+	require.Equal(uint64(5), lb.LastSeq())
+
+	lines = lb.Last(2)
+	require.Equal("line-4", lines[0].Text)
+
+	// Lines 1 and 2 were overwritten
+	lines, missed := lb.Since(0)
+	require.Equal(uint64(2), missed)
+	require.Equal(3, len(lines))
+
+	lines, missed = lb.Since(4)
+	require.Equal(uint64(0), missed)
+	require.Equal(1, len(lines))
+	require.Equal("line-5", lines[0].Text)
+}
+
+func TestLogWriter(t *testing.T) {
+	require := require.New(t)
+
+	lb := NewLogBuffer(10)
+	lw := &logWriter{buffer: lb, source: "miner"}
+	lw.Write([]byte("first\r\nsec"))
+	lw.Write([]byte("ond\n"))
+	lw.Write([]byte("partial"))
+
+	lines := lb.Last(10)
+	require.Equal(2, len(lines))
+	require.Equal("first", lines[0].Text)
+	require.Equal("second", lines[1].Text)
+	require.Equal("miner", lines[1].Source)
+}
+
+func TestLogHook(t *testing.T) {
+	require := require.New(t)
+
+	first := NewLogBuffer(10)
+	second := NewLogBuffer(10)
+	clientLogHook.add(first)
+	clientLogHook.add(second)
+	log.Warnf("both")
+	clientLogHook.remove(first)
+	log.Warnf("second only")
+	clientLogHook.remove(second)
+	log.Warnf("neither")
+
+	lines := first.Last(10)
+	require.Equal(1, len(lines))
+	require.Equal("WARNING both", lines[0].Text)
+	lines = second.Last(10)
+	require.Equal(2, len(lines))
+	require.Equal("WARNING second only", lines[1].Text)
+}
+
+func TestRateLimiter(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	limiter := newRateLimiter(10)
+	limiter.last = now
+
+	// Burst of up to a second's worth
+	require.Equal(10, limiter.take(100, now))
+	require.Equal(0, limiter.take(100, now))
+
+	// Half a second later, half the rate is available again
+	require.Equal(5, limiter.take(100, now.Add(500*time.Millisecond)))
+	require.Equal(3, limiter.take(3, now.Add(time.Second)))
+
+	// Tokens do not accumulate beyond the rate
+	require.Equal(10, limiter.take(100, now.Add(time.Hour)))
+}
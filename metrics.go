@@ -0,0 +1,270 @@
+package minerconfig
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gurupras/minerconfig/sensors"
+	"github.com/homesound/simple-websockets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	rigOnlineDesc = prometheus.NewDesc("minerconfig_rig_online",
+		"Whether the rig is sending heartbeats.", []string{"rig"}, nil)
+	rigLastSeenDesc = prometheus.NewDesc("minerconfig_rig_last_seen_timestamp_seconds",
+		"When the rig was last heard from.", []string{"rig"}, nil)
+	rigHashrateDesc = prometheus.NewDesc("minerconfig_rig_hashrate_hashes_per_second",
+		"Hashrate last reported by the rig.", []string{"rig", "pool"}, nil)
+	rigSharesDesc = prometheus.NewDesc("minerconfig_rig_shares_total",
+		"Shares last reported by the rig since its miner was started.", []string{"rig", "pool", "result"}, nil)
+	rigGPUTemperatureDesc = prometheus.NewDesc("minerconfig_rig_gpu_temperature_celsius",
+		"GPU temperature last reported by the rig.", []string{"rig", "gpu"}, nil)
+	rigGPUFanDesc = prometheus.NewDesc("minerconfig_rig_gpu_fan_percent",
+		"GPU fan speed last reported by the rig.", []string{"rig", "gpu"}, nil)
+	rigGPUPowerDesc = prometheus.NewDesc("minerconfig_rig_gpu_power_watts",
+		"GPU power draw last reported by the rig.", []string{"rig", "gpu"}, nil)
+
+	clientMinerRunningDesc = prometheus.NewDesc("minerconfig_client_miner_running",
+		"Whether the miner is running.", []string{"rig", "pool"}, nil)
+	clientMinerStartsDesc = prometheus.NewDesc("minerconfig_client_miner_starts_total",
+		"Number of times the miner was started.", []string{"rig"}, nil)
+	clientMinerUptimeDesc = prometheus.NewDesc("minerconfig_client_miner_uptime_seconds",
+		"How long the miner has been running.", []string{"rig"}, nil)
+	clientHashrateDesc = prometheus.NewDesc("minerconfig_client_hashrate_hashes_per_second",
+		"Hashrate parsed from the miner's output.", []string{"rig", "pool"}, nil)
+	clientThreadHashrateDesc = prometheus.NewDesc("minerconfig_client_thread_hashrate_hashes_per_second",
+		"Hashrate of every miner thread parsed from the miner's output.", []string{"rig", "pool", "thread"}, nil)
+	clientSharesDesc = prometheus.NewDesc("minerconfig_client_shares_total",
+		"Shares parsed from the miner's output since it was started.", []string{"rig", "pool", "result"}, nil)
+	clientGPUResetsDesc = prometheus.NewDesc("minerconfig_client_gpu_resets_total",
+		"Number of times the GPUs were reset.", []string{"rig"}, nil)
+	clientReconnectsDesc = prometheus.NewDesc("minerconfig_client_reconnects_total",
+		"Number of times the client re-connected to the webserver.", []string{"rig"}, nil)
+	clientGPUTemperatureDesc = prometheus.NewDesc("minerconfig_client_gpu_temperature_celsius",
+		"GPU temperature read from its sensors.", []string{"rig", "gpu"}, nil)
+	clientGPUFanDesc = prometheus.NewDesc("minerconfig_client_gpu_fan_percent",
+		"GPU fan speed read from its sensors.", []string{"rig", "gpu"}, nil)
+	clientGPUPowerDesc = prometheus.NewDesc("minerconfig_client_gpu_power_watts",
+		"GPU power draw read from its sensors.", []string{"rig", "gpu"}, nil)
+)
+
+// serverMetrics holds the Prometheus metrics of a webserver
+type serverMetrics struct {
+	registry          *prometheus.Registry
+	events            *prometheus.CounterVec
+	broadcastDuration prometheus.Histogram
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{}
+	m.registry = prometheus.NewRegistry()
+	m.events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "minerconfig_webserver_events_total",
+		Help: "Number of websocket events processed by type.",
+	}, []string{"event"})
+	m.broadcastDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "minerconfig_webserver_broadcast_duration_seconds",
+		Help:    "Time taken to push selected pools to rigs.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+	})
+	m.registry.MustRegister(
+		m.events,
+		m.broadcastDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "minerconfig_webserver_connected_clients",
+			Help: "Number of connected websocket clients, including browsers.",
+		}, func() float64 {
+			return float64(s.connections.count())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "minerconfig_webserver_pools",
+			Help: "Number of pools in the pool store.",
+		}, func() float64 {
+			return float64(len(s.Store.Pools()))
+		}),
+		&inventoryCollector{s.Inventory},
+		prometheus.NewGoCollector(),
+	)
+	return m
+}
+
+func (m *serverMetrics) observeBroadcast(start time.Time) {
+	m.broadcastDuration.Observe(time.Since(start).Seconds())
+}
+
+// publishEvent publishes evt on the event channel. Events are counted where
+// their handlers are registered, see on
+func (s *Server) publishEvent(evt string, details string) {
+	if s.UseEvents {
+		s.EventChan <- &websockets.Event{evt, details}
+	}
+}
+
+// inventoryCollector exposes the state of every known rig
+type inventoryCollector struct {
+	inventory *RigInventory
+}
+
+func (ic *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rigOnlineDesc
+	ch <- rigLastSeenDesc
+	ch <- rigHashrateDesc
+	ch <- rigSharesDesc
+	ch <- rigGPUTemperatureDesc
+	ch <- rigGPUFanDesc
+	ch <- rigGPUPowerDesc
+}
+
+// collectReadings exposes the sensors of every GPU in readings that could be
+// read, labelled by PCI address
+func collectReadings(ch chan<- prometheus.Metric, temperature, fan, power *prometheus.Desc, rig string, readings []*sensors.Reading) {
+	for _, reading := range readings {
+		// Readings come from the rigs and cannot be labelled without a topology
+		if reading == nil || reading.Topology == nil {
+			continue
+		}
+		gpu := reading.Topology.String()
+		if reading.Temperature != nil {
+			ch <- prometheus.MustNewConstMetric(temperature, prometheus.GaugeValue, *reading.Temperature, rig, gpu)
+		}
+		if reading.FanPercent != nil {
+			ch <- prometheus.MustNewConstMetric(fan, prometheus.GaugeValue, *reading.FanPercent, rig, gpu)
+		}
+		if reading.Power != nil {
+			ch <- prometheus.MustNewConstMetric(power, prometheus.GaugeValue, *reading.Power, rig, gpu)
+		}
+	}
+}
+
+func (ic *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, rig := range ic.inventory.Rigs() {
+		online := 0.0
+		if rig.Online {
+			online = 1
+		}
+		ch <- prometheus.MustNewConstMetric(rigOnlineDesc, prometheus.GaugeValue, online, rig.RigID)
+		ch <- prometheus.MustNewConstMetric(rigLastSeenDesc, prometheus.GaugeValue, float64(rig.LastSeen.Unix()), rig.RigID)
+		if !rig.Online || rig.Status == nil {
+			continue
+		}
+		status := rig.Status
+		if status.Hashrate != nil {
+			ch <- prometheus.MustNewConstMetric(rigHashrateDesc, prometheus.GaugeValue, *status.Hashrate, rig.RigID, status.Pool)
+		}
+		ch <- prometheus.MustNewConstMetric(rigSharesDesc, prometheus.CounterValue, float64(status.Accepted), rig.RigID, status.Pool, "accepted")
+		ch <- prometheus.MustNewConstMetric(rigSharesDesc, prometheus.CounterValue, float64(status.Rejected), rig.RigID, status.Pool, "rejected")
+		collectReadings(ch, rigGPUTemperatureDesc, rigGPUFanDesc, rigGPUPowerDesc, rig.RigID, status.GPUs)
+	}
+}
+
+// clientCounters counts client events that are exposed as metrics. Its zero
+// value is ready to use.
+type clientCounters struct {
+	sync.Mutex
+	gpuResets  int
+	reconnects int
+}
+
+func (cc *clientCounters) gpuReset() {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.gpuResets++
+}
+
+func (cc *clientCounters) reconnected() {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.reconnects++
+}
+
+// threadHashrates returns a copy of the per-thread hashrates of the miner
+func (ms *minerStats) threadHashrates() map[int]float64 {
+	ms.Lock()
+	defer ms.Unlock()
+	ret := make(map[int]float64)
+	for thread, hashrate := range ms.threads {
+		ret[thread] = hashrate
+	}
+	return ret
+}
+
+// clientCollector exposes the state of a client and its miner
+type clientCollector struct {
+	c *Client
+}
+
+func (cc *clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientMinerRunningDesc
+	ch <- clientMinerStartsDesc
+	ch <- clientMinerUptimeDesc
+	ch <- clientHashrateDesc
+	ch <- clientThreadHashrateDesc
+	ch <- clientSharesDesc
+	ch <- clientGPUResetsDesc
+	ch <- clientReconnectsDesc
+	ch <- clientGPUTemperatureDesc
+	ch <- clientGPUFanDesc
+	ch <- clientGPUPowerDesc
+}
+
+func (cc *clientCollector) Collect(ch chan<- prometheus.Metric) {
+	c := cc.c
+	rig := c.RigID
+	status := c.Status()
+	pool := status.Pool
+
+	running := 0.0
+	if status.Mining {
+		running = 1
+	}
+	ch <- prometheus.MustNewConstMetric(clientMinerRunningDesc, prometheus.GaugeValue, running, rig, pool)
+	ch <- prometheus.MustNewConstMetric(clientMinerStartsDesc, prometheus.CounterValue, float64(status.MinerStarts), rig)
+	ch <- prometheus.MustNewConstMetric(clientMinerUptimeDesc, prometheus.GaugeValue, float64(status.MinerUptime), rig)
+	if status.Mining {
+		if status.Hashrate != nil {
+			ch <- prometheus.MustNewConstMetric(clientHashrateDesc, prometheus.GaugeValue, *status.Hashrate, rig, pool)
+		}
+		threadHashrates := c.stats.threadHashrates()
+		threads := make([]int, 0)
+		for thread := range threadHashrates {
+			threads = append(threads, thread)
+		}
+		sort.Ints(threads)
+		for _, thread := range threads {
+			ch <- prometheus.MustNewConstMetric(clientThreadHashrateDesc, prometheus.GaugeValue, threadHashrates[thread], rig, pool, fmt.Sprintf("%d", thread))
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(clientSharesDesc, prometheus.CounterValue, float64(status.Accepted), rig, pool, "accepted")
+	ch <- prometheus.MustNewConstMetric(clientSharesDesc, prometheus.CounterValue, float64(status.Rejected), rig, pool, "rejected")
+
+	c.counters.Lock()
+	gpuResets := c.counters.gpuResets
+	reconnects := c.counters.reconnects
+	c.counters.Unlock()
+	ch <- prometheus.MustNewConstMetric(clientGPUResetsDesc, prometheus.CounterValue, float64(gpuResets), rig)
+	ch <- prometheus.MustNewConstMetric(clientReconnectsDesc, prometheus.CounterValue, float64(reconnects), rig)
+	collectReadings(ch, clientGPUTemperatureDesc, clientGPUFanDesc, clientGPUPowerDesc, rig, status.GPUs)
+}
+
+// MetricsHandler returns the HTTP handler serving the client's metrics
+func (c *Client) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&clientCollector{c}, prometheus.NewGoCollector())
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// serveMetrics serves the client's metrics on MetricsAddress
+func (c *Client) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.MetricsHandler())
+	log.Infof("Serving metrics on %v/metrics", c.MetricsAddress)
+	if err := http.ListenAndServe(c.MetricsAddress, mux); err != nil {
+		log.Errorf("Failed to serve metrics on '%v': %v", c.MetricsAddress, err)
+	}
+}
@@ -0,0 +1,89 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/gurupras/minerconfig/sensors"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(require *require.Assertions, handler http.Handler) string {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestServerMetrics(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-metrics")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	_, err = server.Store.AddPool([]byte(`{"url": "pool.minexmr.com:5555", "user": "a"}`))
+	require.Nil(err)
+
+	server.Inventory.Register(&RigInfo{RigID: "rig1"}, "10.0.0.2:51234")
+	hashrate := 1234.5
+	status := &StatusReport{}
+	status.Mining = true
+	status.Pool = "pool.minexmr.com:5555"
+	status.Hashrate = &hashrate
+	status.Accepted = 10
+	temperature := 71.0
+	power := 152.5
+	// Readings without a topology cannot be labelled and are skipped
+	status.GPUs = []*sensors.Reading{{Topology: &pcie.Topology{Bus: 1}, Temperature: &temperature, Power: &power}, {Temperature: &temperature}}
+	server.Inventory.ReportStatus("rig1", status)
+	server.metrics.events.WithLabelValues("add-pool").Inc()
+	server.PushSelectedPools("rig1")
+
+	body := scrape(require, server.Router)
+	require.Contains(body, "minerconfig_webserver_pools 1")
+	require.Contains(body, `minerconfig_webserver_events_total{event="add-pool"} 1`)
+	require.Contains(body, "minerconfig_webserver_broadcast_duration_seconds_count 1")
+	require.Contains(body, `minerconfig_rig_online{rig="rig1"} 1`)
+	require.Contains(body, `minerconfig_rig_hashrate_hashes_per_second{pool="pool.minexmr.com:5555",rig="rig1"} 1234.5`)
+	require.Contains(body, `minerconfig_rig_shares_total{pool="pool.minexmr.com:5555",result="accepted",rig="rig1"} 10`)
+	require.Contains(body, `minerconfig_rig_gpu_temperature_celsius{gpu="01:00.0",rig="rig1"} 71`)
+	require.Contains(body, `minerconfig_rig_gpu_power_watts{gpu="01:00.0",rig="rig1"} 152.5`)
+	require.NotContains(body, "minerconfig_rig_gpu_fan_percent")
+}
+
+func TestClientMetrics(t *testing.T) {
+	require := require.New(t)
+
+	clientConfig := generateValidClientConfig(require)
+	defer os.Remove(clientConfig.MinerConfigPath)
+	clientConfig.RigID = "rig1"
+	c := newOfflineClient(require, clientConfig)
+	c.MinerConfig.Pools = []Pool{{Url: "pool.minexmr.com:5555"}}
+
+	// Pretend the miner is running and printed a hashrate report
+	c.miner = &exec.Cmd{}
+	c.stats.minerStarted(time.Now())
+	c.stats.Write([]byte("| ID |    10s |    60s |    15m | ID |    10s |    60s |    15m |\n"))
+	c.stats.Write([]byte("|  0 |  512.3 |  510.2 |  (na) |  1 |  498.1 |  497.0 |  (na) |\n"))
+	c.stats.Write([]byte("Totals (ALL):   1010.4  1007.2     0.0 H/s\n"))
+	c.counters.gpuReset()
+
+	body := scrape(require, c.MetricsHandler())
+	require.Contains(body, `minerconfig_client_miner_running{pool="pool.minexmr.com:5555",rig="rig1"} 1`)
+	require.Contains(body, `minerconfig_client_miner_starts_total{rig="rig1"} 1`)
+	require.Contains(body, `minerconfig_client_hashrate_hashes_per_second{pool="pool.minexmr.com:5555",rig="rig1"} 1010.4`)
+	require.Contains(body, `minerconfig_client_thread_hashrate_hashes_per_second{pool="pool.minexmr.com:5555",rig="rig1",thread="0"} 512.3`)
+	require.Contains(body, `minerconfig_client_thread_hashrate_hashes_per_second{pool="pool.minexmr.com:5555",rig="rig1",thread="1"} 498.1`)
+	require.Contains(body, `minerconfig_client_gpu_resets_total{rig="rig1"} 1`)
+	require.Contains(body, `minerconfig_client_reconnects_total{rig="rig1"} 0`)
+}
@@ -0,0 +1,243 @@
+package minerconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMinerCommandWait = 1000
+	maxMinerCommandWait     = 30000
+	// Maximum number of bytes of output returned for a single command
+	maxMinerCommandOutput = 64 * 1024
+)
+
+// MinerCommand structure representing a miner-command request and its result
+type MinerCommand struct {
+	// Assigned by the server to match results to requests
+	ID  string `json:"id"`
+	Rig string `json:"rig"`
+	// Keystrokes or text written to the miner's stdin as-is, e.g. "h"
+	Command string `json:"command"`
+	// Milliseconds to collect output for after writing the command
+	Wait   int    `json:"wait"`
+	Output string `json:"output"`
+	Error  string `json:"error"`
+}
+
+// outputTap is an io.Writer that copies everything written to it into any
+// active captures. Its zero value is ready to use.
+type outputTap struct {
+	sync.Mutex
+	captures []*bytes.Buffer
+}
+
+func (t *outputTap) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	for _, capture := range t.captures {
+		if capture.Len() < maxMinerCommandOutput {
+			capture.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *outputTap) startCapture() *bytes.Buffer {
+	t.Lock()
+	defer t.Unlock()
+	capture := &bytes.Buffer{}
+	t.captures = append(t.captures, capture)
+	return capture
+}
+
+func (t *outputTap) stopCapture(capture *bytes.Buffer) string {
+	t.Lock()
+	defer t.Unlock()
+	for idx, c := range t.captures {
+		if c == capture {
+			t.captures = append(t.captures[:idx], t.captures[idx+1:]...)
+			break
+		}
+	}
+	ret := capture.String()
+	if len(ret) > maxMinerCommandOutput {
+		ret = ret[:maxMinerCommandOutput]
+	}
+	return ret
+}
+
+// RunMinerCommand writes command to the miner's stdin and returns whatever
+// the miner printed within wait
+func (c *Client) RunMinerCommand(command string, wait time.Duration) (string, error) {
+	capture := c.output.startCapture()
+	if err := c.WriteMinerStdin([]byte(command)); err != nil {
+		c.output.stopCapture(capture)
+		return "", err
+	}
+	time.Sleep(wait)
+	return c.output.stopCapture(capture), nil
+}
+
+// HandleMinerCommand handles miner-command requests from the server
+func (c *Client) HandleMinerCommand(w *websockets.WebsocketClient, data interface{}) {
+	var command MinerCommand
+	if err := decodeData(data, &command); err != nil {
+		log.Errorf("Failed to parse miner-command request: %v", err)
+		return
+	}
+	// Collecting output takes a while. Don't hold up other messages
+	go func() {
+		log.Infof("Running miner command: %q", command.Command)
+		output, err := c.RunMinerCommand(command.Command, minerCommandWait(command.Wait))
+		command.Output = output
+		if err != nil {
+			command.Error = err.Error()
+		}
+		b, err := json.Marshal(&command)
+		if err != nil {
+			log.Errorf("Failed to marshal miner-command result: %v", err)
+			return
+		}
+		if err := c.Emit("miner-command-result", string(b)); err != nil {
+			log.Errorf("Failed to send miner-command result: %v", err)
+		}
+	}()
+}
+
+func minerCommandWait(wait int) time.Duration {
+	if wait <= 0 {
+		wait = defaultMinerCommandWait
+	}
+	if wait > maxMinerCommandWait {
+		wait = maxMinerCommandWait
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+// pendingMinerCommand structure representing a miner command that was sent
+// to a rig and has not been answered yet
+type pendingMinerCommand struct {
+	requester *websockets.WebsocketClient
+	rig       string
+}
+
+// minerCommands keeps track of which websocket client requested each
+// outstanding miner command and which rig it was sent to
+type minerCommands struct {
+	sync.Mutex
+	nextID  int
+	pending map[string]*pendingMinerCommand
+}
+
+func (mc *minerCommands) add(w *websockets.WebsocketClient, rig string) string {
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.pending == nil {
+		mc.pending = make(map[string]*pendingMinerCommand)
+	}
+	mc.nextID++
+	id := fmt.Sprintf("%d", mc.nextID)
+	mc.pending[id] = &pendingMinerCommand{w, rig}
+	return id
+}
+
+// remove forgets the command with id and returns its requester. Unless rig is
+// empty, the command is only forgotten if it was sent to rig
+func (mc *minerCommands) remove(id string, rig string) *websockets.WebsocketClient {
+	mc.Lock()
+	defer mc.Unlock()
+	command, ok := mc.pending[id]
+	if !ok {
+		return nil
+	}
+	if strings.Compare(rig, "") != 0 && strings.Compare(command.rig, rig) != 0 {
+		return nil
+	}
+	delete(mc.pending, id)
+	return command.requester
+}
+
+// forget drops the commands requested by w
+func (mc *minerCommands) forget(w *websockets.WebsocketClient) {
+	mc.Lock()
+	defer mc.Unlock()
+	for id, command := range mc.pending {
+		if command.requester == w {
+			delete(mc.pending, id)
+		}
+	}
+}
+
+// handleMinerCommand forwards a miner-command request to the targeted rig
+func (s *Server) handleMinerCommand(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("miner-command", fmt.Sprintf("clientaddr=%v command=%v", w.RemoteAddr(), data))
+	var command MinerCommand
+	if err := decodeData(data, &command); err != nil {
+		log.Errorf("[miner-command]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid miner-command request: %v", err))
+		return
+	}
+	clients := s.RigClients(command.Rig)
+	if strings.Compare(command.Rig, "") == 0 || len(clients) == 0 {
+		command.Error = fmt.Sprintf("Rig '%v' is not connected", command.Rig)
+		w.Emit("miner-command-result", jsonData(&command))
+		return
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_MINER_COMMAND,
+		Actor:   clientAddr(w),
+		Rig:     command.Rig,
+		Message: fmt.Sprintf("Sent %q to the miner", command.Command),
+	})
+	command.ID = s.minerCommands.add(w, command.Rig)
+	// Give up on rigs that never answer
+	timeout := command
+	time.AfterFunc(minerCommandWait(command.Wait)+10*time.Second, func() {
+		if requester := s.minerCommands.remove(timeout.ID, ""); requester != nil {
+			timeout.Error = "Timed out waiting for the rig to respond"
+			requester.Emit("miner-command-result", jsonData(&timeout))
+		}
+	})
+	b, err := json.Marshal(&command)
+	if err != nil {
+		log.Errorf("[miner-command]: Failed to marshal: %v", err)
+		return
+	}
+	// Only one client is expected per rig, but the first to answer wins
+	for _, client := range clients {
+		if err := s.emit(client, "miner-command", string(b)); err != nil {
+			log.Errorf("[miner-command]: Failed to forward to rig '%v': %v", command.Rig, err)
+		}
+	}
+}
+
+// handleMinerCommandResult sends the result of a miner command back to
+// whoever requested it. Only the rig the command was sent to can answer it
+func (s *Server) handleMinerCommandResult(w *websockets.WebsocketClient, data interface{}) {
+	rigID := s.RigID(w)
+	if strings.Compare(rigID, "") == 0 {
+		log.Warnf("[miner-command-result]: Ignoring result from unregistered client %v", w.RemoteAddr())
+		return
+	}
+	var command MinerCommand
+	if err := decodeData(data, &command); err != nil {
+		log.Errorf("[miner-command-result]: Failed to unmarshal: %v", err)
+		return
+	}
+	requester := s.minerCommands.remove(command.ID, rigID)
+	if requester == nil {
+		log.Debugf("[miner-command-result]: Ignoring result of rig '%v' for unknown command '%v'", rigID, command.ID)
+		return
+	}
+	if err := requester.Emit("miner-command-result", jsonData(&command)); err != nil {
+		log.Errorf("[miner-command-result]: Failed to send result: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// MiningControl structure representing the target of a pause-mining or
+// resume-mining request. An empty Rig and Group targets the whole farm.
+type MiningControl struct {
+	Rig   string `json:"rig"`
+	Group string `json:"group"`
+	// Only used by pause-mining. Mining resumes automatically at this time
+	Until *time.Time `json:"until"`
+}
+
+// Describe returns a human readable description of the rigs targeted
+func (mc *MiningControl) Describe() string {
+	var ret string
+	if strings.Compare(mc.Rig, "") != 0 {
+		ret = fmt.Sprintf("rig '%v'", mc.Rig)
+	} else if strings.Compare(mc.Group, "") != 0 {
+		ret = fmt.Sprintf("group '%v'", mc.Group)
+	} else {
+		ret = "all rigs"
+	}
+	if mc.Until != nil {
+		ret = fmt.Sprintf("%v until %v", ret, mc.Until.Format(time.RFC3339))
+	}
+	return ret
+}
+
+// ClientState structure representing client state that must survive
+// re-connects and restarts
+type ClientState struct {
+	Paused      bool       `json:"paused"`
+	PausedUntil *time.Time `json:"paused_until"`
+	// GPU settings that are active and must be reverted when mining stops
+	GPUTool *GPUTool `json:"gpu_tool"`
+}
+
+// LoadState reads the client state from StatePath, if it exists
+func (c *Client) LoadState() error {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if !easyfiles.Exists(c.StatePath) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(c.StatePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read state file '%v': %v", c.StatePath, err)
+	}
+	if err := json.Unmarshal(b, &c.state); err != nil {
+		return fmt.Errorf("Failed to parse state file '%v': %v", c.StatePath, err)
+	}
+	if c.state.PausedUntil != nil && time.Now().After(*c.state.PausedUntil) {
+		c.state.Paused = false
+		c.state.PausedUntil = nil
+	}
+	if c.state.Paused {
+		log.Infof("Mining was paused before restart")
+	}
+	return nil
+}
+
+// saveState writes the client state to StatePath. Must be called with
+// stateMutex held
+func (c *Client) saveState() error {
+	b, err := json.Marshal(&c.state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.StatePath, b, 0666); err != nil {
+		return fmt.Errorf("Failed to write state file '%v': %v", c.StatePath, err)
+	}
+	return nil
+}
+
+// scheduleResume sets up a timer to resume mining at PausedUntil. Must be
+// called with stateMutex held
+func (c *Client) scheduleResume() {
+	if c.resumeTimer != nil {
+		c.resumeTimer.Stop()
+		c.resumeTimer = nil
+	}
+	if c.state.PausedUntil == nil {
+		return
+	}
+	c.resumeTimer = time.AfterFunc(time.Until(*c.state.PausedUntil), func() {
+		log.Infof("Pause expired")
+		if err := c.Resume(); err != nil {
+			log.Errorf("Failed to resume mining: %v", err)
+		}
+	})
+}
+
+// Paused returns whether mining is currently paused
+func (c *Client) Paused() bool {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state.Paused
+}
+
+// Pause stops mining until Resume is called or until, if it is not nil
+func (c *Client) Pause(until *time.Time) error {
+	c.stateMutex.Lock()
+	c.state.Paused = true
+	c.state.PausedUntil = until
+	err := c.saveState()
+	c.scheduleResume()
+	c.stateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.minerMutex.Lock()
+	defer c.minerMutex.Unlock()
+	if c.miner == nil {
+		return nil
+	}
+	if c.StdinPause {
+		return c.writeMinerStdin([]byte("p"))
+	}
+	if err := c.stopMiner(); err != nil {
+		return fmt.Errorf("Failed to stop miner: %v", err)
+	}
+	return nil
+}
+
+// Resume resumes mining after Pause
+func (c *Client) Resume() error {
+	c.stateMutex.Lock()
+	wasPaused := c.state.Paused
+	c.state.Paused = false
+	c.state.PausedUntil = nil
+	err := c.saveState()
+	c.scheduleResume()
+	c.stateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !wasPaused {
+		return nil
+	}
+
+	if c.StdinPause && c.minerRunning() {
+		return c.WriteMinerStdin([]byte("r"))
+	}
+	// Ask the server for pools. Receiving them starts the miner
+	return c.UpdatePools()
+}
+
+// HandlePause handles pause-mining requests from the server
+func (c *Client) HandlePause(w *websockets.WebsocketClient, data interface{}) {
+	var control MiningControl
+	if err := decodeData(data, &control); err != nil {
+		log.Errorf("Failed to parse pause-mining request: %v", err)
+		return
+	}
+	if control.Until != nil {
+		log.Infof("Pausing mining until %v", control.Until)
+	} else {
+		log.Infof("Pausing mining")
+	}
+	if err := c.Pause(control.Until); err != nil {
+		log.Errorf("Failed to pause mining: %v", err)
+	}
+}
+
+// HandleResume handles resume-mining requests from the server
+func (c *Client) HandleResume(w *websockets.WebsocketClient, data interface{}) {
+	log.Infof("Resuming mining")
+	if err := c.Resume(); err != nil {
+		log.Errorf("Failed to resume mining: %v", err)
+	}
+}
+
+// TargetClients returns the connected clients of the rigs addressed by rig and
+// group. An empty rig and group address every registered rig.
+func (s *Server) TargetClients(rig string, group string) []*websockets.WebsocketClient {
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	ret := make([]*websockets.WebsocketClient, 0)
+	for client, rigInfo := range s.rigs {
+		if strings.Compare(rig, "") != 0 && strings.Compare(rigInfo.RigID, rig) != 0 {
+			continue
+		}
+		if strings.Compare(group, "") != 0 && strings.Compare(rigInfo.Group, group) != 0 {
+			continue
+		}
+		ret = append(ret, client)
+	}
+	return ret
+}
+
+// forwardMiningControl handles pause-mining and resume-mining requests by
+// forwarding them to the targeted rigs
+func (s *Server) forwardMiningControl(evt string, w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent(evt, fmt.Sprintf("clientaddr=%v target=%v", w.RemoteAddr(), data))
+	var control MiningControl
+	if err := decodeData(data, &control); err != nil {
+		log.Errorf("[%v]: Failed to unmarshal: %v", evt, err)
+		w.Emit("error", fmt.Sprintf("Invalid %v request: %v", evt, err))
+		return
+	}
+	b, err := json.Marshal(&control)
+	if err != nil {
+		log.Errorf("[%v]: Failed to marshal: %v", evt, err)
+		return
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   evt,
+		Actor:   clientAddr(w),
+		Rig:     control.Rig,
+		Message: fmt.Sprintf("Sent %v to %v", evt, control.Describe()),
+	})
+	for _, client := range s.TargetClients(control.Rig, control.Group) {
+		if err := s.emit(client, evt, string(b)); err != nil {
+			log.Errorf("[%v]: Failed to forward to rig '%v': %v", evt, s.RigID(client), err)
+		}
+	}
+}
@@ -1,7 +1,49 @@
 package pcie
 
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var addressRegexp = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])$`)
+
 type Topology struct {
+	// PCI domain (segment). 0 on most machines and whenever it is not known
+	Domain   int
 	Bus      int
 	Device   int
 	Function int
 }
+
+// String returns the topology as a PCI address, e.g. "01:00.0". The domain is
+// only included if it is not 0, e.g. "0001:01:00.0"
+func (t *Topology) String() string {
+	if t.Domain != 0 {
+		return t.Address()
+	}
+	return fmt.Sprintf("%02x:%02x.%x", t.Bus, t.Device, t.Function)
+}
+
+// Address returns the full PCI address of the topology, as used by sysfs,
+// e.g. "0000:01:00.0"
+func (t *Topology) Address() string {
+	return fmt.Sprintf("%04x:%02x:%02x.%x", t.Domain, t.Bus, t.Device, t.Function)
+}
+
+// ParseTopology parses a PCI address such as "0000:01:00.0" or "01:00.0".
+// Addresses without a domain are in domain 0
+func ParseTopology(address string) (*Topology, error) {
+	match := addressRegexp.FindStringSubmatch(address)
+	if match == nil {
+		return nil, fmt.Errorf("Invalid PCI address: '%v'", address)
+	}
+	var domain int64
+	if len(match[1]) > 0 {
+		domain, _ = strconv.ParseInt(match[1], 16, 0)
+	}
+	bus, _ := strconv.ParseInt(match[2], 16, 0)
+	device, _ := strconv.ParseInt(match[3], 16, 0)
+	function, _ := strconv.ParseInt(match[4], 16, 0)
+	return &Topology{Domain: int(domain), Bus: int(bus), Device: int(device), Function: int(function)}, nil
+}
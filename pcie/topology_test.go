@@ -0,0 +1,33 @@
+package pcie
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTopology(t *testing.T) {
+	require := require.New(t)
+
+	topology, err := ParseTopology("0000:0a:00.1")
+	require.Nil(err)
+	require.Equal(Topology{Bus: 10, Function: 1}, *topology)
+	require.Equal("0a:00.1", topology.String())
+	require.Equal("0000:0a:00.1", topology.Address())
+
+	topology, err = ParseTopology("01:00.0")
+	require.Nil(err)
+	require.Equal(Topology{Bus: 1}, *topology)
+
+	// Devices in other domains are told apart
+	topology, err = ParseTopology("0001:01:00.0")
+	require.Nil(err)
+	require.Equal(Topology{Domain: 1, Bus: 1}, *topology)
+	require.Equal("0001:01:00.0", topology.String())
+	require.Equal("0001:01:00.0", topology.Address())
+
+	_, err = ParseTopology(`PCI\VEN_1002&DEV_687F`)
+	require.NotNil(err)
+	_, err = ParseTopology("01:00.8")
+	require.NotNil(err)
+}
@@ -0,0 +1,172 @@
+package minerconfig
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gurupras/minerconfig/profit"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProfitConfig structure representing the configuration of the profit switcher
+type ProfitConfig struct {
+	// Seconds between evaluations
+	Interval int `json:"interval" yaml:"interval"`
+	// Percent by which a pool must beat the current one before switching
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+	// Minimum number of seconds to stay on a pool before switching
+	MinHoldTime int `json:"min_hold_time" yaml:"min_hold_time"`
+	// Maximum number of pools sent to a rig. The remaining pools act as failover
+	MaxPools int                    `json:"max_pools" yaml:"max_pools"`
+	Provider *profit.ProviderConfig `json:"provider" yaml:"provider"`
+	// Per-rig, per-algorithm hashrates (H/s). These override any hashrates
+	// reported by the rigs themselves.
+	Hashrates map[string]map[string]float64 `json:"hashrates" yaml:"hashrates"`
+}
+
+// ProfitSwitcher periodically ranks the available pools for every rig by
+// estimated revenue and updates the selected pools of each rig
+type ProfitSwitcher struct {
+	sync.Mutex
+	*ProfitConfig
+	Market profit.Provider
+	// Clock used for hysteresis. Defaults to time.Now
+	Now      func() time.Time
+	server   *Server
+	selector *profit.Selector
+	stop     chan struct{}
+}
+
+// NewProfitSwitcher creates a new ProfitSwitcher for server
+func NewProfitSwitcher(server *Server, config *ProfitConfig) (*ProfitSwitcher, error) {
+	if config.Provider == nil {
+		return nil, fmt.Errorf("No market data provider specified")
+	}
+	provider, err := profit.ParseProvider(config.Provider)
+	if err != nil {
+		return nil, err
+	}
+	if config.Interval <= 0 {
+		config.Interval = 300
+	}
+	if config.MaxPools <= 0 {
+		config.MaxPools = 3
+	}
+	p := &ProfitSwitcher{}
+	p.ProfitConfig = config
+	p.Market = provider
+	p.Now = time.Now
+	p.server = server
+	p.selector = profit.NewSelector(config.Threshold, time.Duration(config.MinHoldTime)*time.Second)
+	return p, nil
+}
+
+// Start periodically evaluates pools until Stop is called
+func (p *ProfitSwitcher) Start() {
+	p.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(p.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := p.Evaluate(); err != nil {
+				log.Errorf("Failed to evaluate pool profitability: %v", err)
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops periodic evaluation
+func (p *ProfitSwitcher) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// RigHashrates returns the per-algorithm hashrates of every known rig
+func (p *ProfitSwitcher) RigHashrates() map[string]map[string]float64 {
+	ret := make(map[string]map[string]float64)
+	for rig, rigInfo := range p.server.Rigs() {
+		ret[rig] = make(map[string]float64)
+		for algorithm, hashrate := range rigInfo.Hashrates {
+			ret[rig][algorithm] = hashrate
+		}
+	}
+	for rig, hashrates := range p.Hashrates {
+		if _, ok := ret[rig]; !ok {
+			ret[rig] = make(map[string]float64)
+		}
+		for algorithm, hashrate := range hashrates {
+			ret[rig][algorithm] = hashrate
+		}
+	}
+	return ret
+}
+
+// Evaluate ranks the available pools for every rig and switches the selected
+// pools of rigs for which a sufficiently better pool was found
+func (p *ProfitSwitcher) Evaluate() error {
+	p.Lock()
+	defer p.Unlock()
+	market, err := p.Market.MarketData()
+	if err != nil {
+		return err
+	}
+
+	// Keep the pools as they were submitted so that no fields are lost when
+	// they are sent to the rigs
+	rawPools := make(map[string]interface{})
+	candidates := make([]profit.Candidate, 0)
+	for _, rawPool := range p.server.Store.Pools() {
+		var pool Pool
+		if err := decodeData(rawPool, &pool); err != nil {
+			log.Warnf("Ignoring malformed pool: %v", err)
+			continue
+		}
+		if pool.Coin == nil {
+			continue
+		}
+		candidate := profit.Candidate{
+			ID:        pool.Hash(),
+			Coin:      *pool.Coin,
+			Algorithm: pool.Algorithm,
+		}
+		if pool.Fee != nil {
+			candidate.Fee = *pool.Fee
+		}
+		rawPools[candidate.ID] = rawPool
+		candidates = append(candidates, candidate)
+	}
+
+	now := p.Now()
+	for rig, hashrates := range p.RigHashrates() {
+		ranked := profit.Rank(hashrates, candidates, market)
+		// Canaries keep the selection being tried on them until the rollout
+		// is over
+		if p.server.Rollout != nil && p.server.Rollout.IsCanary(rig) {
+			continue
+		}
+		id, changed := p.selector.Select(rig, ranked, now)
+		if !changed {
+			continue
+		}
+		selectedPools := make([]interface{}, 0)
+		for idx := 0; idx < len(ranked) && idx < p.MaxPools; idx++ {
+			selectedPools = append(selectedPools, rawPools[ranked[idx].ID])
+		}
+		log.Infof("[profit]: Switching rig '%v' to pool %v (%.6f/day)", rig, id, ranked[0].Revenue)
+		if err := p.server.Store.SetSelectedPools(rig, selectedPools); err != nil {
+			log.Errorf("[profit]: Failed to update selected pools of rig '%v': %v", rig, err)
+			continue
+		}
+		p.server.auditSelection(ACTOR_PROFIT_SWITCHER, rig, fmt.Sprintf("Switched to the most profitable pool (%.6f/day)", ranked[0].Revenue))
+		p.server.PushSelectedPools(rig)
+	}
+	return nil
+}
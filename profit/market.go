@@ -0,0 +1,130 @@
+package profit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type ProviderType string
+
+const (
+	PROVIDER_FILE   ProviderType = "FILE"
+	PROVIDER_URL    ProviderType = "URL"
+	PROVIDER_STATIC ProviderType = "STATIC"
+)
+
+// MarketData structure representing the network conditions and price of a coin
+type MarketData struct {
+	Coin      string `json:"coin" yaml:"coin"`
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	// Network difficulty
+	Difficulty float64 `json:"difficulty" yaml:"difficulty"`
+	// Block reward in coins
+	Reward float64 `json:"reward" yaml:"reward"`
+	// Price of a single coin in whatever currency the farm is accounted in
+	Price float64 `json:"price" yaml:"price"`
+}
+
+// Provider is the interface implemented by all sources of market data.
+// MarketData returns the current market data keyed by lower-case coin name
+type Provider interface {
+	MarketData() (map[string]*MarketData, error)
+}
+
+// ProviderConfig structure representing the configuration of a Provider
+type ProviderConfig struct {
+	Type    ProviderType  `json:"type" yaml:"type"`
+	Path    string        `json:"path" yaml:"path"`
+	URL     string        `json:"url" yaml:"url"`
+	Timeout int           `json:"timeout" yaml:"timeout"`
+	Coins   []*MarketData `json:"coins" yaml:"coins"`
+}
+
+// ParseProvider returns the Provider described by conf
+func ParseProvider(conf *ProviderConfig) (Provider, error) {
+	switch conf.Type {
+	case PROVIDER_FILE:
+		return &FileProvider{conf.Path}, nil
+	case PROVIDER_URL:
+		timeout := 10 * time.Second
+		if conf.Timeout > 0 {
+			timeout = time.Duration(conf.Timeout) * time.Second
+		}
+		return &URLProvider{conf.URL, &http.Client{Timeout: timeout}}, nil
+	case PROVIDER_STATIC:
+		return StaticProvider(conf.Coins), nil
+	default:
+		return nil, fmt.Errorf("Unimplemented market data provider: %v", conf.Type)
+	}
+}
+
+// FileProvider reads market data from a local JSON or YAML file containing a
+// list of MarketData entries. The file is re-read on every call so that it can
+// be updated by an external process.
+type FileProvider struct {
+	Path string
+}
+
+func (fp *FileProvider) MarketData() (map[string]*MarketData, error) {
+	b, err := ioutil.ReadFile(fp.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read market data file '%v': %v", fp.Path, err)
+	}
+	return parseMarketData(b)
+}
+
+// URLProvider fetches market data from an HTTP endpoint serving the same
+// format as FileProvider
+type URLProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+func (up *URLProvider) MarketData() (map[string]*MarketData, error) {
+	resp, err := up.Client.Get(up.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch market data from '%v': %v", up.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch market data from '%v': %v", up.URL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read market data from '%v': %v", up.URL, err)
+	}
+	return parseMarketData(b)
+}
+
+// StaticProvider serves a fixed list of MarketData entries, usually straight
+// from the webserver configuration
+type StaticProvider []*MarketData
+
+func (sp StaticProvider) MarketData() (map[string]*MarketData, error) {
+	return marketDataByCoin(sp)
+}
+
+func parseMarketData(b []byte) (map[string]*MarketData, error) {
+	var entries []*MarketData
+	// YAML is a superset of JSON, so this handles both
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("Failed to parse market data: %v", err)
+	}
+	return marketDataByCoin(entries)
+}
+
+func marketDataByCoin(entries []*MarketData) (map[string]*MarketData, error) {
+	ret := make(map[string]*MarketData)
+	for _, md := range entries {
+		if strings.Compare(md.Coin, "") == 0 {
+			return nil, fmt.Errorf("Market data entry is missing 'coin'")
+		}
+		ret[strings.ToLower(md.Coin)] = md
+	}
+	return ret, nil
+}
@@ -0,0 +1,125 @@
+package profit
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Candidate structure representing a pool that can be ranked
+type Candidate struct {
+	ID        string
+	Coin      string
+	Algorithm string
+	// Pool fee in percent
+	Fee float64
+}
+
+// Estimate structure representing the expected revenue of mining on a
+// Candidate, in the currency of MarketData.Price per day
+type Estimate struct {
+	Candidate
+	Revenue float64
+}
+
+// DailyRevenue estimates the revenue of mining with hashrate (H/s) for a day
+// on a pool charging fee percent, assuming CryptoNote-style difficulty where
+// the expected number of hashes per block equals the difficulty
+func DailyRevenue(hashrate float64, fee float64, md *MarketData) float64 {
+	if md.Difficulty <= 0 {
+		return 0
+	}
+	coins := hashrate * 86400 * md.Reward / md.Difficulty
+	return coins * md.Price * (1 - fee/100)
+}
+
+// Rank estimates the revenue of each candidate using the per-algorithm
+// hashrates of a rig and returns them sorted by decreasing revenue.
+// Candidates whose coin has no market data or whose algorithm the rig has no
+// hashrate for are left out.
+func Rank(hashrates map[string]float64, candidates []Candidate, market map[string]*MarketData) []Estimate {
+	ret := make([]Estimate, 0)
+	for _, candidate := range candidates {
+		md, ok := market[strings.ToLower(candidate.Coin)]
+		if !ok {
+			continue
+		}
+		algorithm := candidate.Algorithm
+		if strings.Compare(algorithm, "") == 0 {
+			algorithm = md.Algorithm
+		}
+		hashrate, ok := hashrates[algorithm]
+		if !ok || hashrate <= 0 {
+			continue
+		}
+		ret = append(ret, Estimate{candidate, DailyRevenue(hashrate, candidate.Fee, md)})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Revenue > ret[j].Revenue
+	})
+	return ret
+}
+
+type selection struct {
+	id    string
+	since time.Time
+}
+
+// Selector picks the best Candidate for every rig while applying hysteresis:
+// a rig only switches if the best candidate beats the current one by more
+// than Threshold percent and the current one has been held for at least
+// MinHold.
+type Selector struct {
+	Threshold float64
+	MinHold   time.Duration
+	current   map[string]*selection
+}
+
+// NewSelector creates a new Selector
+func NewSelector(threshold float64, minHold time.Duration) *Selector {
+	return &Selector{threshold, minHold, make(map[string]*selection)}
+}
+
+// Current returns the ID of the candidate currently selected for rig
+func (s *Selector) Current(rig string) string {
+	if sel, ok := s.current[rig]; ok {
+		return sel.id
+	}
+	return ""
+}
+
+// Select returns the ID of the candidate rig should be mining on and whether
+// this differs from the previous selection
+func (s *Selector) Select(rig string, ranked []Estimate, now time.Time) (string, bool) {
+	if len(ranked) == 0 {
+		return s.Current(rig), false
+	}
+	best := ranked[0]
+	sel, ok := s.current[rig]
+	if !ok {
+		s.current[rig] = &selection{best.ID, now}
+		return best.ID, true
+	}
+	if strings.Compare(sel.id, best.ID) == 0 {
+		return sel.id, false
+	}
+
+	var current *Estimate
+	for idx := range ranked {
+		if strings.Compare(ranked[idx].ID, sel.id) == 0 {
+			current = &ranked[idx]
+			break
+		}
+	}
+	// If the current candidate is no longer available, switch immediately
+	if current != nil {
+		if now.Sub(sel.since) < s.MinHold {
+			return sel.id, false
+		}
+		if best.Revenue <= current.Revenue*(1+s.Threshold/100) {
+			return sel.id, false
+		}
+	}
+	s.current[rig] = &selection{best.ID, now}
+	return best.ID, true
+}
@@ -0,0 +1,105 @@
+package profit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testMarketData(require *require.Assertions) map[string]*MarketData {
+	provider, err := ParseProvider(&ProviderConfig{Type: PROVIDER_FILE, Path: "testdata/market.json"})
+	require.Nil(err)
+	market, err := provider.MarketData()
+	require.Nil(err)
+	return market
+}
+
+func TestFileProvider(t *testing.T) {
+	require := require.New(t)
+
+	market := testMarketData(require)
+	require.Equal(3, len(market))
+	require.Equal("cryptonight", market["xmr"].Algorithm)
+	require.Equal(40.0, market["sumo"].Reward)
+
+	provider := &FileProvider{"testdata/missing.json"}
+	_, err := provider.MarketData()
+	require.NotNil(err)
+}
+
+func TestRank(t *testing.T) {
+	require := require.New(t)
+
+	market := testMarketData(require)
+	candidates := []Candidate{
+		{"bcn", "bcn", "", 0},
+		{"xmr", "xmr", "cryptonight", 0},
+		{"sumo", "sumo", "cryptonight-heavy", 0},
+		{"etn", "etn", "cryptonight", 0},
+	}
+
+	// Without a cryptonight-heavy hashrate, sumo cannot be ranked and etn has
+	// no market data
+	ranked := Rank(map[string]float64{"cryptonight": 1000}, candidates, market)
+	require.Equal(2, len(ranked))
+	require.Equal("xmr", ranked[0].ID)
+	require.Equal("bcn", ranked[1].ID)
+	require.InDelta(0.7128, ranked[0].Revenue, 1e-6)
+
+	ranked = Rank(map[string]float64{"cryptonight": 1000, "cryptonight-heavy": 800}, candidates, market)
+	require.Equal(3, len(ranked))
+	require.Equal("sumo", ranked[0].ID)
+
+	// A large enough fee changes the order
+	candidates[1].Fee = 50
+	ranked = Rank(map[string]float64{"cryptonight": 1000}, candidates, market)
+	require.Equal("bcn", ranked[0].ID)
+}
+
+func TestSelectorHysteresis(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1500000000, 0)
+	selector := NewSelector(10, 10*time.Minute)
+
+	ranked := []Estimate{
+		{Candidate{ID: "a"}, 100},
+		{Candidate{ID: "b"}, 95},
+	}
+	id, changed := selector.Select("rig", ranked, now)
+	require.Equal("a", id)
+	require.True(changed)
+
+	// b is now better but within the threshold
+	ranked = []Estimate{
+		{Candidate{ID: "b"}, 105},
+		{Candidate{ID: "a"}, 100},
+	}
+	id, changed = selector.Select("rig", ranked, now.Add(time.Hour))
+	require.Equal("a", id)
+	require.False(changed)
+
+	// b is better by more than the threshold, but a was not held long enough
+	selector = NewSelector(10, 10*time.Minute)
+	selector.Select("rig", []Estimate{{Candidate{ID: "a"}, 100}}, now)
+	ranked = []Estimate{
+		{Candidate{ID: "b"}, 150},
+		{Candidate{ID: "a"}, 100},
+	}
+	id, changed = selector.Select("rig", ranked, now.Add(time.Minute))
+	require.Equal("a", id)
+	require.False(changed)
+
+	id, changed = selector.Select("rig", ranked, now.Add(11*time.Minute))
+	require.Equal("b", id)
+	require.True(changed)
+
+	// If the current pool disappears, switch immediately
+	id, changed = selector.Select("rig", []Estimate{{Candidate{ID: "c"}, 1}}, now.Add(12*time.Minute))
+	require.Equal("c", id)
+	require.True(changed)
+
+	// Rigs are tracked independently
+	require.Equal("", selector.Current("other-rig"))
+}
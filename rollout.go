@@ -0,0 +1,505 @@
+package minerconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+type RolloutState string
+
+const (
+	ROLLOUT_CANARY      RolloutState = "CANARY"
+	ROLLOUT_PROMOTED    RolloutState = "PROMOTED"
+	ROLLOUT_ROLLED_BACK RolloutState = "ROLLED_BACK"
+)
+
+// Number of shares needed before a canary's reject rate is acted upon ahead
+// of the end of the window
+const rolloutMinShares = 10
+
+// RolloutConfig structure representing the configuration of staged rollouts
+// of farm-wide selection changes
+type RolloutConfig struct {
+	// Rigs to try changes on first. If empty, CanaryPercent of the affected
+	// rigs are picked
+	CanaryRigs []string `json:"canary_rigs" yaml:"canary_rigs"`
+	// Percent of the affected rigs to use as canaries. Defaults to 10
+	CanaryPercent float64 `json:"canary_percent" yaml:"canary_percent"`
+	// Seconds to watch the canaries for before applying the change to the
+	// rest of the farm. Defaults to 600
+	Window int `json:"window" yaml:"window"`
+	// Accepted shares every canary must submit within the window. Defaults to 1
+	MinAccepted uint64 `json:"min_accepted" yaml:"min_accepted"`
+	// Maximum percent of rejected shares of a canary. Defaults to 10
+	MaxRejectRate float64 `json:"max_reject_rate" yaml:"max_reject_rate"`
+	// Seconds between checks of the canaries. Defaults to 15
+	Interval int `json:"interval" yaml:"interval"`
+}
+
+// CanaryStatus structure representing how a canary rig has been doing since
+// the rollout started
+type CanaryStatus struct {
+	Rig string `json:"rig"`
+	// Status of the rig when the rollout started
+	StartMinerStarts int    `json:"start_miner_starts"`
+	StartAccepted    uint64 `json:"start_accepted"`
+	StartRejected    uint64 `json:"start_rejected"`
+	// Shares since the rollout started
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	// Selection of the rig before the rollout. Nil if the rig had no
+	// selection of its own
+	Saved []interface{} `json:"saved"`
+}
+
+// update updates the shares of the canary from the latest status of rig
+func (cs *CanaryStatus) update(rig *Rig) {
+	if rig == nil || rig.Status == nil {
+		return
+	}
+	status := rig.Status
+	// The miner restarts with the new pools, resetting its share counts
+	if status.MinerStarts != cs.StartMinerStarts || status.Accepted < cs.StartAccepted || status.Rejected < cs.StartRejected {
+		cs.Accepted = status.Accepted
+		cs.Rejected = status.Rejected
+	} else {
+		cs.Accepted = status.Accepted - cs.StartAccepted
+		cs.Rejected = status.Rejected - cs.StartRejected
+	}
+}
+
+// RejectRate returns the percent of rejected shares
+func (cs *CanaryStatus) RejectRate() float64 {
+	total := cs.Accepted + cs.Rejected
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Rejected) * 100 / float64(total)
+}
+
+// Rollout structure representing a farm-wide selection change being tried on
+// a set of canary rigs
+type Rollout struct {
+	Pools    []interface{}   `json:"pools"`
+	Canaries []*CanaryStatus `json:"canaries"`
+	Actor    string          `json:"actor"`
+	Started  time.Time       `json:"started"`
+	Deadline time.Time       `json:"deadline"`
+	State    RolloutState    `json:"state"`
+	// Why the rollout was rolled back
+	Reason string `json:"reason"`
+}
+
+func (r *Rollout) canaryRigs() []string {
+	ret := make([]string, 0)
+	for _, canary := range r.Canaries {
+		ret = append(ret, canary.Rig)
+	}
+	return ret
+}
+
+// RolloutManager applies farm-wide selection changes to canary rigs first and
+// either applies them to the rest of the farm or rolls them back depending on
+// how the canaries fare
+type RolloutManager struct {
+	sync.Mutex
+	*RolloutConfig
+	// Clock used for the canary window. Defaults to time.Now
+	Now       func() time.Time
+	server    *Server
+	statePath string
+	// The active rollout, or the last one if none is active
+	rollout *Rollout
+	stop    chan struct{}
+}
+
+// NewRolloutManager creates a new RolloutManager for server. Any rollout that
+// was active when the server stopped is resumed
+func NewRolloutManager(server *Server, config *RolloutConfig, statePath string) (*RolloutManager, error) {
+	if config.CanaryPercent <= 0 {
+		config.CanaryPercent = 10
+	}
+	if config.CanaryPercent > 100 {
+		return nil, fmt.Errorf("Canary percent must be at most 100")
+	}
+	if config.Window <= 0 {
+		config.Window = 600
+	}
+	if config.MinAccepted == 0 {
+		config.MinAccepted = 1
+	}
+	if config.MaxRejectRate <= 0 {
+		config.MaxRejectRate = 10
+	}
+	if config.Interval <= 0 {
+		config.Interval = 15
+	}
+	rm := &RolloutManager{}
+	rm.RolloutConfig = config
+	rm.Now = time.Now
+	rm.server = server
+	rm.statePath = statePath
+	if easyfiles.Exists(statePath) {
+		b, err := ioutil.ReadFile(statePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read rollout state: %v", err)
+		}
+		if err := json.Unmarshal(b, &rm.rollout); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal rollout state: %v", err)
+		}
+	}
+	return rm, nil
+}
+
+// Start periodically checks the canaries until Stop is called
+func (rm *RolloutManager) Start() {
+	rm.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(rm.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rm.stop:
+				return
+			case <-ticker.C:
+				rm.Evaluate()
+			}
+		}
+	}()
+}
+
+// Stop stops periodic checks
+func (rm *RolloutManager) Stop() {
+	if rm.stop != nil {
+		close(rm.stop)
+		rm.stop = nil
+	}
+}
+
+// saveState persists the rollout. Must be called with the lock held
+func (rm *RolloutManager) saveState() {
+	b, err := json.Marshal(rm.rollout)
+	if err != nil {
+		log.Errorf("[rollout]: Failed to marshal rollout state: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(rm.statePath, b, 0666); err != nil {
+		log.Errorf("[rollout]: Failed to write rollout state: %v", err)
+	}
+}
+
+// pickCanaries returns the online rigs to try a farm-wide change on
+func (rm *RolloutManager) pickCanaries() []string {
+	affected := make([]string, 0)
+	for _, rig := range rm.server.Inventory.Rigs() {
+		// Only online rigs report the shares canaries are judged by and rigs
+		// with a selection of their own or of their group are unaffected
+		if rig.Online && rm.server.Store.UsesFarmSelection(rig.RigID, rig.Group) {
+			affected = append(affected, rig.RigID)
+		}
+	}
+	sort.Strings(affected)
+	if len(rm.CanaryRigs) > 0 {
+		return intersection(affected, rm.CanaryRigs)
+	}
+	if len(affected) == 0 {
+		return affected
+	}
+	count := int(math.Ceil(float64(len(affected)) * rm.CanaryPercent / 100))
+	return affected[:count]
+}
+
+// intersection returns the entries of a that are also in b
+func intersection(a []string, b []string) []string {
+	return difference(a, difference(a, b))
+}
+
+// Active returns whether a rollout is in progress
+func (rm *RolloutManager) Active() bool {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.rollout != nil && rm.rollout.State == ROLLOUT_CANARY
+}
+
+// Current returns a copy of the active rollout, or the last one if none is
+// active. Returns nil if there never was one
+func (rm *RolloutManager) Current() *Rollout {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.rollout == nil {
+		return nil
+	}
+	ret := &Rollout{}
+	*ret = *rm.rollout
+	ret.Canaries = make([]*CanaryStatus, 0)
+	for _, canary := range rm.rollout.Canaries {
+		c := &CanaryStatus{}
+		*c = *canary
+		ret.Canaries = append(ret.Canaries, c)
+	}
+	return ret
+}
+
+// Begin starts rolling out pools as the farm-wide selection on behalf of
+// actor. Returns false if there are no canaries to try the change on, in which
+// case the caller is expected to apply it right away
+func (rm *RolloutManager) Begin(actor string, pools []interface{}) (bool, error) {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.rollout != nil && rm.rollout.State == ROLLOUT_CANARY {
+		return false, fmt.Errorf("A rollout started by '%v' is still in progress", rm.rollout.Actor)
+	}
+	canaryRigs := rm.pickCanaries()
+	if len(canaryRigs) == 0 {
+		return false, nil
+	}
+
+	now := rm.Now()
+	rollout := &Rollout{}
+	rollout.Pools = pools
+	rollout.Actor = actor
+	rollout.Started = now
+	rollout.Deadline = now.Add(time.Duration(rm.Window) * time.Second)
+	rollout.State = ROLLOUT_CANARY
+	rollout.Canaries = make([]*CanaryStatus, 0)
+	for _, rigID := range canaryRigs {
+		canary := &CanaryStatus{Rig: rigID}
+		if rig := rm.server.Inventory.Get(rigID); rig != nil && rig.Status != nil {
+			canary.StartMinerStarts = rig.Status.MinerStarts
+			canary.StartAccepted = rig.Status.Accepted
+			canary.StartRejected = rig.Status.Rejected
+		}
+		if rm.server.Store.HasRigSelectedPools(rigID) {
+			canary.Saved = rm.server.Store.SelectedPools(rigID)
+		}
+		if err := rm.server.Store.SetSelectedPools(rigID, pools); err != nil {
+			// Undo what was done so far
+			for _, started := range rollout.Canaries {
+				rm.restore(rollout, started)
+			}
+			return false, fmt.Errorf("Failed to apply selected pools to canary '%v': %v", rigID, err)
+		}
+		rollout.Canaries = append(rollout.Canaries, canary)
+	}
+	rm.rollout = rollout
+	rm.saveState()
+
+	log.Infof("[rollout]: Trying new selection on %v for %v", canaryRigs, time.Duration(rm.Window)*time.Second)
+	rm.server.Audit.Record(&AuditEntry{
+		Event:   AUDIT_ROLLOUT,
+		Actor:   actor,
+		Message: fmt.Sprintf("Started rollout on canaries %v", strings.Join(canaryRigs, ", ")),
+		Details: poolURLs(pools),
+	})
+	for _, rigID := range canaryRigs {
+		rm.server.PushSelectedPools(rigID)
+	}
+	return true, nil
+}
+
+// Evaluate checks the canaries of the active rollout, rolling it back as soon
+// as one of them misbehaves and promoting it once the window has passed
+func (rm *RolloutManager) Evaluate() {
+	rm.Lock()
+	defer rm.Unlock()
+	rollout := rm.rollout
+	if rollout == nil || rollout.State != ROLLOUT_CANARY {
+		return
+	}
+	now := rm.Now()
+	done := !now.Before(rollout.Deadline)
+	for _, canary := range rollout.Canaries {
+		rig := rm.server.Inventory.Get(canary.Rig)
+		if rig == nil || !rig.Online {
+			rm.rollback(ACTOR_ROLLOUT, fmt.Sprintf("Canary '%v' went offline", canary.Rig))
+			return
+		}
+		canary.update(rig)
+		total := canary.Accepted + canary.Rejected
+		if (done || total >= rolloutMinShares) && canary.RejectRate() > rm.MaxRejectRate {
+			rm.rollback(ACTOR_ROLLOUT, fmt.Sprintf("Canary '%v' had %.1f%% of its shares rejected", canary.Rig, canary.RejectRate()))
+			return
+		}
+		if done && canary.Accepted < rm.MinAccepted {
+			rm.rollback(ACTOR_ROLLOUT, fmt.Sprintf("Canary '%v' only had %d shares accepted", canary.Rig, canary.Accepted))
+			return
+		}
+	}
+	if done {
+		rm.promote(ACTOR_ROLLOUT)
+		return
+	}
+	rm.saveState()
+}
+
+// Promote applies the active rollout to the whole farm without waiting for
+// the window to pass
+func (rm *RolloutManager) Promote(actor string) error {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.rollout == nil || rm.rollout.State != ROLLOUT_CANARY {
+		return fmt.Errorf("No rollout in progress")
+	}
+	rm.promote(actor)
+	return nil
+}
+
+// Cancel rolls back the active rollout
+func (rm *RolloutManager) Cancel(actor string) error {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.rollout == nil || rm.rollout.State != ROLLOUT_CANARY {
+		return fmt.Errorf("No rollout in progress")
+	}
+	rm.rollback(actor, fmt.Sprintf("Cancelled by %v", actor))
+	return nil
+}
+
+// restore returns canary to the selection it had before rollout. Canaries
+// whose selection was changed by something else during the rollout are left
+// alone
+func (rm *RolloutManager) restore(rollout *Rollout, canary *CanaryStatus) {
+	store := rm.server.Store
+	if !store.HasRigSelectedPools(canary.Rig) || !sameSelection(store.SelectedPools(canary.Rig), rollout.Pools) {
+		log.Warnf("[rollout]: Selection of canary '%v' changed during the rollout. Leaving it as it is", canary.Rig)
+		return
+	}
+	var err error
+	if canary.Saved == nil {
+		err = store.RemoveRigSelectedPools(canary.Rig)
+	} else {
+		err = store.SetSelectedPools(canary.Rig, canary.Saved)
+	}
+	if err != nil {
+		log.Errorf("[rollout]: Failed to restore the selection of canary '%v': %v", canary.Rig, err)
+	}
+}
+
+// sameSelection returns whether a and b select the same pools with the same
+// settings
+func sameSelection(a []interface{}, b []interface{}) bool {
+	aBytes, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bBytes, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// IsCanary returns whether rig is a canary of the active rollout
+func (rm *RolloutManager) IsCanary(rig string) bool {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.rollout == nil || rm.rollout.State != ROLLOUT_CANARY {
+		return false
+	}
+	for _, canary := range rm.rollout.Canaries {
+		if strings.Compare(canary.Rig, rig) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFarmSelectedPools changes the farm-wide selection on behalf of actor. If
+// staged rollouts are enabled, the change is tried on canaries first and true
+// is returned. Otherwise the change is applied, audited with message and
+// pushed right away
+func (s *Server) SetFarmSelectedPools(actor string, pools []interface{}, message string) (bool, error) {
+	if s.Rollout != nil {
+		started, err := s.Rollout.Begin(actor, pools)
+		if err != nil || started {
+			return started, err
+		}
+	}
+	if err := s.Store.SetSelectedPools("", pools); err != nil {
+		return false, err
+	}
+	s.auditSelection(actor, "", message)
+	s.BroadcastSelectedPools()
+	return false, nil
+}
+
+// promote makes the rollout's pools the farm-wide selection and returns the
+// canaries to it. Must be called with the lock held
+func (rm *RolloutManager) promote(actor string) {
+	rollout := rm.rollout
+	if err := rm.server.Store.SetSelectedPools("", rollout.Pools); err != nil {
+		log.Errorf("[rollout]: Failed to apply selected pools to the farm: %v", err)
+		return
+	}
+	for _, canary := range rollout.Canaries {
+		rm.restore(rollout, canary)
+	}
+	rollout.State = ROLLOUT_PROMOTED
+	rm.saveState()
+	log.Infof("[rollout]: Canaries look good. Applying new selection to the farm")
+	rm.server.auditSelection(actor, "", "Promoted rollout to the whole farm")
+	rm.server.BroadcastSelectedPools()
+}
+
+// rollback returns the canaries to the selection they had before the
+// rollout. Must be called with the lock held
+func (rm *RolloutManager) rollback(actor string, reason string) {
+	rollout := rm.rollout
+	for _, canary := range rollout.Canaries {
+		rm.restore(rollout, canary)
+	}
+	rollout.State = ROLLOUT_ROLLED_BACK
+	rollout.Reason = reason
+	rm.saveState()
+	log.Warnf("[rollout]: Rolling back: %v", reason)
+	rm.server.Audit.Record(&AuditEntry{
+		Event:   AUDIT_ROLLOUT,
+		Actor:   actor,
+		Message: fmt.Sprintf("Rolled back rollout: %v", reason),
+		Details: rollout.canaryRigs(),
+	})
+	for _, rigID := range rollout.canaryRigs() {
+		rm.server.PushSelectedPools(rigID)
+	}
+}
+
+// handleGetRollout sends the active or last rollout to the requester
+func (s *Server) handleGetRollout(w *websockets.WebsocketClient, data interface{}) {
+	var rollout *Rollout
+	if s.Rollout != nil {
+		rollout = s.Rollout.Current()
+	}
+	w.Emit("get-rollout-result", jsonData(rollout))
+}
+
+// handleRolloutAction handles promote-rollout and cancel-rollout requests
+func (s *Server) handleRolloutAction(evt string, w *websockets.WebsocketClient) {
+	s.publishEvent(evt, fmt.Sprintf("clientaddr=%v", w.RemoteAddr()))
+	if s.Rollout == nil {
+		w.Emit("error", "Staged rollouts are not enabled")
+		return
+	}
+	var err error
+	if strings.Compare(evt, "promote-rollout") == 0 {
+		err = s.Rollout.Promote(clientAddr(w))
+	} else {
+		err = s.Rollout.Cancel(clientAddr(w))
+	}
+	if err != nil {
+		log.Errorf("[%v]: %v", evt, err)
+		w.Emit("error", err.Error())
+		return
+	}
+	w.Emit("get-rollout-result", jsonData(s.Rollout.Current()))
+}
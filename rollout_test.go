@@ -0,0 +1,174 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollout(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-rollout")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Rollout:       &RolloutConfig{CanaryPercent: 25, Window: 600},
+	})
+	require.Nil(err)
+	rm := server.Rollout
+
+	now := time.Unix(1500000000, 0)
+	clock := func() time.Time {
+		return now
+	}
+	rm.Now = clock
+	server.Inventory.Now = clock
+
+	oldPools := []interface{}{map[string]interface{}{"url": "old"}}
+	newPools := []interface{}{map[string]interface{}{"url": "new"}}
+	require.Nil(server.Store.SetSelectedPools("", oldPools))
+	for _, rig := range []string{"rig1", "rig2", "rig3", "rig4", "rig5"} {
+		server.Inventory.Register(&RigInfo{RigID: rig}, "10.0.0.2:51234")
+		server.Inventory.ReportStatus(rig, &StatusReport{MinerStarts: 1, Accepted: 100, Rejected: 1})
+	}
+	// rig5 is unaffected by farm-wide changes
+	require.Nil(server.Store.SetSelectedPools("rig5", oldPools))
+
+	report := func(rig string, starts int, accepted uint64, rejected uint64) {
+		server.Inventory.ReportStatus(rig, &StatusReport{MinerStarts: starts, Accepted: accepted, Rejected: rejected})
+	}
+
+	// 25% of the 4 affected rigs
+	started, err := rm.Begin("10.0.0.5:40000", newPools)
+	require.Nil(err)
+	require.True(started)
+	rollout := rm.Current()
+	require.Equal([]string{"rig1"}, rollout.canaryRigs())
+	require.Equal([]string{"new"}, poolURLs(server.Store.SelectedPools("rig1")))
+	require.Equal([]string{"old"}, poolURLs(server.Store.SelectedPools("rig2")))
+
+	// Only one rollout at a time
+	_, err = rm.Begin("10.0.0.5:40000", oldPools)
+	require.NotNil(err)
+
+	// The miner restarted on the new pool and is doing fine
+	now = now.Add(5 * time.Minute)
+	report("rig1", 2, 20, 1)
+	rm.Evaluate()
+	require.Equal(ROLLOUT_CANARY, rm.Current().State)
+	require.Equal(uint64(20), rm.Current().Canaries[0].Accepted)
+
+	now = now.Add(5 * time.Minute)
+	report("rig1", 2, 40, 1)
+	rm.Evaluate()
+	require.Equal(ROLLOUT_PROMOTED, rm.Current().State)
+	require.Equal([]string{"new"}, poolURLs(server.Store.SelectedPools("")))
+	require.False(server.Store.HasRigSelectedPools("rig1"))
+	require.Equal([]string{"old"}, poolURLs(server.Store.SelectedPools("rig5")))
+
+	// A pool rejecting shares is rolled back before the window ends
+	started, err = rm.Begin(ACTOR_SCHEDULER, oldPools)
+	require.Nil(err)
+	require.True(started)
+	now = now.Add(time.Minute)
+	report("rig1", 3, 5, 10)
+	rm.Evaluate()
+	rollout = rm.Current()
+	require.Equal(ROLLOUT_ROLLED_BACK, rollout.State)
+	require.Contains(rollout.Reason, "rejected")
+	require.False(server.Store.HasRigSelectedPools("rig1"))
+	require.Equal([]string{"new"}, poolURLs(server.Store.SelectedPools("rig1")))
+
+	// Canaries without accepted shares by the end of the window are rolled back
+	started, err = rm.Begin(ACTOR_SCHEDULER, oldPools)
+	require.Nil(err)
+	require.True(started)
+	now = now.Add(10 * time.Minute)
+	server.Inventory.Heartbeat("rig1", &Heartbeat{})
+	rm.Evaluate()
+	require.Equal(ROLLOUT_ROLLED_BACK, rm.Current().State)
+	require.Contains(rm.Current().Reason, "accepted")
+
+	// Rollouts survive restarts and can be cancelled
+	started, err = rm.Begin(ACTOR_SCHEDULER, oldPools)
+	require.Nil(err)
+	require.True(started)
+	rm, err = NewRolloutManager(server, server.Rollout.RolloutConfig, rm.statePath)
+	require.Nil(err)
+	require.True(rm.Active())
+	require.Nil(rm.Cancel("10.0.0.5:40000"))
+	require.NotNil(rm.Cancel("10.0.0.5:40000"))
+	require.False(server.Store.HasRigSelectedPools("rig1"))
+
+	entries, err := server.Audit.Query(&AuditQuery{Events: []string{AUDIT_ROLLOUT}})
+	require.Nil(err)
+	require.Equal(7, len(entries))
+
+	// Nothing to try the change on
+	for _, rig := range []string{"rig1", "rig2", "rig3", "rig4"} {
+		server.Inventory.Remove(rig)
+	}
+	started, err = rm.Begin("10.0.0.5:40000", oldPools)
+	require.Nil(err)
+	require.False(started)
+}
+
+func TestRolloutFarmChanges(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-rollout")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Rollout:       &RolloutConfig{CanaryRigs: []string{"rig1", "rig2"}, Window: 600},
+	})
+	require.Nil(err)
+	rm := server.Rollout
+	oldPools := []interface{}{map[string]interface{}{"url": "old"}}
+	newPools := []interface{}{map[string]interface{}{"url": "new"}}
+	otherPools := []interface{}{map[string]interface{}{"url": "other"}}
+	for _, rig := range []string{"rig1", "rig2", "rig3"} {
+		server.Inventory.Register(&RigInfo{RigID: rig}, "10.0.0.2:51234")
+	}
+
+	started, err := server.SetFarmSelectedPools("10.0.0.5:40000", oldPools, "Selected 1 pools")
+	require.Nil(err)
+	require.True(started)
+	require.Nil(rm.Cancel("10.0.0.5:40000"))
+
+	// Without canaries the change is applied right away
+	rm.CanaryRigs = []string{"rig4"}
+	started, err = server.SetFarmSelectedPools("10.0.0.5:40000", oldPools, "Selected 1 pools")
+	require.Nil(err)
+	require.False(started)
+	require.Equal([]string{"old"}, poolURLs(server.Store.SelectedPools("")))
+	started, err = server.SetFarmSelectedPools("10.0.0.5:40000", newPools, "Selected 1 pools")
+	require.Nil(err)
+	require.False(started)
+
+	// Rolling back the farm-wide selection is tried on canaries too
+	rm.CanaryRigs = []string{"rig1", "rig2"}
+	history, err := server.Store.History("")
+	require.Nil(err)
+	started, err = server.RollbackFarmSelection("10.0.0.5:40000", history[0].Version)
+	require.Nil(err)
+	require.True(started)
+	require.True(rm.IsCanary("rig1"))
+	require.False(rm.IsCanary("rig3"))
+	require.Equal([]string{"new"}, poolURLs(server.Store.SelectedPools("")))
+	require.Equal([]string{"old"}, poolURLs(server.Store.SelectedPools("rig1")))
+
+	// Canaries whose selection changed during the rollout keep it
+	require.Nil(server.Store.SetSelectedPools("rig2", otherPools))
+	require.Nil(rm.Cancel("10.0.0.5:40000"))
+	require.False(server.Store.HasRigSelectedPools("rig1"))
+	require.Equal([]string{"other"}, poolURLs(server.Store.SelectedPools("rig2")))
+}
@@ -0,0 +1,177 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string][]time.Weekday{
+	"sunday":    {time.Sunday},
+	"monday":    {time.Monday},
+	"tuesday":   {time.Tuesday},
+	"wednesday": {time.Wednesday},
+	"thursday":  {time.Thursday},
+	"friday":    {time.Friday},
+	"saturday":  {time.Saturday},
+	"sun":       {time.Sunday},
+	"mon":       {time.Monday},
+	"tue":       {time.Tuesday},
+	"wed":       {time.Wednesday},
+	"thu":       {time.Thursday},
+	"fri":       {time.Friday},
+	"sat":       {time.Saturday},
+	"weekdays":  {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends":  {time.Saturday, time.Sunday},
+	"daily":     {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+// Rule structure representing a time-of-day and calendar rule.
+// A rule matches when all of its specified conditions match. Unspecified
+// conditions match everything.
+type Rule struct {
+	Name string `json:"name" yaml:"name"`
+	// Days of the week, e.g. ["monday", "friday"], ["weekdays"] or ["weekends"]
+	Days []string `json:"days" yaml:"days"`
+	// Occurrence of Days within the month: 1-5 for the first to fifth, -1 for
+	// the last. Use along with Days, e.g. days: [sunday], week: 1 for the first
+	// Sunday of the month
+	Week int `json:"week" yaml:"week"`
+	// Days of the month
+	Dates []int `json:"dates" yaml:"dates"`
+	// Time of day in 24-hour HH:MM. If End is before Start, the rule wraps
+	// past midnight and the part after midnight belongs to the previous day
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end" yaml:"end"`
+	// Name of the pool set to select while this rule is active
+	PoolSet string `json:"pool_set" yaml:"pool_set"`
+	// Rigs this rule applies to. Empty applies to the whole farm
+	Rigs []string `json:"rigs" yaml:"rigs"`
+
+	weekdays map[time.Weekday]bool
+	start    time.Duration
+	end      time.Duration
+}
+
+func parseTimeOfDay(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day '%v': %v", str, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Validate checks the rule for errors and prepares it for matching. It must be
+// called before Matches.
+func (r *Rule) Validate() error {
+	if strings.Compare(r.PoolSet, "") == 0 {
+		return fmt.Errorf("Rule '%v' is missing 'pool_set'", r.Name)
+	}
+	r.weekdays = nil
+	if len(r.Days) > 0 {
+		r.weekdays = make(map[time.Weekday]bool)
+		for _, day := range r.Days {
+			weekdays, ok := dayNames[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("Rule '%v': unknown day '%v'", r.Name, day)
+			}
+			for _, weekday := range weekdays {
+				r.weekdays[weekday] = true
+			}
+		}
+	}
+	if r.Week != 0 && (r.Week < -1 || r.Week > 5) {
+		return fmt.Errorf("Rule '%v': week must be between 1 and 5 or -1", r.Name)
+	}
+	if r.Week != 0 && len(r.Days) == 0 {
+		return fmt.Errorf("Rule '%v': week requires days", r.Name)
+	}
+	for _, date := range r.Dates {
+		if date < 1 || date > 31 {
+			return fmt.Errorf("Rule '%v': invalid date %d", r.Name, date)
+		}
+	}
+	if (strings.Compare(r.Start, "") == 0) != (strings.Compare(r.End, "") == 0) {
+		return fmt.Errorf("Rule '%v': start and end must be specified together", r.Name)
+	}
+	if strings.Compare(r.Start, "") != 0 {
+		var err error
+		if r.start, err = parseTimeOfDay(r.Start); err != nil {
+			return fmt.Errorf("Rule '%v': %v", r.Name, err)
+		}
+		if r.end, err = parseTimeOfDay(r.End); err != nil {
+			return fmt.Errorf("Rule '%v': %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matchesDay(t time.Time) bool {
+	if r.weekdays != nil && !r.weekdays[t.Weekday()] {
+		return false
+	}
+	if r.Week > 0 && (t.Day()-1)/7+1 != r.Week {
+		return false
+	}
+	if r.Week == -1 && t.AddDate(0, 0, 7).Month() == t.Month() {
+		return false
+	}
+	if len(r.Dates) > 0 {
+		found := false
+		for _, date := range r.Dates {
+			if date == t.Day() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns whether the rule is active at t
+func (r *Rule) Matches(t time.Time) bool {
+	if strings.Compare(r.Start, "") == 0 {
+		return r.matchesDay(t)
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	timeOfDay := t.Sub(midnight)
+	if r.start < r.end {
+		return timeOfDay >= r.start && timeOfDay < r.end && r.matchesDay(t)
+	}
+	// Wraps past midnight
+	if timeOfDay >= r.start {
+		return r.matchesDay(t)
+	}
+	if timeOfDay < r.end {
+		return r.matchesDay(midnight.AddDate(0, 0, -1))
+	}
+	return false
+}
+
+// AppliesTo returns whether the rule applies to rig. An empty rig refers to
+// the whole farm.
+func (r *Rule) AppliesTo(rig string) bool {
+	if len(r.Rigs) == 0 {
+		return strings.Compare(rig, "") == 0
+	}
+	for _, target := range r.Rigs {
+		if strings.Compare(target, rig) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Active returns the first of rules that applies to rig and matches t, or nil
+// if there is none
+func Active(rules []*Rule, rig string, t time.Time) *Rule {
+	for _, rule := range rules {
+		if rule.AppliesTo(rig) && rule.Matches(t) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func parseRules(require *require.Assertions, str string) []*Rule {
+	var rules []*Rule
+	err := yaml.Unmarshal([]byte(str), &rules)
+	require.Nil(err)
+	for _, rule := range rules {
+		require.Nil(rule.Validate())
+	}
+	return rules
+}
+
+func at(str string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", str)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestWeekdayWindow(t *testing.T) {
+	require := require.New(t)
+
+	rules := parseRules(require, `
+- name: peak
+  days: [weekdays]
+  start: "17:00"
+  end: "21:00"
+  pool_set: peak-pools
+`)
+	rule := rules[0]
+	// 2017-11-06 is a Monday
+	require.True(rule.Matches(at("2017-11-06 17:00")))
+	require.True(rule.Matches(at("2017-11-10 20:59")))
+	require.False(rule.Matches(at("2017-11-06 21:00")))
+	require.False(rule.Matches(at("2017-11-06 16:59")))
+	require.False(rule.Matches(at("2017-11-11 18:00")))
+}
+
+func TestFirstSundayOfMonth(t *testing.T) {
+	require := require.New(t)
+
+	rules := parseRules(require, `
+- name: donate
+  days: [sunday]
+  week: 1
+  pool_set: donation
+- name: last-friday
+  days: [fri]
+  week: -1
+  pool_set: donation
+`)
+	require.True(rules[0].Matches(at("2017-11-05 10:00")))
+	require.False(rules[0].Matches(at("2017-11-12 10:00")))
+	require.False(rules[0].Matches(at("2017-11-04 10:00")))
+
+	require.True(rules[1].Matches(at("2017-11-24 10:00")))
+	require.False(rules[1].Matches(at("2017-11-17 10:00")))
+}
+
+func TestWrapPastMidnight(t *testing.T) {
+	require := require.New(t)
+
+	rules := parseRules(require, `
+- name: night
+  days: [friday]
+  start: "22:00"
+  end: "06:00"
+  pool_set: night
+`)
+	rule := rules[0]
+	require.True(rule.Matches(at("2017-11-10 23:00")))
+	// Saturday morning belongs to Friday night
+	require.True(rule.Matches(at("2017-11-11 05:59")))
+	require.False(rule.Matches(at("2017-11-11 06:00")))
+	require.False(rule.Matches(at("2017-11-10 05:00")))
+}
+
+func TestActive(t *testing.T) {
+	require := require.New(t)
+
+	rules := parseRules(require, `
+- name: donate
+  days: [sunday]
+  week: 1
+  pool_set: donation
+- name: rig1-evening
+  start: "17:00"
+  end: "21:00"
+  pool_set: cheap
+  rigs: [rig1]
+- name: evening
+  start: "17:00"
+  end: "21:00"
+  pool_set: cheap
+`)
+	require.Equal("donate", Active(rules, "", at("2017-11-05 18:00")).Name)
+	require.Equal("evening", Active(rules, "", at("2017-11-06 18:00")).Name)
+	require.Equal("rig1-evening", Active(rules, "rig1", at("2017-11-06 18:00")).Name)
+	require.Nil(Active(rules, "rig1", at("2017-11-06 12:00")))
+	require.Nil(Active(rules, "", at("2017-11-06 12:00")))
+}
+
+func TestValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NotNil((&Rule{Name: "a"}).Validate())
+	require.NotNil((&Rule{Name: "a", PoolSet: "x", Days: []string{"someday"}}).Validate())
+	require.NotNil((&Rule{Name: "a", PoolSet: "x", Start: "17:00"}).Validate())
+	require.NotNil((&Rule{Name: "a", PoolSet: "x", Start: "25:00", End: "01:00"}).Validate())
+	require.NotNil((&Rule{Name: "a", PoolSet: "x", Week: 1}).Validate())
+	require.Nil((&Rule{Name: "a", PoolSet: "x", Dates: []int{1, 15}}).Validate())
+}
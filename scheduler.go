@@ -0,0 +1,343 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/gurupras/minerconfig/schedule"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScheduleConfig structure representing the configuration of the pool
+// scheduler
+type ScheduleConfig struct {
+	// Seconds between evaluations
+	Interval int `json:"interval" yaml:"interval"`
+	// Timezone the rules are evaluated in, e.g. America/New_York. Defaults to
+	// the local timezone of the server
+	Timezone string `json:"timezone" yaml:"timezone"`
+	// Named lists of pools. Pools are referenced by label, pool_name or url
+	PoolSets map[string][]string `json:"pool_sets" yaml:"pool_sets"`
+	// Rules in order of priority
+	Rules []*schedule.Rule `json:"rules" yaml:"rules"`
+}
+
+// scheduleState structure representing what the scheduler has done to a
+// target so that it can be undone once the rule stops matching
+type scheduleState struct {
+	// Rule whose pools are in place. Empty while the farm-wide selection of
+	// the first rule is still being rolled out
+	Rule string `json:"rule"`
+	// Selection in place before the rule was applied. A nil Saved on a rig
+	// means the rig had no selection of its own
+	Saved []interface{} `json:"saved"`
+}
+
+// Scheduler selects pool sets according to time-of-day and calendar rules.
+// When a rule stops matching, the selection in place before it was applied is
+// restored.
+type Scheduler struct {
+	sync.Mutex
+	*ScheduleConfig
+	// Clock used to evaluate rules. Defaults to time.Now
+	Now       func() time.Time
+	server    *Server
+	location  *time.Location
+	statePath string
+	state     map[string]*scheduleState
+	stop      chan struct{}
+}
+
+// NewScheduler creates a new Scheduler for server
+func NewScheduler(server *Server, config *ScheduleConfig) (*Scheduler, error) {
+	for _, rule := range config.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := config.PoolSets[rule.PoolSet]; !ok {
+			return nil, fmt.Errorf("Rule '%v' refers to unknown pool set '%v'", rule.Name, rule.PoolSet)
+		}
+	}
+	location := time.Local
+	if strings.Compare(config.Timezone, "") != 0 {
+		var err error
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("Failed to load timezone '%v': %v", config.Timezone, err)
+		}
+	}
+	if config.Interval <= 0 {
+		config.Interval = 60
+	}
+
+	s := &Scheduler{}
+	s.ScheduleConfig = config
+	s.Now = time.Now
+	s.server = server
+	s.location = location
+	s.statePath = filepath.Join(server.Store.Dir, "schedule-state")
+	s.state = make(map[string]*scheduleState)
+	if easyfiles.Exists(s.statePath) {
+		b, err := ioutil.ReadFile(s.statePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read schedule state '%v': %v", s.statePath, err)
+		}
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal schedule state '%v': %v", s.statePath, err)
+		}
+	}
+	return s, nil
+}
+
+// Start periodically evaluates the rules until Stop is called
+func (s *Scheduler) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := s.Evaluate(); err != nil {
+				log.Errorf("Failed to evaluate schedule: %v", err)
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops periodic evaluation
+func (s *Scheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// targets returns the farm ("") followed by every rig that has a rule of its
+// own or is still under the effect of one
+func (s *Scheduler) targets() []string {
+	seen := map[string]bool{"": true}
+	ret := []string{""}
+	for _, rule := range s.Rules {
+		for _, rig := range rule.Rigs {
+			if !seen[rig] {
+				seen[rig] = true
+				ret = append(ret, rig)
+			}
+		}
+	}
+	for rig := range s.state {
+		if !seen[rig] {
+			seen[rig] = true
+			ret = append(ret, rig)
+		}
+	}
+	return ret
+}
+
+// ResolvePoolSet returns the available pools making up the pool set name in
+// the order they are listed
+func (s *Scheduler) ResolvePoolSet(name string) ([]interface{}, error) {
+	refs, ok := s.PoolSets[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown pool set '%v'", name)
+	}
+	pools := s.server.Store.Pools()
+	ret := make([]interface{}, 0)
+	for _, ref := range refs {
+		found := false
+		for _, rawPool := range pools {
+			var pool Pool
+			if err := decodeData(rawPool, &pool); err != nil {
+				continue
+			}
+			if strings.Compare(pool.Url, ref) == 0 ||
+				(pool.Label != nil && strings.Compare(*pool.Label, ref) == 0) ||
+				(pool.PoolName != nil && strings.Compare(*pool.PoolName, ref) == 0) {
+				ret = append(ret, rawPool)
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("[schedule]: Pool set '%v': no pool matching '%v'", name, ref)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("Pool set '%v' has no available pools", name)
+	}
+	return ret, nil
+}
+
+// Evaluate applies the rules that match the current time and restores the
+// selections of targets whose rule stopped matching
+func (s *Scheduler) Evaluate() error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.Now().In(s.location)
+	changed := false
+	for _, target := range s.targets() {
+		rule := schedule.Active(s.Rules, target, now)
+		if strings.Compare(target, "") == 0 {
+			if s.evaluateFarm(rule) {
+				changed = true
+			}
+			continue
+		}
+		state, scheduled := s.state[target]
+		if rule == nil {
+			if !scheduled {
+				continue
+			}
+			log.Infof("[schedule]: Rule '%v' ended for '%v'. Restoring previous selection", state.Rule, target)
+			if err := s.restore(target, state); err != nil {
+				log.Errorf("[schedule]: %v", err)
+				continue
+			}
+			delete(s.state, target)
+			changed = true
+			continue
+		}
+		if scheduled && strings.Compare(state.Rule, rule.Name) == 0 {
+			continue
+		}
+		selectedPools, err := s.ResolvePoolSet(rule.PoolSet)
+		if err != nil {
+			log.Errorf("[schedule]: Rule '%v': %v", rule.Name, err)
+			continue
+		}
+		if !scheduled {
+			state = &scheduleState{}
+			if s.server.Store.HasRigSelectedPools(target) {
+				state.Saved = s.server.Store.SelectedPools(target)
+			}
+		}
+		log.Infof("[schedule]: Applying rule '%v' to '%v'", rule.Name, target)
+		if err := s.set(target, selectedPools, fmt.Sprintf("Applied rule '%v' (pool set '%v')", rule.Name, rule.PoolSet)); err != nil {
+			log.Errorf("[schedule]: %v", err)
+			continue
+		}
+		state.Rule = rule.Name
+		s.state[target] = state
+		changed = true
+	}
+	if changed {
+		return s.saveState()
+	}
+	return nil
+}
+
+// evaluateFarm moves the farm-wide selection to the pools of rule, or back to
+// the selection saved before the first rule once no rule matches. Farm-wide
+// changes may be rolled out to canaries first, so a rule only counts as
+// applied once its pools are actually selected. Changes that are refused or
+// rolled back are tried again on the next evaluation. Returns whether the
+// state changed
+func (s *Scheduler) evaluateFarm(rule *schedule.Rule) bool {
+	changed := false
+	state, scheduled := s.state[""]
+	var desired []interface{}
+	var message string
+	if rule == nil {
+		if !scheduled {
+			return false
+		}
+		desired = state.Saved
+		if desired == nil {
+			desired = make([]interface{}, 0)
+		}
+		message = fmt.Sprintf("Rule '%v' ended. Restored the previous selection", state.Rule)
+	} else {
+		if scheduled && strings.Compare(state.Rule, rule.Name) == 0 {
+			return false
+		}
+		pools, err := s.ResolvePoolSet(rule.PoolSet)
+		if err != nil {
+			log.Errorf("[schedule]: Rule '%v': %v", rule.Name, err)
+			return false
+		}
+		desired = pools
+		message = fmt.Sprintf("Applied rule '%v' (pool set '%v')", rule.Name, rule.PoolSet)
+		if !scheduled {
+			state = &scheduleState{Saved: s.server.Store.SelectedPools("")}
+			s.state[""] = state
+			changed = true
+		}
+	}
+
+	if !sameSelection(s.server.Store.SelectedPools(""), desired) {
+		if s.server.Rollout != nil && s.server.Rollout.Active() {
+			log.Infof("[schedule]: Waiting for the current rollout to finish before changing the farm-wide selection")
+			return changed
+		}
+		if rule == nil {
+			log.Infof("[schedule]: Rule '%v' ended for the farm. Restoring previous selection", state.Rule)
+		} else {
+			log.Infof("[schedule]: Applying rule '%v' to the farm", rule.Name)
+		}
+		started, err := s.server.SetFarmSelectedPools(ACTOR_SCHEDULER, desired, message)
+		if err != nil {
+			log.Errorf("[schedule]: Failed to change the farm-wide selection: %v. Trying again later", err)
+			return changed
+		}
+		if started {
+			log.Infof("[schedule]: Rolling out the farm-wide selection. Trying again later if it is rolled back")
+			return changed
+		}
+	}
+	if rule == nil {
+		delete(s.state, "")
+	} else {
+		state.Rule = rule.Name
+	}
+	return true
+}
+
+// restore returns rig target to the selection it had before its rule
+func (s *Scheduler) restore(target string, state *scheduleState) error {
+	message := fmt.Sprintf("Rule '%v' ended. Restored the previous selection", state.Rule)
+	if state.Saved == nil {
+		if err := s.server.Store.RemoveRigSelectedPools(target); err != nil {
+			return err
+		}
+		s.server.auditSelection(ACTOR_SCHEDULER, target, message)
+		s.push(target)
+		return nil
+	}
+	return s.set(target, state.Saved, message)
+}
+
+// set changes the selection of rig target
+func (s *Scheduler) set(target string, pools []interface{}, message string) error {
+	if err := s.server.Store.SetSelectedPools(target, pools); err != nil {
+		return err
+	}
+	s.server.auditSelection(ACTOR_SCHEDULER, target, message)
+	s.push(target)
+	return nil
+}
+
+// push sends the new selection the same way update-selected-pools does
+func (s *Scheduler) push(target string) {
+	s.server.PushSelection(target)
+}
+
+func (s *Scheduler) saveState() error {
+	b, err := json.Marshal(s.state)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal schedule state: %v", err)
+	}
+	if err := ioutil.WriteFile(s.statePath, b, 0666); err != nil {
+		return fmt.Errorf("Failed to write schedule state: %v", err)
+	}
+	return nil
+}
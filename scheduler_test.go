@@ -0,0 +1,171 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gurupras/minerconfig/schedule"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testScheduleConfig string = `
+interval: 60
+timezone: UTC
+pool_sets:
+  peak: [xmr-low-power]
+  donation: [donation]
+rules:
+  - name: donate
+    days: [sunday]
+    week: 1
+    pool_set: donation
+  - name: peak
+    days: [weekdays]
+    start: "17:00"
+    end: "21:00"
+    pool_set: peak
+`
+
+func newTestScheduler(require *require.Assertions, webserverPath string) (*Server, *Scheduler, *time.Time) {
+	var scheduleConfig ScheduleConfig
+	err := yaml.Unmarshal([]byte(testScheduleConfig), &scheduleConfig)
+	require.Nil(err)
+
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Schedule:      &scheduleConfig,
+	})
+	require.Nil(err)
+
+	now := time.Date(2017, 11, 6, 12, 0, 0, 0, time.UTC)
+	server.Scheduler.Now = func() time.Time {
+		return now
+	}
+	return server, server.Scheduler, &now
+}
+
+func TestScheduler(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-schedule")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, scheduler, now := newTestScheduler(require, webserverPath)
+	for _, poolStr := range []string{
+		`{"url": "pool.minexmr.com:5555", "user": "a", "label": "default"}`,
+		`{"url": "low.power.pool:3333", "user": "b", "label": "xmr-low-power"}`,
+		`{"url": "donate.pool:3333", "user": "c", "label": "donation"}`,
+	} {
+		_, err := server.Store.AddPool([]byte(poolStr))
+		require.Nil(err)
+	}
+	defaultPools := server.Store.Pools()[:1]
+	require.Nil(server.Store.SetSelectedPools("", defaultPools))
+
+	// Monday noon: nothing scheduled
+	require.Nil(scheduler.Evaluate())
+	checkJson(require, defaultPools, server.Store.SelectedPools(""))
+
+	// Monday evening: peak rule
+	*now = time.Date(2017, 11, 6, 18, 0, 0, 0, time.UTC)
+	require.Nil(scheduler.Evaluate())
+	selected := server.Store.SelectedPools("")
+	require.Equal(1, len(selected))
+	require.Equal("low.power.pool:3333", selected[0].(map[string]interface{})["url"])
+
+	// The state survives a restart and the previous selection is restored
+	_, scheduler, now = newTestScheduler(require, webserverPath)
+	scheduler.server = server
+	*now = time.Date(2017, 11, 6, 21, 30, 0, 0, time.UTC)
+	require.Nil(scheduler.Evaluate())
+	checkJson(require, defaultPools, server.Store.SelectedPools(""))
+
+	// First Sunday of the month is a donation day
+	*now = time.Date(2017, 11, 5, 9, 0, 0, 0, time.UTC)
+	require.Nil(scheduler.Evaluate())
+	selected = server.Store.SelectedPools("")
+	require.Equal("donate.pool:3333", selected[0].(map[string]interface{})["url"])
+}
+
+func TestSchedulerRollout(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-schedule")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	var scheduleConfig ScheduleConfig
+	require.Nil(yaml.Unmarshal([]byte(testScheduleConfig), &scheduleConfig))
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Schedule:      &scheduleConfig,
+		Rollout:       &RolloutConfig{CanaryRigs: []string{"rig1"}, Window: 600},
+	})
+	require.Nil(err)
+	scheduler := server.Scheduler
+	now := time.Date(2017, 11, 6, 18, 0, 0, 0, time.UTC)
+	scheduler.Now = func() time.Time {
+		return now
+	}
+	for _, rig := range []string{"rig1", "rig2"} {
+		server.Inventory.Register(&RigInfo{RigID: rig}, "10.0.0.2:51234")
+	}
+	for _, poolStr := range []string{
+		`{"url": "pool.minexmr.com:5555", "user": "a", "label": "default"}`,
+		`{"url": "low.power.pool:3333", "user": "b", "label": "xmr-low-power"}`,
+	} {
+		_, err := server.Store.AddPool([]byte(poolStr))
+		require.Nil(err)
+	}
+	require.Nil(server.Store.SetSelectedPools("", server.Store.Pools()[:1]))
+
+	// The rule only starts a rollout and is not applied yet
+	require.Nil(scheduler.Evaluate())
+	require.True(server.Rollout.Active())
+	require.Equal([]string{"pool.minexmr.com:5555"}, poolURLs(server.Store.SelectedPools("")))
+	require.Equal("", scheduler.state[""].Rule)
+	require.Nil(scheduler.Evaluate())
+
+	// Rolled back changes are tried again
+	require.Nil(server.Rollout.Cancel("10.0.0.5:40000"))
+	require.Nil(scheduler.Evaluate())
+	require.True(server.Rollout.Active())
+
+	require.Nil(server.Rollout.Promote("10.0.0.5:40000"))
+	require.Nil(scheduler.Evaluate())
+	require.Equal([]string{"low.power.pool:3333"}, poolURLs(server.Store.SelectedPools("")))
+	require.Equal("peak", scheduler.state[""].Rule)
+
+	// Restoring the previous selection is rolled out as well
+	now = time.Date(2017, 11, 6, 21, 30, 0, 0, time.UTC)
+	require.Nil(scheduler.Evaluate())
+	require.True(server.Rollout.Active())
+	require.Nil(server.Rollout.Promote("10.0.0.5:40000"))
+	require.Nil(scheduler.Evaluate())
+	require.Equal([]string{"pool.minexmr.com:5555"}, poolURLs(server.Store.SelectedPools("")))
+	_, scheduled := scheduler.state[""]
+	require.False(scheduled)
+}
+
+func TestSchedulerUnknownPoolSet(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-schedule")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Schedule: &ScheduleConfig{
+			Rules: []*schedule.Rule{
+				{Name: "missing", PoolSet: "missing"},
+			},
+		},
+	})
+	require.Nil(server)
+	require.NotNil(err)
+}
@@ -0,0 +1,101 @@
+package sensors
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gputool "github.com/gurupras/minerconfig/gpu-tool"
+)
+
+// pp_dpm_sclk and pp_dpm_mclk: "1: 1400Mhz *" marks the current state
+var dpmRegexp = regexp.MustCompile(`(?im)^\s*\d+:\s*(\d+)mhz\s*\*\s*$`)
+
+// AMDGPUReader reads the sensors of amdgpu devices from hwmon and sysfs
+type AMDGPUReader struct {
+	// Root of sysfs. Defaults to /sys
+	Root string
+}
+
+func readFloat(path string) *float64 {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// currentClock returns the clock of the current DPM state in a pp_dpm_* file
+func currentClock(path string) *int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	m := dpmRegexp.FindStringSubmatch(string(b))
+	if m == nil {
+		return nil
+	}
+	clock, _ := strconv.Atoi(m[1])
+	return &clock
+}
+
+// ReadDevice reads the sensors of the amdgpu device at devicePath
+func (ar *AMDGPUReader) ReadDevice(devicePath string) *Reading {
+	reading := &Reading{}
+	reading.Source = SOURCE_AMDGPU
+	reading.Name = "amdgpu"
+	reading.CoreClock = currentClock(filepath.Join(devicePath, "pp_dpm_sclk"))
+	reading.MemoryClock = currentClock(filepath.Join(devicePath, "pp_dpm_mclk"))
+
+	matches, _ := filepath.Glob(filepath.Join(devicePath, "hwmon", "hwmon*"))
+	if len(matches) == 0 {
+		return reading
+	}
+	hwmon := matches[0]
+	if millidegrees := readFloat(filepath.Join(hwmon, "temp1_input")); millidegrees != nil {
+		temperature := *millidegrees / 1000
+		reading.Temperature = &temperature
+	}
+	if rpm := readFloat(filepath.Join(hwmon, "fan1_input")); rpm != nil {
+		fanRPM := int(*rpm)
+		reading.FanRPM = &fanRPM
+	}
+	if pwm := readFloat(filepath.Join(hwmon, "pwm1")); pwm != nil {
+		max := 255.0
+		if pwmMax := readFloat(filepath.Join(hwmon, "pwm1_max")); pwmMax != nil && *pwmMax > 0 {
+			max = *pwmMax
+		}
+		percent := *pwm * 100 / max
+		reading.FanPercent = &percent
+	}
+	// Older kernels only have the average
+	for _, file := range []string{"power1_input", "power1_average"} {
+		if microwatts := readFloat(filepath.Join(hwmon, file)); microwatts != nil {
+			watts := *microwatts / 1000000
+			reading.Power = &watts
+			break
+		}
+	}
+	return reading
+}
+
+func (ar *AMDGPUReader) Read() ([]*Reading, error) {
+	cards, err := (&gputool.AMDGPUSysfs{Root: ar.Root}).Cards()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Reading, 0)
+	for topology, devicePath := range cards {
+		t := topology
+		reading := ar.ReadDevice(devicePath)
+		reading.Topology = &t
+		ret = append(ret, reading)
+	}
+	return ret, nil
+}
@@ -0,0 +1,59 @@
+package sensors
+
+import (
+	"testing"
+
+	"github.com/gurupras/minerconfig/internal/sysfstest"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAMDGPUReader(t *testing.T) {
+	require := require.New(t)
+
+	sysfs := sysfstest.New(require)
+	defer sysfs.Remove()
+	device, hwmon := sysfs.AddCard("0000:01:00.0", "amdgpu")
+	sysfs.WriteFiles(device, map[string]string{
+		"pp_dpm_sclk": "0: 300Mhz\n1: 1000Mhz\n2: 1366Mhz *\n",
+		"pp_dpm_mclk": "0: 300Mhz\n1: 2000Mhz *\n",
+	})
+	sysfs.WriteFiles(hwmon, map[string]string{
+		"temp1_input":    "67000\n",
+		"fan1_input":     "2150\n",
+		"pwm1":           "153\n",
+		"pwm1_max":       "255\n",
+		"power1_average": "121000000\n",
+	})
+	// Cards whose sensors are missing or unreadable are still reported
+	device, hwmon = sysfs.AddCard("0000:02:00.0", "amdgpu")
+	sysfs.WriteFiles(device, map[string]string{"pp_dpm_sclk": "0: 300Mhz\n1: 1000Mhz\n"})
+	sysfs.WriteFiles(hwmon, map[string]string{"temp1_input": "garbage\n"})
+
+	readings, err := (&AMDGPUReader{sysfs.Root}).Read()
+	require.Nil(err)
+	require.Equal(2, len(readings))
+
+	reading := Find(readings, &pcie.Topology{Bus: 1})
+	require.NotNil(reading)
+	require.Equal(SOURCE_AMDGPU, reading.Source)
+	require.Equal(67.0, *reading.Temperature)
+	require.Equal(2150, *reading.FanRPM)
+	require.Equal(60.0, *reading.FanPercent)
+	require.Equal(121.0, *reading.Power)
+	require.Equal(1366, *reading.CoreClock)
+	require.Equal(2000, *reading.MemoryClock)
+
+	reading = Find(readings, &pcie.Topology{Bus: 2})
+	require.NotNil(reading)
+	require.Nil(reading.Temperature)
+	require.Nil(reading.FanRPM)
+	require.Nil(reading.Power)
+	require.Nil(reading.CoreClock)
+	require.Nil(reading.MemoryClock)
+
+	// ReadAll orders GPUs by PCI address
+	readings = ReadAll([]Reader{&AMDGPUReader{sysfs.Root}})
+	require.Equal("01:00.0", readings[0].Topology.String())
+	require.Equal("02:00.0", readings[1].Topology.String())
+}
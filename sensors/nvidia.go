@@ -0,0 +1,113 @@
+package sensors
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gurupras/minerconfig/pcie"
+)
+
+var nvidiaQueryFields = []string{"pci.bus_id", "temperature.gpu", "fan.speed", "power.draw", "clocks.sm", "clocks.mem", "name"}
+
+// NVIDIAReader reads the sensors of NVIDIA GPUs with nvidia-smi
+type NVIDIAReader struct {
+	Path string
+	// Runs nvidia-smi and returns its output. Replaced in tests with recorded
+	// output
+	Run func(name string, args ...string) ([]byte, error)
+}
+
+// NewNVIDIAReader creates an NVIDIAReader that runs the nvidia-smi at path
+func NewNVIDIAReader(path string) *NVIDIAReader {
+	nr := &NVIDIAReader{}
+	nr.Path = path
+	nr.Run = func(name string, args ...string) ([]byte, error) {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%v failed: %v: %v", name, err, strings.TrimSpace(string(out)))
+		}
+		return out, nil
+	}
+	return nr
+}
+
+func (nr *NVIDIAReader) Read() ([]*Reading, error) {
+	out, err := nr.Run(nr.Path, "--query-gpu="+strings.Join(nvidiaQueryFields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	return ParseNVIDIAQuery(string(out))
+}
+
+// parseBusID parses the PCI bus ID of nvidia-smi, e.g. "00000000:01:00.0"
+func parseBusID(busID string) (*pcie.Topology, error) {
+	tokens := strings.Split(busID, ":")
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("Invalid PCI bus ID: '%v'", busID)
+	}
+	topology, err := pcie.ParseTopology(strings.Join(tokens[len(tokens)-2:], ":"))
+	if err != nil {
+		return nil, err
+	}
+	// nvidia-smi prints the domain with 8 digits
+	if len(tokens) > 2 {
+		domain, err := strconv.ParseInt(tokens[len(tokens)-3], 16, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PCI domain in bus ID: '%v'", busID)
+		}
+		topology.Domain = int(domain)
+	}
+	return topology, nil
+}
+
+// nvidiaValue parses a value of nvidia-smi's output. Unsupported values such
+// as "[N/A]" are nil
+func nvidiaValue(value string) *float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func nvidiaInt(value string) *int {
+	v := nvidiaValue(value)
+	if v == nil {
+		return nil
+	}
+	i := int(*v)
+	return &i
+}
+
+// ParseNVIDIAQuery parses the output of nvidia-smi --query-gpu with the
+// fields NVIDIAReader asks for
+func ParseNVIDIAQuery(out string) ([]*Reading, error) {
+	ret := make([]*Reading, 0)
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Compare(line, "") == 0 {
+			continue
+		}
+		fields := strings.SplitN(line, ",", len(nvidiaQueryFields))
+		if len(fields) != len(nvidiaQueryFields) {
+			return nil, fmt.Errorf("Unexpected nvidia-smi output: %v", line)
+		}
+		topology, err := parseBusID(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+		reading := &Reading{}
+		reading.Topology = topology
+		reading.Source = SOURCE_NVIDIA
+		reading.Temperature = nvidiaValue(fields[1])
+		reading.FanPercent = nvidiaValue(fields[2])
+		reading.Power = nvidiaValue(fields[3])
+		reading.CoreClock = nvidiaInt(fields[4])
+		reading.MemoryClock = nvidiaInt(fields[5])
+		reading.Name = strings.TrimSpace(fields[6])
+		ret = append(ret, reading)
+	}
+	return ret, nil
+}
@@ -0,0 +1,87 @@
+package sensors
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/stretchr/testify/require"
+)
+
+// Recorded from nvidia-smi with a GTX 1070 and a GTX 1060 whose fan is not
+// reported
+var recordedNvidiaSmi = `00000000:01:00.0, 64, 75, 151.20, 1835, 4006, GeForce GTX 1070
+00000000:03:00.0, 58, [N/A], 98.74, 1771, 4006, GeForce GTX 1060 6GB
+`
+
+func TestNVIDIAReader(t *testing.T) {
+	require := require.New(t)
+
+	var invocation string
+	reader := NewNVIDIAReader("nvidia-smi")
+	reader.Run = func(name string, args ...string) ([]byte, error) {
+		invocation = fmt.Sprintf("%v %v", name, strings.Join(args, " "))
+		return []byte(recordedNvidiaSmi), nil
+	}
+	readings, err := reader.Read()
+	require.Nil(err)
+	require.Equal("nvidia-smi --query-gpu=pci.bus_id,temperature.gpu,fan.speed,power.draw,clocks.sm,clocks.mem,name --format=csv,noheader,nounits", invocation)
+	require.Equal(2, len(readings))
+
+	reading := Find(readings, &pcie.Topology{Bus: 1})
+	require.NotNil(reading)
+	require.Equal(SOURCE_NVIDIA, reading.Source)
+	require.Equal("GeForce GTX 1070", reading.Name)
+	require.Equal(64.0, *reading.Temperature)
+	require.Equal(75.0, *reading.FanPercent)
+	require.Equal(151.2, *reading.Power)
+	require.Equal(1835, *reading.CoreClock)
+	require.Equal(4006, *reading.MemoryClock)
+	require.Nil(reading.FanRPM)
+
+	reading = Find(readings, &pcie.Topology{Bus: 3})
+	require.NotNil(reading)
+	require.Nil(reading.FanPercent)
+	require.Equal(58.0, *reading.Temperature)
+
+	reader.Run = func(name string, args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver")
+	}
+	_, err = reader.Read()
+	require.NotNil(err)
+	// Failing readers are skipped
+	require.Equal(0, len(ReadAll([]Reader{reader})))
+}
+
+func TestParseNVIDIAQuery(t *testing.T) {
+	require := require.New(t)
+
+	readings, err := ParseNVIDIAQuery("\n")
+	require.Nil(err)
+	require.Equal(0, len(readings))
+
+	_, err = ParseNVIDIAQuery("00000000:01:00.0, 64\n")
+	require.NotNil(err)
+
+	_, err = ParseNVIDIAQuery("GPU-0, 64, 75, 151.20, 1835, 4006, GeForce GTX 1070\n")
+	require.NotNil(err)
+	// GPUs in other PCI domains are told apart
+	readings, err = ParseNVIDIAQuery("00000001:01:00.0, 64, 75, 151.20, 1835, 4006, GeForce GTX 1070\n")
+	require.Nil(err)
+	require.Equal(pcie.Topology{Domain: 1, Bus: 1}, *readings[0].Topology)
+}
+
+func TestNewReaders(t *testing.T) {
+	require := require.New(t)
+
+	readers, err := NewReaders(&Config{Sources: []Source{SOURCE_AMDGPU, SOURCE_NVIDIA}})
+	require.Nil(err)
+	require.Equal(2, len(readers))
+
+	_, err = NewReaders(&Config{Sources: []Source{"LM_SENSORS"}})
+	require.NotNil(err)
+
+	require.Equal(defaultInterval, (&Config{}).IntervalSeconds())
+	require.Equal(5, (&Config{Interval: 5}).IntervalSeconds())
+}
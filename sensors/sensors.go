@@ -0,0 +1,126 @@
+package sensors
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/gurupras/minerconfig/pcie"
+	log "github.com/sirupsen/logrus"
+)
+
+type Source string
+
+const (
+	// hwmon and sysfs of the amdgpu driver on Linux
+	SOURCE_AMDGPU Source = "AMDGPU"
+	// nvidia-smi
+	SOURCE_NVIDIA Source = "NVIDIA"
+)
+
+const defaultInterval = 10
+
+// Reading structure representing the sensors of a single GPU. Sensors that
+// could not be read are nil
+type Reading struct {
+	Topology *pcie.Topology `json:"topology"`
+	Source   Source         `json:"source"`
+	Name     string         `json:"name"`
+	// Degrees Celsius
+	Temperature *float64 `json:"temperature"`
+	FanRPM      *int     `json:"fan_rpm"`
+	FanPercent  *float64 `json:"fan_percent"`
+	// Watts
+	Power *float64 `json:"power"`
+	// MHz
+	CoreClock   *int `json:"core_clock"`
+	MemoryClock *int `json:"memory_clock"`
+}
+
+// Reader reads the sensors of every GPU it knows of
+type Reader interface {
+	Read() ([]*Reading, error)
+}
+
+// Config structure representing where and how often sensors are read
+type Config struct {
+	// Seconds between readings. Defaults to 10
+	Interval int `json:"interval" yaml:"interval"`
+	// Where to read sensors from. Defaults to amdgpu on Linux and to
+	// nvidia-smi if it is installed
+	Sources []Source `json:"sources" yaml:"sources"`
+	// Root of sysfs. Defaults to /sys
+	SysfsRoot string `json:"sysfs_root" yaml:"sysfs_root"`
+	// Path to nvidia-smi. Defaults to looking it up on PATH
+	NvidiaSmi string `json:"nvidia_smi" yaml:"nvidia_smi"`
+}
+
+// IntervalSeconds returns the number of seconds between readings
+func (c *Config) IntervalSeconds() int {
+	if c.Interval <= 0 {
+		return defaultInterval
+	}
+	return c.Interval
+}
+
+// NewReaders creates a Reader for every source in config
+func NewReaders(config *Config) ([]Reader, error) {
+	sources := config.Sources
+	if len(sources) == 0 {
+		if runtime.GOOS == "linux" {
+			sources = append(sources, SOURCE_AMDGPU)
+		}
+		if _, err := exec.LookPath(nvidiaSmi(config)); err == nil {
+			sources = append(sources, SOURCE_NVIDIA)
+		}
+	}
+	ret := make([]Reader, 0)
+	for _, source := range sources {
+		switch source {
+		case SOURCE_AMDGPU:
+			ret = append(ret, &AMDGPUReader{config.SysfsRoot})
+		case SOURCE_NVIDIA:
+			ret = append(ret, NewNVIDIAReader(nvidiaSmi(config)))
+		default:
+			return nil, fmt.Errorf("Unknown sensor source: '%v'", source)
+		}
+	}
+	return ret, nil
+}
+
+func nvidiaSmi(config *Config) string {
+	if strings.Compare(config.NvidiaSmi, "") == 0 {
+		return "nvidia-smi"
+	}
+	return config.NvidiaSmi
+}
+
+// ReadAll returns the readings of every reader in PCI order. Readers that fail
+// are logged and skipped
+func ReadAll(readers []Reader) []*Reading {
+	ret := make([]*Reading, 0)
+	for _, reader := range readers {
+		readings, err := reader.Read()
+		if err != nil {
+			log.Warnf("Failed to read sensors: %v", err)
+			continue
+		}
+		ret = append(ret, readings...)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.Compare(ret[i].Topology.String(), ret[j].Topology.String()) < 0
+	})
+	return ret
+}
+
+// Find returns the reading of the GPU at topology, or nil if there is none
+func Find(readings []*Reading, topology *pcie.Topology) *Reading {
+	for _, reading := range readings {
+		if *reading.Topology == *topology {
+			return reading
+		}
+	}
+	return nil
+}
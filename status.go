@@ -0,0 +1,249 @@
+package minerconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/minerconfig/sensors"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStatusInterval = 30
+	// Hashrates not updated by the miner in this long are reported as 0
+	staleHashrate = 2 * time.Minute
+)
+
+var (
+	// xmr-stak: "Totals (ALL):    1234.5   1230.1      0.0 H/s"
+	// xmrig:    "speed 10s/60s/15m 1234.5 1230.0 n/a H/s max 1240.2 H/s"
+	// claymore: "Total Speed: 1234 H/s, Total Shares: 100, Rejected: 2"
+	hashrateRegexp = regexp.MustCompile(`(?i)(?:totals(?: \(all\))?:|speed(?: 10s/60s/15m)?:?)\s+([0-9]+(?:\.[0-9]+)?)[\s0-9.na/]*?([kmg]?)h/s`)
+	// cpuminer: "accepted: 12/13 (92.31%), 1234.56 H/s yes!"
+	cpuminerRegexp = regexp.MustCompile(`(?i)accepted:\s*(\d+)/(\d+)\s*\([0-9.]+%\),\s*([0-9]+(?:\.[0-9]+)?)\s*([kmg]?)h/s`)
+	// xmrig: "accepted (12/1) diff 5000 (45 ms)"
+	xmrigSharesRegexp = regexp.MustCompile(`(?i)(?:accepted|rejected) \((\d+)/(\d+)\)`)
+	// xmr-stak: "Result accepted by the pool."
+	xmrstakSharesRegexp = regexp.MustCompile(`(?i)result (accepted|rejected)`)
+	// claymore: "Total Shares: 100, Rejected: 2"
+	claymoreSharesRegexp = regexp.MustCompile(`(?i)total shares:\s*(\d+),\s*rejected:\s*(\d+)`)
+	// xmr-stak: "|  0 |  512.3 |  510.2 |  (na) |  1 |  498.1 |  497.0 |  (na) |"
+	xmrstakThreadRegexp = regexp.MustCompile(`\|\s*(\d+)\s*\|\s*([0-9]+(?:\.[0-9]+)?)\s*\|\s*(?:[0-9.]+|\(na\))\s*\|\s*(?:[0-9.]+|\(na\))\s*`)
+	// claymore: "GPU0 852 H/s, GPU1 849 H/s"
+	claymoreThreadRegexp = regexp.MustCompile(`(?i)gpu\s*(\d+)[:\s]+([0-9]+(?:\.[0-9]+)?)\s*([kmg]?)h/s`)
+)
+
+// StatusReport structure representing the periodic status report sent by
+// clients
+type StatusReport struct {
+	Heartbeat
+	// When the client last connected to the webserver
+	ConnectedSince time.Time `json:"connected_since"`
+	Algorithm      string    `json:"algorithm"`
+	// Seconds the miner has been running
+	MinerUptime int `json:"miner_uptime"`
+	// Number of times the miner was started since the client started
+	MinerStarts int `json:"miner_starts"`
+	// Hashrate (H/s) parsed from the miner's output, or nil if the miner's
+	// output format is not understood
+	Hashrate *float64 `json:"hashrate"`
+	// Shares since the miner was last started
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	// Latest sensor readings of every GPU
+	GPUs []*sensors.Reading `json:"gpus"`
+}
+
+// minerStats is an io.Writer that parses the hashrate and share counts out of
+// the miner's output. Its zero value is ready to use.
+type minerStats struct {
+	sync.Mutex
+	partial      bytes.Buffer
+	hashrate     *float64
+	hashrateTime time.Time
+	// Hashrate (H/s) of every thread or GPU the miner reported on its own
+	threads  map[int]float64
+	accepted uint64
+	rejected uint64
+	started  time.Time
+	starts   int
+}
+
+func (ms *minerStats) Write(p []byte) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	for _, b := range p {
+		if b == '\n' {
+			ms.parseLine(strings.TrimRight(ms.partial.String(), "\r"), time.Now())
+			ms.partial.Reset()
+			continue
+		}
+		if ms.partial.Len() < maxLogLineLength {
+			ms.partial.WriteByte(b)
+		}
+	}
+	return len(p), nil
+}
+
+func parseHashrate(value string, unit string) (float64, bool) {
+	hashrate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch strings.ToLower(unit) {
+	case "k":
+		hashrate *= 1e3
+	case "m":
+		hashrate *= 1e6
+	case "g":
+		hashrate *= 1e9
+	}
+	return hashrate, true
+}
+
+func (ms *minerStats) setHashrate(value string, unit string, now time.Time) {
+	if hashrate, ok := parseHashrate(value, unit); ok {
+		ms.hashrate = &hashrate
+		ms.hashrateTime = now
+	}
+}
+
+func (ms *minerStats) setThreadHashrate(thread string, value string, unit string) {
+	idx, err := strconv.Atoi(thread)
+	if err != nil {
+		return
+	}
+	if hashrate, ok := parseHashrate(value, unit); ok {
+		if ms.threads == nil {
+			ms.threads = make(map[int]float64)
+		}
+		ms.threads[idx] = hashrate
+	}
+}
+
+// parseLine updates the stats from a single line of miner output. Must be
+// called with the lock held
+func (ms *minerStats) parseLine(line string, now time.Time) {
+	if m := cpuminerRegexp.FindStringSubmatch(line); m != nil {
+		accepted, _ := strconv.ParseUint(m[1], 10, 64)
+		total, _ := strconv.ParseUint(m[2], 10, 64)
+		if total >= accepted {
+			ms.accepted = accepted
+			ms.rejected = total - accepted
+		}
+		ms.setHashrate(m[3], m[4], now)
+		return
+	}
+	if m := hashrateRegexp.FindStringSubmatch(line); m != nil {
+		ms.setHashrate(m[1], m[2], now)
+	}
+	for _, m := range xmrstakThreadRegexp.FindAllStringSubmatch(line, -1) {
+		ms.setThreadHashrate(m[1], m[2], "")
+	}
+	for _, m := range claymoreThreadRegexp.FindAllStringSubmatch(line, -1) {
+		ms.setThreadHashrate(m[1], m[2], m[3])
+	}
+	if m := xmrigSharesRegexp.FindStringSubmatch(line); m != nil {
+		ms.accepted, _ = strconv.ParseUint(m[1], 10, 64)
+		ms.rejected, _ = strconv.ParseUint(m[2], 10, 64)
+	} else if m := claymoreSharesRegexp.FindStringSubmatch(line); m != nil {
+		total, _ := strconv.ParseUint(m[1], 10, 64)
+		rejected, _ := strconv.ParseUint(m[2], 10, 64)
+		if total >= rejected {
+			ms.accepted = total - rejected
+			ms.rejected = rejected
+		}
+	} else if m := xmrstakSharesRegexp.FindStringSubmatch(line); m != nil {
+		if strings.Compare(strings.ToLower(m[1]), "accepted") == 0 {
+			ms.accepted++
+		} else {
+			ms.rejected++
+		}
+	}
+}
+
+// minerStarted resets the stats for a freshly started miner
+func (ms *minerStats) minerStarted(now time.Time) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.partial.Reset()
+	ms.hashrate = nil
+	ms.threads = nil
+	ms.accepted = 0
+	ms.rejected = 0
+	ms.started = now
+	ms.starts++
+}
+
+// fill copies the stats into report. running is whether the miner is
+// currently running
+func (ms *minerStats) fill(report *StatusReport, running bool, now time.Time) {
+	ms.Lock()
+	defer ms.Unlock()
+	report.MinerStarts = ms.starts
+	report.Accepted = ms.accepted
+	report.Rejected = ms.rejected
+	if !running {
+		return
+	}
+	report.MinerUptime = int(now.Sub(ms.started) / time.Second)
+	if ms.hashrate != nil {
+		hashrate := *ms.hashrate
+		// A miner that stopped printing its hashrate has most likely hung
+		if now.Sub(ms.hashrateTime) > staleHashrate {
+			hashrate = 0
+		}
+		report.Hashrate = &hashrate
+	}
+}
+
+// Status returns the current status of this client
+func (c *Client) Status() *StatusReport {
+	report := &StatusReport{}
+	report.Heartbeat = *c.heartbeat()
+	report.ConnectedSince = c.connectedSince
+	report.Algorithm = c.MinerConfig.Algorithm
+	c.stats.fill(report, c.minerRunning(), time.Now())
+	report.GPUs = c.Readings()
+	return report
+}
+
+// reportStatus periodically sends the status of this client to the server
+func (c *Client) reportStatus() {
+	interval := c.StatusInterval
+	if interval <= 0 {
+		interval = defaultStatusInterval
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		b, err := json.Marshal(c.Status())
+		if err != nil {
+			log.Errorf("Failed to marshal status report: %v", err)
+			continue
+		}
+		// Failed connections are taken care of by keepalive
+		if err := c.Emit("status-report", string(b)); err != nil {
+			log.Debugf("Failed to send status report: %v", err)
+		}
+	}
+}
+
+// handleStatusReport records the status report of a registered rig
+func (s *Server) handleStatusReport(w *websockets.WebsocketClient, data interface{}) {
+	var report StatusReport
+	if err := decodeData(data, &report); err != nil {
+		log.Errorf("[status-report]: Failed to unmarshal status report from '%v': %v", clientAddr(w), err)
+		return
+	}
+	rigID := s.heartbeatRigID(w, &report.Heartbeat)
+	if strings.Compare(rigID, "") == 0 {
+		return
+	}
+	s.Inventory.ReportStatus(rigID, &report)
+}
@@ -0,0 +1,73 @@
+package minerconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinerStats(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	report := &StatusReport{}
+	ms := &minerStats{}
+	ms.minerStarted(now)
+	ms.fill(report, true, now)
+	require.Nil(report.Hashrate)
+	require.Equal(1, report.MinerStarts)
+
+	// xmr-stak
+	ms.Write([]byte("Totals (ALL):    1234.5   1230.1      0.0 H/s\n"))
+	ms.Write([]byte("[2017-11-06 12:00:00] : Result accepted by the pool.\n"))
+	ms.Write([]byte("[2017-11-06 12:00:10] : Result accepted by the pool.\r\n"))
+	ms.Write([]byte("[2017-11-06 12:00:20] : Result rejected by the pool.\n"))
+	ms.fill(report, true, now.Add(time.Minute))
+	require.Equal(1234.5, *report.Hashrate)
+	require.Equal(uint64(2), report.Accepted)
+	require.Equal(uint64(1), report.Rejected)
+	require.Equal(60, report.MinerUptime)
+
+	// The miner stopped printing its hashrate
+	ms.fill(report, true, now.Add(time.Hour))
+	require.Equal(0.0, *report.Hashrate)
+
+	// Stats are reset with every start
+	ms.minerStarted(now)
+	report = &StatusReport{}
+	ms.fill(report, true, now)
+	require.Nil(report.Hashrate)
+	require.Equal(uint64(0), report.Accepted)
+	require.Equal(2, report.MinerStarts)
+
+	// xmrig
+	ms.Write([]byte("[2017-11-06 12:00:00] speed 10s/60s/15m 812.3 810.0 n/a H/s max 820.1 H/s\n"))
+	ms.Write([]byte("[2017-11-06 12:00:01] accepted (12/1) diff 5000 (45 ms)\n"))
+	ms.fill(report, true, now)
+	require.Equal(812.3, *report.Hashrate)
+	require.Equal(uint64(12), report.Accepted)
+	require.Equal(uint64(1), report.Rejected)
+
+	// claymore, split across writes
+	ms.Write([]byte("Total Speed: 1.5 kH/s, Total Shares: 100, Rej"))
+	ms.Write([]byte("ected: 4, Time: 01:23\n"))
+	ms.fill(report, true, now)
+	require.Equal(1500.0, *report.Hashrate)
+	require.Equal(uint64(96), report.Accepted)
+	require.Equal(uint64(4), report.Rejected)
+
+	// cpuminer
+	ms.Write([]byte("[2017-11-06 12:00:00] accepted: 12/13 (92.31%), 321.07 H/s yes!\n"))
+	ms.fill(report, true, now)
+	require.Equal(321.07, *report.Hashrate)
+	require.Equal(uint64(12), report.Accepted)
+	require.Equal(uint64(1), report.Rejected)
+
+	// Nothing but share counts are reported while the miner is stopped
+	report = &StatusReport{}
+	ms.fill(report, false, now)
+	require.Nil(report.Hashrate)
+	require.Equal(0, report.MinerUptime)
+	require.Equal(uint64(12), report.Accepted)
+}
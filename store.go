@@ -0,0 +1,606 @@
+package minerconfig
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/gurupras/go-easyfiles"
+	log "github.com/sirupsen/logrus"
+)
+
+var rigIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const defaultMaxHistory = 50
+
+// SelectionVersion structure representing a version of the farm-wide, a
+// group's or a rig's selected pools
+type SelectionVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Nil if the rig or group had no selection of its own, making it fall
+	// back to the group's or the farm-wide selection
+	Pools []interface{} `json:"pools"`
+}
+
+// PoolStore structure holds the pools known to the webserver along with the
+// farm-wide, per-group and per-rig selected pools. Everything is persisted
+// under Dir.
+type PoolStore struct {
+	sync.Mutex
+	Dir                string
+	pools              []interface{}
+	selectedPools      []interface{}
+	rigSelectedPools   map[string][]interface{}
+	groupSelectedPools map[string][]interface{}
+	// Files the pools are persisted in, in the same order as pools
+	poolFiles []string
+	// Number of versions of every selection kept for rollback
+	MaxHistory int
+	// Clock used to timestamp versions. Defaults to time.Now
+	Now func() time.Time
+}
+
+// NewPoolStore creates a PoolStore backed by dir, loading any pools and
+// selected pools that were previously persisted there
+func NewPoolStore(dir string) *PoolStore {
+	ps := &PoolStore{}
+	ps.Dir = dir
+	ps.pools = make([]interface{}, 0)
+	ps.selectedPools = make([]interface{}, 0)
+	ps.rigSelectedPools = make(map[string][]interface{})
+	ps.groupSelectedPools = make(map[string][]interface{})
+	ps.MaxHistory = defaultMaxHistory
+	ps.Now = time.Now
+
+	if !easyfiles.Exists(dir) {
+		easyfiles.Makedirs(dir)
+	}
+	if !easyfiles.Exists(filepath.Join(dir, "history")) {
+		easyfiles.Makedirs(filepath.Join(dir, "history"))
+	}
+
+	files, err := doublestar.Glob(filepath.Join(dir, "pool-*"))
+	if err != nil {
+		log.Errorf("Failed to list pools in poolsDir: %v", err)
+	}
+	log.Debugf("Found %d pool files", len(files))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("Failed to read file '%v': %v", file, err)
+			continue
+		}
+		var pool map[string]interface{}
+		if err = json.Unmarshal(b, &pool); err != nil {
+			log.Errorf("Failed to unmarshal pool from file '%v': %v", file, err)
+		} else {
+			ps.pools = append(ps.pools, pool)
+			ps.poolFiles = append(ps.poolFiles, file)
+		}
+	}
+
+	// Load selected pools
+	if selected, err := readSelectedPools(filepath.Join(dir, "selected-pools")); err != nil {
+		log.Errorf("%v", err)
+	} else if selected != nil {
+		ps.selectedPools = selected
+	}
+
+	files, err = doublestar.Glob(filepath.Join(dir, "selected-pools-*"))
+	if err != nil {
+		log.Errorf("Failed to list rig selected pools in poolsDir: %v", err)
+	}
+	for _, file := range files {
+		rig := strings.TrimPrefix(filepath.Base(file), "selected-pools-")
+		if selected, err := readSelectedPools(file); err != nil {
+			log.Errorf("%v", err)
+		} else if selected != nil {
+			ps.rigSelectedPools[rig] = selected
+		}
+	}
+
+	files, err = doublestar.Glob(filepath.Join(dir, "group-selected-pools-*"))
+	if err != nil {
+		log.Errorf("Failed to list group selected pools in poolsDir: %v", err)
+	}
+	for _, file := range files {
+		group := strings.TrimPrefix(filepath.Base(file), "group-selected-pools-")
+		if selected, err := readSelectedPools(file); err != nil {
+			log.Errorf("%v", err)
+		} else if selected != nil {
+			ps.groupSelectedPools[group] = selected
+		}
+	}
+	return ps
+}
+
+func readSelectedPools(path string) ([]interface{}, error) {
+	if !easyfiles.Exists(path) {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read selected pools file '%v': %v", path, err)
+	}
+	var selected []interface{}
+	if err = json.Unmarshal(b, &selected); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal selected pools file '%v': %v", path, err)
+	}
+	return selected, nil
+}
+
+func (ps *PoolStore) selectedPoolsPath(rig string) string {
+	if strings.Compare(rig, "") == 0 {
+		return filepath.Join(ps.Dir, "selected-pools")
+	}
+	return filepath.Join(ps.Dir, fmt.Sprintf("selected-pools-%v", rig))
+}
+
+func (ps *PoolStore) groupSelectedPoolsPath(group string) string {
+	return filepath.Join(ps.Dir, fmt.Sprintf("group-selected-pools-%v", group))
+}
+
+// historyPath returns where the history of the selection persisted at
+// selectionPath is kept
+func (ps *PoolStore) historyPath(selectionPath string) string {
+	return filepath.Join(ps.Dir, "history", fmt.Sprintf("%v.json", filepath.Base(selectionPath)))
+}
+
+func (ps *PoolStore) readHistory(selectionPath string) ([]*SelectionVersion, error) {
+	history := make([]*SelectionVersion, 0)
+	path := ps.historyPath(selectionPath)
+	if !easyfiles.Exists(path) {
+		return history, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read selection history '%v': %v", path, err)
+	}
+	if err := json.Unmarshal(b, &history); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal selection history '%v': %v", path, err)
+	}
+	return history, nil
+}
+
+// recordVersion adds pools as the newest version of the selection persisted
+// at selectionPath. previous is the selection being replaced, if there was
+// one. Must be called with the lock held
+func (ps *PoolStore) recordVersion(selectionPath string, previous []interface{}, pools []interface{}) error {
+	history, err := ps.readHistory(selectionPath)
+	if err != nil {
+		return err
+	}
+	now := ps.Now()
+	// Selections made before there was any history can be rolled back to too.
+	// Rigs and groups without a selection of their own fall back to another
+	// selection, which is a version of its own
+	fallsBack := strings.Compare(selectionPath, ps.selectedPoolsPath("")) != 0
+	if len(history) == 0 && (previous != nil || fallsBack) {
+		history = append(history, &SelectionVersion{1, now, previous})
+	}
+	version := 1
+	if len(history) > 0 {
+		version = history[len(history)-1].Version + 1
+	}
+	history = append(history, &SelectionVersion{version, now, pools})
+	if ps.MaxHistory > 0 && len(history) > ps.MaxHistory {
+		history = history[len(history)-ps.MaxHistory:]
+	}
+	b, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal selection history: %v", err)
+	}
+	if err := ioutil.WriteFile(ps.historyPath(selectionPath), b, 0666); err != nil {
+		return fmt.Errorf("Failed to write selection history: %v", err)
+	}
+	return nil
+}
+
+// writeSelection persists selected at selectionPath and records it as the
+// newest version. Must be called with the lock held
+func (ps *PoolStore) writeSelection(selectionPath string, previous []interface{}, selected []interface{}) error {
+	b, err := json.Marshal(selected)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal selected pools: %v", err)
+	}
+	if err := ioutil.WriteFile(selectionPath, b, 0666); err != nil {
+		return fmt.Errorf("Failed to write selected pools to file: %v", err)
+	}
+	if err := ps.recordVersion(selectionPath, previous, selected); err != nil {
+		log.Errorf("%v", err)
+	}
+	return nil
+}
+
+// removeSelection removes the selection persisted at selectionPath and
+// records the removal as the newest version. Must be called with the lock
+// held
+func (ps *PoolStore) removeSelection(selectionPath string, previous []interface{}) error {
+	if err := os.Remove(selectionPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove selected pools file: %v", err)
+	}
+	if err := ps.recordVersion(selectionPath, previous, nil); err != nil {
+		log.Errorf("%v", err)
+	}
+	return nil
+}
+
+// findVersion returns version from history, or nil if there is no such
+// version
+func findVersion(history []*SelectionVersion, version int) *SelectionVersion {
+	for _, v := range history {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// History returns the past versions of the selection of rig, oldest first.
+// An empty rig refers to the farm-wide selection
+func (ps *PoolStore) History(rig string) ([]*SelectionVersion, error) {
+	if strings.Compare(rig, "") != 0 && !rigIDRegexp.MatchString(rig) {
+		return nil, fmt.Errorf("Invalid rig ID: '%v'", rig)
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.readHistory(ps.selectedPoolsPath(rig))
+}
+
+// GroupHistory returns the past versions of the selection of group, oldest
+// first
+func (ps *PoolStore) GroupHistory(group string) ([]*SelectionVersion, error) {
+	if !rigIDRegexp.MatchString(group) {
+		return nil, fmt.Errorf("Invalid group: '%v'", group)
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.readHistory(ps.groupSelectedPoolsPath(group))
+}
+
+// Rollback restores version of the selection of rig. The restored selection
+// becomes the newest version
+func (ps *PoolStore) Rollback(rig string, version int) error {
+	history, err := ps.History(rig)
+	if err != nil {
+		return err
+	}
+	v := findVersion(history, version)
+	if v == nil {
+		return fmt.Errorf("No version %d of the selected pools of '%v'", version, rig)
+	}
+	if v.Pools == nil {
+		return ps.RemoveRigSelectedPools(rig)
+	}
+	return ps.SetSelectedPools(rig, v.Pools)
+}
+
+// RollbackGroup restores version of the selection of group. The restored
+// selection becomes the newest version
+func (ps *PoolStore) RollbackGroup(group string, version int) error {
+	history, err := ps.GroupHistory(group)
+	if err != nil {
+		return err
+	}
+	v := findVersion(history, version)
+	if v == nil {
+		return fmt.Errorf("No version %d of the selected pools of group '%v'", version, group)
+	}
+	if v.Pools == nil {
+		return ps.RemoveGroupSelectedPools(group)
+	}
+	return ps.SetGroupSelectedPools(group, v.Pools)
+}
+
+// Pools returns all available pools
+func (ps *PoolStore) Pools() []interface{} {
+	ps.Lock()
+	defer ps.Unlock()
+	ret := make([]interface{}, len(ps.pools))
+	copy(ret, ps.pools)
+	return ret
+}
+
+// AddPool adds the JSON-encoded pool in poolBytes to the store
+func (ps *PoolStore) AddPool(poolBytes []byte) (map[string]interface{}, error) {
+	var pool map[string]interface{}
+	if err := json.Unmarshal(poolBytes, &pool); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal pool: %v", err)
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	hash := fmt.Sprintf("%X", md5.Sum(poolBytes))
+	poolFile := filepath.Join(ps.Dir, fmt.Sprintf("pool-%v", hash))
+	if !easyfiles.Exists(poolFile) {
+		if err := ioutil.WriteFile(poolFile, poolBytes, 0666); err != nil {
+			return nil, fmt.Errorf("Failed to write new pool to file: %v", err)
+		}
+	}
+	ps.pools = append(ps.pools, pool)
+	ps.poolFiles = append(ps.poolFiles, poolFile)
+	return pool, nil
+}
+
+// ImportAction is what importing a pool does to the store
+type ImportAction string
+
+const (
+	IMPORT_ADD    ImportAction = "add"
+	IMPORT_UPDATE ImportAction = "update"
+	IMPORT_SKIP   ImportAction = "skip"
+	// The pool failed validation, so nothing was imported
+	IMPORT_INVALID ImportAction = "invalid"
+)
+
+// ImportEntry structure representing what happens to a single imported pool
+type ImportEntry struct {
+	Index  int          `json:"index"`
+	Url    string       `json:"url"`
+	User   string       `json:"user"`
+	Action ImportAction `json:"action"`
+	Reason string       `json:"reason"`
+}
+
+// poolKey returns what identifies a pool, matching Pool.Hash
+func poolKey(pool map[string]interface{}) string {
+	return fmt.Sprintf("%v-%v", pool["url"], pool["user"])
+}
+
+// samePool returns whether a and b describe the same pool settings
+func samePool(a map[string]interface{}, b map[string]interface{}) bool {
+	var poolA, poolB Pool
+	if err := decodeData(a, &poolA); err != nil {
+		return false
+	}
+	if err := decodeData(b, &poolB); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(poolA, poolB)
+}
+
+// ImportPools adds pools to the store. Pools with the URL and user of an
+// existing pool replace it, unless they are identical in which case they are
+// skipped. Nothing is changed if dryRun is set or if any pool fails to be
+// written. Selections keep the pool settings they were made with
+func (ps *PoolStore) ImportPools(pools []map[string]interface{}, dryRun bool) ([]*ImportEntry, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	existing := make(map[string]int)
+	for idx, rawPool := range ps.pools {
+		if pool, ok := rawPool.(map[string]interface{}); ok {
+			existing[poolKey(pool)] = idx
+		}
+	}
+	entries := make([]*ImportEntry, 0)
+	seen := make(map[string]int)
+	// Pools to write along with the index into ps.pools they replace, or -1
+	// for additions
+	type importTarget struct {
+		index    int
+		replaces int
+	}
+	targets := make([]importTarget, 0)
+	for idx, pool := range pools {
+		entry := &ImportEntry{Index: idx}
+		entry.Url, _ = pool["url"].(string)
+		entry.User, _ = pool["user"].(string)
+		entries = append(entries, entry)
+		if strings.Compare(entry.Url, "") == 0 {
+			entry.Action = IMPORT_SKIP
+			entry.Reason = "Missing url"
+			continue
+		}
+		key := poolKey(pool)
+		if other, ok := seen[key]; ok {
+			entry.Action = IMPORT_SKIP
+			entry.Reason = fmt.Sprintf("Duplicate of entry %d", other)
+			continue
+		}
+		seen[key] = idx
+		existingIdx, ok := existing[key]
+		if !ok {
+			entry.Action = IMPORT_ADD
+			targets = append(targets, importTarget{idx, -1})
+			continue
+		}
+		if samePool(ps.pools[existingIdx].(map[string]interface{}), pool) {
+			entry.Action = IMPORT_SKIP
+			entry.Reason = "Already exists"
+			continue
+		}
+		entry.Action = IMPORT_UPDATE
+		targets = append(targets, importTarget{idx, existingIdx})
+	}
+	if dryRun {
+		return entries, nil
+	}
+
+	// Write every new file before touching anything so that a failure leaves
+	// the store as it was
+	written := make(map[int]string)
+	for _, target := range targets {
+		idx := target.index
+		poolBytes, err := json.Marshal(pools[idx])
+		if err == nil {
+			poolFile := filepath.Join(ps.Dir, fmt.Sprintf("pool-%X", md5.Sum(poolBytes)))
+			if err = ioutil.WriteFile(poolFile, poolBytes, 0666); err == nil {
+				written[idx] = poolFile
+				continue
+			}
+		}
+		for _, poolFile := range written {
+			os.Remove(poolFile)
+		}
+		return nil, fmt.Errorf("Failed to write pool %d: %v", idx, err)
+	}
+	for _, target := range targets {
+		idx, existingIdx := target.index, target.replaces
+		if existingIdx < 0 {
+			ps.pools = append(ps.pools, pools[idx])
+			ps.poolFiles = append(ps.poolFiles, written[idx])
+			continue
+		}
+		if strings.Compare(ps.poolFiles[existingIdx], written[idx]) != 0 {
+			if err := os.Remove(ps.poolFiles[existingIdx]); err != nil && !os.IsNotExist(err) {
+				log.Errorf("Failed to remove replaced pool file: %v", err)
+			}
+		}
+		ps.pools[existingIdx] = pools[idx]
+		ps.poolFiles[existingIdx] = written[idx]
+	}
+	return entries, nil
+}
+
+// SelectedPools returns the pools selected for rig. Rigs without a selection
+// of their own fall back to the farm-wide selection, which is also what is
+// returned for an empty rig.
+func (ps *PoolStore) SelectedPools(rig string) []interface{} {
+	ps.Lock()
+	defer ps.Unlock()
+	selected := ps.selectedPools
+	if rigSelected, ok := ps.rigSelectedPools[rig]; ok {
+		selected = rigSelected
+	}
+	ret := make([]interface{}, len(selected))
+	copy(ret, selected)
+	return ret
+}
+
+// RigSelectedPools returns the pools used by rig, which belongs to group. Rigs
+// without a selection of their own fall back to the selection of their group
+// and then to the farm-wide selection
+func (ps *PoolStore) RigSelectedPools(rig string, group string) []interface{} {
+	ps.Lock()
+	defer ps.Unlock()
+	selected := ps.selectedPools
+	if rigSelected, ok := ps.rigSelectedPools[rig]; ok {
+		selected = rigSelected
+	} else if groupSelected, ok := ps.groupSelectedPools[group]; ok {
+		selected = groupSelected
+	}
+	ret := make([]interface{}, len(selected))
+	copy(ret, selected)
+	return ret
+}
+
+// HasRigSelectedPools returns whether rig has a selection of its own
+func (ps *PoolStore) HasRigSelectedPools(rig string) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	_, ok := ps.rigSelectedPools[rig]
+	return ok
+}
+
+// HasGroupSelectedPools returns whether group has a selection of its own
+func (ps *PoolStore) HasGroupSelectedPools(group string) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	_, ok := ps.groupSelectedPools[group]
+	return ok
+}
+
+// UsesFarmSelection returns whether rig, which belongs to group, uses the
+// farm-wide selection
+func (ps *PoolStore) UsesFarmSelection(rig string, group string) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	if _, ok := ps.rigSelectedPools[rig]; ok {
+		return false
+	}
+	_, ok := ps.groupSelectedPools[group]
+	return !ok
+}
+
+// SetSelectedPools persists and updates the pools selected for rig. An empty
+// rig updates the farm-wide selection.
+func (ps *PoolStore) SetSelectedPools(rig string, selected []interface{}) error {
+	if strings.Compare(rig, "") != 0 && !rigIDRegexp.MatchString(rig) {
+		return fmt.Errorf("Invalid rig ID: '%v'", rig)
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	var previous []interface{}
+	if strings.Compare(rig, "") == 0 {
+		if easyfiles.Exists(ps.selectedPoolsPath(rig)) {
+			previous = ps.selectedPools
+		}
+	} else {
+		previous = ps.rigSelectedPools[rig]
+	}
+	if selected == nil {
+		selected = make([]interface{}, 0)
+	}
+	if err := ps.writeSelection(ps.selectedPoolsPath(rig), previous, selected); err != nil {
+		return err
+	}
+	if strings.Compare(rig, "") == 0 {
+		ps.selectedPools = selected
+	} else {
+		ps.rigSelectedPools[rig] = selected
+	}
+	return nil
+}
+
+// SetGroupSelectedPools persists and updates the pools selected for the rigs
+// of group that have no selection of their own
+func (ps *PoolStore) SetGroupSelectedPools(group string, selected []interface{}) error {
+	if !rigIDRegexp.MatchString(group) {
+		return fmt.Errorf("Invalid group: '%v'", group)
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	if selected == nil {
+		selected = make([]interface{}, 0)
+	}
+	if err := ps.writeSelection(ps.groupSelectedPoolsPath(group), ps.groupSelectedPools[group], selected); err != nil {
+		return err
+	}
+	ps.groupSelectedPools[group] = selected
+	return nil
+}
+
+// RemoveRigSelectedPools removes the selection of rig, making it fall back to
+// the farm-wide selection
+func (ps *PoolStore) RemoveRigSelectedPools(rig string) error {
+	if strings.Compare(rig, "") == 0 {
+		return fmt.Errorf("Cannot remove the farm-wide selection")
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	previous, ok := ps.rigSelectedPools[rig]
+	if !ok {
+		return nil
+	}
+	if err := ps.removeSelection(ps.selectedPoolsPath(rig), previous); err != nil {
+		return err
+	}
+	delete(ps.rigSelectedPools, rig)
+	return nil
+}
+
+// RemoveGroupSelectedPools removes the selection of group, making its rigs
+// fall back to the farm-wide selection
+func (ps *PoolStore) RemoveGroupSelectedPools(group string) error {
+	ps.Lock()
+	defer ps.Unlock()
+	previous, ok := ps.groupSelectedPools[group]
+	if !ok {
+		return nil
+	}
+	if err := ps.removeSelection(ps.groupSelectedPoolsPath(group), previous); err != nil {
+		return err
+	}
+	delete(ps.groupSelectedPools, group)
+	return nil
+}
@@ -0,0 +1,288 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/minerconfig/alert"
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/gurupras/minerconfig/sensors"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+type ThermalAction string
+
+const (
+	THERMAL_NONE ThermalAction = "NONE"
+	// Run the threads of the GPU with the throttle profile
+	THERMAL_THROTTLE ThermalAction = "THROTTLE"
+	// Remove the threads of the GPU from the miner config
+	THERMAL_EXCLUDE ThermalAction = "EXCLUDE"
+	// Stop mining on every GPU
+	THERMAL_STOP ThermalAction = "STOP"
+)
+
+const defaultHysteresis = 5.0
+
+// Actions in increasing order of severity
+var thermalActions = []ThermalAction{THERMAL_NONE, THERMAL_THROTTLE, THERMAL_EXCLUDE, THERMAL_STOP}
+
+func (ta ThermalAction) severity() int {
+	for idx, action := range thermalActions {
+		if action == ta {
+			return idx
+		}
+	}
+	return 0
+}
+
+// ThermalConfig structure representing the temperatures (°C) above which the
+// client protects its GPUs. Unset thresholds are not acted on
+type ThermalConfig struct {
+	Throttle *float64 `json:"throttle" yaml:"throttle"`
+	Exclude  *float64 `json:"exclude" yaml:"exclude"`
+	Stop     *float64 `json:"stop" yaml:"stop"`
+	// Degrees a GPU must cool down below a threshold before its action is
+	// undone. Defaults to 5
+	Hysteresis float64 `json:"hysteresis" yaml:"hysteresis"`
+	// Settings of the threads of throttled GPUs. Index, DeviceIndex and
+	// AffineToCPU of the threads are kept
+	ThrottleProfile *GPUThread `json:"throttle_profile" yaml:"throttle_profile"`
+}
+
+func (tc *ThermalConfig) threshold(action ThermalAction) *float64 {
+	switch action {
+	case THERMAL_THROTTLE:
+		return tc.Throttle
+	case THERMAL_EXCLUDE:
+		return tc.Exclude
+	case THERMAL_STOP:
+		return tc.Stop
+	}
+	return nil
+}
+
+func (tc *ThermalConfig) hysteresis() float64 {
+	if tc.Hysteresis <= 0 {
+		return defaultHysteresis
+	}
+	return tc.Hysteresis
+}
+
+// Validate checks that thresholds increase with the severity of their action
+func (tc *ThermalConfig) Validate() error {
+	if tc.Throttle != nil && tc.ThrottleProfile == nil {
+		return fmt.Errorf("Throttling requires a throttle_profile")
+	}
+	var last *float64
+	var lastAction ThermalAction
+	for _, action := range thermalActions[1:] {
+		t := tc.threshold(action)
+		if t == nil {
+			continue
+		}
+		if last != nil && *t <= *last {
+			return fmt.Errorf("Threshold of %v (%v°C) must be above the threshold of %v (%v°C)", action, *t, lastAction, *last)
+		}
+		last = t
+		lastAction = action
+	}
+	if last == nil {
+		return fmt.Errorf("No thermal thresholds configured")
+	}
+	return nil
+}
+
+// ThermalEvent structure representing a GPU whose thermal action changed
+type ThermalEvent struct {
+	Topology    *pcie.Topology `json:"topology"`
+	Temperature float64        `json:"temperature"`
+	Previous    ThermalAction  `json:"previous"`
+	Action      ThermalAction  `json:"action"`
+}
+
+func (te *ThermalEvent) String() string {
+	return fmt.Sprintf("GPU %v at %.1f°C: %v -> %v", te.Topology, te.Temperature, te.Previous, te.Action)
+}
+
+// thermalPolicy keeps track of the action taken for every GPU
+type thermalPolicy struct {
+	sync.Mutex
+	config  *ThermalConfig
+	actions map[pcie.Topology]ThermalAction
+}
+
+func newThermalPolicy(config *ThermalConfig) *thermalPolicy {
+	tp := &thermalPolicy{}
+	tp.config = config
+	tp.actions = make(map[pcie.Topology]ThermalAction)
+	return tp
+}
+
+// evaluate returns the action for a GPU at temperature whose current action
+// is current. A GPU keeps an action until it cools down to hysteresis degrees
+// below its threshold
+func (tp *thermalPolicy) evaluate(current ThermalAction, temperature float64) ThermalAction {
+	hysteresis := tp.config.hysteresis()
+	ret := THERMAL_NONE
+	for _, action := range thermalActions[1:] {
+		t := tp.config.threshold(action)
+		if t == nil {
+			continue
+		}
+		if temperature >= *t {
+			ret = action
+		} else if action.severity() <= current.severity() && temperature > *t-hysteresis {
+			ret = action
+		}
+	}
+	return ret
+}
+
+// update evaluates readings and returns the GPUs whose action changed. GPUs
+// without a temperature keep their action
+func (tp *thermalPolicy) update(readings []*sensors.Reading) []*ThermalEvent {
+	tp.Lock()
+	defer tp.Unlock()
+	ret := make([]*ThermalEvent, 0)
+	for _, reading := range readings {
+		if reading.Topology == nil || reading.Temperature == nil {
+			continue
+		}
+		current, ok := tp.actions[*reading.Topology]
+		if !ok {
+			current = THERMAL_NONE
+		}
+		action := tp.evaluate(current, *reading.Temperature)
+		if action == current {
+			continue
+		}
+		tp.actions[*reading.Topology] = action
+		ret = append(ret, &ThermalEvent{reading.Topology, *reading.Temperature, current, action})
+	}
+	return ret
+}
+
+// action returns the action taken for the GPU at topology
+func (tp *thermalPolicy) action(topology *pcie.Topology) ThermalAction {
+	tp.Lock()
+	defer tp.Unlock()
+	if action, ok := tp.actions[*topology]; ok {
+		return action
+	}
+	return THERMAL_NONE
+}
+
+// stopped returns whether a GPU is hot enough that mining must stop
+func (tp *thermalPolicy) stopped() bool {
+	tp.Lock()
+	defer tp.Unlock()
+	for _, action := range tp.actions {
+		if action == THERMAL_STOP {
+			return true
+		}
+	}
+	return false
+}
+
+// apply throttles and excludes the threads of config that run on overheating
+// GPUs. Threads given by OpenCL index are matched through gpus. It fails if no
+// threads would be left
+func (tp *thermalPolicy) apply(config *Config, gpus []GPUInfo) error {
+	if len(config.Threads) == 0 {
+		return nil
+	}
+	threads := make([]GPUThread, 0)
+	for idx, thread := range config.Threads {
+		topology := threadTopology(config, gpus, &thread)
+		if topology == nil {
+			threads = append(threads, thread)
+			continue
+		}
+		switch tp.action(topology) {
+		case THERMAL_EXCLUDE, THERMAL_STOP:
+			log.Warnf("Excluding thread-%d: GPU %v is overheating", idx, topology)
+			continue
+		case THERMAL_THROTTLE:
+			log.Warnf("Throttling thread-%d: GPU %v is overheating", idx, topology)
+			thread.StandardGPUThread = tp.config.ThrottleProfile.StandardGPUThread
+			thread.HIPGPUThread = tp.config.ThrottleProfile.HIPGPUThread
+		}
+		threads = append(threads, thread)
+	}
+	if len(threads) == 0 {
+		return fmt.Errorf("Every thread runs on an overheating GPU")
+	}
+	config.Threads = threads
+	return nil
+}
+
+// protect applies the thermal policy to readings. The webserver is informed
+// of GPUs whose action changed and the miner is stopped or restarted with
+// the new threads
+func (c *Client) protect(readings []*sensors.Reading) {
+	events := c.thermal.update(readings)
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		log.Warnf("Thermal protection: %v", event)
+	}
+	if c.WebsocketClient != nil {
+		b, err := json.Marshal(events)
+		if err != nil {
+			log.Errorf("Failed to marshal thermal events: %v", err)
+		} else if err := c.Emit("thermal-event", string(b)); err != nil {
+			log.Errorf("Failed to report thermal events: %v", err)
+		}
+	}
+
+	if c.thermal.stopped() {
+		c.minerMutex.Lock()
+		defer c.minerMutex.Unlock()
+		if c.miner == nil {
+			return
+		}
+		log.Warnf("Stopping miner: GPUs are overheating")
+		if err := c.stopMiner(); err != nil {
+			log.Errorf("Failed to stop miner: %v", err)
+		}
+		return
+	}
+	if c.WebsocketClient == nil {
+		return
+	}
+	// Receiving the pools restarts the miner with the new threads
+	if err := c.UpdatePools(); err != nil {
+		log.Errorf("Failed to request pools: %v", err)
+	}
+}
+
+// handleThermalEvent records that a rig changed how it protects its GPUs and
+// raises an alert when a GPU got hotter
+func (s *Server) handleThermalEvent(w *websockets.WebsocketClient, data interface{}) {
+	rigID := s.RigID(w)
+	if strings.Compare(rigID, "") == 0 {
+		return
+	}
+	var events []*ThermalEvent
+	if err := decodeData(data, &events); err != nil {
+		log.Errorf("[thermal-event]: Failed to unmarshal events from rig '%v': %v", rigID, err)
+		return
+	}
+	for _, event := range events {
+		log.Warnf("[thermal-event]: Rig '%v': %v", rigID, event)
+		s.publishEvent("thermal-event", fmt.Sprintf("rig=%v %v", rigID, event))
+		if s.Alerter != nil && event.Action.severity() > event.Previous.severity() {
+			s.Alerter.Raise(&alert.Alert{
+				Rule:    "thermal",
+				Type:    alert.RULE_THERMAL,
+				Rig:     rigID,
+				Message: event.String(),
+			})
+		}
+	}
+}
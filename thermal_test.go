@@ -0,0 +1,187 @@
+package minerconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/minerconfig/pcie"
+	"github.com/gurupras/minerconfig/sensors"
+	"github.com/stretchr/testify/require"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func testThermalConfig() *ThermalConfig {
+	profile := &GPUThread{}
+	profile.Intensity = 512
+	profile.WorkSize = 8
+	return &ThermalConfig{
+		Throttle:        floatPtr(80),
+		Exclude:         floatPtr(88),
+		Stop:            floatPtr(95),
+		ThrottleProfile: profile,
+	}
+}
+
+func TestThermalPolicy(t *testing.T) {
+	require := require.New(t)
+
+	tp := newThermalPolicy(testThermalConfig())
+	gpu1 := &pcie.Topology{Bus: 1}
+	gpu2 := &pcie.Topology{Bus: 2}
+	read := func(temperatures ...float64) []*ThermalEvent {
+		return tp.update([]*sensors.Reading{
+			{Topology: gpu1, Temperature: &temperatures[0]},
+			{Topology: gpu2, Temperature: &temperatures[1]},
+		})
+	}
+
+	require.Equal(0, len(read(70, 60)))
+	require.Equal(THERMAL_NONE, tp.action(gpu1))
+
+	events := read(81, 60)
+	require.Equal(1, len(events))
+	require.Equal(THERMAL_NONE, events[0].Previous)
+	require.Equal(THERMAL_THROTTLE, events[0].Action)
+	require.Equal(81.0, events[0].Temperature)
+
+	// Cooling down below the threshold is not enough to recover
+	require.Equal(0, len(read(77, 60)))
+	require.Equal(THERMAL_THROTTLE, tp.action(gpu1))
+
+	// Thresholds can be skipped in either direction
+	events = read(90, 60)
+	require.Equal(THERMAL_EXCLUDE, events[0].Action)
+	events = read(82, 60)
+	require.Equal(THERMAL_THROTTLE, events[0].Action)
+	require.Equal(0, len(read(76, 60)))
+	events = read(75, 60)
+	require.Equal(THERMAL_NONE, events[0].Action)
+
+	require.False(tp.stopped())
+	events = read(70, 96)
+	require.Equal(1, len(events))
+	require.Equal(gpu2, events[0].Topology)
+	require.True(tp.stopped())
+	require.Equal(0, len(read(70, 91)))
+	require.True(tp.stopped())
+	read(70, 89)
+	require.False(tp.stopped())
+	require.Equal(THERMAL_EXCLUDE, tp.action(gpu2))
+
+	// GPUs without a temperature keep their action
+	require.Equal(0, len(tp.update([]*sensors.Reading{{Topology: gpu2}})))
+	require.Equal(THERMAL_EXCLUDE, tp.action(gpu2))
+}
+
+func TestThermalPolicyApply(t *testing.T) {
+	require := require.New(t)
+
+	tp := newThermalPolicy(testThermalConfig())
+	newConfig := func() *Config {
+		config := &Config{}
+		config.DeviceInstanceIDs = []string{"0000:01:00.0", "0000:02:00.0"}
+		config.Threads = []GPUThread{
+			{DeviceIndex: intPtr(0)},
+			{DeviceIndex: intPtr(1)},
+			{Index: intPtr(2)},
+		}
+		for idx := range config.Threads {
+			config.Threads[idx].Intensity = 1024
+		}
+		return config
+	}
+	gpus := []GPUInfo{{OpenCLIndex: intPtr(2), Topology: &pcie.Topology{Bus: 3}}}
+
+	config := newConfig()
+	require.Nil(tp.apply(config, gpus))
+	require.Equal(3, len(config.Threads))
+
+	tp.update([]*sensors.Reading{
+		{Topology: &pcie.Topology{Bus: 1}, Temperature: floatPtr(85)},
+		{Topology: &pcie.Topology{Bus: 3}, Temperature: floatPtr(90)},
+	})
+	config = newConfig()
+	require.Nil(tp.apply(config, gpus))
+	require.Equal(2, len(config.Threads))
+	require.Equal(0, *config.Threads[0].DeviceIndex)
+	require.Equal(512, config.Threads[0].Intensity)
+	require.Equal(8, config.Threads[0].WorkSize)
+	require.Equal(1, *config.Threads[1].DeviceIndex)
+	require.Equal(1024, config.Threads[1].Intensity)
+
+	tp.update([]*sensors.Reading{{Topology: &pcie.Topology{Bus: 2}, Temperature: floatPtr(89)}})
+	tp.update([]*sensors.Reading{{Topology: &pcie.Topology{Bus: 1}, Temperature: floatPtr(89)}})
+	require.NotNil(tp.apply(newConfig(), gpus))
+}
+
+func TestThermalConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(testThermalConfig().Validate())
+	require.Nil((&ThermalConfig{Stop: floatPtr(90)}).Validate())
+	require.NotNil((&ThermalConfig{}).Validate())
+	require.NotNil((&ThermalConfig{Throttle: floatPtr(80)}).Validate())
+
+	config := testThermalConfig()
+	config.Exclude = floatPtr(96)
+	require.NotNil(config.Validate())
+}
+
+func TestClientProtect(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{}
+	c.thermal = newThermalPolicy(testThermalConfig())
+	reader := &fakeSensorReader{}
+	reader.readings = []*sensors.Reading{{Topology: &pcie.Topology{Bus: 1}, Temperature: floatPtr(97)}}
+	readings := c.updateSensors([]sensors.Reader{reader})
+	require.Equal(1, len(readings))
+	require.Equal(readings, c.Readings())
+	require.True(c.thermal.stopped())
+}
+
+func TestClientProtectStopsMiner(t *testing.T) {
+	require := require.New(t)
+
+	binaryPath := buildDummyMiner(require)
+	defer os.RemoveAll(filepath.Dir(binaryPath))
+
+	clientConfig := generateValidClientConfig(require)
+	defer os.Remove(clientConfig.MinerConfigPath)
+	clientConfig.BinaryPath = binaryPath
+	clientConfig.StatePath = filepath.Join(filepath.Dir(binaryPath), "state")
+
+	c := newOfflineClient(require, clientConfig)
+	c.thermal = newThermalPolicy(testThermalConfig())
+	require.Nil(c.StartMiner())
+
+	// The miner is stopped from the sensors goroutine while the websocket
+	// goroutine looks at it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 100; idx++ {
+			c.Status()
+		}
+	}()
+	c.protect([]*sensors.Reading{{Topology: &pcie.Topology{Bus: 1}, Temperature: floatPtr(97)}})
+	<-done
+	require.False(c.minerRunning())
+	require.False(c.Status().Mining)
+}
+
+type fakeSensorReader struct {
+	readings []*sensors.Reading
+}
+
+func (fr *fakeSensorReader) Read() ([]*sensors.Reading, error) {
+	return fr.readings, nil
+}
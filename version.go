@@ -0,0 +1,5 @@
+package minerconfig
+
+// Version of minerconfig reported by clients. Override at build time with
+// -ldflags "-X github.com/gurupras/minerconfig.Version=<version>"
+var Version = "dev"
@@ -0,0 +1,108 @@
+package wallet
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Characters used by CryptoNote's base58 encoding
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var (
+	nameRegexp        = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	paymentIDRegexp   = regexp.MustCompile(`^([0-9a-fA-F]{16}|[0-9a-fA-F]{64})$`)
+	placeholderRegexp = regexp.MustCompile(`\{([a-z_]+)\}`)
+)
+
+// AddressFormat structure representing what addresses of a coin look like
+type AddressFormat struct {
+	Prefix string
+	Length int
+}
+
+// AddressFormats holds the formats of standard, sub- and integrated addresses
+// of common CryptoNote coins keyed by upper-case ticker
+var AddressFormats = map[string][]AddressFormat{
+	"XMR":  {{"4", 95}, {"8", 95}, {"4", 106}},
+	"AEON": {{"Wm", 97}},
+	"ETN":  {{"etn", 98}},
+	"TRTL": {{"TRTL", 99}, {"TRTL", 187}},
+	"SUMO": {{"Sumo", 99}},
+	"MSR":  {{"5", 95}},
+}
+
+// Wallet structure representing a named wallet that pools can mine to
+type Wallet struct {
+	Name    string `json:"name" yaml:"name"`
+	Coin    string `json:"coin" yaml:"coin"`
+	Address string `json:"address" yaml:"address"`
+	// Optional payment ID for exchange or shared wallets
+	PaymentID string `json:"payment_id" yaml:"payment_id"`
+}
+
+// Validate checks the wallet for errors
+func (w *Wallet) Validate() error {
+	if !nameRegexp.MatchString(w.Name) {
+		return fmt.Errorf("Invalid wallet name: '%v'", w.Name)
+	}
+	if strings.Compare(w.Coin, "") == 0 {
+		return fmt.Errorf("Wallet '%v' has no coin", w.Name)
+	}
+	if err := ValidateAddress(w.Coin, w.Address); err != nil {
+		return fmt.Errorf("Wallet '%v': %v", w.Name, err)
+	}
+	if strings.Compare(w.PaymentID, "") != 0 && !paymentIDRegexp.MatchString(w.PaymentID) {
+		return fmt.Errorf("Wallet '%v': payment ID must be 16 or 64 hex characters", w.Name)
+	}
+	return nil
+}
+
+// ValidateAddress checks that address is a plausible address of coin. Only
+// the characters are checked for coins without a known format
+func ValidateAddress(coin string, address string) error {
+	if strings.Compare(address, "") == 0 {
+		return fmt.Errorf("Address is empty")
+	}
+	formats, ok := AddressFormats[strings.ToUpper(coin)]
+	if !ok {
+		if strings.ContainsAny(address, " \t\r\n") {
+			return fmt.Errorf("Address contains whitespace")
+		}
+		return nil
+	}
+	for _, r := range address {
+		if !strings.ContainsRune(base58Alphabet, r) {
+			return fmt.Errorf("Address contains invalid character '%c'", r)
+		}
+	}
+	for _, format := range formats {
+		if len(address) == format.Length && strings.HasPrefix(address, format.Prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Not a valid %v address", strings.ToUpper(coin))
+}
+
+// Values returns the placeholders of the wallet that pool templates can use
+func (w *Wallet) Values() map[string]string {
+	return map[string]string{
+		"wallet":      w.Address,
+		"address":     w.Address,
+		"payment_id":  w.PaymentID,
+		"wallet_name": w.Name,
+		"coin":        w.Coin,
+	}
+}
+
+// Expand replaces the {placeholders} in template that are in values. Unknown
+// placeholders are left as they are so that they can be expanded later
+func Expand(template string, values map[string]string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		if value, ok := values[key]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
@@ -0,0 +1,53 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const xmrAddress = "42ZSsWcvppV1Ux3XDPvBoZ3Lt1MZdfG9tFAuvVwTsceFZYcYovTPAQLgi9c6ectzqiUSimgwkBscQA4RDfpgE5ieLQjYjAv"
+
+func TestValidateAddress(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(ValidateAddress("XMR", xmrAddress))
+	require.Nil(ValidateAddress("xmr", xmrAddress))
+	// Truncated
+	require.NotNil(ValidateAddress("XMR", xmrAddress[:94]))
+	// Wrong coin
+	require.NotNil(ValidateAddress("AEON", xmrAddress))
+	// '0' is not part of base58
+	require.NotNil(ValidateAddress("XMR", "0"+xmrAddress[1:]))
+	require.NotNil(ValidateAddress("XMR", ""))
+
+	// Unknown coins only need to look like an address
+	require.Nil(ValidateAddress("BTC", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"))
+	require.NotNil(ValidateAddress("BTC", "1Boat SLRHtKNngkdXEeobR76b53LETtpyT"))
+}
+
+func TestWalletValidate(t *testing.T) {
+	require := require.New(t)
+
+	w := &Wallet{Name: "main", Coin: "XMR", Address: xmrAddress}
+	require.Nil(w.Validate())
+	w.PaymentID = "0123456789abcdef"
+	require.Nil(w.Validate())
+	w.PaymentID = "xyz"
+	require.NotNil(w.Validate())
+
+	require.NotNil((&Wallet{Name: "../main", Coin: "XMR", Address: xmrAddress}).Validate())
+	require.NotNil((&Wallet{Name: "main", Address: xmrAddress}).Validate())
+}
+
+func TestExpand(t *testing.T) {
+	require := require.New(t)
+
+	w := &Wallet{Name: "main", Coin: "XMR", Address: xmrAddress}
+	values := w.Values()
+	values["rig"] = "rig1"
+	require.Equal(xmrAddress+".rig1", Expand("{wallet}.{rig}", values))
+	// Unknown placeholders are left for later
+	require.Equal(xmrAddress+".{hostname}", Expand("{wallet}.{hostname}", values))
+	require.Equal("x", Expand("x", values))
+}
@@ -0,0 +1,251 @@
+package minerconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/gurupras/minerconfig/wallet"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// Template used for the user of pools that reference a wallet without a
+// user_template of their own
+const defaultUserTemplate = "{wallet}"
+
+// WalletStore keeps track of the wallets pools can reference by name
+type WalletStore struct {
+	sync.Mutex
+	path    string
+	wallets map[string]*wallet.Wallet
+}
+
+// NewWalletStore creates a WalletStore persisted at path
+func NewWalletStore(path string) *WalletStore {
+	ws := &WalletStore{}
+	ws.path = path
+	ws.wallets = make(map[string]*wallet.Wallet)
+	if easyfiles.Exists(path) {
+		if b, err := ioutil.ReadFile(path); err != nil {
+			log.Errorf("Failed to read wallets '%v': %v", path, err)
+		} else if err := json.Unmarshal(b, &ws.wallets); err != nil {
+			log.Errorf("Failed to unmarshal wallets '%v': %v", path, err)
+		}
+	}
+	return ws
+}
+
+// save persists the wallets. Must be called with the lock held
+func (ws *WalletStore) save() error {
+	b, err := json.Marshal(ws.wallets)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal wallets: %v", err)
+	}
+	if err := ioutil.WriteFile(ws.path, b, 0666); err != nil {
+		return fmt.Errorf("Failed to write wallets: %v", err)
+	}
+	return nil
+}
+
+// Wallets returns every wallet sorted by name
+func (ws *WalletStore) Wallets() []*wallet.Wallet {
+	ws.Lock()
+	defer ws.Unlock()
+	ret := make([]*wallet.Wallet, 0)
+	for _, w := range ws.wallets {
+		c := &wallet.Wallet{}
+		*c = *w
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Get returns a copy of the wallet called name, or nil if there is none
+func (ws *WalletStore) Get(name string) *wallet.Wallet {
+	ws.Lock()
+	defer ws.Unlock()
+	w, ok := ws.wallets[name]
+	if !ok {
+		return nil
+	}
+	ret := &wallet.Wallet{}
+	*ret = *w
+	return ret
+}
+
+// Set validates and adds w, replacing any wallet with the same name
+func (ws *WalletStore) Set(w *wallet.Wallet) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+	ws.Lock()
+	defer ws.Unlock()
+	c := &wallet.Wallet{}
+	*c = *w
+	ws.wallets[w.Name] = c
+	return ws.save()
+}
+
+// Remove removes the wallet called name
+func (ws *WalletStore) Remove(name string) error {
+	ws.Lock()
+	defer ws.Unlock()
+	if _, ok := ws.wallets[name]; !ok {
+		return fmt.Errorf("No wallet named '%v'", name)
+	}
+	delete(ws.wallets, name)
+	return ws.save()
+}
+
+// CheckPool returns an error if pool references a wallet that does not exist
+func (ws *WalletStore) CheckPool(pool map[string]interface{}) error {
+	name, ok := pool["wallet"].(string)
+	if !ok || strings.Compare(name, "") == 0 {
+		return nil
+	}
+	if ws.Get(name) == nil {
+		return fmt.Errorf("Pool references unknown wallet '%v'", name)
+	}
+	return nil
+}
+
+// ExpandPools returns a copy of pools in which the user of every pool that
+// references a wallet is filled in from its user_template. values holds any
+// other placeholders the templates may use
+func (ws *WalletStore) ExpandPools(pools []interface{}, values map[string]string) []interface{} {
+	ret := make([]interface{}, 0)
+	for _, rawPool := range pools {
+		pool, ok := rawPool.(map[string]interface{})
+		if !ok {
+			ret = append(ret, rawPool)
+			continue
+		}
+		expanded := make(map[string]interface{})
+		for k, v := range pool {
+			expanded[k] = v
+		}
+		template, _ := pool["user_template"].(string)
+		templateValues := make(map[string]string)
+		for k, v := range values {
+			templateValues[k] = v
+		}
+		if name, ok := pool["wallet"].(string); ok && strings.Compare(name, "") != 0 {
+			w := ws.Get(name)
+			if w == nil {
+				log.Errorf("Pool '%v' references unknown wallet '%v'", pool["url"], name)
+				ret = append(ret, expanded)
+				continue
+			}
+			for k, v := range w.Values() {
+				templateValues[k] = v
+			}
+			if strings.Compare(template, "") == 0 {
+				template = defaultUserTemplate
+			}
+			expanded["wallet_name"] = w.Name
+			if coin, _ := pool["coin"].(string); strings.Compare(coin, "") == 0 {
+				expanded["coin"] = w.Coin
+			}
+		}
+		if strings.Compare(template, "") != 0 {
+			expanded["user"] = wallet.Expand(template, templateValues)
+		}
+		ret = append(ret, expanded)
+	}
+	return ret
+}
+
+// SelectedPoolsFor returns the selected pools of rig as they are sent to it,
+// with wallets and user templates expanded. An empty rig returns the
+// farm-wide selection as it is, for clients that are not rigs, such as the
+// UI, so that it can be edited
+func (s *Server) SelectedPoolsFor(rig string) []interface{} {
+	if strings.Compare(rig, "") == 0 {
+		return s.Store.SelectedPools(rig)
+	}
+	pools, values := s.rigSelection(rig)
+	return s.Wallets.ExpandPools(pools, values)
+}
+
+// rigSelection returns the pools that apply to rig, which are its own, its
+// group's or the farm-wide ones, along with the placeholder values of rig
+func (s *Server) rigSelection(rig string) ([]interface{}, map[string]string) {
+	values := map[string]string{
+		"rig": rig,
+	}
+	if rigInfo, ok := s.Rigs()[rig]; ok {
+		values["group"] = rigInfo.Group
+	}
+	return s.Store.RigSelectedPools(rig, values["group"]), values
+}
+
+// walletRequest structure representing a remove-wallet request
+type walletRequest struct {
+	Name string `json:"name"`
+}
+
+// handleGetWallets sends every wallet to the requester
+func (s *Server) handleGetWallets(w *websockets.WebsocketClient, data interface{}) {
+	w.Emit("get-wallets-result", jsonData(s.Wallets.Wallets()))
+}
+
+// handleAddWallet adds or updates a wallet and sends the affected rigs their
+// pools again
+func (s *Server) handleAddWallet(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("add-wallet", fmt.Sprintf("clientaddr=%v wallet=%v", w.RemoteAddr(), data))
+	var newWallet wallet.Wallet
+	if err := decodeData(data, &newWallet); err != nil {
+		log.Errorf("[add-wallet]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid add-wallet request: %v", err))
+		return
+	}
+	if err := s.Wallets.Set(&newWallet); err != nil {
+		log.Errorf("[add-wallet]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_WALLET,
+		Actor:   clientAddr(w),
+		Message: fmt.Sprintf("Saved wallet '%v'", newWallet.Name),
+		Details: &newWallet,
+	})
+	w.Emit("get-wallets-result", jsonData(s.Wallets.Wallets()))
+	s.BroadcastSelectedPools()
+}
+
+// handleRemoveWallet removes a wallet that no pool references
+func (s *Server) handleRemoveWallet(w *websockets.WebsocketClient, data interface{}) {
+	s.publishEvent("remove-wallet", fmt.Sprintf("clientaddr=%v wallet=%v", w.RemoteAddr(), data))
+	var request walletRequest
+	if err := decodeData(data, &request); err != nil {
+		log.Errorf("[remove-wallet]: Failed to unmarshal: %v", err)
+		w.Emit("error", fmt.Sprintf("Invalid remove-wallet request: %v", err))
+		return
+	}
+	for _, rawPool := range s.Store.Pools() {
+		if pool, ok := rawPool.(map[string]interface{}); ok && pool["wallet"] == request.Name {
+			w.Emit("error", fmt.Sprintf("Wallet '%v' is used by pool '%v'", request.Name, pool["url"]))
+			return
+		}
+	}
+	if err := s.Wallets.Remove(request.Name); err != nil {
+		log.Errorf("[remove-wallet]: %v", err)
+		w.Emit("error", err.Error())
+		return
+	}
+	s.Audit.Record(&AuditEntry{
+		Event:   AUDIT_WALLET,
+		Actor:   clientAddr(w),
+		Message: fmt.Sprintf("Removed wallet '%v'", request.Name),
+	})
+	w.Emit("get-wallets-result", jsonData(s.Wallets.Wallets()))
+}
@@ -0,0 +1,77 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/minerconfig/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+const testXMRAddress = "42ZSsWcvppV1Ux3XDPvBoZ3Lt1MZdfG9tFAuvVwTsceFZYcYovTPAQLgi9c6ectzqiUSimgwkBscQA4RDfpgE5ieLQjYjAv"
+
+func TestWalletStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "minerconfig-wallets")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wallets.json")
+	store := NewWalletStore(path)
+	require.Nil(store.Set(&wallet.Wallet{Name: "main", Coin: "XMR", Address: testXMRAddress}))
+	require.NotNil(store.Set(&wallet.Wallet{Name: "bad", Coin: "XMR", Address: "4abc"}))
+
+	// Persisted
+	store = NewWalletStore(path)
+	require.Equal(1, len(store.Wallets()))
+	require.Equal(testXMRAddress, store.Get("main").Address)
+	require.Nil(store.Get("bad"))
+
+	require.Nil(store.CheckPool(map[string]interface{}{"url": "a", "wallet": "main"}))
+	require.Nil(store.CheckPool(map[string]interface{}{"url": "a"}))
+	require.NotNil(store.CheckPool(map[string]interface{}{"url": "a", "wallet": "other"}))
+
+	pools := []interface{}{
+		map[string]interface{}{"url": "a", "wallet": "main", "user_template": "{wallet}.{rig}"},
+		map[string]interface{}{"url": "b", "wallet": "main"},
+		map[string]interface{}{"url": "c", "user": "plain"},
+	}
+	expanded := store.ExpandPools(pools, map[string]string{"rig": "rig1"})
+	require.Equal(testXMRAddress+".rig1", expanded[0].(map[string]interface{})["user"])
+	require.Equal("XMR", expanded[0].(map[string]interface{})["coin"])
+	require.Equal("main", expanded[0].(map[string]interface{})["wallet_name"])
+	require.Equal(testXMRAddress, expanded[1].(map[string]interface{})["user"])
+	require.Equal("plain", expanded[2].(map[string]interface{})["user"])
+	// The stored pools are untouched
+	_, ok := pools[0].(map[string]interface{})["user"]
+	require.False(ok)
+
+	require.Nil(store.Remove("main"))
+	require.NotNil(store.Remove("main"))
+}
+
+func TestSelectedPoolsFor(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-wallets")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	require.Nil(server.Wallets.Set(&wallet.Wallet{Name: "main", Coin: "XMR", Address: testXMRAddress}))
+	require.Nil(server.Store.SetSelectedPools("", []interface{}{
+		map[string]interface{}{"url": "a", "wallet": "main", "user_template": "{wallet}.{rig}"},
+	}))
+
+	pools := server.SelectedPoolsFor("rig7")
+	require.Equal(testXMRAddress+".rig7", pools[0].(map[string]interface{})["user"])
+
+	// The UI gets the template
+	pools = server.SelectedPoolsFor("")
+	_, ok := pools[0].(map[string]interface{})["user"]
+	require.False(ok)
+}
@@ -1,148 +1,273 @@
 package minerconfig
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/bmatcuk/doublestar"
 	"github.com/gorilla/mux"
-	"github.com/gurupras/go-easyfiles"
 	"github.com/gurupras/go-stoppable-net-listener"
 	"github.com/homesound/simple-websockets"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 )
 
-var pools []interface{}
-var selectedPools []interface{}
+// ServerConfig structure representing the configuration parameters for a
+// minerconfig webserver
+type ServerConfig struct {
+	WebserverPath string          `json:"webserver_path" yaml:"webserver_path"`
+	Port          int             `json:"port" yaml:"port"`
+	Profit        *ProfitConfig   `json:"profit" yaml:"profit"`
+	Schedule      *ScheduleConfig `json:"schedule" yaml:"schedule"`
+	Alerts        *AlertConfig    `json:"alerts" yaml:"alerts"`
+	Rollout       *RolloutConfig  `json:"rollout" yaml:"rollout"`
+	// Seconds without a heartbeat after which a rig is considered offline
+	RigTimeout int `json:"rig_timeout" yaml:"rig_timeout"`
+}
+
+// Server structure represents a minerconfig webserver
+// minerconfig Servers are responsible for:
+// 1) Keeping track of available and selected pools
+// 2) Serving the UI used to select pools
+// 3) Pushing selected pools to connected clients
+type Server struct {
+	*ServerConfig
+	*websockets.Server
+	Router    *mux.Router
+	Store     *PoolStore
+	Wallets   *WalletStore
+	Profit    *ProfitSwitcher
+	Scheduler *Scheduler
+	Inventory *RigInventory
+	Audit     *AuditLog
+	Alerter   *Alerter
+	Rollout   *RolloutManager
+	snl       *stoppablenetlistener.StoppableNetListener
+	metrics   *serverMetrics
+	stop      chan struct{}
+
+	rigsMutex      sync.Mutex
+	rigs           map[*websockets.WebsocketClient]*RigInfo
+	connections    connections
+	minerCommands  minerCommands
+	logSubscribers logSubscribers
+}
 
+// RunServer starts a webserver serving webserverPath on port
 func RunServer(webserverPath string, port int) *stoppablenetlistener.StoppableNetListener {
+	server, err := NewServer(&ServerConfig{
+		WebserverPath: webserverPath,
+		Port:          port,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create server: %v\n", err)
+		os.Exit(-1)
+	}
+	snl, err := server.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get snl: %v\n", err)
+		os.Exit(-1)
+	}
+	return snl
+}
+
+// NewServer creates a new minerconfig webserver
+func NewServer(serverConfig *ServerConfig) (*Server, error) {
 	r := mux.NewRouter()
 	ws := websockets.NewServer(r)
 	ws.UseEvents = true
 
-	pools = make([]interface{}, 0)
-
-	poolsDir := filepath.Join(webserverPath, "pools")
-	if !easyfiles.Exists(poolsDir) {
-		easyfiles.Makedirs(poolsDir)
+	s := &Server{}
+	s.ServerConfig = serverConfig
+	s.Server = ws
+	s.Router = r
+	s.Store = NewPoolStore(filepath.Join(serverConfig.WebserverPath, "pools"))
+	s.Wallets = NewWalletStore(filepath.Join(serverConfig.WebserverPath, "wallets.json"))
+	s.rigs = make(map[*websockets.WebsocketClient]*RigInfo)
+	if serverConfig.RigTimeout <= 0 {
+		serverConfig.RigTimeout = defaultRigTimeout
 	}
+	s.Inventory = NewRigInventory(filepath.Join(serverConfig.WebserverPath, "rigs.json"), time.Duration(serverConfig.RigTimeout)*time.Second)
+	s.Audit = NewAuditLog(filepath.Join(serverConfig.WebserverPath, "audit.log"))
+	s.metrics = newServerMetrics(s)
 
-	files, err := doublestar.Glob(filepath.Join(poolsDir, "pool-*"))
-	if err != nil {
-		log.Errorf("Failed to list pools in poolsDir: %v", err)
-	}
-	log.Debugf("Found %d pool files", len(files))
-	for _, file := range files {
-		b, err := ioutil.ReadFile(file)
+	if serverConfig.Profit != nil {
+		profitSwitcher, err := NewProfitSwitcher(s, serverConfig.Profit)
 		if err != nil {
-			log.Errorf("Failed to read file '%v': %v", file, err)
-			continue
+			return nil, fmt.Errorf("Failed to set up profit switcher: %v", err)
 		}
-		var pool map[string]interface{}
-		if err = json.Unmarshal(b, &pool); err != nil {
-			log.Errorf("Failed to unmarshal pool from file '%v': %v", file, err)
-		} else {
-			pools = append(pools, pool)
+		s.Profit = profitSwitcher
+	}
+	if serverConfig.Schedule != nil {
+		scheduler, err := NewScheduler(s, serverConfig.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up scheduler: %v", err)
 		}
+		s.Scheduler = scheduler
 	}
-
-	// Load selected pools
-	selectedPoolsPath := filepath.Join(poolsDir, "selected-pools")
-	noSelectedPools := true
-	if easyfiles.Exists(selectedPoolsPath) {
-		noSelectedPools = false
-		b, err := ioutil.ReadFile(selectedPoolsPath)
+	if serverConfig.Alerts != nil {
+		alerter, err := NewAlerter(s, serverConfig.Alerts)
 		if err != nil {
-			log.Errorf("Failed to read selected pools file '%v': %v", selectedPoolsPath, err)
-			noSelectedPools = true
-		} else {
-			if err = json.Unmarshal(b, &selectedPools); err != nil {
-				log.Errorf("Failed to unmarshal selected pools file '%v': %v", selectedPoolsPath, err)
-				noSelectedPools = true
-			}
+			return nil, fmt.Errorf("Failed to set up alerts: %v", err)
 		}
+		s.Alerter = alerter
 	}
-	if noSelectedPools {
-		selectedPools = make([]interface{}, 0)
+	if serverConfig.Rollout != nil {
+		rollout, err := NewRolloutManager(s, serverConfig.Rollout, filepath.Join(serverConfig.WebserverPath, "rollout.json"))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up staged rollouts: %v", err)
+		}
+		s.Rollout = rollout
 	}
 
-	ws.On("update-selected-pools", func(w *websockets.WebsocketClient, data interface{}) {
-		if ws.UseEvents {
-			evt := &websockets.Event{"update-selected-pools", fmt.Sprintf("clientaddr=%v pools=%v", w.RemoteAddr(), data)}
-			ws.EventChan <- evt
-		}
-		poolStr := data.(string)
-		poolBytes := []byte(poolStr)
-		if err := json.Unmarshal(poolBytes, &selectedPools); err != nil {
+	s.AddHandlers()
+	return s, nil
+}
+
+// AddHandlers adds the websocket listeners and HTTP routes of the server
+func (s *Server) AddHandlers() {
+	ws := s.Server
+	r := s.Router
+
+	s.on("update-selected-pools", func(w *websockets.WebsocketClient, data interface{}) {
+		s.publishEvent("update-selected-pools", fmt.Sprintf("clientaddr=%v pools=%v", w.RemoteAddr(), data))
+		var selectedPools []interface{}
+		if err := decodeData(data, &selectedPools); err != nil {
 			log.Errorf("[update-selected-pools]: Failed to unmarshal: %v", err)
 			return
 		}
-		if err := ioutil.WriteFile(selectedPoolsPath, poolBytes, 0666); err != nil {
-			log.Errorf("Failed to write selected pools to file: %v", err)
+		started, err := s.SetFarmSelectedPools(clientAddr(w), selectedPools, fmt.Sprintf("Selected %d pools", len(selectedPools)))
+		if err != nil {
+			log.Errorf("[update-selected-pools]: %v", err)
+			w.Emit("error", err.Error())
+			return
 		}
-
-		for client, _ := range ws.Clients {
-			client.Emit("update-selected-pools", selectedPools)
+		if started {
+			// The change is tried on the canaries first
+			w.Emit("get-rollout-result", jsonData(s.Rollout.Current()))
 		}
 	})
 
-	ws.On("add-pool", func(w *websockets.WebsocketClient, data interface{}) {
-		if ws.UseEvents {
-			evt := &websockets.Event{"add-pool", fmt.Sprintf("clientaddr=%v pool=%v", w.RemoteAddr(), data)}
-			ws.EventChan <- evt
-		}
+	s.on("add-pool", func(w *websockets.WebsocketClient, data interface{}) {
+		s.publishEvent("add-pool", fmt.Sprintf("clientaddr=%v pool=%v", w.RemoteAddr(), data))
 		poolStr := data.(string)
 		poolBytes := []byte(poolStr)
-		var pool map[string]interface{}
-		if err := json.Unmarshal(poolBytes, &pool); err != nil {
-			log.Errorf("[add-pool]: Failed to unmarshal pool: %v", err)
-		}
-		hash := fmt.Sprintf("%X", md5.Sum(poolBytes))
-		poolFile := filepath.Join(poolsDir, fmt.Sprintf("pool-%v", hash))
-		if !easyfiles.Exists(poolFile) {
-			if err := ioutil.WriteFile(poolFile, poolBytes, 0666); err != nil {
-				log.Errorf("Failed to write new pool to file: %v", err)
-				w.Emit("error", fmt.Sprintf("Failed to write new pool to file: %v", err))
+		var newPool map[string]interface{}
+		if err := json.Unmarshal(poolBytes, &newPool); err == nil {
+			if err := s.ValidatePool(newPool); err != nil {
+				log.Errorf("[add-pool]: %v", err)
+				w.Emit("error", err.Error())
+				return
 			}
 		}
-		pools = append(pools, pool)
+		pool, err := s.Store.AddPool(poolBytes)
+		if err != nil {
+			log.Errorf("[add-pool]: %v", err)
+			w.Emit("error", err.Error())
+			return
+		}
+		s.Audit.Record(&AuditEntry{
+			Event:   AUDIT_ADD_POOL,
+			Actor:   clientAddr(w),
+			Message: "Added pool",
+			Details: pool,
+		})
 		for client, _ := range ws.Clients {
 			client.Emit("new-pool", pool)
 		}
 	})
 
-	ws.On("get-available-pools", func(w *websockets.WebsocketClient, data interface{}) {
-		if ws.UseEvents {
-			evt := &websockets.Event{"get-available-pools", fmt.Sprintf("clientaddr=%v", w.RemoteAddr())}
-			ws.EventChan <- evt
+	s.on("add-pools", s.handleAddPools)
+
+	s.on("get-available-pools", func(w *websockets.WebsocketClient, data interface{}) {
+		s.publishEvent("get-available-pools", fmt.Sprintf("clientaddr=%v", w.RemoteAddr()))
+		w.Emit("get-available-pools-result", s.Store.Pools())
+	})
+
+	s.on("get-selected-pools", func(w *websockets.WebsocketClient, data interface{}) {
+		s.publishEvent("get-selected-pools", fmt.Sprintf("clientaddr=%v", w.RemoteAddr()))
+		var request SelectionRequest
+		if data != nil {
+			if err := decodeData(data, &request); err != nil {
+				log.Errorf("[get-selected-pools]: Failed to unmarshal: %v", err)
+				w.Emit("error", fmt.Sprintf("Invalid get-selected-pools request: %v", err))
+				return
+			}
 		}
-		b, _ := json.Marshal(pools)
-		_ = b
-		w.Emit("get-available-pools-result", pools)
+		rigID := s.RigID(w)
+		if strings.Compare(rigID, "") == 0 && strings.Compare(request.Rig, "") != 0 {
+			// Rigs are only ever sent pools with their wallets expanded. The
+			// query leaves the connections of rigs alone
+			if s.Inventory.Get(request.Rig) == nil {
+				log.Warnf("[get-selected-pools]: Rig '%v' is not registered", request.Rig)
+				w.Emit("error", fmt.Sprintf("Rig '%v' is not registered", request.Rig))
+				return
+			}
+			rigID = request.Rig
+		}
+		w.Emit("get-selected-pools-result", s.SelectedPoolsFor(rigID))
 	})
 
-	ws.On("get-selected-pools", func(w *websockets.WebsocketClient, data interface{}) {
-		if ws.UseEvents {
-			evt := &websockets.Event{"get-selected-pools", fmt.Sprintf("clientaddr=%v", w.RemoteAddr())}
-			ws.EventChan <- evt
+	s.on("register-rig", func(w *websockets.WebsocketClient, data interface{}) {
+		s.publishEvent("register-rig", fmt.Sprintf("clientaddr=%v rig=%v", w.RemoteAddr(), data))
+		var rigInfo RigInfo
+		if err := decodeData(data, &rigInfo); err != nil {
+			log.Errorf("[register-rig]: Failed to unmarshal: %v", err)
+			return
 		}
-		b, _ := json.Marshal(selectedPools)
-		_ = b
-		w.Emit("get-selected-pools-result", selectedPools)
+		if !rigIDRegexp.MatchString(rigInfo.RigID) {
+			log.Errorf("[register-rig]: Invalid rig ID: '%v'", rigInfo.RigID)
+			w.Emit("error", fmt.Sprintf("Invalid rig ID: '%v'", rigInfo.RigID))
+			return
+		}
+		s.registerRig(w, &rigInfo)
+	})
+
+	s.on("pause-mining", func(w *websockets.WebsocketClient, data interface{}) {
+		s.forwardMiningControl("pause-mining", w, data)
 	})
 
-	ws.On("keepalive", func(w *websockets.WebsocketClient, data interface{}) {
-		// do nothing
+	s.on("resume-mining", func(w *websockets.WebsocketClient, data interface{}) {
+		s.forwardMiningControl("resume-mining", w, data)
+	})
+
+	s.on("miner-command", s.handleMinerCommand)
+	s.on("miner-command-result", s.handleMinerCommandResult)
+	s.on("subscribe-logs", s.handleSubscribeLogs)
+	s.on("unsubscribe-logs", s.handleUnsubscribeLogs)
+	s.on("log-lines", s.handleLogLines)
+
+	s.on("get-rigs", s.handleGetRigs)
+	s.on("keepalive", s.handleKeepalive)
+	s.on("status-report", s.handleStatusReport)
+	s.on("gpu-reset-failed", s.handleGPUResetFailed)
+	s.on("thermal-event", s.handleThermalEvent)
+	s.on("get-alerts", s.handleGetAlerts)
+	s.on("get-audit-log", s.handleGetAuditLog)
+	s.on("get-selected-pools-history", s.handleGetSelectionHistory)
+	s.on("rollback-selected-pools", s.handleRollbackSelectedPools)
+	s.on("update-group-selected-pools", s.handleUpdateGroupSelectedPools)
+	s.on("preview-selected-pools", s.handlePreviewSelectedPools)
+	s.on("preview-workers", s.handlePreviewWorkers)
+	s.on("get-wallets", s.handleGetWallets)
+	s.on("add-wallet", s.handleAddWallet)
+	s.on("remove-wallet", s.handleRemoveWallet)
+	s.on("get-rollout", s.handleGetRollout)
+	s.on("promote-rollout", func(w *websockets.WebsocketClient, data interface{}) {
+		s.handleRolloutAction("promote-rollout", w)
+	})
+	s.on("cancel-rollout", func(w *websockets.WebsocketClient, data interface{}) {
+		s.handleRolloutAction("cancel-rollout", w)
 	})
 
-	webserverBasePath := webserverPath
+	webserverBasePath := s.WebserverPath
 	staticPath := filepath.Join(webserverBasePath, "static") + "/"
 
 	r.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -157,25 +282,184 @@ func RunServer(webserverPath string, port int) *stoppablenetlistener.StoppableNe
 		}
 
 	})
+	r.HandleFunc("/api/audit", s.handleAuditHTTP)
+	r.HandleFunc("/api/pools/export", s.handleExportHTTP).Methods("GET")
+	r.HandleFunc("/api/pools/import", s.handleImportHTTP).Methods("POST")
+	r.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
 	r.PathPrefix("/static").Handler(http.StripPrefix("/static", http.FileServer(http.Dir(staticPath))))
+}
 
+// Run starts serving on the configured port
+func (s *Server) Run() (*stoppablenetlistener.StoppableNetListener, error) {
 	mux := http.NewServeMux()
-	mux.Handle("/", r)
+	mux.Handle("/", s.Router)
 	corsHandler := cors.Default().Handler(mux)
 	server := http.Server{}
 	server.Handler = corsHandler
-	snl, err := stoppablenetlistener.New(port)
+	snl, err := stoppablenetlistener.New(s.Port)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get snl: %v\n", err)
-		os.Exit(-1)
+		return nil, err
 	}
+	s.snl = snl
 	go func() {
-		for evt := range ws.EventChan {
+		for evt := range s.EventChan {
 			log.Infof("Websocket event: %v", evt)
 		}
 	}()
 	go func() {
 		server.Serve(snl)
 	}()
-	return snl
+	if s.Profit != nil {
+		s.Profit.Start()
+	}
+	if s.Scheduler != nil {
+		s.Scheduler.Start()
+	}
+	if s.Alerter != nil {
+		s.Alerter.Start()
+	}
+	if s.Rollout != nil {
+		s.Rollout.Start()
+	}
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.sweepConnections(time.Now())
+				s.sweepRigs()
+			}
+		}
+	}()
+	return snl, nil
+}
+
+// Stop stops the server along with any background tasks
+func (s *Server) Stop() {
+	if s.Profit != nil {
+		s.Profit.Stop()
+	}
+	if s.Scheduler != nil {
+		s.Scheduler.Stop()
+	}
+	if s.Alerter != nil {
+		s.Alerter.Stop()
+	}
+	if s.Rollout != nil {
+		s.Rollout.Stop()
+	}
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	if s.snl != nil {
+		s.snl.Stop()
+	}
+}
+
+// RigID returns the ID of the rig that client registered as, or an empty
+// string if it never registered
+func (s *Server) RigID(client *websockets.WebsocketClient) string {
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	if rigInfo, ok := s.rigs[client]; ok {
+		return rigInfo.RigID
+	}
+	return ""
+}
+
+// Rigs returns the information of every registered rig keyed by rig ID
+func (s *Server) Rigs() map[string]*RigInfo {
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	ret := make(map[string]*RigInfo)
+	for _, rigInfo := range s.rigs {
+		ret[rigInfo.RigID] = rigInfo
+	}
+	return ret
+}
+
+// RigClients returns the connected clients registered as rig
+func (s *Server) RigClients(rig string) []*websockets.WebsocketClient {
+	s.rigsMutex.Lock()
+	defer s.rigsMutex.Unlock()
+	ret := make([]*websockets.WebsocketClient, 0)
+	for client, rigInfo := range s.rigs {
+		if strings.Compare(rigInfo.RigID, rig) == 0 {
+			ret = append(ret, client)
+		}
+	}
+	return ret
+}
+
+// BroadcastSelectedPools sends every registered rig the selected pools that
+// apply to it. Connections that did not register are left alone since they
+// cannot be sent pools with their wallets expanded
+func (s *Server) BroadcastSelectedPools() {
+	defer s.metrics.observeBroadcast(time.Now())
+	for _, client := range s.TargetClients("", "") {
+		rig := s.RigID(client)
+		if err := s.emit(client, "update-selected-pools", s.SelectedPoolsFor(rig)); err != nil {
+			log.Errorf("Failed to send selected pools to rig '%v': %v", rig, err)
+		}
+	}
+}
+
+// PushSelectedPools sends the current selected pools of rig to all of its
+// connected clients
+func (s *Server) PushSelectedPools(rig string) {
+	defer s.metrics.observeBroadcast(time.Now())
+	selectedPools := s.SelectedPoolsFor(rig)
+	for _, client := range s.RigClients(rig) {
+		if err := s.emit(client, "update-selected-pools", selectedPools); err != nil {
+			log.Errorf("Failed to send selected pools to rig '%v': %v", rig, err)
+		}
+	}
+}
+
+// PushGroupSelectedPools sends the connected rigs of group the pools they use
+func (s *Server) PushGroupSelectedPools(group string) {
+	defer s.metrics.observeBroadcast(time.Now())
+	for _, client := range s.TargetClients("", group) {
+		rig := s.RigID(client)
+		if err := s.emit(client, "update-selected-pools", s.SelectedPoolsFor(rig)); err != nil {
+			log.Errorf("Failed to send selected pools to rig '%v': %v", rig, err)
+		}
+	}
+}
+
+// decodeData converts websocket event data, which is either a JSON string or
+// an already decoded object, into v
+func decodeData(data interface{}, v interface{}) error {
+	var b []byte
+	var err error
+	switch data.(type) {
+	case string:
+		b = []byte(data.(string))
+	default:
+		if b, err = json.Marshal(data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jsonData converts v into generic JSON objects so that it is sent to the
+// browser using its json field names
+func jsonData(v interface{}) interface{} {
+	var ret interface{}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to marshal %T: %v", v, err)
+		return nil
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		log.Errorf("Failed to unmarshal %T: %v", v, err)
+		return nil
+	}
+	return ret
 }
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 
+	yaml "gopkg.in/yaml.v2"
+
 	"github.com/alecthomas/kingpin"
 	"github.com/gurupras/minerconfig"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	app     = kingpin.New("minerconfig-webserver", "Miner webserver")
-	verbose = app.Flag("verbose", "Enable verbose messages").Short('v').Default("false").Bool()
+	app        = kingpin.New("minerconfig-webserver", "Miner webserver")
+	verbose    = app.Flag("verbose", "Enable verbose messages").Short('v').Default("false").Bool()
+	configPath = app.Flag("config", "Path to YAML configuration").Short('c').String()
 )
 
 func main() {
@@ -21,7 +26,31 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	minerconfig.RunServer("www", 61117)
+	serverConfig := minerconfig.ServerConfig{
+		WebserverPath: "www",
+		Port:          61117,
+	}
+	if strings.Compare(*configPath, "") != 0 {
+		if b, err := ioutil.ReadFile(*configPath); err != nil {
+			log.Errorf("Failed to read config file: '%v': %v", *configPath, err)
+			os.Exit(-1)
+		} else {
+			if err := yaml.Unmarshal(b, &serverConfig); err != nil {
+				log.Errorf("Failed to parse config file into ServerConfig: %v", err)
+				os.Exit(-1)
+			}
+		}
+	}
+
+	server, err := minerconfig.NewServer(&serverConfig)
+	if err != nil {
+		log.Errorf("Failed to create server: %v", err)
+		os.Exit(-1)
+	}
+	if _, err := server.Run(); err != nil {
+		log.Errorf("Failed to start server: %v", err)
+		os.Exit(-1)
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	wg.Wait()
@@ -0,0 +1,86 @@
+package minerconfig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gurupras/minerconfig/wallet"
+	"github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// TemplateValues returns the placeholders that pool users and passwords can
+// use to tell rigs apart, such as "{wallet}.{rig_id}". {rig} is the same as
+// {rig_id}. The webserver expands the same placeholders in user templates
+func (ri *RigInfo) TemplateValues() map[string]string {
+	return map[string]string{
+		"rig":       ri.RigID,
+		"rig_id":    ri.RigID,
+		"group":     ri.Group,
+		"hostname":  ri.Hostname,
+		"gpu_count": strconv.Itoa(len(ri.GPUs)),
+	}
+}
+
+// expandPoolTemplates replaces the placeholders in the user and password of
+// every pool with values
+func expandPoolTemplates(pools []Pool, values map[string]string) {
+	for idx := range pools {
+		pools[idx].User = wallet.Expand(pools[idx].User, values)
+		pools[idx].Pass = wallet.Expand(pools[idx].Pass, values)
+	}
+}
+
+// PoolUser structure representing the credentials a rig uses for a pool
+type PoolUser struct {
+	Url  string `json:"url"`
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// WorkerPreview structure representing the pool credentials of a rig once
+// every placeholder has been expanded
+type WorkerPreview struct {
+	Rig   string      `json:"rig"`
+	Pools []*PoolUser `json:"pools"`
+}
+
+// PreviewWorkers returns the pool credentials every known rig would use with
+// its current selection. An empty rig previews every rig
+func (s *Server) PreviewWorkers(rig string) []*WorkerPreview {
+	ret := make([]*WorkerPreview, 0)
+	for _, r := range s.Inventory.Rigs() {
+		if strings.Compare(rig, "") != 0 && strings.Compare(rig, r.RigID) != 0 {
+			continue
+		}
+		var pools []Pool
+		if err := decodeData(s.SelectedPoolsFor(r.RigID), &pools); err != nil {
+			log.Errorf("Failed to decode selected pools of rig '%v': %v", r.RigID, err)
+			continue
+		}
+		expandPoolTemplates(pools, r.RigInfo.TemplateValues())
+		preview := &WorkerPreview{}
+		preview.Rig = r.RigID
+		preview.Pools = make([]*PoolUser, 0)
+		for _, pool := range pools {
+			preview.Pools = append(preview.Pools, &PoolUser{pool.Url, pool.User, pool.Pass})
+		}
+		ret = append(ret, preview)
+	}
+	return ret
+}
+
+// handlePreviewWorkers sends the expanded pool credentials of the requested
+// rig, or every rig, to the requester
+func (s *Server) handlePreviewWorkers(w *websockets.WebsocketClient, data interface{}) {
+	var request SelectionRequest
+	if data != nil {
+		if err := decodeData(data, &request); err != nil {
+			log.Errorf("[preview-workers]: Failed to unmarshal: %v", err)
+			w.Emit("error", fmt.Sprintf("Invalid preview-workers request: %v", err))
+			return
+		}
+	}
+	w.Emit("preview-workers-result", jsonData(s.PreviewWorkers(request.Rig)))
+}
@@ -0,0 +1,54 @@
+package minerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPoolTemplates(t *testing.T) {
+	require := require.New(t)
+
+	rigInfo := &RigInfo{RigID: "rig1", Hostname: "miner-01", GPUs: []GPUInfo{{Name: "Ellesmere"}, {Name: "Ellesmere"}}}
+	pools := []Pool{
+		{Url: "a", User: "4abc.{rig_id}", Pass: "{hostname}:{gpu_count}"},
+		{Url: "b", User: "4abc.{unknown}", Pass: "x"},
+	}
+	expandPoolTemplates(pools, rigInfo.TemplateValues())
+	require.Equal("4abc.rig1", pools[0].User)
+	require.Equal("miner-01:2", pools[0].Pass)
+	require.Equal("4abc.{unknown}", pools[1].User)
+	require.Equal("x", pools[1].Pass)
+}
+
+func TestPreviewWorkers(t *testing.T) {
+	require := require.New(t)
+
+	webserverPath, err := ioutil.TempDir(os.TempDir(), "minerconfig-worker")
+	require.Nil(err)
+	defer os.RemoveAll(webserverPath)
+
+	server, err := NewServer(&ServerConfig{WebserverPath: webserverPath})
+	require.Nil(err)
+	require.Nil(server.Store.SetSelectedPools("", []interface{}{
+		map[string]interface{}{"url": "a", "user": "4abc.{hostname}", "pass": "x"},
+	}))
+	require.Nil(server.Store.SetSelectedPools("rig2", []interface{}{
+		map[string]interface{}{"url": "b", "user": "4abc.{rig_id}", "pass": "x"},
+	}))
+	server.Inventory.Register(&RigInfo{RigID: "rig1", Hostname: "miner-01"}, "10.0.0.2:51234")
+	server.Inventory.Register(&RigInfo{RigID: "rig2", Hostname: "miner-02"}, "10.0.0.3:51234")
+
+	previews := server.PreviewWorkers("")
+	require.Equal(2, len(previews))
+	require.Equal("rig1", previews[0].Rig)
+	require.Equal("4abc.miner-01", previews[0].Pools[0].User)
+	require.Equal("b", previews[1].Pools[0].Url)
+	require.Equal("4abc.rig2", previews[1].Pools[0].User)
+
+	previews = server.PreviewWorkers("rig2")
+	require.Equal(1, len(previews))
+	require.Equal(0, len(server.PreviewWorkers("rig3")))
+}